@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+Attachments are files (e.g. images) uploaded to a note. Content is saved in
+blob stores like note content (content-addressed so uploading the same file
+again doesn't use more space) and recorded in attachments table.
+
+They're served at /a/{attachment_id_hash}/{name} to users who can access
+the note. Attachments are deleted with the note and their content is kept
+by -gc and backed up with -backup.
+*/
+
+const (
+	maxAttachmentSize = 10 * 1024 * 1024
+	// max length of attachment name, in characters
+	maxAttachmentNameLen = 255
+	// uploading a big file over a slow connection takes longer than
+	// server's timeouts
+	attachmentUploadTimeout = 5 * time.Minute
+)
+
+// Attachment describes a file attached to a note
+type Attachment struct {
+	id          int
+	noteID      int
+	userID      int
+	Name        string
+	Size        int
+	ContentSha1 []byte
+	CreatedAt   time.Time
+}
+
+// URL returns a stable url of the attachment
+func (a *Attachment) URL() string {
+	return "/a/" + hashInt(a.id) + "/" + url.PathEscape(a.Name)
+}
+
+// AttachmentRsp describes an attachment sent to the client
+type AttachmentRsp struct {
+	HashID     string
+	NoteHashID string
+	Name       string
+	Size       int
+	URL        string
+}
+
+func newAttachmentRsp(a *Attachment) *AttachmentRsp {
+	return &AttachmentRsp{
+		HashID:     hashInt(a.id),
+		NoteHashID: hashInt(a.noteID),
+		Name:       a.Name,
+		Size:       a.Size,
+		URL:        a.URL(),
+	}
+}
+
+// returns a name safe to use in urls and Content-Disposition
+func sanitizeAttachmentName(name string) string {
+	name = filepath.Base(strings.Replace(name, "\\", "/", -1))
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || r == '"' || r == '/' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." {
+		return "attachment"
+	}
+	if r := []rune(name); len(r) > maxAttachmentNameLen {
+		ext := filepath.Ext(name)
+		name = string(r[:maxAttachmentNameLen-len([]rune(ext))]) + ext
+	}
+	return name
+}
+
+const attachmentColumns = `id, note_id, user_id, name, size, content_sha1, created_at`
+
+func scanAttachment(row rowScanner) (*Attachment, error) {
+	var a Attachment
+	err := row.Scan(&a.id, &a.noteID, &a.userID, &a.Name, &a.Size, &a.ContentSha1, &a.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// CreateAttachment saves d and attaches it to the note. Uploading the same
+// file to the same note again returns the existing attachment
+func (r *Repository) CreateAttachment(ctx context.Context, userID, noteID int, name string, d []byte) (*Attachment, error) {
+	sha1, err := blobStore.Put(d)
+	if err != nil {
+		log.Errorf("blobStore.Put() failed with %s\n", err)
+		return nil, err
+	}
+	q := `SELECT ` + attachmentColumns + ` FROM attachments WHERE note_id=? AND content_sha1=? AND name=?`
+	a, err := scanAttachment(r.db.QueryRowContext(ctx, q, noteID, sha1, name))
+	if err == nil {
+		return a, nil
+	}
+	if err != sql.ErrNoRows {
+		log.Errorf("db.QueryRow('%s') failed with %s\n", q, err)
+		return nil, err
+	}
+
+	a = &Attachment{
+		noteID:      noteID,
+		userID:      userID,
+		Name:        name,
+		Size:        len(d),
+		ContentSha1: sha1,
+		CreatedAt:   time.Now(),
+	}
+	vals := NewDbVals("attachments", 6)
+	vals.Add("note_id", a.noteID)
+	vals.Add("user_id", a.userID)
+	vals.Add("name", a.Name)
+	vals.Add("size", a.Size)
+	vals.Add("content_sha1", a.ContentSha1)
+	vals.Add("created_at", a.CreatedAt)
+	res, err := vals.Insert(ctx, r.db)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		log.Errorf("res.LastInsertId() of attachment failed with %s\n", err)
+		return nil, err
+	}
+	a.id = int(id)
+	return a, nil
+}
+
+// GetAttachment returns attachment with a given id
+func (r *Repository) GetAttachment(ctx context.Context, id int) (*Attachment, error) {
+	q := `SELECT ` + attachmentColumns + ` FROM attachments WHERE id=?`
+	return scanAttachment(r.db.QueryRowContext(ctx, q, id))
+}
+
+// GetNoteAttachments returns attachments of the note, oldest first
+func (r *Repository) GetNoteAttachments(ctx context.Context, noteID int) ([]*Attachment, error) {
+	q := `SELECT ` + attachmentColumns + ` FROM attachments WHERE note_id=? ORDER BY id`
+	rows, err := r.db.QueryContext(ctx, q, noteID)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with %s\n", q, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*Attachment
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, a)
+	}
+	return res, rows.Err()
+}
+
+// POST /api/upload_attachment
+// args:
+// - noteHashID : note to attach the file to
+// - file       : multi-part file
+// result: AttachmentRsp
+func handleAPIUploadAttachment(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	extendDeadlines(w, attachmentUploadTimeout)
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1024*1024)
+	noteHashID := r.FormValue("noteHashID")
+	note, err := getNoteByIDHash(ctx, noteHashID)
+	if err != nil || note == nil {
+		httpErrorWithJSONf(w, r, "no note with noteHashID '%s'", noteHashID)
+		return
+	}
+	if note.userID != ctx.User.id {
+		httpErrorWithJSONf(w, r, "note '%s' doesn't belong to the user", noteHashID)
+		return
+	}
+	f, hdr, err := r.FormFile("file")
+	if err != nil {
+		httpErrorWithJSONf(w, r, "no file: %s", err)
+		return
+	}
+	defer f.Close()
+	d, err := ioutil.ReadAll(f)
+	if err != nil {
+		httpErrorWithJSONf(w, r, "reading file failed with %s", err)
+		return
+	}
+	if len(d) > maxAttachmentSize {
+		httpErrorWithJSONf(w, r, "file is too big, max size is %d bytes", maxAttachmentSize)
+		return
+	}
+	name := sanitizeAttachmentName(hdr.Filename)
+	a, err := repo.CreateAttachment(ctx.Context(), ctx.User.id, note.id, name, d)
+	if err != nil {
+		httpErrorWithJSONf(w, r, "saving attachment failed with %s", err)
+		return
+	}
+	log.Verbosef("attached '%s' (%d bytes) to note %s\n", a.Name, a.Size, note.HashID)
+	httpOkWithJSON(w, r, newAttachmentRsp(a))
+}
+
+// GET /a/{attachment_id_hash}/{name}
+func handleAttachment(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
+	// name is only for the user, we use the name we have
+	s := strings.TrimPrefix(r.URL.Path, "/a/")
+	hashID := strings.SplitN(s, "/", 2)[0]
+	id, err := dehashInt(hashID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	a, err := repo.GetAttachment(ctx.Context(), id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	note, err := repo.GetNoteByID(ctx.Context(), a.noteID)
+	if err != nil || !userCanAccessNote(ctx.User, note) {
+		http.NotFound(w, r)
+		return
+	}
+	isOwner := ctx.User != nil && ctx.User.id == note.userID
+	if note.IsDeleted && !isOwner {
+		http.NotFound(w, r)
+		return
+	}
+	d, err := blobStore.Get(a.ContentSha1)
+	if err != nil {
+		httpErrorf(w, "blobStore.Get() of attachment %d failed with %s", a.id, err)
+		return
+	}
+	hdr := w.Header()
+	hdr.Set("Content-Type", MimeTypeByExtensionExt(a.Name))
+	// attachments are uploaded by users, don't let them run scripts on our
+	// domain e.g. in .html or .svg files
+	hdr.Set("Content-Security-Policy", "sandbox")
+	hdr.Set("X-Content-Type-Options", "nosniff")
+	hdr.Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, a.Name))
+	// the note might be made private so don't let proxies cache it
+	hdr.Set("Cache-Control", "private")
+	hdr.Set("ETag", fmt.Sprintf(`"%x"`, a.ContentSha1))
+	http.ServeContent(w, r, a.Name, a.CreatedAt, bytes.NewReader(d))
+}
+
+// AttachmentsRsp is a result of getAttachments
+type AttachmentsRsp struct {
+	NoteHashID  string
+	Attachments []*AttachmentRsp
+}
+
+func wsGetAttachments(ctx *ReqContext, args map[string]interface{}) (interface{}, error) {
+	noteHashIDStr, err := jsonMapGetString(args, "noteHashID")
+	if err != nil {
+		return nil, fmt.Errorf("'noteHashID' argument missing in '%v'", args)
+	}
+	note, err := getNoteByIDHash(ctx, noteHashIDStr)
+	if err != nil || note == nil {
+		return nil, fmt.Errorf("no note with noteHashID '%s'", noteHashIDStr)
+	}
+	if !userCanAccessNote(ctx.User, note) {
+		return nil, fmt.Errorf("access denied for note '%s'", noteHashIDStr)
+	}
+	attachments, err := repo.GetNoteAttachments(ctx.Context(), note.id)
+	if err != nil {
+		return nil, err
+	}
+	res := &AttachmentsRsp{
+		NoteHashID:  note.HashID,
+		Attachments: []*AttachmentRsp{},
+	}
+	for _, a := range attachments {
+		res.Attachments = append(res.Attachments, newAttachmentRsp(a))
+	}
+	return res, nil
+}
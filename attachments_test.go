@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kjk/u"
+)
+
+func TestSanitizeAttachmentName(t *testing.T) {
+	tests := []struct {
+		name string
+		exp  string
+	}{
+		{"photo.png", "photo.png"},
+		{`C:\Users\me\photo.png`, "photo.png"},
+		{"../../etc/passwd", "passwd"},
+		{" a\"b\n.txt ", "ab.txt"},
+		{"", "attachment"},
+		{strings.Repeat("x", 300) + ".jpg", strings.Repeat("x", 251) + ".jpg"},
+	}
+	for _, test := range tests {
+		got := sanitizeAttachmentName(test.name)
+		if got != test.exp {
+			t.Fatalf("sanitizing '%s' gave '%s', expected '%s'", test.name, got, test.exp)
+		}
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	defer openTestDbMust()()
+
+	user, err := repo.GetOrCreateUser(context.Background(), "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	ctx := &ReqContext{User: userSummaryFromDbUser(user)}
+	noteID, err := repo.CreateOrUpdateNote(ctx.Context(), user.ID, &NewNote{
+		title:   "with image",
+		format:  formatMarkdown,
+		content: []byte("see image"),
+	})
+	u.PanicIfErr(err)
+	png := []byte("\x89PNG fake image")
+
+	upload := func(ctx *ReqContext, noteHashID string) *AttachmentRsp {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		u.PanicIfErr(mw.WriteField("noteHashID", noteHashID))
+		fw, err := mw.CreateFormFile("file", "dir/image.png")
+		u.PanicIfErr(err)
+		_, err = fw.Write(png)
+		u.PanicIfErr(err)
+		u.PanicIfErr(mw.Close())
+		r := httptest.NewRequest("POST", "/api/upload_attachment", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		handleAPIUploadAttachment(ctx, w, r)
+		var rsp AttachmentRsp
+		u.PanicIfErr(json.Unmarshal(w.Body.Bytes(), &rsp))
+		return &rsp
+	}
+	get := func(ctx *ReqContext, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleAttachment(ctx, w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	a := upload(ctx, hashInt(noteID))
+	if a.Name != "image.png" || a.Size != len(png) || a.NoteHashID != hashInt(noteID) {
+		t.Fatalf("unexpected attachment %#v", a)
+	}
+	if upload(ctx, hashInt(noteID)).HashID != a.HashID {
+		t.Fatalf("uploading the same file again should return the same attachment")
+	}
+
+	w := get(ctx, a.URL)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), png) {
+		t.Fatalf("unexpected response %d '%s'", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Fatalf("unexpected content type '%s'", ct)
+	}
+
+	// only the owner can see attachments of a private note
+	other, err := repo.GetOrCreateUser(ctx.Context(), "twitter:other", "Other User")
+	u.PanicIfErr(err)
+	otherCtx := &ReqContext{User: userSummaryFromDbUser(other)}
+	if w = get(otherCtx, a.URL); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if upload(otherCtx, hashInt(noteID)).HashID != "" {
+		t.Fatalf("other user shouldn't be able to attach to the note")
+	}
+	u.PanicIfErr(repo.MakeNotePublic(ctx.Context(), user.ID, noteID))
+	if w = get(&ReqContext{}, a.URL); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	rsp, err := wsGetAttachments(ctx, map[string]interface{}{"noteHashID": hashInt(noteID)})
+	u.PanicIfErr(err)
+	if atts := rsp.(*AttachmentsRsp).Attachments; len(atts) != 1 || *atts[0] != *a {
+		t.Fatalf("unexpected attachments %#v", atts)
+	}
+
+	// content is kept by gc and backed up
+	referenced, err := repo.GetAllContentSha1(ctx.Context())
+	u.PanicIfErr(err)
+	if !referenced[string(u.Sha1OfBytes(png))] {
+		t.Fatalf("attachment content should be referenced")
+	}
+
+	// attachments of deleted notes are only visible to the owner
+	u.PanicIfErr(repo.DeleteNote(ctx.Context(), user.ID, noteID))
+	if w = get(otherCtx, a.URL); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a deleted note, got %d", w.Code)
+	}
+	if w = get(ctx, a.URL); w.Code != http.StatusOK {
+		t.Fatalf("owner should see attachments of a deleted note, got %d", w.Code)
+	}
+
+	u.PanicIfErr(repo.PermanentDeleteNote(ctx.Context(), user.ID, noteID))
+	if w = get(ctx, a.URL); w.Code != http.StatusNotFound {
+		t.Fatalf("attachment should be deleted with the note, got %d", w.Code)
+	}
+}
+
+func TestUploadAttachmentSlowly(t *testing.T) {
+	defer openTestDbMust()()
+
+	user, err := repo.GetOrCreateUser(context.Background(), "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	ctx := &ReqContext{User: userSummaryFromDbUser(user)}
+	noteID, err := repo.CreateOrUpdateNote(ctx.Context(), user.ID, &NewNote{
+		title:   "with image",
+		format:  formatMarkdown,
+		content: []byte("see image"),
+	})
+	u.PanicIfErr(err)
+
+	// uploading takes longer than server's read timeout
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleAPIUploadAttachment(ctx, NewRecordingResponseWriter(w), r)
+	}))
+	srv.Config.ReadTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		mw.WriteField("noteHashID", hashInt(noteID))
+		fw, _ := mw.CreateFormFile("file", "image.png")
+		fw.Write([]byte("\x89PNG"))
+		time.Sleep(300 * time.Millisecond)
+		fw.Write([]byte(" fake image"))
+		pw.CloseWithError(mw.Close())
+	}()
+	rsp, err := http.Post(srv.URL, mw.FormDataContentType(), pr)
+	u.PanicIfErr(err)
+	defer rsp.Body.Close()
+	var a AttachmentRsp
+	u.PanicIfErr(json.NewDecoder(rsp.Body).Decode(&a))
+	if a.HashID == "" || a.Size != len("\x89PNG fake image") {
+		t.Fatalf("unexpected attachment %#v", a)
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/kjk/quicknotes/pkg/log"
+	"github.com/kjk/u"
+)
+
+/*
+Backup is a .tar.gz archive with:
+- backup.json : backupInfo
+- {table}.jsonl : rows of a table, one json object per line
+- blobs/{sha1} : content referenced from notes, versions and attachments
+
+Tables are read in a single transaction, which gives us a consistent
+snapshot (REPEATABLE READ is the default in MySQL/InnoDB and in sqlite a
+read transaction sees a snapshot). Content is immutable so we can read it
+after the transaction.
+
+Restore only works on an empty installation. Rows are inserted with their
+original ids.
+*/
+
+const (
+	backupFormatVersion = 1
+	backupInfoName      = "backup.json"
+	backupBlobsDir      = "blobs/"
+)
+
+type backupInfo struct {
+	FormatVersion int       `json:"format_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	// applied db migrations
+	Migrations []int `json:"migrations"`
+}
+
+// backupRow is a row of a table we back up
+type backupRow interface {
+	// returns pointers to fields in the order of backupTable.columns
+	fields() []interface{}
+}
+
+type backupTable struct {
+	name    string
+	columns []string
+	newRow  func() backupRow
+}
+
+type backupUser struct {
+	ID              int       `json:"id"`
+	Login           string    `json:"login"`
+	FullName        *string   `json:"full_name"`
+	Email           *string   `json:"email"`
+	ProState        int       `json:"pro_state"`
+	CreatedAt       time.Time `json:"created_at"`
+	EncryptedSample []byte    `json:"encrypted_sample"`
+	OauthJSON       *string   `json:"oauth_json"`
+}
+
+func (r *backupUser) fields() []interface{} {
+	return []interface{}{&r.ID, &r.Login, &r.FullName, &r.Email, &r.ProState, &r.CreatedAt, &r.EncryptedSample, &r.OauthJSON}
+}
+
+type backupNote struct {
+	ID            int       `json:"id"`
+	UserID        int       `json:"user_id"`
+	CurrVersionID int       `json:"curr_version_id"`
+	VersionsCount int       `json:"versions_count"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	ContentSha1   []byte    `json:"content_sha1"`
+	Size          int       `json:"size"`
+	Format        string    `json:"format"`
+	Title         *string   `json:"title"`
+	Tags          *string   `json:"tags"`
+	IsDeleted     bool      `json:"is_deleted"`
+	IsPublic      bool      `json:"is_public"`
+	IsStarred     bool      `json:"is_starred"`
+	IsEncrypted   bool      `json:"is_encrypted"`
+}
+
+func (r *backupNote) fields() []interface{} {
+	return []interface{}{&r.ID, &r.UserID, &r.CurrVersionID, &r.VersionsCount, &r.CreatedAt, &r.UpdatedAt, &r.ContentSha1, &r.Size, &r.Format, &r.Title, &r.Tags, &r.IsDeleted, &r.IsPublic, &r.IsStarred, &r.IsEncrypted}
+}
+
+type backupVersion struct {
+	ID          int       `json:"id"`
+	NoteID      int       `json:"note_id"`
+	UserID      int       `json:"user_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	ContentSha1 []byte    `json:"content_sha1"`
+	Size        int       `json:"size"`
+	Format      string    `json:"format"`
+	Title       *string   `json:"title"`
+	Tags        *string   `json:"tags"`
+	IsDeleted   bool      `json:"is_deleted"`
+	IsPublic    bool      `json:"is_public"`
+	IsStarred   bool      `json:"is_starred"`
+	IsEncrypted bool      `json:"is_encrypted"`
+}
+
+func (r *backupVersion) fields() []interface{} {
+	return []interface{}{&r.ID, &r.NoteID, &r.UserID, &r.CreatedAt, &r.ContentSha1, &r.Size, &r.Format, &r.Title, &r.Tags, &r.IsDeleted, &r.IsPublic, &r.IsStarred, &r.IsEncrypted}
+}
+
+type backupSimplenoteImport struct {
+	UserID            int    `json:"user_id"`
+	NoteID            int    `json:"note_id"`
+	SimplenoteID      string `json:"simplenote_id"`
+	SimplenoteVersion int    `json:"simplenote_version"`
+}
+
+func (r *backupSimplenoteImport) fields() []interface{} {
+	return []interface{}{&r.UserID, &r.NoteID, &r.SimplenoteID, &r.SimplenoteVersion}
+}
+
+type backupNoteTombstone struct {
+	VersionID int       `json:"version_id"`
+	UserID    int       `json:"user_id"`
+	NoteID    int       `json:"note_id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+func (r *backupNoteTombstone) fields() []interface{} {
+	return []interface{}{&r.VersionID, &r.UserID, &r.NoteID, &r.DeletedAt}
+}
+
+type backupNoteLink struct {
+	SourceNoteID int    `json:"source_note_id"`
+	TargetNoteID int    `json:"target_note_id"`
+	Anchor       string `json:"anchor"`
+}
+
+func (r *backupNoteLink) fields() []interface{} {
+	return []interface{}{&r.SourceNoteID, &r.TargetNoteID, &r.Anchor}
+}
+
+type backupUnresolvedNoteLink struct {
+	SourceNoteID int    `json:"source_note_id"`
+	UserID       int    `json:"user_id"`
+	Title        string `json:"title"`
+	Anchor       string `json:"anchor"`
+}
+
+func (r *backupUnresolvedNoteLink) fields() []interface{} {
+	return []interface{}{&r.SourceNoteID, &r.UserID, &r.Title, &r.Anchor}
+}
+
+type backupAttachment struct {
+	ID          int       `json:"id"`
+	NoteID      int       `json:"note_id"`
+	UserID      int       `json:"user_id"`
+	Name        string    `json:"name"`
+	Size        int       `json:"size"`
+	ContentSha1 []byte    `json:"content_sha1"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (r *backupAttachment) fields() []interface{} {
+	return []interface{}{&r.ID, &r.NoteID, &r.UserID, &r.Name, &r.Size, &r.ContentSha1, &r.CreatedAt}
+}
+
+// in the order in which they must be restored
+var backupTables = []*backupTable{
+	{
+		name:    "users",
+		columns: []string{"id", "login", "full_name", "email", "pro_state", "created_at", "encrypted_sample", "oauth_json"},
+		newRow:  func() backupRow { return &backupUser{} },
+	},
+	{
+		name:    "notes",
+		columns: []string{"id", "user_id", "curr_version_id", "versions_count", "created_at", "updated_at", "content_sha1", "size", "format", "title", "tags", "is_deleted", "is_public", "is_starred", "is_encrypted"},
+		newRow:  func() backupRow { return &backupNote{} },
+	},
+	{
+		name:    "versions",
+		columns: []string{"id", "note_id", "user_id", "created_at", "content_sha1", "size", "format", "title", "tags", "is_deleted", "is_public", "is_starred", "is_encrypted"},
+		newRow:  func() backupRow { return &backupVersion{} },
+	},
+	{
+		name:    "simplenote_imports",
+		columns: []string{"user_id", "note_id", "simplenote_id", "simplenote_version"},
+		newRow:  func() backupRow { return &backupSimplenoteImport{} },
+	},
+	{
+		name:    "note_tombstones",
+		columns: []string{"version_id", "user_id", "note_id", "deleted_at"},
+		newRow:  func() backupRow { return &backupNoteTombstone{} },
+	},
+	{
+		name:    "note_links",
+		columns: []string{"source_note_id", "target_note_id", "anchor"},
+		newRow:  func() backupRow { return &backupNoteLink{} },
+	},
+	{
+		name:    "unresolved_note_links",
+		columns: []string{"source_note_id", "user_id", "title", "anchor"},
+		newRow:  func() backupRow { return &backupUnresolvedNoteLink{} },
+	},
+	{
+		name:    "attachments",
+		columns: []string{"id", "note_id", "user_id", "name", "size", "content_sha1", "created_at"},
+		newRow:  func() backupRow { return &backupAttachment{} },
+	},
+}
+
+// returns sha1 of content referenced by the row, if any
+func backupRowContentSha1(row backupRow) []byte {
+	switch r := row.(type) {
+	case *backupNote:
+		return r.ContentSha1
+	case *backupVersion:
+		return r.ContentSha1
+	case *backupAttachment:
+		return r.ContentSha1
+	}
+	return nil
+}
+
+func (t *backupTable) fileName() string {
+	return t.name + ".jsonl"
+}
+
+func writeTarFile(tw *tar.Writer, name string, d []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(d)),
+		ModTime: time.Now(),
+	}
+	err := tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(d)
+	return err
+}
+
+// dumps rows of the table as json lines. Remembers content sha1 referenced
+// by the rows in blobs
+func backupTableRows(tx *sql.Tx, t *backupTable, blobs map[string]bool) ([]byte, int, error) {
+	q := fmt.Sprintf("SELECT %s FROM %s", strings.Join(t.columns, ", "), t.name)
+	rows, err := tx.Query(q)
+	if err != nil {
+		log.Errorf("tx.Query('%s') failed with %s\n", q, err)
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	n := 0
+	for rows.Next() {
+		row := t.newRow()
+		err = rows.Scan(row.fields()...)
+		if err != nil {
+			log.Errorf("rows.Scan() for '%s' failed with %s\n", q, err)
+			return nil, 0, err
+		}
+		if sha1 := backupRowContentSha1(row); sha1 != nil {
+			blobs[string(sha1)] = true
+		}
+		err = enc.Encode(row)
+		if err != nil {
+			return nil, 0, err
+		}
+		n++
+	}
+	return buf.Bytes(), n, rows.Err()
+}
+
+// writes tables to tw, returns sha1 of referenced content
+func backupTablesTo(tw *tar.Writer) (map[string]bool, error) {
+	db := repo.DB()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// we only read
+	defer tx.Rollback()
+
+	blobs := map[string]bool{}
+	for _, t := range backupTables {
+		d, n, err := backupTableRows(tx, t, blobs)
+		if err != nil {
+			return nil, err
+		}
+		err = writeTarFile(tw, t.fileName(), d)
+		if err != nil {
+			return nil, err
+		}
+		log.Verbosef("backed up %d rows of %s\n", n, t.name)
+	}
+	return blobs, nil
+}
+
+func getAppliedMigrationsSorted(db *sql.DB) ([]int, error) {
+	applied, err := getAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var res []int
+	for _, mi := range getMigrations() {
+		if applied[mi.No] {
+			res = append(res, mi.No)
+		}
+	}
+	return res, nil
+}
+
+// backupTo writes backup of the database and content to w
+func backupTo(w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	migrations, err := getAppliedMigrationsSorted(repo.DB())
+	if err != nil {
+		return err
+	}
+	info := &backupInfo{
+		FormatVersion: backupFormatVersion,
+		CreatedAt:     time.Now().UTC(),
+		Migrations:    migrations,
+	}
+	d, err := json.MarshalIndent(info, "", "  ")
+	u.PanicIfErr(err)
+	err = writeTarFile(tw, backupInfoName, d)
+	if err != nil {
+		return err
+	}
+
+	blobs, err := backupTablesTo(tw)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for s := range blobs {
+		sha1 := []byte(s)
+		d, err := blobStore.Get(sha1)
+		if err != nil {
+			log.Errorf("blobStore.Get(%x) failed with %s\n", sha1, err)
+			return err
+		}
+		if !bytes.Equal(u.Sha1OfBytes(d), sha1) {
+			return fmt.Errorf("content %x is corrupted", sha1)
+		}
+		err = writeTarFile(tw, fmt.Sprintf("%s%x", backupBlobsDir, sha1), d)
+		if err != nil {
+			return err
+		}
+		size += int64(len(d))
+	}
+	log.Infof("backed up %d blobs, %s\n", len(blobs), humanize.Bytes(uint64(size)))
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// runBackup creates a backup in a file at path
+func runBackup(path string) error {
+	timeStart := time.Now()
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = backupTo(f)
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created backup '%s' in %s\n", path, time.Since(timeStart))
+	return nil
+}
+
+func restoreTableRows(tx *sql.Tx, t *backupTable, r io.Reader, blobs map[string]bool) (int, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(t.columns)), ", ")
+	q := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", t.name, strings.Join(t.columns, ", "), placeholders)
+	dec := json.NewDecoder(r)
+	n := 0
+	for {
+		row := t.newRow()
+		err := dec.Decode(row)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("invalid row %d of %s: %s", n, t.name, err)
+		}
+		if sha1 := backupRowContentSha1(row); sha1 != nil {
+			blobs[string(sha1)] = true
+		}
+		_, err = tx.Exec(q, row.fields()...)
+		if err != nil {
+			log.Errorf("tx.Exec('%s') failed with %s\n", q, err)
+			return n, err
+		}
+		n++
+	}
+}
+
+func checkEmptyInstallation(db *sql.DB) error {
+	for _, t := range backupTables {
+		var n int
+		q := fmt.Sprintf("SELECT COUNT(*) FROM %s", t.name)
+		err := db.QueryRow(q).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("can only restore to an empty installation but %s has %d rows", t.name, n)
+		}
+	}
+	return nil
+}
+
+func checkBackupInfo(db *sql.DB, d []byte) error {
+	var info backupInfo
+	err := json.Unmarshal(d, &info)
+	if err != nil {
+		return err
+	}
+	if info.FormatVersion != backupFormatVersion {
+		return fmt.Errorf("unsupported backup format %d", info.FormatVersion)
+	}
+	applied, err := getAppliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, no := range info.Migrations {
+		if !applied[no] {
+			return fmt.Errorf("backup is from a newer version, migration %d is not applied", no)
+		}
+	}
+	log.Infof("restoring backup created at %s\n", info.CreatedAt)
+	return nil
+}
+
+// restoreFrom restores backup from r. Everything is done in a single
+// transaction which is only committed after all referenced content has
+// been restored and verified
+func restoreFrom(r io.Reader) error {
+	db := repo.DB()
+	err := checkEmptyInstallation(db)
+	if err != nil {
+		return err
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gr)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+
+	tables := map[string]*backupTable{}
+	for _, t := range backupTables {
+		tables[t.fileName()] = t
+	}
+	referenced := map[string]bool{}
+	restored := map[string]bool{}
+	seenInfo := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := hdr.Name
+		switch {
+		case name == backupInfoName:
+			d, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			err = checkBackupInfo(db, d)
+			if err != nil {
+				return err
+			}
+			seenInfo = true
+		case tables[name] != nil:
+			if !seenInfo {
+				return fmt.Errorf("%s must be the first file in the backup", backupInfoName)
+			}
+			t := tables[name]
+			n, err := restoreTableRows(tx, t, tr, referenced)
+			if err != nil {
+				return err
+			}
+			log.Verbosef("restored %d rows of %s\n", n, t.name)
+		case strings.HasPrefix(name, backupBlobsDir):
+			sha1 := sha1FromHex(name)
+			if sha1 == nil {
+				return fmt.Errorf("invalid blob name '%s'", name)
+			}
+			d, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(u.Sha1OfBytes(d), sha1) {
+				return fmt.Errorf("content of '%s' doesn't match its sha1", name)
+			}
+			_, err = blobStore.Put(d)
+			if err != nil {
+				return err
+			}
+			restored[string(sha1)] = true
+		default:
+			log.Errorf("skipping unknown file '%s'\n", name)
+		}
+	}
+
+	for s := range referenced {
+		if !restored[s] {
+			return fmt.Errorf("content %x is referenced but not in the backup", []byte(s))
+		}
+	}
+	// backups made before versions.user_id existed
+	q := `UPDATE versions SET user_id = (SELECT user_id FROM notes WHERE notes.id = versions.note_id) WHERE user_id = 0`
+	_, err = tx.Exec(q)
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with %s\n", q, err)
+		return err
+	}
+	// new versions must get ids after the restored ones
+	for _, q = range dbSplitMultiStatements(sqlRaiseVersionIDs) {
+		_, err = tx.Exec(q)
+		if err != nil {
+			log.Errorf("tx.Exec('%s') failed with %s\n", q, err)
+			return err
+		}
+	}
+	err = tx.Commit()
+	tx = nil
+	if err != nil {
+		return err
+	}
+	log.Infof("restored %d blobs\n", len(restored))
+	return nil
+}
+
+// runRestore restores backup from a file at path
+func runRestore(path string) error {
+	timeStart := time.Now()
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = restoreFrom(f)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored backup '%s' in %s\n", path, time.Since(timeStart))
+	return nil
+}
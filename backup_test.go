@@ -0,0 +1,112 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/kjk/u"
+)
+
+// returns a copy of backup with content of blobs modified
+func corruptBackupBlobs(d []byte) []byte {
+	gr, err := gzip.NewReader(bytes.NewReader(d))
+	u.PanicIfErr(err)
+	tr := tar.NewReader(gr)
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		u.PanicIfErr(err)
+		d, err := ioutil.ReadAll(tr)
+		u.PanicIfErr(err)
+		if strings.HasPrefix(hdr.Name, backupBlobsDir) && len(d) > 0 {
+			d[0]++
+		}
+		u.PanicIfErr(writeTarFile(tw, hdr.Name, d))
+	}
+	u.PanicIfErr(tw.Close())
+	u.PanicIfErr(gw.Close())
+	return buf.Bytes()
+}
+
+func TestBackupRestore(t *testing.T) {
+	cleanup := openTestDbMust()
+	ctx := context.Background()
+	user, err := repo.GetOrCreateUser(ctx, "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	note := &NewNote{
+		title:   "backed up",
+		format:  formatText,
+		content: []byte("content of a note that is backed up"),
+	}
+	noteID, err := repo.CreateOrUpdateNote(ctx, user.ID, note)
+	u.PanicIfErr(err)
+	note.content = []byte("second version")
+	_, err = repo.CreateOrUpdateNote(ctx, user.ID, note)
+	u.PanicIfErr(err)
+	nVersions, err := repo.GetVersionsCount(ctx)
+	u.PanicIfErr(err)
+	attachment, err := repo.CreateAttachment(ctx, user.ID, noteID, "a.txt", []byte("attached file"))
+	u.PanicIfErr(err)
+
+	var buf bytes.Buffer
+	u.PanicIfErr(backupTo(&buf))
+	backup := buf.Bytes()
+	cleanup()
+
+	// content doesn't match sha1
+	cleanup = openTestDbMust()
+	err = restoreFrom(bytes.NewReader(corruptBackupBlobs(backup)))
+	if err == nil || !strings.Contains(err.Error(), "doesn't match its sha1") {
+		t.Fatalf("expected sha1 mismatch error, got %v", err)
+	}
+	n, err := repo.GetVersionsCount(ctx)
+	u.PanicIfErr(err)
+	if n != 0 {
+		t.Fatalf("failed restore left %d versions", n)
+	}
+	cleanup()
+
+	defer openTestDbMust()()
+	u.PanicIfErr(restoreFrom(bytes.NewReader(backup)))
+	n, err = repo.GetVersionsCount(ctx)
+	u.PanicIfErr(err)
+	if n != nVersions {
+		t.Fatalf("expected %d versions, got %d", nVersions, n)
+	}
+	restored, err := repo.GetNoteByID(ctx, noteID)
+	u.PanicIfErr(err)
+	d, err := localStore.Get(restored.ContentSha1)
+	u.PanicIfErr(err)
+	if restored.Title != "backed up" || string(d) != "second version" {
+		t.Fatalf("unexpected restored note %#v, content: '%s'", restored, d)
+	}
+	a, err := repo.GetAttachment(ctx, attachment.id)
+	u.PanicIfErr(err)
+	d, err = localStore.Get(a.ContentSha1)
+	u.PanicIfErr(err)
+	if a.noteID != noteID || a.Name != "a.txt" || string(d) != "attached file" {
+		t.Fatalf("unexpected restored attachment %#v, content: '%s'", a, d)
+	}
+	dbUser, err := repo.GetUserByLogin(ctx, "twitter:test")
+	u.PanicIfErr(err)
+	if dbUser.ID != user.ID {
+		t.Fatalf("expected user id %d, got %d", user.ID, dbUser.ID)
+	}
+
+	// can only restore to an empty installation
+	err = restoreFrom(bytes.NewReader(backup))
+	if err == nil {
+		t.Fatalf("restore to non-empty installation should fail")
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/kjk/quicknotes/pkg/log"
+	"github.com/kjk/u"
+)
+
+/*
+BlobStore is a content-addressed storage of note content. Blobs are
+identified by sha1 of their content.
+
+We have several implementations:
+- LocalStore : leveldb index + segment files on local disk
+- GoogleStorageStore : Google Storage bucket
+- FileStore : a plain directory with one file per blob
+- S3Store : S3-compatible storage (AWS, MinIO etc.)
+
+TieredStore composes them into a chain. Configured with -blob-stores flag
+e.g. "local,gcs" means: write to local store and Google Storage, read from
+local store and fall back to Google Storage (and cache locally) on a miss.
+
+A store with async: prefix e.g. "local,async:gcs" is written to in the
+background via UploadQueue so that saving a note doesn't wait for the
+upload. It must come after a writable local store.
+*/
+
+// BlobStore is a content-addressed storage
+type BlobStore interface {
+	// Put saves d and returns its sha1
+	Put(d []byte) ([]byte, error)
+	Get(sha1 []byte) ([]byte, error)
+	// GetLimited returns up to limit bytes from the beginning of the blob.
+	// limit of -1 means no limit
+	GetLimited(sha1 []byte, limit int) ([]byte, error)
+	Has(sha1 []byte) (bool, error)
+	Delete(sha1 []byte) error
+	// List calls fn with sha1 of every blob in the store. Stops at first
+	// error returned by fn
+	List(fn func(sha1 []byte) error) error
+	Name() string
+}
+
+// deltaPutter is implemented by stores that can save content as a delta
+// against other content (LocalStore)
+type deltaPutter interface {
+	PutDelta(d, baseSha1 []byte) ([]byte, error)
+}
+
+var (
+	// ErrBlobNotFound is returned when blob doesn't exist in a store
+	ErrBlobNotFound = errors.New("blob not found")
+
+	// blob store used for reading and saving note content. Built from
+	// -blob-stores flag
+	blobStore *TieredStore
+)
+
+// blobStoragePath returns path of the blob in remote stores
+// (Google Storage and S3)
+func blobStoragePath(sha1 []byte) string {
+	return fmt.Sprintf("notes_sha1/%02x/%02x/%02x/%x", sha1[0], sha1[1], sha1[2], sha1)
+}
+
+// sha1FromHex parses hex-encoded sha1 in the last element of a file path
+// or object name. Returns nil if not a valid sha1
+func sha1FromHex(name string) []byte {
+	name = path.Base(filepath.ToSlash(name))
+	if len(name) != 40 {
+		return nil
+	}
+	sha1, err := hex.DecodeString(name)
+	if err != nil {
+		return nil
+	}
+	return sha1
+}
+
+func truncateBlob(d []byte, limit int) []byte {
+	if limit >= 0 && len(d) > limit {
+		return d[:limit]
+	}
+	return d
+}
+
+// FileStore stores each blob in a separate file {dir}/{ab}/{cd}/{sha1}.
+// Meant as a mirror of LocalStore on e.g. a separate disk or nfs mount
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore creates FileStore in a given directory
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) pathForSha1(sha1 []byte) string {
+	return filepath.Join(s.dir, fileNameForSha1(sha1))
+}
+
+// Name returns name of the store
+func (s *FileStore) Name() string {
+	return "fs:" + s.dir
+}
+
+// Put saves d to a file
+func (s *FileStore) Put(d []byte) ([]byte, error) {
+	sha1 := u.Sha1OfBytes(d)
+	filePath := s.pathForSha1(sha1)
+	if u.FileExists(filePath) {
+		return sha1, nil
+	}
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return nil, err
+	}
+	// write to a temporary file and rename so that we never end up with
+	// a partially written blob. The temporary file is unique so that
+	// concurrent writes of the same blob don't clobber each other
+	f, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := f.Name()
+	_, err = f.Write(d)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	err = os.Rename(tmpPath, filePath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	return sha1, nil
+}
+
+// Get returns content of the blob
+func (s *FileStore) Get(sha1 []byte) ([]byte, error) {
+	return s.GetLimited(sha1, -1)
+}
+
+// GetLimited returns up to limit bytes of the blob
+func (s *FileStore) GetLimited(sha1 []byte, limit int) ([]byte, error) {
+	var d []byte
+	var err error
+	filePath := s.pathForSha1(sha1)
+	if limit == -1 {
+		d, err = ioutil.ReadFile(filePath)
+	} else {
+		d, err = readFileLimited(filePath, limit)
+	}
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return d, err
+}
+
+// Has returns true if blob is in the store
+func (s *FileStore) Has(sha1 []byte) (bool, error) {
+	return u.FileExists(s.pathForSha1(sha1)), nil
+}
+
+// Delete deletes the blob
+func (s *FileStore) Delete(sha1 []byte) error {
+	err := os.Remove(s.pathForSha1(sha1))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List lists all blobs in the store
+func (s *FileStore) List(fn func(sha1 []byte) error) error {
+	return filepath.Walk(s.dir, func(filePath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		sha1 := sha1FromHex(filePath)
+		if sha1 == nil {
+			return nil
+		}
+		return fn(sha1)
+	})
+}
+
+type blobTier struct {
+	store    BlobStore
+	readOnly bool
+	// if true, writes go through queue
+	async bool
+}
+
+// TieredStore is a chain of stores. Writes go to all writable stores.
+// Reads are served from the first store that has the blob and the blob
+// is copied to writable stores before it.
+type TieredStore struct {
+	tiers []blobTier
+	queue *UploadQueue
+}
+
+// NewTieredStore creates a new TieredStore
+func NewTieredStore() *TieredStore {
+	return &TieredStore{}
+}
+
+// Add adds a store at the end of the chain. If readOnly is true, we only
+// read from the store
+func (s *TieredStore) Add(store BlobStore, readOnly bool) {
+	s.tiers = append(s.tiers, blobTier{store: store, readOnly: readOnly})
+}
+
+// AddAsync adds a store at the end of the chain. Writes to the store are
+// queued in queue and uploaded in the background
+func (s *TieredStore) AddAsync(store BlobStore, queue *UploadQueue) {
+	s.tiers = append(s.tiers, blobTier{store: store, async: true})
+	s.queue = queue
+	queue.AddStore(store)
+}
+
+// putTier saves d with a given sha1 in a store, or queues the upload if
+// the store is async
+func (s *TieredStore) putTier(tier blobTier, sha1, d []byte) error {
+	if tier.async {
+		return s.queue.Add(sha1, tier.store.Name())
+	}
+	_, err := tier.store.Put(d)
+	return err
+}
+
+// Stores returns the stores in the chain, in order
+func (s *TieredStore) Stores() []BlobStore {
+	var res []BlobStore
+	for _, tier := range s.tiers {
+		res = append(res, tier.store)
+	}
+	return res
+}
+
+// Name returns description of the chain e.g. "local,ro:gcs"
+func (s *TieredStore) Name() string {
+	var parts []string
+	for _, tier := range s.tiers {
+		name := tier.store.Name()
+		if tier.readOnly {
+			name = "ro:" + name
+		}
+		if tier.async {
+			name = "async:" + name
+		}
+		parts = append(parts, name)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Put saves d in all writable stores. Returns the first error but tries
+// to save in all stores
+func (s *TieredStore) Put(d []byte) ([]byte, error) {
+	var firstErr error
+	sha1 := u.Sha1OfBytes(d)
+	for _, tier := range s.tiers {
+		if tier.readOnly {
+			continue
+		}
+		err := s.putTier(tier, sha1, d)
+		if err != nil {
+			log.Errorf("%s.Put() failed with %s\n", tier.store.Name(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return sha1, firstErr
+}
+
+// PutDelta is like Put but stores that support it save d as a delta
+// against content with baseSha1
+func (s *TieredStore) PutDelta(d, baseSha1 []byte) ([]byte, error) {
+	var firstErr error
+	sha1 := u.Sha1OfBytes(d)
+	for _, tier := range s.tiers {
+		if tier.readOnly {
+			continue
+		}
+		var err error
+		if dp, ok := tier.store.(deltaPutter); ok && !tier.async {
+			_, err = dp.PutDelta(d, baseSha1)
+		} else {
+			err = s.putTier(tier, sha1, d)
+		}
+		if err != nil {
+			log.Errorf("%s.PutDelta() failed with %s\n", tier.store.Name(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return sha1, firstErr
+}
+
+// Get returns content of the blob
+func (s *TieredStore) Get(sha1 []byte) ([]byte, error) {
+	return s.GetLimited(sha1, -1)
+}
+
+// GetLimited returns up to limit bytes of the blob from the first store
+// that has it
+func (s *TieredStore) GetLimited(sha1 []byte, limit int) ([]byte, error) {
+	err := ErrBlobNotFound
+	for i, tier := range s.tiers {
+		// when reading from a secondary store, we need full content to
+		// cache it in stores before it
+		tierLimit := limit
+		if i > 0 {
+			tierLimit = -1
+		}
+		var d []byte
+		d, err = tier.store.GetLimited(sha1, tierLimit)
+		if err != nil {
+			if err != ErrBlobNotFound {
+				log.Errorf("%s.GetLimited(%x) failed with %s\n", tier.store.Name(), sha1, err)
+			}
+			continue
+		}
+		if len(d) == 0 {
+			log.Errorf("TieredStore.GetLimited: len(d) for %x in %s is 0!\n", sha1, tier.store.Name())
+		}
+		for _, prev := range s.tiers[:i] {
+			if prev.readOnly {
+				continue
+			}
+			err = s.putTier(prev, sha1, d)
+			if err != nil {
+				log.Errorf("TieredStore.GetLimited: %s.Put() failed with %s\n", prev.store.Name(), err)
+			}
+		}
+		return truncateBlob(d, limit), nil
+	}
+	return nil, err
+}
+
+// Has returns true if any of the stores has the blob
+func (s *TieredStore) Has(sha1 []byte) (bool, error) {
+	for _, tier := range s.tiers {
+		has, err := tier.store.Has(sha1)
+		if err != nil {
+			return false, err
+		}
+		if has {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Delete deletes the blob from all writable stores
+func (s *TieredStore) Delete(sha1 []byte) error {
+	var firstErr error
+	for _, tier := range s.tiers {
+		if tier.readOnly {
+			continue
+		}
+		err := tier.store.Delete(sha1)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// DeleteExcept deletes the blob from all writable stores other than store
+// e.g. after it was deleted from store by its own garbage collection
+func (s *TieredStore) DeleteExcept(store BlobStore, sha1 []byte) error {
+	var firstErr error
+	for _, tier := range s.tiers {
+		if tier.readOnly || tier.store == store {
+			continue
+		}
+		err := tier.store.Delete(sha1)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// List lists blobs in the first store in the chain
+func (s *TieredStore) List(fn func(sha1 []byte) error) error {
+	if len(s.tiers) == 0 {
+		return nil
+	}
+	return s.tiers[0].store.List(fn)
+}
+
+func defaultBlobStoresSpec() string {
+	// in production or in cowboy mode we save notes to google storage as well.
+	// otherwise we only read from it
+	if flgProduction || flgProdDb {
+		return "local,async:gcs"
+	}
+	return "local,ro:gcs"
+}
+
+func newBlobStoreFromSpecName(name string) (BlobStore, error) {
+	switch {
+	case name == "local":
+		return localStore, nil
+	case name == "gcs":
+		return NewGoogleStorageStore(quicknotesBucket)
+	case strings.HasPrefix(name, "fs:"):
+		return NewFileStore(u.ExpandTildeInPath(name[len("fs:"):]))
+	case strings.HasPrefix(name, "s3:"):
+		return NewS3Store(flgS3Endpoint, flgS3Region, name[len("s3:"):])
+	}
+	return nil, fmt.Errorf("unknown blob store '%s'", name)
+}
+
+// newTieredStoreFromSpec creates a chain of stores from a spec like
+// "local,ro:gcs,fs:/mnt/backup,async:s3:quicknotes". Uploads to async:
+// stores go through queue
+func newTieredStoreFromSpec(spec string, queue *UploadQueue) (*TieredStore, error) {
+	res := NewTieredStore()
+	hasLocal := false
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		readOnly := strings.HasPrefix(name, "ro:")
+		name = strings.TrimPrefix(name, "ro:")
+		async := strings.HasPrefix(name, "async:")
+		name = strings.TrimPrefix(name, "async:")
+		if async && (readOnly || !hasLocal) {
+			return nil, fmt.Errorf("async store '%s' must be writable and come after writable local store", name)
+		}
+		store, err := newBlobStoreFromSpecName(name)
+		if err != nil {
+			return nil, err
+		}
+		if async {
+			res.AddAsync(store, queue)
+			continue
+		}
+		if name == "local" && !readOnly {
+			hasLocal = true
+		}
+		res.Add(store, readOnly)
+	}
+	if len(res.tiers) == 0 {
+		return nil, fmt.Errorf("no blob stores in '%s'", spec)
+	}
+	return res, nil
+}
+
+// opens localStore and configures blobStore based on -blob-stores flag
+func openBlobStoresMust() {
+	var err error
+	localStore, err = NewLocalStore(getLocalStoreDir())
+	if err != nil {
+		log.Fatalf("NewLocalStore() failed with %s\n", err)
+	}
+	spec := flgBlobStores
+	if spec == "" {
+		spec = defaultBlobStoresSpec()
+	}
+	uploadQueue = NewUploadQueue(localStore)
+	blobStore, err = newTieredStoreFromSpec(spec, uploadQueue)
+	if err != nil {
+		log.Fatalf("newTieredStoreFromSpec('%s') failed with %s\n", spec, err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/kjk/u"
+)
+
+// fakeS3 is a minimal in-memory stand-in for S3 / MinIO, good enough for
+// operations used by S3Store
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+type fakeS3ListResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	IsTruncated bool
+	Contents    []fakeS3Object
+}
+
+type fakeS3Object struct {
+	Key  string
+	Size int
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// path-style: /{bucket}/{key}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method != "HEAD" {
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+		}
+	}
+	switch {
+	case r.Method == "GET" && key == "":
+		prefix := r.URL.Query().Get("prefix")
+		res := fakeS3ListResult{Name: parts[0], Prefix: prefix}
+		var keys []string
+		for k := range s.objects {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			res.Contents = append(res.Contents, fakeS3Object{Key: k, Size: len(s.objects[k])})
+		}
+		res.KeyCount = len(keys)
+		d, _ := xml.Marshal(res)
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(d)
+	case r.Method == "PUT":
+		d, _ := ioutil.ReadAll(r.Body)
+		s.objects[key] = d
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == "GET" || r.Method == "HEAD":
+		d, ok := s.objects[key]
+		if !ok {
+			notFound()
+			return
+		}
+		code := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			// only support bytes=0-N
+			end, err := strconv.Atoi(strings.TrimPrefix(rng, "bytes=0-"))
+			if err == nil && end+1 < len(d) {
+				d = d[:end+1]
+			}
+			code = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(d)))
+		w.WriteHeader(code)
+		if r.Method == "GET" {
+			w.Write(d)
+		}
+	case r.Method == "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func testBlobStore(t *testing.T, store BlobStore) {
+	d1 := []byte("hello, this is content of the first blob")
+	d2 := []byte("second blob")
+	sha1, err := store.Put(d1)
+	u.PanicIfErr(err)
+	if !bytes.Equal(sha1, u.Sha1OfBytes(d1)) {
+		t.Fatalf("%s: invalid sha1 %x", store.Name(), sha1)
+	}
+	// putting the same content again is fine
+	_, err = store.Put(d1)
+	u.PanicIfErr(err)
+	sha2, err := store.Put(d2)
+	u.PanicIfErr(err)
+
+	d, err := store.Get(sha1)
+	u.PanicIfErr(err)
+	if !bytes.Equal(d, d1) {
+		t.Fatalf("%s: got '%s', expected '%s'", store.Name(), d, d1)
+	}
+	d, err = store.GetLimited(sha1, 5)
+	u.PanicIfErr(err)
+	if string(d) != "hello" {
+		t.Fatalf("%s: got '%s', expected 'hello'", store.Name(), d)
+	}
+	has, err := store.Has(sha2)
+	u.PanicIfErr(err)
+	if !has {
+		t.Fatalf("%s: should have %x", store.Name(), sha2)
+	}
+
+	n := 0
+	err = store.List(func(sha1 []byte) error {
+		n++
+		return nil
+	})
+	u.PanicIfErr(err)
+	if n != 2 {
+		t.Fatalf("%s: expected 2 blobs, got %d", store.Name(), n)
+	}
+
+	u.PanicIfErr(store.Delete(sha2))
+	has, err = store.Has(sha2)
+	u.PanicIfErr(err)
+	if has {
+		t.Fatalf("%s: shouldn't have %x after Delete()", store.Name(), sha2)
+	}
+	_, err = store.Get(sha2)
+	if err != ErrBlobNotFound {
+		t.Fatalf("%s: expected ErrBlobNotFound, got %v", store.Name(), err)
+	}
+}
+
+func TestBlobStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quicknotes_blobs")
+	u.PanicIfErr(err)
+	defer os.RemoveAll(dir)
+
+	ls, err := NewLocalStore(dir + "/local")
+	u.PanicIfErr(err)
+	defer ls.Close()
+	testBlobStore(t, ls)
+
+	fs, err := NewFileStore(dir + "/fs")
+	u.PanicIfErr(err)
+	testBlobStore(t, fs)
+
+	srv := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	defer srv.Close()
+	conf := &aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(srv.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("key", "secret", ""),
+	}
+	s3Store, err := NewS3StoreWithConfig(conf, "quicknotes")
+	u.PanicIfErr(err)
+	testBlobStore(t, s3Store)
+}
+
+func TestTieredStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quicknotes_tiered")
+	u.PanicIfErr(err)
+	defer os.RemoveAll(dir)
+
+	primary, err := NewFileStore(dir + "/primary")
+	u.PanicIfErr(err)
+	secondary, err := NewFileStore(dir + "/secondary")
+	u.PanicIfErr(err)
+	readOnly, err := NewFileStore(dir + "/readonly")
+	u.PanicIfErr(err)
+
+	store := NewTieredStore()
+	store.Add(primary, false)
+	store.Add(secondary, false)
+	store.Add(readOnly, true)
+	if store.Name() != "fs:"+dir+"/primary,fs:"+dir+"/secondary,ro:fs:"+dir+"/readonly" {
+		t.Fatalf("unexpected name '%s'", store.Name())
+	}
+
+	d := []byte("content saved to all writable stores")
+	sha1, err := store.Put(d)
+	u.PanicIfErr(err)
+	for _, s := range []BlobStore{primary, secondary} {
+		has, _ := s.Has(sha1)
+		if !has {
+			t.Fatalf("%s should have %x", s.Name(), sha1)
+		}
+	}
+	has, _ := readOnly.Has(sha1)
+	if has {
+		t.Fatalf("read-only store shouldn't have %x", sha1)
+	}
+
+	// a miss in primary store is served from a later store and cached
+	d = []byte("content only in read-only store")
+	sha1, err = readOnly.Put(d)
+	u.PanicIfErr(err)
+	got, err := store.GetLimited(sha1, 7)
+	u.PanicIfErr(err)
+	if string(got) != "content" {
+		t.Fatalf("got '%s', expected 'content'", got)
+	}
+	got, err = primary.Get(sha1)
+	u.PanicIfErr(err)
+	if !bytes.Equal(got, d) {
+		t.Fatalf("primary store should have full content, got '%s'", got)
+	}
+}
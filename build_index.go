@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -83,7 +84,7 @@ func buildNotesIndexPage(nNotes, nPages, pageNo int, notes []NoteIndex) error {
 }
 
 // unconditionally generate index page for public notes
-func buildPublicNotesIndex() error {
+func buildPublicNotesIndex(ctx context.Context) error {
 	log.Verbosef("buildPublicNotesIndex\n")
 
 	buildIndexMu.Lock()
@@ -92,17 +93,9 @@ func buildPublicNotesIndex() error {
 	timeStart := time.Now()
 	deleteIndexPages()
 	pageNo := 1
-	nNotes := 0
-	db := getDbMust()
-
-	q := `
-SELECT count(*)
-FROM notes
-WHERE is_public = true AND is_deleted = false AND is_encrypted = false`
-
-	err := db.QueryRow(q).Scan(&nNotes)
+	nNotes, err := repo.GetPublicNotesCount(ctx)
 	if err != nil {
-		log.Errorf("row.Scan() for '%s' failed with '%s'\n", q, err)
+		log.Errorf("repo.GetPublicNotesCount() failed with '%s'\n", err)
 		return err
 	}
 
@@ -111,42 +104,20 @@ WHERE is_public = true AND is_deleted = false AND is_encrypted = false`
 		nPages++
 	}
 
-	q = `
-SELECT
-  id,
-  user_id,
-  created_at,
-  title
-FROM notes
-WHERE is_public = true AND is_deleted = false AND is_encrypted = false
-ORDER BY created_at DESC`
-	rows, err := db.Query(q)
+	publicNotes, err := repo.GetPublicNotesForIndex(ctx)
 	if err != nil {
-		log.Errorf("db.Query('%s') failed with '%s'\n", q, err)
 		return err
 	}
-	defer rows.Close()
 	var notes []NoteIndex
-	for rows.Next() {
-		var noteID int
-		var userID int
-		var createdAt time.Time
-		var title string
-		err = rows.Scan(
-			&noteID,
-			&userID,
-			&createdAt,
-			&title)
-		if err != nil {
-			return err
-		}
-		url := "/n/" + hashInt(noteID)
+	for _, note := range publicNotes {
+		title := note.Title
+		url := "/n/" + note.HashID
 		if title == "" {
-			title = hashInt(noteID)
+			title = note.HashID
 		} else {
 			url = url + "-" + title
 		}
-		userInfo, err := getCachedUserInfo(userID)
+		userInfo, _ := getCachedUserInfo(ctx, note.userID)
 		creator := "unknown"
 		if userInfo != nil {
 			creator = userInfo.user.GetHandle()
@@ -155,8 +126,8 @@ ORDER BY created_at DESC`
 			URL:             url,
 			Title:           title,
 			Creator:         creator,
-			CreatedAt:       createdAt,
-			CreatedAtString: createdAt.Format("2006-01-02"),
+			CreatedAt:       note.CreatedAt,
+			CreatedAtString: note.CreatedAt.Format("2006-01-02"),
 		})
 		if len(notes) == nNotesPerPage {
 			err = buildNotesIndexPage(nNotes, nPages, pageNo, notes)
@@ -0,0 +1,731 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+Real-time collaborative editing of a note.
+
+A websocket connection joins a note with collabJoin and gets the content
+and the revision (number of operations applied so far). It then sends
+operations (see ot.go) with collabOp, tagged with the revision they're
+based on. The server transforms an operation against operations applied
+since that revision, applies it and sends it, with the new revision, to
+all other connections as a collabOp message. The sender gets the new
+revision as a response. Both are queued under the session lock, so every
+connection sees operations and acks in the order they were applied, which
+is what ot.js client expects. Queueing doesn't block: a connection whose
+queue is full is dropped from the session and has to re-join.
+
+Presence: every connection in a session has a client id and a selection
+(cursor is a selection where Anchor == Head), updated with collabSelect or
+together with an operation. Selections are transformed by operations. The
+list of clients is sent as a collabPresence message whenever it changes.
+
+The document is saved as a new version of the note every
+collabCheckpointInterval and when the last connection leaves. The save is
+based on the version the session started from (or last saved), so edits
+made outside of the session are merged (see merge.go). If that changes the
+document, the change is sent to clients as an operation with client id 0.
+After saving, all connections of the user get broadcastUserNotes.
+
+If edits made outside of the session overlap edits in the session, nothing
+is saved and clients get a collabConflict message (NoteConflictRsp). A
+client resolves the conflict by changing the document with operations and
+sending collabResolve with CurrentVersionID of the conflict, after which the
+document is saved over that version. If the last connection leaves with
+the conflict unresolved, the document is saved as a new note so that edits
+aren't lost.
+
+Only the owner can edit a note, so all connections in a session belong to
+the same user, editing e.g. on desktop and in the browser.
+*/
+
+const (
+	collabCheckpointInterval = 30 * time.Second
+	// number of operations we keep to transform operations based on
+	// older revisions. Clients that fall further behind have to re-join
+	collabMaxHistory = 1000
+)
+
+// CollabSelection is a selection in a document, in UTF-16 code units
+type CollabSelection struct {
+	Anchor int
+	Head   int
+}
+
+// CollabPresence describes a client editing a note
+type CollabPresence struct {
+	ClientID  int
+	UserName  string
+	Selection *CollabSelection `json:",omitempty"`
+}
+
+// CollabJoinRsp is a result of collabJoin
+type CollabJoinRsp struct {
+	NoteHashID string
+	ClientID   int
+	Revision   int
+	Content    string
+	Clients    []*CollabPresence
+}
+
+// CollabOpRsp is a result of collabOp, sent to the client that sent
+// the operation
+type CollabOpRsp struct {
+	NoteHashID string
+	Revision   int
+}
+
+// CollabOpMsg is sent to clients when an operation is applied. ClientID is
+// 0 for changes made by the server
+type CollabOpMsg struct {
+	NoteHashID string
+	Revision   int
+	ClientID   int
+	Op         TextOp
+	Selection  *CollabSelection `json:",omitempty"`
+}
+
+// CollabPresenceMsg is sent to clients when clients join or leave a note or
+// change their selection
+type CollabPresenceMsg struct {
+	NoteHashID string
+	Clients    []*CollabPresence
+}
+
+// collabClient is a websocket connection taking part in collaborative
+// editing. It's only used from the goroutine reading from the connection
+type collabClient struct {
+	id       int
+	user     *UserSummary
+	c        chan *wsResponse
+	sessions map[int]*collabSession
+}
+
+type collabSession struct {
+	noteID int
+	userID int
+	user   *UserSummary
+	// one checkpoint at a time
+	muCheckpoint sync.Mutex
+
+	mu sync.Mutex
+	// document after all operations in history
+	doc []uint16
+	// history[i] is the operation that changed revision historyStart+i
+	// into the next revision
+	history      []TextOp
+	historyStart int
+	// version of the note doc is based on
+	versionID     int
+	savedRevision int
+	// current version of the note when saving last failed because of
+	// a conflict that clients haven't resolved yet, 0 if there's no conflict
+	conflictVersionID int
+	clients           map[*collabClient]*CollabSelection
+	closed            bool
+	done              chan struct{}
+}
+
+var (
+	// returned for operations of a client that was dropped from a session
+	// because it couldn't keep up with messages
+	errCollabFellBehind = errors.New("fell behind the collaborative session, join the note again")
+
+	muCollabSessions sync.Mutex
+	collabSessions   = map[int]*collabSession{}
+	lastCollabClient int
+)
+
+func newCollabClient(user *UserSummary, c chan *wsResponse) *collabClient {
+	muCollabSessions.Lock()
+	defer muCollabSessions.Unlock()
+	lastCollabClient++
+	return &collabClient{
+		id:       lastCollabClient,
+		user:     user,
+		c:        c,
+		sessions: map[int]*collabSession{},
+	}
+}
+
+func (s *collabSession) revision() int {
+	return s.historyStart + len(s.history)
+}
+
+// must be called with s.mu locked
+func (s *collabSession) presence() []*CollabPresence {
+	var res []*CollabPresence
+	for client, sel := range s.clients {
+		p := &CollabPresence{
+			ClientID:  client.id,
+			Selection: sel,
+		}
+		if client.user != nil {
+			p.UserName = client.user.Handle
+		}
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ClientID < res[j].ClientID
+	})
+	return res
+}
+
+// queues rsp for clients, dropping clients whose queue is full so that
+// a slow connection doesn't block the session. Must be called with s.mu locked
+func (s *collabSession) sendTo(clients []*collabClient, rsp *wsResponse) {
+	dropped := false
+	for _, client := range clients {
+		select {
+		case client.c <- rsp:
+		default:
+			log.Infof("collab client %d fell behind editing note %d, dropping it\n", client.id, s.noteID)
+			delete(s.clients, client)
+			dropped = true
+		}
+	}
+	if dropped {
+		s.broadcastPresence(nil)
+	}
+}
+
+// sends a response to a request of a client. Must be called with s.mu locked
+func (s *collabSession) send(client *collabClient, reqID int, cmd string, v interface{}) {
+	rsp := &wsResponse{
+		ID:     reqID,
+		Cmd:    cmd,
+		Result: v,
+	}
+	s.sendTo([]*collabClient{client}, rsp)
+}
+
+// sends a message to all clients except one. Must be called with s.mu locked
+func (s *collabSession) broadcast(except *collabClient, cmd string, v interface{}) {
+	rsp := &wsResponse{
+		ID:     -1,
+		Cmd:    cmd,
+		Result: v,
+	}
+	var clients []*collabClient
+	for client := range s.clients {
+		if client != except {
+			clients = append(clients, client)
+		}
+	}
+	s.sendTo(clients, rsp)
+}
+
+func (s *collabSession) hasClient(client *collabClient) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.clients[client]
+	return ok
+}
+
+// must be called with s.mu locked
+func (s *collabSession) broadcastPresence(except *collabClient) {
+	msg := &CollabPresenceMsg{
+		NoteHashID: hashInt(s.noteID),
+		Clients:    s.presence(),
+	}
+	s.broadcast(except, "collabPresence", msg)
+}
+
+// applies op based on revision, returns the transformed operation that was
+// applied. If client is given, its selection is set to sel, which is based
+// on revision with op applied. Must be called with s.mu locked
+func (s *collabSession) applyOp(revision int, op TextOp, client *collabClient, sel *CollabSelection) (TextOp, error) {
+	if revision < s.historyStart || revision > s.revision() {
+		return nil, fmt.Errorf("invalid revision %d, the session is at revision %d", revision, s.revision())
+	}
+	// operations applied since revision, transformed to apply after op
+	var concurrent []TextOp
+	for _, other := range s.history[revision-s.historyStart:] {
+		var otherPrime TextOp
+		var err error
+		op, otherPrime, err = transformTextOps(op, other)
+		if err != nil {
+			return nil, err
+		}
+		concurrent = append(concurrent, otherPrime)
+	}
+	doc, err := op.Apply(s.doc)
+	if err != nil {
+		return nil, err
+	}
+	s.doc = doc
+	s.history = append(s.history, op)
+	if len(s.history) > collabMaxHistory {
+		n := len(s.history) - collabMaxHistory
+		s.history = append([]TextOp(nil), s.history[n:]...)
+		s.historyStart += n
+	}
+	for c, cSel := range s.clients {
+		if cSel != nil {
+			s.clients[c] = cSel.transform(op)
+		}
+	}
+	if client != nil && sel != nil {
+		for _, other := range concurrent {
+			sel = sel.transform(other)
+		}
+		s.clients[client] = sel
+	}
+	return op, nil
+}
+
+func (sel *CollabSelection) transform(op TextOp) *CollabSelection {
+	return &CollabSelection{
+		Anchor: op.transformIndex(sel.Anchor),
+		Head:   op.transformIndex(sel.Head),
+	}
+}
+
+// checkpoint saves the document as a new version of the note if it changed
+func (s *collabSession) checkpoint(ctx context.Context) {
+	s.muCheckpoint.Lock()
+	defer s.muCheckpoint.Unlock()
+	s.mu.Lock()
+	revision := s.revision()
+	if revision == s.savedRevision {
+		s.mu.Unlock()
+		return
+	}
+	doc := s.doc
+	baseVersionID := s.versionID
+	s.mu.Unlock()
+
+	if len(doc) == 0 {
+		log.Infof("not saving empty note %d\n", s.noteID)
+		return
+	}
+	current, err := repo.GetNoteByID(ctx, s.noteID)
+	if err != nil {
+		log.Errorf("repo.GetNoteByID(%d) failed with %s\n", s.noteID, err)
+		return
+	}
+	note, err := newNoteFromNote(current)
+	if err != nil {
+		log.Errorf("newNoteFromNote() failed with %s\n", err)
+		return
+	}
+	note.hashID = hashInt(s.noteID)
+	note.content = []byte(string(utf16.Decode(doc)))
+	note.baseVersionID = baseVersionID
+	userCtx := &ReqContext{User: s.user, context: ctx}
+	prevLatestVersion := getLatestVersionForUser(userCtx)
+	_, err = repo.CreateOrUpdateNote(ctx, s.userID, note)
+	if conflict, ok := err.(*NoteConflictError); ok {
+		s.handleConflict(userCtx, note, conflict, prevLatestVersion)
+		return
+	}
+	if err != nil {
+		log.Errorf("repo.CreateOrUpdateNote() of note %d failed with %s\n", s.noteID, err)
+		return
+	}
+	broadcastUserNotes(userCtx, prevLatestVersion)
+	saved, err := repo.GetNoteByID(ctx, s.noteID)
+	if err != nil {
+		log.Errorf("repo.GetNoteByID(%d) failed with %s\n", s.noteID, err)
+		return
+	}
+	savedContent, err := getNoteContent(saved)
+	if err != nil {
+		log.Errorf("getNoteContent() of note %d failed with %s\n", s.noteID, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versionID = saved.CurrVersionID
+	s.savedRevision = revision
+	s.conflictVersionID = 0
+	// merged with changes made outside of the session
+	op := textOpReplace(doc, utf16.Encode([]rune(string(savedContent))))
+	if op.IsNoop() {
+		return
+	}
+	op, err = s.applyOp(revision, op, nil, nil)
+	if err != nil {
+		log.Errorf("applying merged content of note %d failed with %s\n", s.noteID, err)
+		return
+	}
+	// if there were no operations since, the document is what we saved
+	if s.revision() == revision+1 {
+		s.savedRevision = s.revision()
+	}
+	msg := &CollabOpMsg{
+		NoteHashID: hashInt(s.noteID),
+		Revision:   s.revision(),
+		Op:         op,
+	}
+	s.broadcast(nil, "collabOp", msg)
+}
+
+// handleConflict tells clients about edits made outside of the session that
+// conflict with the document. If there are no clients left, the document is
+// saved as a new note instead
+func (s *collabSession) handleConflict(ctx *ReqContext, note *NewNote, conflict *NoteConflictError, prevLatestVersion int) {
+	msg := newNoteConflictRsp(conflict)
+	s.mu.Lock()
+	hasClients := len(s.clients) > 0
+	// clients are told once about each conflicting version
+	if hasClients && s.conflictVersionID != conflict.Current.CurrVersionID {
+		log.Infof("note %d has %d conflicts with version %d\n", s.noteID, conflict.Conflicts, conflict.Current.CurrVersionID)
+		s.conflictVersionID = conflict.Current.CurrVersionID
+		s.broadcast(nil, "collabConflict", msg)
+	}
+	s.mu.Unlock()
+	if hasClients {
+		return
+	}
+
+	cp := &NewNote{
+		title:   note.title + " (conflicted copy)",
+		format:  note.format,
+		tags:    note.tags,
+		content: note.content,
+	}
+	noteID, err := repo.CreateOrUpdateNote(ctx.Context(), s.userID, cp)
+	if err != nil {
+		log.Errorf("repo.CreateOrUpdateNote() of conflicted copy of note %d failed with %s\n", s.noteID, err)
+		return
+	}
+	log.Infof("saved edits of note %d conflicting with version %d as note %d\n", s.noteID, conflict.Current.CurrVersionID, noteID)
+	broadcastUserNotes(ctx, prevLatestVersion)
+}
+
+func (s *collabSession) checkpointLoop() {
+	ticker := time.NewTicker(collabCheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.checkpoint(serverCtx)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// returns a session for the note, creating it if necessary
+func getCollabSession(ctx context.Context, user *UserSummary, noteID int) (*collabSession, error) {
+	userID := user.id
+	muCollabSessions.Lock()
+	s := collabSessions[noteID]
+	muCollabSessions.Unlock()
+	if s == nil {
+		// don't block other sessions while we read the note
+		var err error
+		s, err = loadCollabSession(ctx, user, noteID)
+		if err != nil {
+			return nil, err
+		}
+		muCollabSessions.Lock()
+		if existing := collabSessions[noteID]; existing != nil {
+			// started by another connection while we were reading the note
+			s = existing
+		} else {
+			collabSessions[noteID] = s
+			go s.checkpointLoop()
+			log.Verbosef("started collaborative editing of note %d\n", noteID)
+		}
+		muCollabSessions.Unlock()
+	}
+	if s.userID != userID {
+		return nil, fmt.Errorf("note %d doesn't belong to user %d", noteID, userID)
+	}
+	return s, nil
+}
+
+// creates a session for the note, not yet started
+func loadCollabSession(ctx context.Context, user *UserSummary, noteID int) (*collabSession, error) {
+	userID := user.id
+	note, err := repo.GetNoteByID(ctx, noteID)
+	if err != nil {
+		return nil, err
+	}
+	if note.userID != userID {
+		return nil, fmt.Errorf("note %d doesn't belong to user %d", noteID, userID)
+	}
+	// we can't look inside encrypted content
+	if note.IsEncrypted {
+		return nil, errors.New("encrypted notes can't be edited collaboratively")
+	}
+	content, err := getNoteContent(note)
+	if err != nil {
+		return nil, err
+	}
+	return &collabSession{
+		noteID:    noteID,
+		userID:    userID,
+		user:      user,
+		doc:       utf16.Encode([]rune(string(content))),
+		versionID: note.CurrVersionID,
+		clients:   map[*collabClient]*CollabSelection{},
+		done:      make(chan struct{}),
+	}, nil
+}
+
+func (client *collabClient) send(reqID int, cmd string, v interface{}) {
+	client.c <- &wsResponse{
+		ID:     reqID,
+		Cmd:    cmd,
+		Result: v,
+	}
+}
+
+// join adds the client to editing of the note and sends it the document
+func (client *collabClient) join(ctx context.Context, reqID int, noteID int) error {
+	if s := client.sessions[noteID]; s != nil {
+		if s.hasClient(client) {
+			return fmt.Errorf("already editing note %d", noteID)
+		}
+		// the client was dropped from the session
+		client.leave(noteID)
+	}
+	for {
+		s, err := getCollabSession(ctx, client.user, noteID)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			// the session ended after we got it, start a new one
+			s.mu.Unlock()
+			continue
+		}
+		s.clients[client] = nil
+		client.sessions[noteID] = s
+		rsp := &CollabJoinRsp{
+			NoteHashID: hashInt(noteID),
+			ClientID:   client.id,
+			Revision:   s.revision(),
+			Content:    string(utf16.Decode(s.doc)),
+			Clients:    s.presence(),
+		}
+		s.send(client, reqID, "collabJoin", rsp)
+		s.broadcastPresence(client)
+		s.mu.Unlock()
+		return nil
+	}
+}
+
+// leave removes the client from editing of the note. The last client to
+// leave saves the document and ends the session
+func (client *collabClient) leave(noteID int) {
+	s := client.sessions[noteID]
+	if s == nil {
+		return
+	}
+	delete(client.sessions, noteID)
+	s.mu.Lock()
+	delete(s.clients, client)
+	s.broadcastPresence(nil)
+	isLast := len(s.clients) == 0
+	s.mu.Unlock()
+	if !isLast {
+		return
+	}
+
+	s.checkpoint(serverCtx)
+	muCollabSessions.Lock()
+	defer muCollabSessions.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// somebody might have joined while we were saving
+	if len(s.clients) > 0 || s.closed {
+		return
+	}
+	s.closed = true
+	close(s.done)
+	delete(collabSessions, noteID)
+	log.Verbosef("ended collaborative editing of note %d\n", noteID)
+}
+
+func (client *collabClient) leaveAll() {
+	for noteID := range client.sessions {
+		client.leave(noteID)
+	}
+}
+
+func (client *collabClient) applyOp(reqID int, noteID int, revision int, op TextOp, sel *CollabSelection) error {
+	s := client.sessions[noteID]
+	if s == nil {
+		return fmt.Errorf("not editing note %d", noteID)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[client]; !ok {
+		return errCollabFellBehind
+	}
+	op, err := s.applyOp(revision, op, client, sel)
+	if err != nil {
+		return err
+	}
+	msg := &CollabOpMsg{
+		NoteHashID: hashInt(noteID),
+		Revision:   s.revision(),
+		ClientID:   client.id,
+		Op:         op,
+		Selection:  s.clients[client],
+	}
+	s.send(client, reqID, "collabOp", &CollabOpRsp{
+		NoteHashID: msg.NoteHashID,
+		Revision:   msg.Revision,
+	})
+	s.broadcast(client, "collabOp", msg)
+	return nil
+}
+
+// sets the selection, based on revision
+func (client *collabClient) setSelection(reqID int, noteID int, revision int, sel *CollabSelection) error {
+	s := client.sessions[noteID]
+	if s == nil {
+		return fmt.Errorf("not editing note %d", noteID)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[client]; !ok {
+		return errCollabFellBehind
+	}
+	if revision < s.historyStart || revision > s.revision() {
+		return fmt.Errorf("invalid revision %d, the session is at revision %d", revision, s.revision())
+	}
+	for _, op := range s.history[revision-s.historyStart:] {
+		sel = sel.transform(op)
+	}
+	s.clients[client] = sel
+	s.send(client, reqID, "collabSelect", &CollabOpRsp{
+		NoteHashID: hashInt(noteID),
+		Revision:   s.revision(),
+	})
+	s.broadcastPresence(client)
+	return nil
+}
+
+// resolve marks the conflict with versionID as resolved by the document and
+// saves it over that version
+func (client *collabClient) resolve(ctx context.Context, reqID int, noteID int, versionID int) error {
+	s := client.sessions[noteID]
+	if s == nil {
+		return fmt.Errorf("not editing note %d", noteID)
+	}
+	s.mu.Lock()
+	if _, ok := s.clients[client]; !ok {
+		s.mu.Unlock()
+		return errCollabFellBehind
+	}
+	if s.conflictVersionID == 0 || s.conflictVersionID != versionID {
+		s.mu.Unlock()
+		return fmt.Errorf("note %d has no conflict with version %d", noteID, versionID)
+	}
+	s.versionID = versionID
+	s.conflictVersionID = 0
+	s.send(client, reqID, "collabResolve", &CollabOpRsp{
+		NoteHashID: hashInt(noteID),
+		Revision:   s.revision(),
+	})
+	s.mu.Unlock()
+	s.checkpoint(ctx)
+	return nil
+}
+
+func jsonMapGetCollabSelection(args map[string]interface{}, key string) (*CollabSelection, error) {
+	v, ok := args[key]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not an object but %T", key, v)
+	}
+	var sel CollabSelection
+	var err error
+	sel.Anchor, err = jsonMapGetInt(m, "Anchor")
+	if err != nil {
+		return nil, err
+	}
+	sel.Head, err = jsonMapGetInt(m, "Head")
+	if err != nil {
+		return nil, err
+	}
+	return &sel, nil
+}
+
+// wsCollab handles collabJoin, collabOp, collabSelect, collabResolve and
+// collabLeave commands. On success the response has already been sent, so that it's
+// ordered with messages sent to other clients
+func wsCollab(ctx *ReqContext, client *collabClient, req *wsGenericReq) error {
+	if ctx.User == nil {
+		return errors.New("user not logged in")
+	}
+	args := req.Args
+	noteHashIDStr, err := jsonMapGetString(args, "noteHashID")
+	if err != nil {
+		return fmt.Errorf("'noteHashID' argument missing in '%v'", args)
+	}
+	noteID, err := dehashInt(noteHashIDStr)
+	if err != nil {
+		return err
+	}
+
+	switch req.Cmd {
+	case "collabJoin":
+		return client.join(ctx.Context(), req.ID, noteID)
+
+	case "collabLeave":
+		client.leave(noteID)
+		client.send(req.ID, req.Cmd, nil)
+		return nil
+
+	case "collabResolve":
+		versionID, err := jsonMapGetInt(args, "versionID")
+		if err != nil {
+			return err
+		}
+		err = client.resolve(ctx.Context(), req.ID, noteID, versionID)
+		if err == errCollabFellBehind {
+			client.leave(noteID)
+		}
+		return err
+	}
+
+	revision, err := jsonMapGetInt(args, "revision")
+	if err != nil {
+		return err
+	}
+	sel, err := jsonMapGetCollabSelection(args, "selection")
+	if err != nil {
+		return err
+	}
+	if req.Cmd == "collabSelect" {
+		if sel == nil {
+			return fmt.Errorf("'selection' argument missing in '%v'", args)
+		}
+		err = client.setSelection(req.ID, noteID, revision, sel)
+	} else {
+		var op TextOp
+		op, err = parseTextOp(args["op"])
+		if err != nil {
+			return err
+		}
+		err = client.applyOp(req.ID, noteID, revision, op, sel)
+	}
+	if err == errCollabFellBehind {
+		// the client missed messages, it has to join again
+		client.leave(noteID)
+	}
+	return err
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/kjk/u"
+)
+
+func TestCollabSession(t *testing.T) {
+	defer openTestDbMust()()
+
+	user, err := repo.GetOrCreateUser(context.Background(), "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	ctx := &ReqContext{User: userSummaryFromDbUser(user)}
+	noteID, err := repo.CreateOrUpdateNote(ctx.Context(), user.ID, &NewNote{
+		title:   "collab",
+		format:  formatText,
+		content: []byte("one\ntwo\nthree\nfour\n"),
+	})
+	u.PanicIfErr(err)
+	noteHashID := hashInt(noteID)
+
+	c1 := newCollabClient(ctx.User, make(chan *wsResponse, 100))
+	c2 := newCollabClient(ctx.User, make(chan *wsResponse, 100))
+	nextMsg := func(client *collabClient, cmd string) *wsResponse {
+		select {
+		case rsp := <-client.c:
+			if rsp.Cmd != cmd {
+				t.Fatalf("expected '%s', got %#v", cmd, rsp)
+			}
+			return rsp
+		default:
+			t.Fatalf("no '%s' message for client %d", cmd, client.id)
+		}
+		return nil
+	}
+	send := func(client *collabClient, cmd string, args map[string]interface{}) {
+		args["noteHashID"] = noteHashID
+		err := wsCollab(ctx, client, &wsGenericReq{ID: 1, Cmd: cmd, Args: args})
+		u.PanicIfErr(err)
+	}
+
+	send(c1, "collabJoin", map[string]interface{}{})
+	join := nextMsg(c1, "collabJoin").Result.(*CollabJoinRsp)
+	if join.Content != "one\ntwo\nthree\nfour\n" || join.Revision != 0 || join.ClientID != c1.id {
+		t.Fatalf("unexpected join %#v", join)
+	}
+	send(c2, "collabJoin", map[string]interface{}{})
+	nextMsg(c2, "collabJoin")
+	presence := nextMsg(c1, "collabPresence").Result.(*CollabPresenceMsg)
+	if len(presence.Clients) != 2 || presence.Clients[1].ClientID != c2.id || presence.Clients[1].UserName != ctx.User.Handle {
+		t.Fatalf("unexpected presence %#v", presence.Clients)
+	}
+
+	// only the owner can join
+	other, err := repo.GetOrCreateUser(ctx.Context(), "twitter:other", "Other User")
+	u.PanicIfErr(err)
+	otherCtx := &ReqContext{User: userSummaryFromDbUser(other)}
+	joinOther := func() error {
+		c3 := newCollabClient(otherCtx.User, make(chan *wsResponse, 100))
+		return wsCollab(otherCtx, c3, &wsGenericReq{Cmd: "collabJoin", Args: map[string]interface{}{"noteHashID": noteHashID}})
+	}
+	if joinOther() == nil {
+		t.Fatalf("other user shouldn't be able to join a session of the owner")
+	}
+	if len(collabSessions[noteID].clients) != 2 || len(c1.c) != 0 {
+		t.Fatalf("other user shouldn't be added to the session")
+	}
+
+	// concurrent edits based on revision 0
+	send(c1, "collabOp", map[string]interface{}{
+		"revision": float64(0),
+		"op":       []interface{}{"A", float64(19)},
+	})
+	send(c2, "collabOp", map[string]interface{}{
+		"revision":  float64(0),
+		"op":        []interface{}{float64(19), "five\n"},
+		"selection": map[string]interface{}{"Anchor": float64(24), "Head": float64(24)},
+	})
+	if nextMsg(c1, "collabOp").Result.(*CollabOpRsp).Revision != 1 {
+		t.Fatalf("expected ack of revision 1")
+	}
+	msg := nextMsg(c1, "collabOp").Result.(*CollabOpMsg)
+	expOp := TextOp{}.retain(20).insert([]uint16{'f', 'i', 'v', 'e', '\n'})
+	if msg.Revision != 2 || msg.ClientID != c2.id || !reflect.DeepEqual(msg.Op, expOp) {
+		t.Fatalf("unexpected op %#v", msg)
+	}
+	// the selection moved by the insert of c1
+	if *msg.Selection != (CollabSelection{25, 25}) {
+		t.Fatalf("unexpected selection %#v", msg.Selection)
+	}
+	if nextMsg(c2, "collabOp").Result.(*CollabOpMsg).ClientID != c1.id {
+		t.Fatalf("c2 should get the op of c1 before the ack of its own")
+	}
+	if nextMsg(c2, "collabOp").Result.(*CollabOpRsp).Revision != 2 {
+		t.Fatalf("expected ack of revision 2")
+	}
+
+	s := collabSessions[noteID]
+	s.checkpoint(ctx.Context())
+	n, err := repo.GetNoteByID(ctx.Context(), noteID)
+	u.PanicIfErr(err)
+	if n.Content() != "Aone\ntwo\nthree\nfour\nfive\n" {
+		t.Fatalf("unexpected saved content '%s'", n.Content())
+	}
+
+	// edit outside of the session is merged at the next checkpoint
+	_, err = repo.CreateOrUpdateNote(ctx.Context(), user.ID, &NewNote{
+		hashID:        noteHashID,
+		title:         "collab",
+		format:        formatText,
+		content:       []byte("Aone\ntwo\nthree\nFOUR\nfive\n"),
+		baseVersionID: n.CurrVersionID,
+	})
+	u.PanicIfErr(err)
+	send(c1, "collabOp", map[string]interface{}{
+		"revision": float64(2),
+		"op":       []interface{}{float64(5), "2", float64(-3), float64(17)},
+	})
+	nextMsg(c1, "collabOp")
+	nextMsg(c2, "collabOp")
+	s.checkpoint(ctx.Context())
+	merged := "Aone\n2\nthree\nFOUR\nfive\n"
+	n, err = repo.GetNoteByID(ctx.Context(), noteID)
+	u.PanicIfErr(err)
+	if n.Content() != merged || string(utf16.Decode(s.doc)) != merged {
+		t.Fatalf("unexpected merged content '%s'", n.Content())
+	}
+	for _, client := range []*collabClient{c1, c2} {
+		msg = nextMsg(client, "collabOp").Result.(*CollabOpMsg)
+		if msg.ClientID != 0 || msg.Revision != 4 {
+			t.Fatalf("unexpected server op %#v", msg)
+		}
+	}
+
+	send(c1, "collabLeave", map[string]interface{}{})
+	nextMsg(c1, "collabLeave")
+	if len(nextMsg(c2, "collabPresence").Result.(*CollabPresenceMsg).Clients) != 1 {
+		t.Fatalf("expected 1 client left")
+	}
+	c2.leaveAll()
+	if collabSessions[noteID] != nil {
+		t.Fatalf("session should end when the last client leaves")
+	}
+	if joinOther() == nil {
+		t.Fatalf("other user shouldn't be able to start a session")
+	}
+}
+
+func TestCollabSlowClient(t *testing.T) {
+	defer openTestDbMust()()
+
+	user, err := repo.GetOrCreateUser(context.Background(), "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	ctx := &ReqContext{User: userSummaryFromDbUser(user)}
+	noteID, err := repo.CreateOrUpdateNote(ctx.Context(), user.ID, &NewNote{
+		title:   "collab",
+		format:  formatText,
+		content: []byte("text\n"),
+	})
+	u.PanicIfErr(err)
+	send := func(client *collabClient, cmd string, args map[string]interface{}) error {
+		args["noteHashID"] = hashInt(noteID)
+		return wsCollab(ctx, client, &wsGenericReq{ID: 1, Cmd: cmd, Args: args})
+	}
+	op := func(revision int) map[string]interface{} {
+		return map[string]interface{}{
+			"revision": float64(revision),
+			"op":       []interface{}{"a", float64(5 + revision)},
+		}
+	}
+
+	c1 := newCollabClient(ctx.User, make(chan *wsResponse, 100))
+	// room for the join response only
+	slow := newCollabClient(ctx.User, make(chan *wsResponse, 1))
+	u.PanicIfErr(send(c1, "collabJoin", map[string]interface{}{}))
+	u.PanicIfErr(send(slow, "collabJoin", map[string]interface{}{}))
+
+	// sending to slow doesn't block, it's dropped from the session instead
+	u.PanicIfErr(send(c1, "collabOp", op(0)))
+	s := collabSessions[noteID]
+	if len(s.clients) != 1 {
+		t.Fatalf("slow client should be dropped")
+	}
+	if err = send(slow, "collabOp", op(0)); err != errCollabFellBehind {
+		t.Fatalf("expected errCollabFellBehind, got %v", err)
+	}
+
+	// after catching up it can join again
+	for len(slow.c) > 0 {
+		<-slow.c
+	}
+	u.PanicIfErr(send(slow, "collabJoin", map[string]interface{}{}))
+	join := (<-slow.c).Result.(*CollabJoinRsp)
+	if join.Revision != 1 || join.Content != "atext\n" || len(s.clients) != 2 {
+		t.Fatalf("unexpected join %#v", join)
+	}
+	slow.leaveAll()
+	c1.leaveAll()
+	if collabSessions[noteID] != nil {
+		t.Fatalf("session should end when the last client leaves")
+	}
+}
+
+func TestCollabConflict(t *testing.T) {
+	defer openTestDbMust()()
+
+	user, err := repo.GetOrCreateUser(context.Background(), "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	ctx := &ReqContext{User: userSummaryFromDbUser(user)}
+	noteID, err := repo.CreateOrUpdateNote(ctx.Context(), user.ID, &NewNote{
+		title:   "collab",
+		format:  formatText,
+		content: []byte("one\ntwo\n"),
+	})
+	u.PanicIfErr(err)
+	noteHashID := hashInt(noteID)
+	// another connection of the user
+	conn := make(chan *wsResponse, 10)
+	wsRememberConnection(user.ID, conn)
+	defer wsRemoveConnection(user.ID, conn)
+
+	c1 := newCollabClient(ctx.User, make(chan *wsResponse, 100))
+	nextMsg := func(cmd string) *wsResponse {
+		select {
+		case rsp := <-c1.c:
+			if rsp.Cmd != cmd {
+				t.Fatalf("expected '%s', got %#v", cmd, rsp)
+			}
+			return rsp
+		default:
+			t.Fatalf("no '%s' message", cmd)
+		}
+		return nil
+	}
+	send := func(cmd string, args map[string]interface{}) {
+		args["noteHashID"] = noteHashID
+		u.PanicIfErr(wsCollab(ctx, c1, &wsGenericReq{ID: 1, Cmd: cmd, Args: args}))
+		nextMsg(cmd)
+	}
+	editOutside := func(content string) {
+		n, err := repo.GetNoteByID(ctx.Context(), noteID)
+		u.PanicIfErr(err)
+		_, err = repo.CreateOrUpdateNote(ctx.Context(), user.ID, &NewNote{
+			hashID:        noteHashID,
+			title:         "collab",
+			format:        formatText,
+			content:       []byte(content),
+			baseVersionID: n.CurrVersionID,
+		})
+		u.PanicIfErr(err)
+	}
+	noteContent := func() string {
+		n, err := repo.GetNoteByID(ctx.Context(), noteID)
+		u.PanicIfErr(err)
+		return n.Content()
+	}
+
+	send("collabJoin", map[string]interface{}{})
+	editOutside("one\n2\n")
+	send("collabOp", map[string]interface{}{
+		"revision": float64(0),
+		"op":       []interface{}{float64(4), float64(-3), "TWO", float64(1)},
+	})
+	s := collabSessions[noteID]
+	s.checkpoint(ctx.Context())
+	conflict := nextMsg("collabConflict").Result.(*NoteConflictRsp)
+	if conflict.Conflicts != 1 || noteContent() != "one\n2\n" {
+		t.Fatalf("conflict shouldn't be saved, got %#v", conflict)
+	}
+	if len(conn) != 0 {
+		t.Fatalf("nothing was saved, got %#v", <-conn)
+	}
+	// clients are told only once
+	s.checkpoint(ctx.Context())
+	if len(c1.c) != 0 {
+		t.Fatalf("unexpected %#v", <-c1.c)
+	}
+
+	// resolving saves the document over the conflicting version
+	send("collabOp", map[string]interface{}{
+		"revision": float64(1),
+		"op":       []interface{}{float64(4), "2 ", float64(4)},
+	})
+	send("collabResolve", map[string]interface{}{"versionID": float64(conflict.CurrentVersionID)})
+	if noteContent() != "one\n2 TWO\n" {
+		t.Fatalf("unexpected content '%s'", noteContent())
+	}
+	if rsp := <-conn; rsp.Cmd != "broadcastUserNotes" || len(rsp.Result.(*GetNotesRsp).Notes) != 1 {
+		t.Fatalf("unexpected %#v", rsp)
+	}
+	err = wsCollab(ctx, c1, &wsGenericReq{ID: 1, Cmd: "collabResolve", Args: map[string]interface{}{"noteHashID": noteHashID, "versionID": float64(conflict.CurrentVersionID)}})
+	if err == nil {
+		t.Fatalf("the conflict is already resolved")
+	}
+
+	// unresolved conflict is saved as a new note when the last client leaves
+	editOutside("one\nzwei\n")
+	send("collabOp", map[string]interface{}{
+		"revision": float64(2),
+		"op":       []interface{}{float64(4), float64(-5), "drei", float64(1)},
+	})
+	c1.leaveAll()
+	if noteContent() != "one\nzwei\n" {
+		t.Fatalf("unexpected content '%s'", noteContent())
+	}
+	notes, err := repo.GetNotesForUser(ctx.Context(), user)
+	u.PanicIfErr(err)
+	found := false
+	for _, n := range notes {
+		if n.Title == "collab (conflicted copy)" && n.Content() == "one\ndrei\n" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected a conflicted copy in %#v", notes)
+	}
+}
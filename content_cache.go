@@ -0,0 +1,122 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	defaultContentCacheSizeMB = 64
+)
+
+// CachedContentInfo is content with time when it was cached
+type CachedContentInfo struct {
+	key            string
+	lastAccessTime time.Time
+	d              []byte
+}
+
+// ContentCacheStats describes the state of ContentCache, for monitoring
+type ContentCacheStats struct {
+	Count     int
+	Size      int
+	MaxSize   int
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	// not cached because bigger than cachedContentSizeThresholed
+	Bypasses int64
+}
+
+func (s ContentCacheStats) String() string {
+	return fmt.Sprintf("%d items, %s of %s, hits: %d, misses: %d, evictions: %d, bypasses: %d", s.Count, humanize.Bytes(uint64(s.Size)), humanize.Bytes(uint64(s.MaxSize)), s.Hits, s.Misses, s.Evictions, s.Bypasses)
+}
+
+// ContentCache is in-memory cache of content, limited by total size of
+// cached content. Least recently accessed content is evicted first
+type ContentCache struct {
+	mu      sync.Mutex
+	maxSize int
+	size    int
+	// *CachedContentInfo ordered by lastAccessTime, most recent first
+	lru   *list.List
+	items map[string]*list.Element
+	stats ContentCacheStats
+}
+
+// NewContentCache creates a cache holding up to maxSize bytes of content
+func NewContentCache(maxSize int) *ContentCache {
+	return &ContentCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// Get returns cached content for sha1
+func (c *ContentCache) Get(sha1 []byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el := c.items[string(sha1)]
+	if el == nil {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	i := el.Value.(*CachedContentInfo)
+	i.lastAccessTime = time.Now()
+	c.lru.MoveToFront(el)
+	return i.d, true
+}
+
+// Add caches d, evicting least recently used content if over the budget
+func (c *ContentCache) Add(sha1, d []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(d) > cachedContentSizeThresholed || len(d) > c.maxSize {
+		c.stats.Bypasses++
+		return
+	}
+	k := string(sha1)
+	if el := c.items[k]; el != nil {
+		// content for a given sha1 never changes
+		el.Value.(*CachedContentInfo).lastAccessTime = time.Now()
+		c.lru.MoveToFront(el)
+		return
+	}
+	i := &CachedContentInfo{
+		key:            k,
+		lastAccessTime: time.Now(),
+		d:              d,
+	}
+	c.items[k] = c.lru.PushFront(i)
+	c.size += len(d)
+	for c.size > c.maxSize {
+		c.evictOldest()
+	}
+}
+
+// must be called with c.mu locked
+func (c *ContentCache) evictOldest() {
+	el := c.lru.Back()
+	i := el.Value.(*CachedContentInfo)
+	c.lru.Remove(el)
+	delete(c.items, i.key)
+	c.size -= len(i.d)
+	c.stats.Evictions++
+}
+
+// Stats returns current stats
+func (c *ContentCache) Stats() ContentCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := c.stats
+	res.Count = len(c.items)
+	res.Size = c.size
+	res.MaxSize = c.maxSize
+	return res
+}
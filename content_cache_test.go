@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kjk/u"
+)
+
+func TestContentCache(t *testing.T) {
+	c := NewContentCache(100)
+	var sha1s [][]byte
+	for i := 0; i < 4; i++ {
+		d := bytes.Repeat([]byte{byte('a' + i)}, 30)
+		sha1 := u.Sha1OfBytes(d)
+		c.Add(sha1, d)
+		sha1s = append(sha1s, sha1)
+		if i == 2 {
+			// make the first one most recently used
+			if _, ok := c.Get(sha1s[0]); !ok {
+				t.Fatalf("%x should be cached", sha1s[0])
+			}
+		}
+	}
+	// adding the 4th evicted the 2nd, which was least recently used
+	if _, ok := c.Get(sha1s[1]); ok {
+		t.Fatalf("%x should've been evicted", sha1s[1])
+	}
+	for _, i := range []int{0, 2, 3} {
+		if _, ok := c.Get(sha1s[i]); !ok {
+			t.Fatalf("%x should be cached", sha1s[i])
+		}
+	}
+
+	big := make([]byte, cachedContentSizeThresholed+1)
+	c.Add(u.Sha1OfBytes(big), big)
+
+	stats := c.Stats()
+	exp := ContentCacheStats{Count: 3, Size: 90, MaxSize: 100, Hits: 4, Misses: 1, Evictions: 1, Bypasses: 1}
+	if stats != exp {
+		t.Fatalf("unexpected stats: %#v", stats)
+	}
+}
@@ -63,7 +63,3 @@ CREATE TABLE IF NOT EXISTS versions (
     REFERENCES notes(id)
     ON DELETE CASCADE
 );
-
-CREATE TABLE IF NOT EXISTS db_migrations (
-	version int NOT NULL
-);
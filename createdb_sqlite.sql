@@ -0,0 +1,62 @@
+-- sqlite version of createdb.sql, must be kept in sync with it
+CREATE TABLE IF NOT EXISTS users (
+  id                  INTEGER PRIMARY KEY AUTOINCREMENT,
+  -- in the form of twitter:kjk, github:kjk, google:kowalczyk@gmail.com etc.
+  login               VARCHAR(255) NOT NULL,
+  -- for twitter, deduced from 'name'
+  full_name           VARCHAR(255),
+  email               VARCHAR(255),
+  -- 0 - not even eligible, 1 - can be pro, 2 - is pro
+  pro_state           TINYINT NOT NULL,
+  created_at          TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  -- used to verify the password for encrypted passwords
+  encrypted_sample    BLOB,
+  -- oauth token from latest login
+  oauth_json          VARCHAR(2048)
+);
+
+CREATE INDEX IF NOT EXISTS users_login ON users (login);
+
+CREATE INDEX IF NOT EXISTS users_email ON users (email);
+
+CREATE TABLE IF NOT EXISTS notes (
+  id                INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id           INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  curr_version_id   INTEGER NOT NULL,
+  versions_count    INTEGER NOT NULL,
+  -- cached values from the latest version in versions table
+  -- versions.created_at from the first version
+  created_at        TIMESTAMP NOT NULL,
+  -- versions.created_at from the latest version
+  updated_at        TIMESTAMP NOT NULL,
+  content_sha1      BLOB NOT NULL,
+  size              INTEGER NOT NULL,
+  format            VARCHAR(128) NOT NULL,
+  title             VARCHAR(512),
+  tags              VARCHAR(512),
+  is_deleted        BOOLEAN NOT NULL,
+  is_public         BOOLEAN NOT NULL,
+  is_starred        BOOLEAN NOT NULL,
+  is_encrypted      BOOLEAN NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS notes_user_id ON notes (user_id);
+
+CREATE INDEX IF NOT EXISTS notes_updated_at ON notes (updated_at);
+
+CREATE TABLE IF NOT EXISTS versions (
+  id                INTEGER PRIMARY KEY AUTOINCREMENT,
+  note_id           INTEGER NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+  created_at        TIMESTAMP NOT NULL,
+  content_sha1      BLOB NOT NULL,
+  size              INTEGER NOT NULL,
+  format            VARCHAR(128) NOT NULL,
+  title             VARCHAR(512),
+  tags              VARCHAR(512),
+  is_deleted        BOOLEAN NOT NULL,
+  is_public         BOOLEAN NOT NULL,
+  is_starred        BOOLEAN NOT NULL,
+  is_encrypted      BOOLEAN NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS versions_note_id ON versions (note_id);
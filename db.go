@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -15,14 +16,15 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/kjk/quicknotes/pkg/log"
 	"github.com/kjk/u"
+	_ "github.com/mattn/go-sqlite3"
 )
 
-// TODO: use prepared statements where possible
-
 const (
 	tagsSepByte                 = 30          // record separator
 	snippetSizeThreshold        = 1024        // 1 KB
 	cachedContentSizeThresholed = 1024 * 1024 // 1 MB
+	// size of users.encrypted_sample column
+	maxEncryptedSampleSize = 2048
 )
 
 // must match Note.js
@@ -33,6 +35,12 @@ const (
 	formatCodePrefix = "code:"
 )
 
+// values for -db flag
+const (
+	dbDriverMySQL  = "mysql"
+	dbDriverSqlite = "sqlite"
+)
+
 // DbUser.ProState
 const (
 	NotProEligible = iota
@@ -41,12 +49,12 @@ const (
 )
 
 var (
+	errEncryptedNotePublic = errors.New("encrypted notes can't be public")
+
 	formatNames         = []string{formatText, formatMarkdown, formatHTML, formatCodePrefix}
-	sqlDb               *sql.DB
-	sqlDbMu             sync.Mutex
 	tagSepStr           = string([]byte{30})
 	userIDToCachedInfo  map[int]*CachedUserInfo
-	contentCache        map[string]*CachedContentInfo
+	contentCache        *ContentCache
 	userIDToDbUserCache map[int]*DbUser
 
 	// general purpose mutex for short-lived ops (like lookup/insert in a map)
@@ -55,11 +63,32 @@ var (
 
 func init() {
 	userIDToCachedInfo = make(map[int]*CachedUserInfo)
-	contentCache = make(map[string]*CachedContentInfo)
+	contentCache = NewContentCache(defaultContentCacheSizeMB * 1024 * 1024)
 	userIDToDbUserCache = make(map[int]*DbUser)
 }
 
+func useSqlite() bool {
+	return flgDbDriver == dbDriverSqlite
+}
+
+func getSqlitePath() string {
+	return filepath.Join(getDataDir(), "quicknotes.sqlite")
+}
+
+// name of database/sql driver for the selected backend
+func getSQLDriverName() string {
+	if useSqlite() {
+		return "sqlite3"
+	}
+	return "mysql"
+}
+
 func getSQLConnection() string {
+	if useSqlite() {
+		// foreign keys are off by default in sqlite. busy timeout avoids
+		// "database is locked" errors when multiple goroutines write at once
+		return "file:" + getSqlitePath() + "?_foreign_keys=1&_busy_timeout=10000&_journal_mode=WAL"
+	}
 	host := flgDbHost
 	port := flgDbPort
 	if flgProduction {
@@ -93,12 +122,6 @@ func isValidFormat(s string) bool {
 	return false
 }
 
-// CachedContentInfo is content with time when it was cached
-type CachedContentInfo struct {
-	lastAccessTime time.Time
-	d              []byte
-}
-
 // DbUser is an information about the user
 type DbUser struct {
 	ID int
@@ -142,6 +165,7 @@ type DbNote struct {
 	IsDeleted     bool
 	IsPublic      bool
 	IsStarred     bool
+	IsEncrypted   bool // title and content are encrypted by the client
 	Size          int
 	Title         string
 	Format        string
@@ -173,7 +197,36 @@ type NewNote struct {
 	isDeleted   bool
 	isPublic    bool
 	isStarred   bool
+	isEncrypted bool
 	contentSha1 []byte
+	// version of the note the edit is based on. If set, an update of a note
+	// whose current version is different is merged with changes made since
+	// then and fails with NoteConflictError if they overlap
+	baseVersionID int
+	// if the title changes, change [[old title]] links to the note in other
+	// notes of the user
+	rewriteLinks bool
+	// set when saved: current version of the note, if the edit was merged
+	// with changes made since baseVersionID and the number of notes whose
+	// links were changed because of rewriteLinks
+	currVersionID  int
+	merged         bool
+	linksRewritten int
+}
+
+// NoteConflictError is returned when an update of a note is based on
+// a version that is no longer the current version of the note and changes
+// couldn't be merged. Merged is the content with Conflicts conflicts marked,
+// empty if content couldn't be merged at all (e.g. it's encrypted)
+type NoteConflictError struct {
+	BaseVersionID int
+	Current       *Note
+	Merged        string
+	Conflicts     int
+}
+
+func (e *NoteConflictError) Error() string {
+	return fmt.Sprintf("note %d was changed, edit is based on version %d but the current version is %d", e.Current.id, e.BaseVersionID, e.Current.CurrVersionID)
 }
 
 func newNoteFromNote(n *Note) (*NewNote, error) {
@@ -188,28 +241,42 @@ func newNoteFromNote(n *Note) (*NewNote, error) {
 		isDeleted:   n.IsDeleted,
 		isPublic:    n.IsPublic,
 		isStarred:   n.IsStarred,
+		isEncrypted: n.IsEncrypted,
 		contentSha1: n.ContentSha1,
+		// updating fails if the note changed after we've read it
+		baseVersionID: n.CurrVersionID,
 	}
 	nn.content, err = getCachedContent(nn.contentSha1)
 	return nn, err
 }
 
+// NoteTombstone records permanent deletion of a note. VersionID is
+// allocated from the same sequence as versions.id so that clients can
+// learn about deletions since the latest version they've seen
+type NoteTombstone struct {
+	VersionID int
+	NoteID    int
+	DeletedAt time.Time
+}
+
 // CachedUserInfo has cached user info
 type CachedUserInfo struct {
 	user          *DbUser
 	notes         []*Note
+	tombstones    []*NoteTombstone
 	latestVersion int
 }
 
 // SetSnippet sets a short version of note (if is big)
 func (n *Note) SetSnippet() {
 	var snippetBytes []byte
-	// skip if we've already calculated it
-	if n.Snippet != "" {
+	// skip if we've already calculated it. we can't make a snippet of
+	// encrypted content
+	if n.Snippet != "" || n.IsEncrypted {
 		return
 	}
 
-	snippet, err := localStore.GetSnippet(n.ContentSha1)
+	snippet, err := blobStore.GetLimited(n.ContentSha1, snippetSizeThreshold)
 	if err != nil {
 		return
 	}
@@ -236,27 +303,14 @@ func (n *Note) Content() string {
 }
 
 func getCachedContent(sha1 []byte) ([]byte, error) {
-	k := string(sha1)
-	mu.Lock()
-	i := contentCache[k]
-	if i != nil {
-		i.lastAccessTime = time.Now()
-	}
-	mu.Unlock()
-	if i != nil {
-		return i.d, nil
+	if d, ok := contentCache.Get(sha1); ok {
+		return d, nil
 	}
-	d, err := localStore.GetContentBySha1(sha1)
+	d, err := blobStore.Get(sha1)
 	if err != nil {
 		return nil, err
 	}
-	mu.Lock()
-	// TODO: cache eviction
-	contentCache[k] = &CachedContentInfo{
-		lastAccessTime: time.Now(),
-		d:              d,
-	}
-	mu.Unlock()
+	contentCache.Add(sha1, d)
 	return d, nil
 }
 
@@ -270,20 +324,7 @@ func clearCachedUserInfo(userID int) {
 	mu.Unlock()
 }
 
-// TODO: a probably more robust way would be
-// q := `select id from versions where user_id=$1 order by id desc limit 1;`
-// but we would need user_id on versions table
-func findLatestVersion(notes []*Note) int {
-	id := 0
-	for _, note := range notes {
-		if note.CurrVersionID > id {
-			id = note.CurrVersionID
-		}
-	}
-	return id
-}
-
-func getCachedUserInfo(userID int) (*CachedUserInfo, error) {
+func getCachedUserInfo(ctx context.Context, userID int) (*CachedUserInfo, error) {
 	mu.Lock()
 	i := userIDToCachedInfo[userID]
 	mu.Unlock()
@@ -292,21 +333,30 @@ func getCachedUserInfo(userID int) (*CachedUserInfo, error) {
 		return i, nil
 	}
 	timeStart := time.Now()
-	user, err := dbGetUserByIDCached(userID)
+	user, err := getUserByIDCached(ctx, userID)
 	if user == nil || err != nil {
 		return nil, err
 	}
-	notes, err := dbGetNotesForUser(user)
+	notes, err := repo.GetNotesForUser(ctx, user)
 	if err != nil {
 		return nil, err
 	}
 	sort.Slice(notes, func(i, j int) bool {
 		return notes[i].CreatedAt.After(notes[j].CreatedAt)
 	})
+	tombstones, err := repo.GetNoteTombstones(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	latestVersion, err := repo.GetLatestVersion(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
 	res := &CachedUserInfo{
 		user:          user,
 		notes:         notes,
-		latestVersion: findLatestVersion(notes),
+		tombstones:    tombstones,
+		latestVersion: latestVersion,
 	}
 
 	mu.Lock()
@@ -324,6 +374,9 @@ func execMust(db *sql.DB, q string, args ...interface{}) {
 
 func getCreateDbSQLMust() []byte {
 	path := "createdb.sql"
+	if useSqlite() {
+		path = "createdb_sqlite.sql"
+	}
 	d := resourcesFromZip[path]
 	if len(d) > 0 {
 		return d
@@ -345,19 +398,6 @@ func dumpCreateDbStatements() {
 	}
 }
 
-func createDatabaseMust() {
-	log.Verbosef("trying to create the database\n")
-
-	db, err := getQuickNotesDb()
-	u.PanicIfErr(err, "getQuickNotesDb()")
-	stmts := getCreateDbStatementsMust()
-	for _, stm := range stmts {
-		execMust(db, stm)
-	}
-	db.Close()
-	log.Verbosef("created quicknotes database\n")
-}
-
 func serializeTags(tags []string) string {
 	if len(tags) == 0 {
 		return ""
@@ -376,236 +416,14 @@ func deserializeTags(s string) []string {
 	return strings.Split(s, tagSepStr)
 }
 
-// save to local store and google storage
-// we only save snippets locally
-func saveContent(d []byte) ([]byte, error) {
-	sha1, err := localStore.PutContent(d)
-	if err != nil {
-		return nil, err
+// save to all stores configured with -blob-stores. With -delta-versions,
+// local store saves d as a delta against prevSha1 (content of the previous
+// version of the note), if given
+func saveContent(d, prevSha1 []byte) ([]byte, error) {
+	if flgDeltaVersions && prevSha1 != nil {
+		return blobStore.PutDelta(d, prevSha1)
 	}
-	err = saveNoteToGoogleStorage(sha1, d)
-	return sha1, err
-}
-
-func dbCreateNewNote(userID int, note *NewNote) (int, error) {
-	log.Verbosef("creating a new note '%s' for user %d\n", note.title, userID)
-	db := getDbMust()
-	tx, err := db.Begin()
-	if err != nil {
-		return 0, err
-	}
-	defer func() {
-		if tx != nil {
-			tx.Rollback()
-		}
-	}()
-
-	u.PanicIf(note.contentSha1 == nil, "note.contentSha1 is nil")
-	serializedTags := serializeTags(note.tags)
-
-	// for non-imported notes use current time as note creation time
-	if note.createdAt.IsZero() {
-		note.createdAt = time.Now()
-	}
-	vals := NewDbVals("notes", 8)
-	vals.Add("user_id", userID)
-	vals.Add("curr_version_id", 0)
-	vals.Add("versions_count", 1)
-	vals.Add("created_at", note.createdAt)
-	vals.Add("updated_at", note.createdAt)
-	vals.Add("content_sha1", note.contentSha1)
-	vals.Add("size", len(note.content))
-	vals.Add("format", note.format)
-	vals.Add("title", note.title)
-	vals.Add("tags", serializedTags)
-	vals.Add("is_deleted", note.isDeleted)
-	vals.Add("is_public", note.isPublic)
-	vals.Add("is_starred", false)
-	vals.Add("is_encrypted", false)
-	res, err := vals.TxInsert(tx)
-	if err != nil {
-		log.Errorf("tx.Exec('%s') failed with %s\n", vals.Query, err)
-		return 0, err
-	}
-
-	noteID, err := res.LastInsertId()
-	if err != nil {
-		log.Errorf("res.LastInsertId() of noteID failed with %s\n", err)
-		return 0, err
-	}
-	vals = NewDbVals("versions", 11)
-	vals.Add("note_id", noteID)
-	vals.Add("created_at", note.createdAt)
-	vals.Add("content_sha1", note.contentSha1)
-	vals.Add("size", len(note.content))
-	vals.Add("format", note.format)
-	vals.Add("title", note.title)
-	vals.Add("tags", serializedTags)
-	vals.Add("is_deleted", note.isDeleted)
-	vals.Add("is_public", note.isPublic)
-	vals.Add("is_starred", false)
-	vals.Add("is_encrypted", false)
-	res, err = vals.TxInsert(tx)
-	if err != nil {
-		log.Errorf("tx.Exec('%s') failed with %s\n", vals.Query, err)
-		return 0, err
-	}
-	versionID, err := res.LastInsertId()
-	if err != nil {
-		log.Errorf("res.LastInsertId() of versionId failed with %s\n", err)
-		return 0, err
-	}
-	q := `UPDATE notes SET curr_version_id=? WHERE id=?`
-	_, err = tx.Exec(q, versionID, noteID)
-	if err != nil {
-		log.Errorf("tx.Exec('%s') failed with %s\n", q, err)
-		return 0, err
-	}
-	err = tx.Commit()
-	tx = nil
-	return int(noteID), err
-}
-
-// most operations mark a note as updated except for starring, which is why
-// we need markUpdated
-func dbUpdateNote2(note *NewNote, markUpdated bool) (int, error) {
-	log.Verbosef("noteID: %d, markUpdated: %v\n", note.id, markUpdated)
-	db := getDbMust()
-	tx, err := db.Begin()
-	if err != nil {
-		return 0, err
-	}
-	defer func() {
-		if tx != nil {
-			log.Verbosef("noteID: %d, rolled back\n", note.id)
-			tx.Rollback()
-		}
-	}()
-
-	now := time.Now()
-	if note.createdAt.IsZero() {
-		note.createdAt = now
-		log.Verbosef("note.createdAt is zero, setting to %s\n", note.createdAt)
-	}
-
-	noteSize := len(note.content)
-
-	serializedTags := serializeTags(note.tags)
-	vals := NewDbVals("versions", 11)
-	vals.Add("note_id", note.id)
-	vals.Add("size", noteSize)
-	vals.Add("created_at", now)
-	vals.Add("content_sha1", note.contentSha1)
-	vals.Add("format", note.format)
-	vals.Add("title", note.title)
-	vals.Add("tags", serializedTags)
-	vals.Add("is_deleted", note.isDeleted)
-	vals.Add("is_public", note.isPublic)
-	vals.Add("is_starred", note.isStarred)
-	vals.Add("is_encrypted", false)
-
-	noteUpdatedAt := note.updatedAt
-	if markUpdated {
-		noteUpdatedAt = now
-	}
-	res, err := vals.TxInsert(tx)
-	if err != nil {
-		log.Errorf("tx.Exec('%s') failed with %s\n", vals.Query, err)
-		return 0, err
-	}
-	versionID, err := res.LastInsertId()
-	if err != nil {
-		log.Errorf("res.LastInsertId() of versionId failed with %s\n", err)
-		return 0, err
-	}
-	log.Verbosef("inserted new version of note %d, new version id: %d\n", note.id, versionID)
-
-	//Maybe: could get versions_count as:
-	//q := `SELECT count(*) FROM versions WHERE note_id=?`
-
-	// Note: I don't know why I need to explicitly set created_at, but it does get changed
-	// to the same value as updated_at when I don't set it here
-	q := `
-UPDATE notes SET
-  updated_at=?,
-  created_at=?,
-  content_sha1=?,
-  size=?,
-  format=?,
-  title=?,
-  tags=?,
-  is_public=?,
-  is_deleted=?,
-  is_starred=?,
-  curr_version_id=?,
-  versions_count = versions_count + 1
-WHERE id=?`
-	_, err = tx.Exec(q,
-		noteUpdatedAt,
-		note.createdAt,
-		note.contentSha1,
-		noteSize,
-		note.format,
-		note.title,
-		serializedTags,
-		note.isPublic,
-		note.isDeleted,
-		note.isStarred,
-		versionID,
-		note.id)
-	if err != nil {
-		log.Errorf("tx.Exec('%s') failed with %s\n", q, err)
-		return 0, err
-	}
-
-	log.Verbosef("updated note with id %d, updated_at: %s, created_at: %s\n", note.id, noteUpdatedAt, note.createdAt)
-
-	err = tx.Commit()
-	tx = nil
-
-	return note.id, err
-}
-
-func dbUpdateNoteWith(userID, noteID int, markUpdated bool, updateFn func(*NewNote) bool) error {
-	log.Verbosef("dbUpdateNoteWith: userID=%s, noteID=%s, markUpdated: %v\n", hashInt(userID), hashInt(noteID), markUpdated)
-	defer clearCachedUserInfo(userID)
-
-	note, err := dbGetNoteByID(noteID)
-	if err != nil {
-		return err
-	}
-	if userID != note.userID {
-		return fmt.Errorf("mismatched note user. noteID: %d, userID: %d, note.userID: %d", noteID, userID, note.userID)
-	}
-	newNote, err := newNoteFromNote(note)
-	if err != nil {
-		return err
-	}
-	log.Verbosef("dbUpdateNoteWith: note.IsStarred: %v, newNote.isStarred: %v\n", note.IsStarred, newNote.isStarred)
-
-	shouldUpdate := updateFn(newNote)
-	if !shouldUpdate {
-		log.Verbosef("dbUpdateNoteWith: skipping update of noteID=%s because shouldUpdate=%v\n", hashInt(noteID), shouldUpdate)
-		return nil
-	}
-	_, err = dbUpdateNote2(newNote, markUpdated)
-	return err
-}
-
-func dbUpdateNoteTitle(userID, noteID int, newTitle string) error {
-	return dbUpdateNoteWith(userID, noteID, true, func(newNote *NewNote) bool {
-		shouldUpdate := newNote.title != newTitle
-		newNote.title = newTitle
-		return shouldUpdate
-	})
-}
-
-func dbUpdateNoteTags(userID, noteID int, newTags []string) error {
-	return dbUpdateNoteWith(userID, noteID, true, func(newNote *NewNote) bool {
-		shouldUpdate := !strArrEqual(newNote.tags, newTags)
-		newNote.tags = newTags
-		return shouldUpdate
-	})
+	return blobStore.Put(d)
 }
 
 func needsNewNoteVersion(note *NewNote, existingNote *Note) bool {
@@ -630,28 +448,12 @@ func needsNewNoteVersion(note *NewNote, existingNote *Note) bool {
 	if note.isStarred != existingNote.IsStarred {
 		return true
 	}
+	if note.isEncrypted != existingNote.IsEncrypted {
+		return true
+	}
 	return false
 }
 
-func dbGetSelectCount(query string) (int, error) {
-	db := getDbMust()
-	n := 0
-	err := db.QueryRow(query).Scan(&n)
-	return n, err
-}
-
-func dbGetUsersCount() (int, error) {
-	return dbGetSelectCount(`SELECT count(*) from users`)
-}
-
-func dbGetNotesCount() (int, error) {
-	return dbGetSelectCount(`SELECT count(*) from notes`)
-}
-
-func dbGetVersionsCount() (int, error) {
-	return dbGetSelectCount(`SELECT count(*) from versions`)
-}
-
 // get the beginning of the day
 // TODO: is there a better way?
 func getDayStart(t time.Time) time.Time {
@@ -682,328 +484,6 @@ func timeBetween(t, start, end time.Time) bool {
 	return true
 }
 
-// create a new note. if note.createdAt is non-zero value, this is an import
-// of note from somewhere else, so we want to preserve createdAt value
-func dbCreateOrUpdateNote(userID int, note *NewNote) (int, error) {
-	log.Verbosef("userID: %d\n", userID)
-	var err error
-	if len(note.content) == 0 {
-		return 0, errors.New("empty note content")
-	}
-
-	if !isValidFormat(note.format) {
-		return 0, fmt.Errorf("invalid format %s", note.format)
-	}
-
-	note.contentSha1, err = saveContent(note.content)
-	if err != nil {
-		log.Errorf("saveContent() failed with %s\n", err)
-		return 0, err
-	}
-
-	defer clearCachedUserInfo(userID)
-
-	var noteID int
-	var existingNote *Note
-	if note.hashID == "" {
-		log.Verbosef("creating a new note %s\n", note.title)
-		noteID, err = dbCreateNewNote(userID, note)
-		note.hashID = hashInt(noteID)
-		return noteID, err
-	}
-
-	noteID, err = dehashInt(note.hashID)
-	if err != nil {
-		return 0, err
-	}
-	existingNote, err = dbGetNoteByID(noteID)
-	if err != nil {
-		return 0, err
-	}
-	u.PanicIf(noteID != existingNote.id)
-	if existingNote.userID != userID {
-		return 0, fmt.Errorf("user %d is trying to update note that belongs to user %d", userID, existingNote.userID)
-	}
-
-	note.id = noteID
-
-	// when editing a note, we don't change starred status
-	note.isStarred = existingNote.IsStarred
-	// don't create new versions if not necessary
-	if !needsNewNoteVersion(note, existingNote) {
-		return noteID, nil
-	}
-	log.Verbosef("updating existing note %d (%s). CreatedAt: %s, UpdatedAt: %s\n", existingNote.id, existingNote.HashID, existingNote.CreatedAt.Format(time.RFC3339), existingNote.UpdatedAt.Format(time.RFC3339))
-
-	note.createdAt = existingNote.CreatedAt
-	noteID, err = dbUpdateNote2(note, true)
-
-	return noteID, err
-}
-
-// TODO: also get content_sha1 for each version (requires index on content_sha1
-// to be fast) and if this content_sha1 is only referenced by one version,
-// delete from google storage
-func dbPermanentDeleteNote(userID, noteID int) error {
-	defer clearCachedUserInfo(userID)
-	db := getDbMust()
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if tx != nil {
-			tx.Rollback()
-		}
-	}()
-	q := `
-DELETE FROM notes
-WHERE id=?`
-	_, err = db.Exec(q, noteID)
-	if err != nil {
-		return err
-	}
-	q = `
-DELETE FROM versions
-WHERE note_id=?`
-	_, err = db.Exec(q, noteID)
-	if err != nil {
-		return err
-	}
-	tx = nil
-	return nil
-}
-
-func dbDeleteNote(userID, noteID int) error {
-	return dbUpdateNoteWith(userID, noteID, true, func(note *NewNote) bool {
-		shouldUpdate := !note.isDeleted
-		note.isDeleted = true
-		return shouldUpdate
-	})
-}
-
-func dbUndeleteNote(userID, noteID int) error {
-	return dbUpdateNoteWith(userID, noteID, true, func(note *NewNote) bool {
-		shouldUpdate := note.isDeleted
-		note.isDeleted = false
-		return shouldUpdate
-	})
-}
-
-func dbMakeNotePublic(userID, noteID int) error {
-	// log.Verbosef("dbMakeNotePublic: userID=%d, noteID=%d", userID, noteID)
-	// note: doesn't update lastUpdate for stability of display
-	return dbUpdateNoteWith(userID, noteID, false, func(note *NewNote) bool {
-		shouldUpdate := !note.isPublic
-		note.isPublic = true
-		// log.Verbosef(" shouldUpdate=%v\n", shouldUpdate)
-		return shouldUpdate
-	})
-}
-
-func dbMakeNotePrivate(userID, noteID int) error {
-	// log.Verbosef("dbMakeNotePrivate: userID: %d, noteID: %d\n", userID, noteID)
-	// note: doesn't update lastUpdate for stability of display
-	return dbUpdateNoteWith(userID, noteID, false, func(note *NewNote) bool {
-		shouldUpdate := note.isPublic
-		note.isPublic = false
-		return shouldUpdate
-	})
-}
-
-func dbStarNote(userID, noteID int) error {
-	// note: doesn't update lastUpdate for stability of display
-	return dbUpdateNoteWith(userID, noteID, false, func(note *NewNote) bool {
-		log.Verbosef("dbStarNote: userID: %s, noteID: %s, isStarred: %v\n", hashInt(userID), hashInt(noteID), note.isStarred)
-		shouldUpdate := !note.isStarred
-		note.isStarred = true
-		return shouldUpdate
-	})
-}
-
-func dbUnstarNote(userID, noteID int) error {
-	log.Verbosef("dbUnstarNote: userID: %d, noteID: %d\n", userID, noteID)
-	// note: doesn't update lastUpdate for stability of display
-	return dbUpdateNoteWith(userID, noteID, false, func(note *NewNote) bool {
-		shouldUpdate := note.isStarred
-		note.isStarred = false
-		log.Verbosef("dbUnstarNote: shouldUpdate: %v\n", shouldUpdate)
-		return shouldUpdate
-	})
-}
-
-// note: only use locally for testing search, not in production
-func dbGetAllNotes() ([]*Note, error) {
-	log.Verbosef("dbGetAllNotes\n")
-	var notes []*Note
-	db := getDbMust()
-	q := `
-SELECT
-	id,
-	user_id,
-	curr_version_id,
-	is_deleted,
-	is_public,
-	is_starred,
-	created_at,
-	updated_at,
-	size,
-	format,
-	title,
-	content_sha1,
-	tags
-FROM notes
-ORDER BY updated_at DESC
-LIMIT 10000`
-	rows, err := db.Query(q)
-	if err != nil {
-		log.Errorf("db.Query('%s') failed with %s\n", q, err)
-		return nil, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var n Note
-		var tagsSerialized string
-		err = rows.Scan(
-			&n.id,
-			&n.userID,
-			&n.CurrVersionID,
-			&n.IsDeleted,
-			&n.IsPublic,
-			&n.IsStarred,
-			&n.CreatedAt,
-			&n.UpdatedAt,
-			&n.Size,
-			&n.Format,
-			&n.Title,
-			&n.ContentSha1,
-			&tagsSerialized)
-		if err != nil {
-			return nil, err
-		}
-		n.Tags = deserializeTags(tagsSerialized)
-		n.SetCalculatedProperties()
-		notes = append(notes, &n)
-	}
-	err = rows.Err()
-	if err != nil {
-		log.Errorf("rows.Err() for '%s' failed with %s\n", q, err)
-		return nil, err
-	}
-	return notes, nil
-}
-
-func dbGetAllVersionsSha1ForUser(userID int) ([][]byte, error) {
-	db := getDbMust()
-	q := `
-SELECT content_sha1
-FROM versions
-WHERE id IN
-  (SELECT id FROM notes WHERE user_id = ?);
-`
-	rows, err := db.Query(q, userID)
-	if err != nil {
-		log.Errorf("db.Query('%s') failed with %s\n", q, err)
-		return nil, err
-	}
-	var res [][]byte
-	defer rows.Close()
-	for rows.Next() {
-		var sha1 []byte
-		err = rows.Scan(&sha1)
-		if err != nil {
-			log.Errorf("rows.Scan() failed with '%s'\n", err)
-			return nil, err
-		}
-		if len(sha1) != 20 {
-			log.Errorf("content_sha1 is %d bytes, should be 20\n", len(sha1))
-			return nil, fmt.Errorf("content_sha1 is %d bytes (should be 20)", len(sha1))
-		}
-		res = append(res, sha1)
-	}
-	err = rows.Err()
-	if err != nil {
-		log.Errorf("rows.Err() for '%s' failed with %s\n", q, err)
-		return nil, err
-	}
-	return res, nil
-}
-
-func dbGetNotesForUser(user *DbUser) ([]*Note, error) {
-	var notes []*Note
-	db := getDbMust()
-	q := `
-SELECT
-	id,
-	curr_version_id,
-	is_deleted,
-	is_public,
-	is_starred,
-	created_at,
-	updated_at,
-	size,
-	format,
-	title,
-	content_sha1,
-	tags
-FROM notes
-WHERE user_id = ?`
-	rows, err := db.Query(q, user.ID)
-	if err != nil {
-		log.Errorf("db.Query('%s') failed with %s\n", q, err)
-		return nil, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var n Note
-		var tagsSerialized string
-		err = rows.Scan(
-			&n.id,
-			&n.CurrVersionID,
-			&n.IsDeleted,
-			&n.IsPublic,
-			&n.IsStarred,
-			&n.CreatedAt,
-			&n.UpdatedAt,
-			&n.Size,
-			&n.Format,
-			&n.Title,
-			&n.ContentSha1,
-			&tagsSerialized)
-		if err != nil {
-			return nil, err
-		}
-		n.userID = user.ID
-		n.Tags = deserializeTags(tagsSerialized)
-		notes = append(notes, &n)
-	}
-	err = rows.Err()
-	if err != nil {
-		log.Errorf("rows.Err() for '%s' failed with %s\n", q, err)
-		return nil, err
-	}
-
-	// if note bodies are not cached locally, download them from google storage
-	// in parallel.
-	nWorkers := 64
-	sem := make(chan bool, nWorkers)
-	var wg sync.WaitGroup
-	for _, note := range notes {
-		sem <- true
-		wg.Add(1)
-		go func(note *Note) {
-			defer func() {
-				<-sem
-				wg.Done()
-			}()
-			// force downloading of note content if not cached locally
-			note.SetCalculatedProperties()
-		}(note)
-	}
-	wg.Wait()
-	return notes, nil
-}
-
 var (
 	recentPublicNotesCached     []Note
 	recentPublicNotesLastUpdate time.Time
@@ -1013,7 +493,7 @@ func timeExpired(t time.Time, dur time.Duration) bool {
 	return t.IsZero() || time.Now().Sub(t) > dur
 }
 
-func getRecentPublicNotesCached(limit int) ([]Note, error) {
+func getRecentPublicNotesCached(ctx context.Context, limit int) ([]Note, error) {
 	var res []Note
 
 	mu.Lock()
@@ -1030,61 +510,12 @@ func getRecentPublicNotesCached(limit int) ([]Note, error) {
 		return res, nil
 	}
 
-	db := getDbMust()
-	q := `
-SELECT
-  id,
-  user_id,
-	curr_version_id,
-	is_deleted,
-	is_public,
-	is_starred,
-	created_at,
-	updated_at,
-	size,
-	format,
-	title,
-	content_sha1,
-	tags
-FROM notes
-WHERE is_public=true
-ORDER BY updated_at DESC
-LIMIT %d`
-
-	rows, err := db.Query(fmt.Sprintf(q, limit))
+	notes, err := repo.GetRecentPublicNotes(ctx, limit)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var n Note
-		var tagsSerialized string
-		err = rows.Scan(
-			&n.id,
-			&n.userID,
-			&n.CurrVersionID,
-			&n.IsDeleted,
-			&n.IsPublic,
-			&n.IsStarred,
-			&n.CreatedAt,
-			&n.UpdatedAt,
-			&n.Size,
-			&n.Format,
-			&n.Title,
-			&n.ContentSha1,
-			&tagsSerialized)
-		if err != nil {
-			return nil, err
-		}
-		n.Tags = deserializeTags(tagsSerialized)
-		n.SetCalculatedProperties()
-		res = append(res, n)
-	}
-	err = rows.Err()
-	if err != nil {
-		log.Errorf("rows.Err() for '%s' failed with %s\n", q, err)
-		return nil, err
+	for _, n := range notes {
+		res = append(res, *n)
 	}
 
 	n := len(res)
@@ -1111,50 +542,6 @@ func getTitleFromBody(note *Note) string {
 	return string(getFirstLine(content))
 }
 
-func dbGetNoteByID(id int) (*Note, error) {
-	var n Note
-	var tagsSerialized string
-	db := getDbMust()
-	q := `
-SELECT
-  id,
-  user_id,
-  curr_version_id,
-  is_deleted,
-  is_public,
-  is_starred,
-  created_at,
-  updated_at,
-  size,
-  format,
-  title,
-  content_sha1,
-  tags
-FROM notes
-WHERE id=?`
-	err := db.QueryRow(q, id).Scan(
-		&n.id,
-		&n.userID,
-		&n.CurrVersionID,
-		&n.IsDeleted,
-		&n.IsPublic,
-		&n.IsStarred,
-		&n.CreatedAt,
-		&n.UpdatedAt,
-		&n.Size,
-		&n.Format,
-		&n.Title,
-		&n.ContentSha1,
-		&tagsSerialized)
-	if err != nil {
-		return nil, err
-	}
-	n.Tags = deserializeTags(tagsSerialized)
-	n.SetCalculatedProperties()
-	log.Verbosef("note id: %d, CreatedAt: %s, UpdatedAt: %s\n", n.id, n.CreatedAt, n.UpdatedAt)
-	return &n, nil
-}
-
 func isValidProState(proState int) bool {
 	switch proState {
 	case NotProEligible, CanBePro, IsPro:
@@ -1164,25 +551,7 @@ func isValidProState(proState int) bool {
 	}
 }
 
-// id, login, full_name, email, created_at, pro_state
-func dbGetUserByQuery(q string, args ...interface{}) (*DbUser, error) {
-	var user DbUser
-	db := getDbMust()
-	err := db.QueryRow(q, args...).Scan(&user.ID, &user.Login, &user.FullName, &user.Email, &user.CreatedAt, &user.ProState)
-	if err != nil {
-		if err != sql.ErrNoRows {
-			log.Errorf("db.QueryRow('%s', %v) failed with '%s'\n", q, args, err)
-			return nil, err
-		}
-		return nil, nil
-	}
-	if !isValidProState(user.ProState) {
-		return nil, fmt.Errorf("invalid ProState '%d' for user from query '%s'", user.ProState, q)
-	}
-	return &user, nil
-}
-
-func dbGetUserByIDCached(userID int) (*DbUser, error) {
+func getUserByIDCached(ctx context.Context, userID int) (*DbUser, error) {
 	var res *DbUser
 	mu.Lock()
 	res = userIDToDbUserCache[userID]
@@ -1190,7 +559,7 @@ func dbGetUserByIDCached(userID int) (*DbUser, error) {
 	if res != nil {
 		return res, nil
 	}
-	res, err := dbGetUserByID(userID)
+	res, err := repo.GetUserByID(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -1200,87 +569,14 @@ func dbGetUserByIDCached(userID int) (*DbUser, error) {
 	return res, nil
 }
 
-func dbGetUserByID(userID int) (*DbUser, error) {
-	q := `SELECT id, login, full_name, email, created_at, pro_state FROM users WHERE id=?`
-	return dbGetUserByQuery(q, userID)
-}
-
-func dbGetUserByLogin(login string) (*DbUser, error) {
-	q := `SELECT id, login, full_name, email, created_at, pro_state FROM users WHERE login=?`
-	return dbGetUserByQuery(q, login)
-}
-
-func dbGetAllUsers() ([]*DbUser, error) {
-	db := getDbMust()
-	q := `SELECT id, login, full_name, email, created_at, pro_state FROM users`
-	rows, err := db.Query(q)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	var res []*DbUser
-	for rows.Next() {
-		var user DbUser
-		err = rows.Scan(&user.ID, &user.Login, &user.FullName, &user.Email, &user.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		res = append(res, &user)
-	}
-	return res, rows.Err()
-}
-
 func getWelcomeMD() []byte {
 	d, err := loadResourceFile(filepath.Join("data", "welcome.md"))
 	u.PanicIfErr(err, "getWelcomeMD()")
 	return d
 }
 
-// TODO: also insert oauthJSON
-func dbGetOrCreateUser(userLogin string, fullName string) (*DbUser, error) {
-	user, err := dbGetUserByLogin(userLogin)
-	if user != nil {
-		u.PanicIfErr(err)
-		return user, nil
-	}
-
-	db := getDbMust()
-	vals := NewDbVals("users", 3)
-	vals.Add("login", userLogin)
-	vals.Add("full_name", fullName)
-	vals.Add("pro_state", NotProEligible)
-	_, err = vals.Insert(db)
-	if err != nil {
-		return nil, err
-	}
-
-	dbUser, err := dbGetUserByLogin(userLogin)
-	if err != nil {
-		return nil, err
-	}
-
-	d := getWelcomeMD()
-	if len(d) > 0 {
-		note := &NewNote{
-			title:     "Welcome!",
-			format:    formatMarkdown,
-			content:   d,
-			tags:      []string{"quicknotes"},
-			createdAt: time.Now(),
-			isDeleted: false,
-			isPublic:  false,
-			isStarred: false,
-		}
-		_, err = dbCreateOrUpdateNote(dbUser.ID, note)
-		if err != nil {
-			log.Errorf("dbCreateOrUpdateNote() failed with '%s'\n", err)
-		}
-	}
-	return dbUser, err
-}
-
 func getQuickNotesDb() (*sql.DB, error) {
-	db, err := sql.Open("mysql", getSQLConnection())
+	db, err := sql.Open(getSQLDriverName(), getSQLConnection())
 	if err != nil {
 		return nil, err
 	}
@@ -1291,34 +587,3 @@ func getQuickNotesDb() (*sql.DB, error) {
 	}
 	return db, nil
 }
-
-// note: no locking. the presumption is that this is called at startup and
-// available throughout the lifetime of the program
-func getDbMust() *sql.DB {
-	sqlDbMu.Lock()
-	defer sqlDbMu.Unlock()
-
-	if sqlDb != nil {
-		return sqlDb
-	}
-
-	_, err := getQuickNotesDb()
-	u.PanicIfErr(err)
-	createDatabaseMust()
-
-	db, err := getQuickNotesDb()
-	u.PanicIfErr(err, "getQuickNotesDb")
-	err = upgradeDb(db)
-	if err != nil {
-		log.Fatalf("upgradeDb() failed with '%s'\n", err)
-	}
-	sqlDb = db
-	return sqlDb
-}
-
-func closeDb() {
-	if sqlDb != nil {
-		sqlDb.Close()
-		sqlDb = nil
-	}
-}
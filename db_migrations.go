@@ -2,10 +2,32 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/kjk/quicknotes/pkg/log"
 )
 
+/*
+Database schema is managed with migrations. A migration has a unique number,
+a name, steps to apply it (Up) and steps to roll it back (Down). A step is
+either SQL statements (with optional sqlite dialect) or Go code.
+
+Numbers of applied migrations are recorded in db_migrations table.
+
+Migration 1 is the base schema from createdb.sql (createdb_sqlite.sql). It
+only has CREATE ... IF NOT EXISTS statements so applying it to a database
+created before it existed is a no-op.
+
+Pending migrations are applied at startup. -migrate flag shows the status,
+applies or rolls back migrations. Migrating is done while holding a lock
+(a row in db_migrations_lock table) so that two instances of the server
+don't migrate at the same time.
+*/
+
 const (
 	sql10 = `
 CREATE TABLE simplenote_imports (
@@ -24,37 +46,354 @@ CREATE TABLE simplenote_imports (
     ON DELETE CASCADE
 );
 `
+
+	sql10Sqlite = `
+CREATE TABLE simplenote_imports (
+  user_id             INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  note_id             INTEGER NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+  simplenote_id       VARCHAR(128) NOT NULL,
+  simplenote_version  INTEGER NOT NULL
+);
+
+CREATE INDEX simplenote_imports_user_id ON simplenote_imports (user_id);
+`
+
+	// versions.user_id lets us find changes of user's notes since a given
+	// version. note_tombstones remembers permanently deleted notes so that
+	// clients can remove them when syncing incrementally
+	sql11 = `
+ALTER TABLE versions ADD COLUMN user_id INT NOT NULL DEFAULT 0;
+UPDATE versions SET user_id = (SELECT user_id FROM notes WHERE notes.id = versions.note_id);
+CREATE INDEX versions_user_id ON versions (user_id, id);
+CREATE TABLE note_tombstones (
+  version_id  INT NOT NULL PRIMARY KEY,
+  user_id     INT NOT NULL,
+  note_id     INT NOT NULL,
+  deleted_at  TIMESTAMP NOT NULL,
+
+  INDEX (user_id, version_id),
+  FOREIGN KEY fk_note_tombstones_users(user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE
+);
+`
+
+	sql11Sqlite = `
+ALTER TABLE versions ADD COLUMN user_id INTEGER NOT NULL DEFAULT 0;
+UPDATE versions SET user_id = (SELECT user_id FROM notes WHERE notes.id = versions.note_id);
+CREATE INDEX versions_user_id ON versions (user_id, id);
+CREATE TABLE note_tombstones (
+  version_id  INTEGER NOT NULL PRIMARY KEY,
+  user_id     INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  note_id     INTEGER NOT NULL,
+  deleted_at  TIMESTAMP NOT NULL
+);
+CREATE INDEX note_tombstones_user_id ON note_tombstones (user_id, version_id);
+`
+
+	// links between notes, parsed from content. See links.go
+	sql12 = `
+CREATE TABLE note_links (
+  source_note_id  INT NOT NULL,
+  target_note_id  INT NOT NULL,
+  anchor          VARCHAR(512) NOT NULL,
+
+  INDEX (source_note_id),
+  INDEX (target_note_id),
+  FOREIGN KEY fk_note_links_source(source_note_id)
+    REFERENCES notes(id)
+    ON DELETE CASCADE,
+  FOREIGN KEY fk_note_links_target(target_note_id)
+    REFERENCES notes(id)
+    ON DELETE CASCADE
+);
+`
+
+	sql12Sqlite = `
+CREATE TABLE note_links (
+  source_note_id  INTEGER NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+  target_note_id  INTEGER NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+  anchor          VARCHAR(512) NOT NULL
+);
+CREATE INDEX note_links_source_note_id ON note_links (source_note_id);
+CREATE INDEX note_links_target_note_id ON note_links (target_note_id);
+`
+
+	// files attached to notes. See attachments.go
+	sql13 = `
+CREATE TABLE attachments (
+  id            INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  note_id       INT NOT NULL,
+  user_id       INT NOT NULL,
+  name          VARCHAR(255) NOT NULL,
+  size          INT NOT NULL,
+  content_sha1  BINARY(20) NOT NULL,
+  created_at    TIMESTAMP NOT NULL,
+
+  INDEX (note_id),
+  FOREIGN KEY fk_attachments_notes(note_id)
+    REFERENCES notes(id)
+    ON DELETE CASCADE,
+  FOREIGN KEY fk_attachments_users(user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE
+);
+`
+
+	sql13Sqlite = `
+CREATE TABLE attachments (
+  id            INTEGER PRIMARY KEY AUTOINCREMENT,
+  note_id       INTEGER NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+  user_id       INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name          VARCHAR(255) NOT NULL,
+  size          INTEGER NOT NULL,
+  content_sha1  BLOB NOT NULL,
+  created_at    TIMESTAMP NOT NULL
+);
+CREATE INDEX attachments_note_id ON attachments (note_id);
+`
+
+	// counter from which ids of versions and tombstones are allocated. See
+	// nextVersionIDTx
+	sql14 = `
+CREATE TABLE version_ids (
+  id  INT NOT NULL
+);
+INSERT INTO version_ids (id) VALUES (0);
+` + sqlRaiseVersionIDs
+
+	sql14Sqlite = `
+CREATE TABLE version_ids (
+  id  INTEGER NOT NULL
+);
+INSERT INTO version_ids (id) VALUES (0);
+` + sqlRaiseVersionIDs
+
+	// makes sure the counter is past ids already used, e.g. after a restore
+	sqlRaiseVersionIDs = `
+UPDATE version_ids SET id = (SELECT COALESCE(MAX(id), 0) FROM versions)
+WHERE id < (SELECT COALESCE(MAX(id), 0) FROM versions);
+UPDATE version_ids SET id = (SELECT COALESCE(MAX(version_id), 0) FROM note_tombstones)
+WHERE id < (SELECT COALESCE(MAX(version_id), 0) FROM note_tombstones);
+`
+
+	// [[Title]] links to notes that don't exist yet. See links.go
+	sql15 = `
+CREATE TABLE unresolved_note_links (
+  source_note_id  INT NOT NULL,
+  user_id         INT NOT NULL,
+  title           VARCHAR(512) NOT NULL,
+  anchor          VARCHAR(512) NOT NULL,
+
+  INDEX (source_note_id),
+  INDEX (user_id),
+  FOREIGN KEY fk_unresolved_note_links_source(source_note_id)
+    REFERENCES notes(id)
+    ON DELETE CASCADE
+);
+`
+
+	sql15Sqlite = `
+CREATE TABLE unresolved_note_links (
+  source_note_id  INTEGER NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+  user_id         INTEGER NOT NULL,
+  title           VARCHAR(512) NOT NULL,
+  anchor          VARCHAR(512) NOT NULL
+);
+CREATE INDEX unresolved_note_links_source_note_id ON unresolved_note_links (source_note_id);
+CREATE INDEX unresolved_note_links_user_id ON unresolved_note_links (user_id);
+`
+
+	sql11Down = `
+DROP TABLE note_tombstones;
+DROP INDEX versions_user_id ON versions;
+ALTER TABLE versions DROP COLUMN user_id;
+`
+
+	// ALTER TABLE DROP COLUMN needs sqlite 3.35 and go-sqlite3 v1.14.0
+	// bundles 3.32.2 so we re-create the table
+	sql11DownSqlite = `
+DROP TABLE note_tombstones;
+DROP INDEX versions_user_id;
+CREATE TABLE versions_old (
+  id                INTEGER PRIMARY KEY AUTOINCREMENT,
+  note_id           INTEGER NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+  created_at        TIMESTAMP NOT NULL,
+  content_sha1      BLOB NOT NULL,
+  size              INTEGER NOT NULL,
+  format            VARCHAR(128) NOT NULL,
+  title             VARCHAR(512),
+  tags              VARCHAR(512),
+  is_deleted        BOOLEAN NOT NULL,
+  is_public         BOOLEAN NOT NULL,
+  is_starred        BOOLEAN NOT NULL,
+  is_encrypted      BOOLEAN NOT NULL
+);
+INSERT INTO versions_old SELECT id, note_id, created_at, content_sha1, size, format, title, tags, is_deleted, is_public, is_starred, is_encrypted FROM versions;
+DROP TABLE versions;
+ALTER TABLE versions_old RENAME TO versions;
+CREATE INDEX versions_note_id ON versions (note_id);
+`
+
+	// tables used by migrations themselves, created before anything else
+	sqlMigrationsTables = `
+CREATE TABLE IF NOT EXISTS db_migrations (
+	version int NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS db_migrations_lock (
+  id         INT NOT NULL PRIMARY KEY,
+  owner      VARCHAR(255) NOT NULL,
+  locked_at  TIMESTAMP NOT NULL
+);
+`
+
+	// a lock older than that is left by a crashed process
+	migrationsLockStaleTimeout = 15 * time.Minute
+	// how long we wait for another process to finish migrating
+	migrationsLockWaitTimeout = 5 * time.Minute
 )
 
+// MigrationStep is a part of a migration: either SQL statements or Go code
+type MigrationStep struct {
+	SQL string
+	// sqlite dialect of SQL, if different
+	SQLSqlite string
+	// for changes that can't be done in SQL
+	Fn func(tx *sql.Tx) error
+	// describes what Fn does, for dry run
+	FnDesc string
+}
+
 // DbMigration describes a db migration
 type DbMigration struct {
-	No  int
-	SQL string
+	No   int
+	Name string
+	Up   []MigrationStep
+	Down []MigrationStep
+}
+
+func sqlStep(mysql, sqlite string) MigrationStep {
+	return MigrationStep{SQL: mysql, SQLSqlite: sqlite}
 }
 
-var (
-	migrations = []DbMigration{
-		{10, sql10},
+// returns all migrations, ordered by number
+func getMigrations() []*DbMigration {
+	return []*DbMigration{
+		{
+			No:   1,
+			Name: "base schema",
+			// getCreateDbSQLMust() already picks the right dialect
+			Up: []MigrationStep{sqlStep(string(getCreateDbSQLMust()), "")},
+			Down: []MigrationStep{sqlStep(`
+DROP TABLE versions;
+DROP TABLE notes;
+DROP TABLE users;
+`, "")},
+		},
+		{
+			No:   10,
+			Name: "simplenote imports",
+			Up:   []MigrationStep{sqlStep(sql10, sql10Sqlite)},
+			Down: []MigrationStep{sqlStep(`DROP TABLE simplenote_imports;`, "")},
+		},
+		{
+			No:   11,
+			Name: "versions.user_id and note tombstones",
+			Up:   []MigrationStep{sqlStep(sql11, sql11Sqlite)},
+			Down: []MigrationStep{sqlStep(sql11Down, sql11DownSqlite)},
+		},
+		{
+			No:   12,
+			Name: "links between notes",
+			Up:   []MigrationStep{sqlStep(sql12, sql12Sqlite)},
+			Down: []MigrationStep{sqlStep(`DROP TABLE note_links;`, "")},
+		},
+		{
+			No:   13,
+			Name: "attachments",
+			Up:   []MigrationStep{sqlStep(sql13, sql13Sqlite)},
+			Down: []MigrationStep{sqlStep(`DROP TABLE attachments;`, "")},
+		},
+		{
+			No:   14,
+			Name: "version id counter",
+			Up:   []MigrationStep{sqlStep(sql14, sql14Sqlite)},
+			Down: []MigrationStep{sqlStep(`DROP TABLE version_ids;`, "")},
+		},
+		{
+			No:   15,
+			Name: "unresolved links between notes",
+			Up:   []MigrationStep{sqlStep(sql15, sql15Sqlite)},
+			Down: []MigrationStep{sqlStep(`DROP TABLE unresolved_note_links;`, "")},
+		},
 	}
-)
+}
+
+func (s *MigrationStep) getSQL() string {
+	if useSqlite() && s.SQLSqlite != "" {
+		return s.SQLSqlite
+	}
+	return s.SQL
+}
 
-func execMigration(db *sql.DB, mi *DbMigration) error {
-	log.Verbosef("Executing migration %d\n", mi.No)
+// describe returns statements of the step, for dry run
+func (s *MigrationStep) describe() []string {
+	if s.Fn != nil {
+		return []string{fmt.Sprintf("-- Go code: %s", s.FnDesc)}
+	}
+	var res []string
+	for _, stm := range dbSplitMultiStatements(s.getSQL()) {
+		res = append(res, stm+";")
+	}
+	return res
+}
+
+func execMigrationSteps(tx *sql.Tx, steps []MigrationStep) error {
+	for _, step := range steps {
+		if step.Fn != nil {
+			err := step.Fn(tx)
+			if err != nil {
+				log.Errorf("migration code '%s' failed with '%s'\n", step.FnDesc, err)
+				return err
+			}
+			log.Verbosef("executed '%s'\n", step.FnDesc)
+			continue
+		}
+		for _, stm := range dbSplitMultiStatements(step.getSQL()) {
+			_, err := tx.Exec(stm)
+			if err != nil {
+				log.Errorf("tx.Exec('%s') failed with '%s'\n", stm, err)
+				return err
+			}
+			log.Verbosef("executed '%s'\n", stm)
+		}
+	}
+	return nil
+}
+
+// execMigration applies (if up is true) or rolls back a migration
+// note: in MySQL DDL statements can't be rolled back so a failed migration
+// might be partially applied
+func execMigration(db *sql.DB, mi *DbMigration, up bool) error {
+	steps := mi.Up
+	q := `INSERT INTO db_migrations (version) VALUES (?)`
+	if up {
+		log.Infof("applying migration %d '%s'\n", mi.No, mi.Name)
+	} else {
+		log.Infof("rolling back migration %d '%s'\n", mi.No, mi.Name)
+		steps = mi.Down
+		q = `DELETE FROM db_migrations WHERE version = ?`
+	}
 	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	stmts := dbSplitMultiStatements(mi.SQL)
-	for _, stm := range stmts {
-		_, err = tx.Exec(stm)
-		if err != nil {
-			log.Errorf("tx.Exec('%s') failed with '%s'\n", stm, err)
-			tx.Rollback()
-			return err
-		}
-		log.Verbosef("executed '%s'\n", stm)
+	err = execMigrationSteps(tx, steps)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
-	q := `INSERT INTO db_migrations (version) VALUES (?)`
 	_, err = tx.Exec(q, mi.No)
 	if err != nil {
 		log.Errorf("tx.Exec('%s') failed with '%s'\n", q, err)
@@ -64,21 +403,242 @@ func execMigration(db *sql.DB, mi *DbMigration) error {
 	return tx.Commit()
 }
 
-func upgradeDb(db *sql.DB) error {
-	var unused int
-	for _, mi := range migrations {
-		q := `SELECT 1 FROM db_migrations WHERE version = ?`
-		err := db.QueryRow(q, mi.No).Scan(&unused)
-		switch {
-		case err == sql.ErrNoRows:
-			err = execMigration(db, &mi)
-			if err != nil {
-				return err
-			}
-		case err != nil:
-			log.Errorf("db.Query('%s') failed with %s\n", q, err)
+func createMigrationsTables(db *sql.DB) error {
+	for _, stm := range dbSplitMultiStatements(sqlMigrationsTables) {
+		_, err := db.Exec(stm)
+		if err != nil {
+			log.Errorf("db.Exec('%s') failed with '%s'\n", stm, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// returns numbers of applied migrations
+func getAppliedMigrations(db *sql.DB) (map[int]bool, error) {
+	q := `SELECT version FROM db_migrations`
+	rows, err := db.Query(q)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with %s\n", q, err)
+		return nil, err
+	}
+	defer rows.Close()
+	res := map[int]bool{}
+	for rows.Next() {
+		var no int
+		err = rows.Scan(&no)
+		if err != nil {
+			return nil, err
+		}
+		res[no] = true
+	}
+	return res, rows.Err()
+}
+
+func migrationsLockOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// tries to take the lock once. Returns false if it's held by someone else
+func tryLockMigrations(db *sql.DB, owner string) (bool, error) {
+	q := `INSERT INTO db_migrations_lock (id, owner, locked_at) VALUES (1, ?, ?)`
+	_, err := db.Exec(q, owner, time.Now().UTC())
+	if err == nil {
+		return true, nil
+	}
+	// most likely a duplicate primary key, check who holds the lock
+	var currOwner string
+	var lockedAt time.Time
+	q = `SELECT owner, locked_at FROM db_migrations_lock WHERE id = 1`
+	err2 := db.QueryRow(q).Scan(&currOwner, &lockedAt)
+	if err2 == sql.ErrNoRows {
+		// released in the meantime
+		return false, nil
+	}
+	if err2 != nil {
+		log.Errorf("db.QueryRow('%s') failed with %s\n", q, err2)
+		return false, err2
+	}
+	if time.Since(lockedAt) > migrationsLockStaleTimeout {
+		log.Errorf("breaking stale migrations lock held by '%s' since %s\n", currOwner, lockedAt)
+		q = `DELETE FROM db_migrations_lock WHERE id = 1 AND owner = ?`
+		_, err = db.Exec(q, currOwner)
+		return false, err
+	}
+	log.Verbosef("migrations lock is held by '%s' since %s\n", currOwner, lockedAt)
+	return false, nil
+}
+
+// lockMigrations waits until it takes the lock. Returns a function that
+// releases the lock
+func lockMigrations(db *sql.DB) (func(), error) {
+	owner := migrationsLockOwner()
+	timeStart := time.Now()
+	for {
+		ok, err := tryLockMigrations(db, owner)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		if time.Since(timeStart) > migrationsLockWaitTimeout {
+			return nil, fmt.Errorf("timed out waiting for migrations lock")
+		}
+		time.Sleep(time.Second)
+	}
+	unlock := func() {
+		q := `DELETE FROM db_migrations_lock WHERE id = 1 AND owner = ?`
+		_, err := db.Exec(q, owner)
+		if err != nil {
+			log.Errorf("db.Exec('%s') failed with %s\n", q, err)
+		}
+	}
+	return unlock, nil
+}
+
+// migrateUp applies up to n (all if -1) pending migrations. If dryRun is
+// true, only prints statements
+func migrateUp(db *sql.DB, n int, dryRun bool) error {
+	applied, err := getAppliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, mi := range getMigrations() {
+		if n == 0 {
+			break
+		}
+		if applied[mi.No] {
+			continue
+		}
+		n--
+		if dryRun {
+			printMigrationSteps(mi, mi.Up)
+			continue
+		}
+		err = execMigration(db, mi, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDown rolls back n most recently applied migrations. If dryRun is
+// true, only prints statements
+func migrateDown(db *sql.DB, n int, dryRun bool) error {
+	applied, err := getAppliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	migrations := getMigrations()
+	for i := len(migrations) - 1; i >= 0 && n > 0; i-- {
+		mi := migrations[i]
+		if !applied[mi.No] {
+			continue
+		}
+		n--
+		if dryRun {
+			printMigrationSteps(mi, mi.Down)
+			continue
+		}
+		err = execMigration(db, mi, false)
+		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+func printMigrationSteps(mi *DbMigration, steps []MigrationStep) {
+	fmt.Printf("-- migration %d '%s'\n", mi.No, mi.Name)
+	for _, step := range steps {
+		for _, s := range step.describe() {
+			fmt.Printf("%s\n\n", s)
+		}
+	}
+}
+
+func printMigrationsStatus(db *sql.DB) error {
+	applied, err := getAppliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	known := map[int]bool{}
+	for _, mi := range getMigrations() {
+		known[mi.No] = true
+		status := "pending"
+		if applied[mi.No] {
+			status = "applied"
+		}
+		fmt.Printf("%4d %-8s %s\n", mi.No, status, mi.Name)
+	}
+	var unknown []int
+	for no := range applied {
+		if !known[no] {
+			unknown = append(unknown, no)
+		}
+	}
+	sort.Ints(unknown)
+	for _, no := range unknown {
+		fmt.Printf("%4d %-8s (unknown to this version)\n", no, "applied")
+	}
+	return nil
+}
+
+// upgradeDb applies all pending migrations
+func upgradeDb(db *sql.DB) error {
+	err := createMigrationsTables(db)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockMigrations(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return migrateUp(db, -1, false)
+}
+
+// runMigrateCommand implements -migrate status|up|down [N]
+func runMigrateCommand(cmd string, args []string, dryRun bool) error {
+	n := -1
+	if cmd == "down" {
+		n = 1
+	}
+	if len(args) > 0 {
+		var err error
+		n, err = strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid number of migrations '%s'", args[0])
+		}
+	}
+
+	db, err := getQuickNotesDb()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = createMigrationsTables(db)
+	if err != nil {
+		return err
+	}
+	if cmd == "status" {
+		return printMigrationsStatus(db)
+	}
+	if cmd != "up" && cmd != "down" {
+		return fmt.Errorf("unknown -migrate command '%s', must be status, up or down", cmd)
+	}
+	if !dryRun {
+		unlock, err := lockMigrations(db)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if cmd == "up" {
+		return migrateUp(db, n, dryRun)
+	}
+	return migrateDown(db, n, dryRun)
+}
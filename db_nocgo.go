@@ -0,0 +1,6 @@
+// +build !cgo
+
+package main
+
+// sqlite backend uses github.com/mattn/go-sqlite3, which needs cgo
+const sqliteSupported = false
@@ -1,8 +1,18 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/kjk/u"
 )
 
 func testSerializeTagsOne(t *testing.T, tags []string, expSerialized string) {
@@ -21,3 +31,687 @@ func TestSerializeTags(t *testing.T) {
 	testSerializeTagsOne(t, []string{"one"}, "one")
 	testSerializeTagsOne(t, []string{"one", "two"}, "one"+tagSepStr+"two")
 }
+
+// openTestDbMust creates sqlite database and local store in a temporary
+// directory so that repo can be tested without mysql.
+// returns a function that cleans up
+func openTestDbMust() func() {
+	dir, err := ioutil.TempDir("", "quicknotes_test")
+	u.PanicIfErr(err)
+	dataDir = dir
+	flgDbDriver = dbDriverSqlite
+	initHashID()
+	localStore, err = NewLocalStore(filepath.Join(dir, "localstore"))
+	u.PanicIfErr(err)
+	blobStore = NewTieredStore()
+	blobStore.Add(localStore, false)
+	openRepositoryMust()
+	return func() {
+		closeRepository()
+		localStore.Close()
+		mu.Lock()
+		userIDToCachedInfo = make(map[int]*CachedUserInfo)
+		userIDToDbUserCache = make(map[int]*DbUser)
+		mu.Unlock()
+		dataDir = ""
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSqliteNotes(t *testing.T) {
+	defer openTestDbMust()()
+	ctx := context.Background()
+
+	user, err := repo.GetOrCreateUser(ctx, "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	if user == nil || user.Login != "twitter:test" {
+		t.Fatalf("unexpected user %#v", user)
+	}
+
+	note := &NewNote{
+		title:   "first",
+		format:  formatText,
+		content: []byte("hello"),
+		tags:    []string{"one", "two"},
+	}
+	noteID, err := repo.CreateOrUpdateNote(ctx, user.ID, note)
+	u.PanicIfErr(err)
+
+	note = &NewNote{
+		hashID:  hashInt(noteID),
+		title:   "first",
+		format:  formatMarkdown,
+		content: []byte("hello world"),
+		tags:    []string{"one"},
+	}
+	_, err = repo.CreateOrUpdateNote(ctx, user.ID, note)
+	u.PanicIfErr(err)
+	u.PanicIfErr(repo.StarNote(ctx, user.ID, noteID))
+
+	n, err := repo.GetNoteByID(ctx, noteID)
+	u.PanicIfErr(err)
+	if n.Content() != "hello world" || n.Format != formatMarkdown || !n.IsStarred {
+		t.Fatalf("unexpected note %#v", n)
+	}
+	if !reflect.DeepEqual(n.Tags, []string{"one"}) {
+		t.Fatalf("unexpected tags %#v", n.Tags)
+	}
+
+	nVersions, err := repo.GetVersionsCount(ctx)
+	u.PanicIfErr(err)
+	// welcome note + 3 versions of our note
+	if nVersions != 4 {
+		t.Fatalf("expected 4 versions, got %d", nVersions)
+	}
+
+	notes, err := repo.GetNotesForUser(ctx, user)
+	u.PanicIfErr(err)
+	if len(notes) != 2 {
+		t.Fatalf("expected 2 notes, got %d", len(notes))
+	}
+
+	u.PanicIfErr(repo.PermanentDeleteNote(ctx, user.ID, noteID))
+	_, err = repo.GetNoteByID(ctx, noteID)
+	if err == nil {
+		t.Fatalf("note %d should be deleted", noteID)
+	}
+}
+
+func TestRecentPublicNotes(t *testing.T) {
+	defer openTestDbMust()()
+	ctx := context.Background()
+
+	user, err := repo.GetOrCreateUser(ctx, "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	for i := 0; i < 3; i++ {
+		note := &NewNote{
+			title:    fmt.Sprintf("public %d", i),
+			format:   formatText,
+			content:  []byte(fmt.Sprintf("public note %d", i)),
+			isPublic: true,
+		}
+		_, err = repo.CreateOrUpdateNote(ctx, user.ID, note)
+		u.PanicIfErr(err)
+	}
+	notes, err := repo.GetRecentPublicNotes(ctx, 2)
+	u.PanicIfErr(err)
+	if len(notes) != 2 {
+		t.Fatalf("expected 2 notes, got %d", len(notes))
+	}
+	for _, n := range notes {
+		if !n.IsPublic || n.userID != user.ID {
+			t.Fatalf("unexpected note %#v", n)
+		}
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = repo.GetNoteByID(cancelled, notes[0].id)
+	if err == nil {
+		t.Fatalf("query with cancelled context should fail")
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	defer openTestDbMust()()
+	db := repo.DB()
+
+	applied, err := getAppliedMigrations(db)
+	u.PanicIfErr(err)
+	for _, mi := range getMigrations() {
+		if !applied[mi.No] {
+			t.Fatalf("migration %d wasn't applied", mi.No)
+		}
+	}
+
+	u.PanicIfErr(migrateDown(db, 6, false))
+	_, err = db.Exec(`SELECT 1 FROM unresolved_note_links`)
+	if err == nil {
+		t.Fatalf("unresolved_note_links should've been dropped")
+	}
+	_, err = db.Exec(`SELECT 1 FROM version_ids`)
+	if err == nil {
+		t.Fatalf("version_ids should've been dropped")
+	}
+	_, err = db.Exec(`SELECT 1 FROM attachments`)
+	if err == nil {
+		t.Fatalf("attachments should've been dropped")
+	}
+	_, err = db.Exec(`SELECT 1 FROM note_links`)
+	if err == nil {
+		t.Fatalf("note_links should've been dropped")
+	}
+	_, err = db.Exec(`SELECT 1 FROM simplenote_imports`)
+	if err == nil {
+		t.Fatalf("simplenote_imports should've been dropped")
+	}
+	_, err = db.Exec(`SELECT user_id FROM versions`)
+	if err == nil {
+		t.Fatalf("versions.user_id should've been dropped")
+	}
+	u.PanicIfErr(migrateUp(db, -1, false))
+	_, err = db.Exec(`SELECT 1 FROM simplenote_imports`)
+	u.PanicIfErr(err)
+	_, err = db.Exec(`SELECT user_id FROM note_tombstones`)
+	u.PanicIfErr(err)
+	_, err = db.Exec(`SELECT anchor FROM note_links`)
+	u.PanicIfErr(err)
+	_, err = db.Exec(`SELECT content_sha1 FROM attachments`)
+	u.PanicIfErr(err)
+	_, err = db.Exec(`SELECT id FROM version_ids`)
+	u.PanicIfErr(err)
+	_, err = db.Exec(`SELECT title FROM unresolved_note_links`)
+	u.PanicIfErr(err)
+
+	ok, err := tryLockMigrations(db, "first")
+	u.PanicIfErr(err)
+	if !ok {
+		t.Fatalf("should take the lock")
+	}
+	ok, err = tryLockMigrations(db, "second")
+	u.PanicIfErr(err)
+	if ok {
+		t.Fatalf("shouldn't take the lock held by another owner")
+	}
+	// a stale lock is broken
+	stale := time.Now().Add(-migrationsLockStaleTimeout * 2).UTC()
+	_, err = db.Exec(`UPDATE db_migrations_lock SET locked_at = ?`, stale)
+	u.PanicIfErr(err)
+	ok, err = tryLockMigrations(db, "second")
+	u.PanicIfErr(err)
+	if ok {
+		t.Fatalf("breaking a stale lock shouldn't take it")
+	}
+	ok, err = tryLockMigrations(db, "second")
+	u.PanicIfErr(err)
+	if !ok {
+		t.Fatalf("should take the lock after breaking a stale lock")
+	}
+}
+
+func TestEncryptedNotes(t *testing.T) {
+	defer openTestDbMust()()
+	ctx := context.Background()
+
+	user, err := repo.GetOrCreateUser(ctx, "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	u.PanicIfErr(repo.SetUserEncryptedSample(ctx, user.ID, []byte("sample ciphertext")))
+	sample, err := repo.GetUserEncryptedSample(ctx, user.ID)
+	u.PanicIfErr(err)
+	if string(sample) != "sample ciphertext" {
+		t.Fatalf("unexpected encrypted sample '%s'", sample)
+	}
+
+	note := &NewNote{
+		title:       "encrypted title",
+		format:      formatText,
+		content:     []byte("secret ciphertext"),
+		isEncrypted: true,
+	}
+	noteID, err := repo.CreateOrUpdateNote(ctx, user.ID, note)
+	u.PanicIfErr(err)
+	n, err := repo.GetNoteByID(ctx, noteID)
+	u.PanicIfErr(err)
+	if !n.IsEncrypted || n.Snippet != "" {
+		t.Fatalf("unexpected note %#v", n)
+	}
+	if searchNote([]string{"secret"}, n, -1) != nil {
+		t.Fatalf("encrypted notes shouldn't be searched")
+	}
+	if repo.MakeNotePublic(ctx, user.ID, noteID) != errEncryptedNotePublic {
+		t.Fatalf("encrypted notes can't be made public")
+	}
+	compact, err := noteToCompact(n, false)
+	u.PanicIfErr(err)
+	if !isBitSet(compact[noteFlagsIdx].(int), flagEncryptedBit) {
+		t.Fatalf("encrypted flag not set in %v", compact)
+	}
+
+	// starring doesn't lose encrypted flag
+	u.PanicIfErr(repo.StarNote(ctx, user.ID, noteID))
+	n, err = repo.GetNoteByID(ctx, noteID)
+	u.PanicIfErr(err)
+	if !n.IsEncrypted || !n.IsStarred {
+		t.Fatalf("unexpected note %#v", n)
+	}
+
+	// passphrase can't change while there are encrypted notes
+	err = repo.SetUserEncryptedSample(ctx, user.ID, []byte("other sample"))
+	if err == nil {
+		t.Fatalf("changing encrypted sample should fail")
+	}
+}
+
+func TestIncrementalSync(t *testing.T) {
+	defer openTestDbMust()()
+
+	user, err := repo.GetOrCreateUser(context.Background(), "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	ctx := &ReqContext{User: userSummaryFromDbUser(user)}
+	newNote := func(content string) int {
+		note := &NewNote{
+			title:   content,
+			format:  formatText,
+			content: []byte(content),
+		}
+		noteID, err := repo.CreateOrUpdateNote(ctx.Context(), user.ID, note)
+		u.PanicIfErr(err)
+		return noteID
+	}
+	toDelete := newNote("to delete")
+	toStar := newNote("to star")
+
+	full, err := getNotesForUser(ctx, user.ID, 0)
+	u.PanicIfErr(err)
+	// welcome note + 2 notes
+	if len(full.Notes) != 3 || full.SinceVersion != 0 {
+		t.Fatalf("unexpected full sync %#v", full)
+	}
+
+	u.PanicIfErr(repo.StarNote(ctx.Context(), user.ID, toStar))
+	u.PanicIfErr(repo.PermanentDeleteNote(ctx.Context(), user.ID, toDelete))
+	added := newNote("added")
+
+	res, err := getNotesForUser(ctx, user.ID, full.LatestVersion)
+	u.PanicIfErr(err)
+	if res.SinceVersion != full.LatestVersion || res.LatestVersion <= full.LatestVersion {
+		t.Fatalf("unexpected versions in %#v", res)
+	}
+	var changed []string
+	for _, n := range res.Notes {
+		changed = append(changed, strings.Split(n[noteIDVerIdx].(string), "-")[0])
+	}
+	sort.Strings(changed)
+	exp := []string{hashInt(toStar), hashInt(added)}
+	sort.Strings(exp)
+	if !reflect.DeepEqual(changed, exp) {
+		t.Fatalf("expected changed notes %v, got %v", exp, changed)
+	}
+	if !reflect.DeepEqual(res.DeletedNotes, []string{hashInt(toDelete)}) {
+		t.Fatalf("expected deleted notes %v, got %v", []string{hashInt(toDelete)}, res.DeletedNotes)
+	}
+
+	// up to date client gets nothing
+	res, err = getNotesForUser(ctx, user.ID, res.LatestVersion)
+	u.PanicIfErr(err)
+	if len(res.Notes) != 0 || len(res.DeletedNotes) != 0 {
+		t.Fatalf("expected no changes, got %#v", res)
+	}
+
+	// a note made private disappears for other users
+	u.PanicIfErr(repo.MakeNotePublic(ctx.Context(), user.ID, toStar))
+	public, err := getNotesForUser(&ReqContext{}, user.ID, 0)
+	u.PanicIfErr(err)
+	u.PanicIfErr(repo.MakeNotePrivate(ctx.Context(), user.ID, toStar))
+	res, err = getNotesForUser(&ReqContext{}, user.ID, public.LatestVersion)
+	u.PanicIfErr(err)
+	if len(res.Notes) != 0 || !reflect.DeepEqual(res.DeletedNotes, []string{hashInt(toStar)}) {
+		t.Fatalf("unexpected result for other user %#v", res)
+	}
+
+	// deleting the most recently changed note still moves the version forward
+	latest, err := getNotesForUser(ctx, user.ID, 0)
+	u.PanicIfErr(err)
+	u.PanicIfErr(repo.PermanentDeleteNote(ctx.Context(), user.ID, added))
+	res, err = getNotesForUser(ctx, user.ID, latest.LatestVersion)
+	u.PanicIfErr(err)
+	if res.LatestVersion <= latest.LatestVersion || !reflect.DeepEqual(res.DeletedNotes, []string{hashInt(added)}) {
+		t.Fatalf("unexpected result after deleting newest note %#v", res)
+	}
+}
+
+func TestNoteVersions(t *testing.T) {
+	defer openTestDbMust()()
+
+	user, err := repo.GetOrCreateUser(context.Background(), "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	ctx := &ReqContext{User: userSummaryFromDbUser(user)}
+	note := &NewNote{
+		title:   "v1",
+		format:  formatText,
+		content: []byte("first version"),
+	}
+	noteID, err := repo.CreateOrUpdateNote(ctx.Context(), user.ID, note)
+	u.PanicIfErr(err)
+	note.title = "v2"
+	note.content = []byte("second version")
+	_, err = repo.CreateOrUpdateNote(ctx.Context(), user.ID, note)
+	u.PanicIfErr(err)
+
+	args := map[string]interface{}{"noteHashID": hashInt(noteID)}
+	res, err := wsGetNoteVersions(ctx, args)
+	u.PanicIfErr(err)
+	versions := res.(*NoteVersionsRsp).Versions
+	if len(versions) != 2 || versions[0][noteTitleIdx] != "v2" || versions[1][noteTitleIdx] != "v1" {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+
+	first, err := repo.GetNoteVersions(ctx.Context(), noteID)
+	u.PanicIfErr(err)
+	args["versionID"] = float64(first[1].CurrVersionID)
+	version, err := wsGetNoteVersion(ctx, args)
+	u.PanicIfErr(err)
+	if version[noteContentIdx] != "first version" {
+		t.Fatalf("unexpected version %v", version)
+	}
+
+	// other users can't see versions of private notes
+	other, err := repo.GetOrCreateUser(ctx.Context(), "twitter:other", "Other User")
+	u.PanicIfErr(err)
+	otherCtx := &ReqContext{User: userSummaryFromDbUser(other)}
+	_, err = wsGetNoteVersions(otherCtx, args)
+	if err == nil {
+		t.Fatalf("other user shouldn't see versions of a private note")
+	}
+	_, err = wsGetNoteVersion(otherCtx, args)
+	if err == nil {
+		t.Fatalf("other user shouldn't see a version of a private note")
+	}
+	// others see only versions of a public note that were public
+	u.PanicIfErr(repo.MakeNotePublic(ctx.Context(), user.ID, noteID))
+	public, err := repo.GetNoteByID(ctx.Context(), noteID)
+	u.PanicIfErr(err)
+	for _, c := range []*ReqContext{otherCtx, {}} {
+		res, err = wsGetNoteVersions(c, args)
+		u.PanicIfErr(err)
+		versions = res.(*NoteVersionsRsp).Versions
+		if len(versions) != 1 || versions[0][noteIDVerIdx] != fmt.Sprintf("%s-%d", public.HashID, public.CurrVersionID) {
+			t.Fatalf("expected only the public version, got %v", versions)
+		}
+		if _, err = wsGetNoteVersion(c, args); err == nil {
+			t.Fatalf("other users shouldn't see a private version of a public note")
+		}
+	}
+	args["versionID"] = float64(public.CurrVersionID)
+	version, err = wsGetNoteVersion(otherCtx, args)
+	u.PanicIfErr(err)
+	if version[noteContentIdx] != "second version" {
+		t.Fatalf("unexpected version %v", version)
+	}
+
+	// version must belong to the note
+	welcome, err := repo.GetNotesForUser(ctx.Context(), user)
+	u.PanicIfErr(err)
+	for _, n := range welcome {
+		if n.id != noteID {
+			args["versionID"] = float64(n.CurrVersionID)
+		}
+	}
+	_, err = wsGetNoteVersion(ctx, args)
+	if err == nil {
+		t.Fatalf("shouldn't get a version of another note")
+	}
+}
+
+func TestRestoreNoteVersion(t *testing.T) {
+	defer openTestDbMust()()
+
+	user, err := repo.GetOrCreateUser(context.Background(), "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	ctx := &ReqContext{User: userSummaryFromDbUser(user)}
+	note := &NewNote{
+		title:   "v1",
+		format:  formatText,
+		content: []byte("first version"),
+		tags:    []string{"one"},
+	}
+	noteID, err := repo.CreateOrUpdateNote(ctx.Context(), user.ID, note)
+	u.PanicIfErr(err)
+	note.title = "v2"
+	note.format = formatMarkdown
+	note.content = []byte("second version")
+	note.tags = []string{"two"}
+	_, err = repo.CreateOrUpdateNote(ctx.Context(), user.ID, note)
+	u.PanicIfErr(err)
+	u.PanicIfErr(repo.StarNote(ctx.Context(), user.ID, noteID))
+
+	versions, err := repo.GetNoteVersions(ctx.Context(), noteID)
+	u.PanicIfErr(err)
+	first := versions[len(versions)-1]
+	args := map[string]interface{}{
+		"noteHashID": hashInt(noteID),
+		"versionID":  float64(first.CurrVersionID),
+	}
+	_, err = wsRestoreNoteVersion(ctx, args)
+	u.PanicIfErr(err)
+
+	n, err := repo.GetNoteByID(ctx.Context(), noteID)
+	u.PanicIfErr(err)
+	if n.Content() != "first version" || n.Title != "v1" || n.Format != formatText || !reflect.DeepEqual(n.Tags, []string{"one"}) {
+		t.Fatalf("unexpected note %#v", n)
+	}
+	if !n.IsStarred {
+		t.Fatalf("restoring a version shouldn't change starred state")
+	}
+	// history is kept
+	restored, err := repo.GetNoteVersions(ctx.Context(), noteID)
+	u.PanicIfErr(err)
+	if len(restored) != len(versions)+1 || restored[0].CurrVersionID != n.CurrVersionID {
+		t.Fatalf("expected a new version, got %d versions", len(restored))
+	}
+
+	// only the owner can restore
+	other, err := repo.GetOrCreateUser(ctx.Context(), "twitter:other", "Other User")
+	u.PanicIfErr(err)
+	_, err = wsRestoreNoteVersion(&ReqContext{User: userSummaryFromDbUser(other)}, args)
+	if err == nil {
+		t.Fatalf("other user shouldn't be able to restore a version")
+	}
+}
+
+func TestNoteDiff(t *testing.T) {
+	defer openTestDbMust()()
+
+	user, err := repo.GetOrCreateUser(context.Background(), "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	ctx := &ReqContext{User: userSummaryFromDbUser(user)}
+	note := &NewNote{
+		title:   "diff",
+		format:  formatText,
+		content: []byte("one\ntwo\nthree\n"),
+	}
+	noteID, err := repo.CreateOrUpdateNote(ctx.Context(), user.ID, note)
+	u.PanicIfErr(err)
+	first, err := repo.GetNoteByID(ctx.Context(), noteID)
+	u.PanicIfErr(err)
+	note.content = []byte("one\n2\nthree\n")
+	_, err = repo.CreateOrUpdateNote(ctx.Context(), user.ID, note)
+	u.PanicIfErr(err)
+
+	args := map[string]interface{}{
+		"noteHashID":    hashInt(noteID),
+		"fromVersionID": float64(first.CurrVersionID),
+		"words":         true,
+	}
+	res, err := wsGetNoteDiff(ctx, args)
+	u.PanicIfErr(err)
+	diff := res.(*NoteDiffRsp)
+	if diff.FromVersionID != first.CurrVersionID || diff.ToVersionID <= first.CurrVersionID {
+		t.Fatalf("unexpected versions in %#v", diff)
+	}
+	if len(diff.Hunks) != 1 || diff.Hunks[0].Lines[1].Text != "two" || diff.Hunks[0].Lines[2].Text != "2" {
+		t.Fatalf("unexpected diff %#v", diff.Hunks)
+	}
+
+	// diff of the same versions is empty
+	args["toVersionID"] = float64(first.CurrVersionID)
+	res, err = wsGetNoteDiff(ctx, args)
+	u.PanicIfErr(err)
+	if len(res.(*NoteDiffRsp).Hunks) != 0 {
+		t.Fatalf("expected no changes")
+	}
+
+	// others can't diff against versions that were private
+	u.PanicIfErr(repo.MakeNotePublic(ctx.Context(), user.ID, noteID))
+	if _, err = wsGetNoteDiff(&ReqContext{}, args); err == nil {
+		t.Fatalf("other users shouldn't see a diff of private versions")
+	}
+	public, err := repo.GetNoteByID(ctx.Context(), noteID)
+	u.PanicIfErr(err)
+	args = map[string]interface{}{
+		"noteHashID":    hashInt(noteID),
+		"fromVersionID": float64(public.CurrVersionID),
+	}
+	res, err = wsGetNoteDiff(&ReqContext{}, args)
+	u.PanicIfErr(err)
+	if len(res.(*NoteDiffRsp).Hunks) != 0 {
+		t.Fatalf("expected no changes")
+	}
+}
+
+func TestNoteConflict(t *testing.T) {
+	defer openTestDbMust()()
+
+	user, err := repo.GetOrCreateUser(context.Background(), "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	ctx := &ReqContext{User: userSummaryFromDbUser(user)}
+	note := &NewNote{
+		title:   "conflict",
+		format:  formatText,
+		content: []byte("first"),
+	}
+	noteID, err := repo.CreateOrUpdateNote(ctx.Context(), user.ID, note)
+	u.PanicIfErr(err)
+	first, err := repo.GetNoteByID(ctx.Context(), noteID)
+	u.PanicIfErr(err)
+
+	update := func(content string, baseVersionID int) error {
+		noteJSON := fmt.Sprintf(`{"HashID":"%s","Title":"conflict","Format":"%s","Content":"%s","BaseVersionID":%d}`, hashInt(noteID), formatText, content, baseVersionID)
+		_, err := wsCreateOrUpdateNote(ctx, map[string]interface{}{"noteJSON": noteJSON})
+		return err
+	}
+	u.PanicIfErr(update("edited in tab 1", first.CurrVersionID))
+
+	// edit based on the first version is rejected
+	err = update("edited in tab 2", first.CurrVersionID)
+	conflict, ok := err.(*NoteConflictError)
+	if !ok {
+		t.Fatalf("expected NoteConflictError, got %v", err)
+	}
+	rsp := newNoteConflictRsp(conflict)
+	if rsp.NoteHashID != hashInt(noteID) || rsp.BaseVersionID != first.CurrVersionID || rsp.CurrentVersionID <= first.CurrVersionID {
+		t.Fatalf("unexpected conflict %#v", rsp)
+	}
+	if rsp.Note[noteContentIdx] != "edited in tab 1" {
+		t.Fatalf("unexpected current note %#v", rsp.Note)
+	}
+	expMerged := mergeMarkerCurrent + "edited in tab 1\n" + mergeMarkerSep + "edited in tab 2\n" + mergeMarkerEdit
+	if rsp.Merged != expMerged || rsp.Conflicts != 1 {
+		t.Fatalf("unexpected merge '%s'", rsp.Merged)
+	}
+	n, err := repo.GetNoteByID(ctx.Context(), noteID)
+	u.PanicIfErr(err)
+	if n.Content() != "edited in tab 1" {
+		t.Fatalf("conflicting edit shouldn't be saved, content: '%s'", n.Content())
+	}
+
+	// edit based on the current version succeeds, without a base version
+	// the note is overwritten
+	u.PanicIfErr(update("edited in tab 2", rsp.CurrentVersionID))
+	u.PanicIfErr(update("overwritten", 0))
+	n, err = repo.GetNoteByID(ctx.Context(), noteID)
+	u.PanicIfErr(err)
+	if n.Content() != "overwritten" {
+		t.Fatalf("unexpected content '%s'", n.Content())
+	}
+}
+
+func TestMergeConcurrentEdits(t *testing.T) {
+	defer openTestDbMust()()
+
+	user, err := repo.GetOrCreateUser(context.Background(), "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	ctx := context.Background()
+	note := &NewNote{
+		title:   "merge",
+		format:  formatText,
+		content: []byte("one\ntwo\nthree\nfour\n"),
+		tags:    []string{"base"},
+	}
+	noteID, err := repo.CreateOrUpdateNote(ctx, user.ID, note)
+	u.PanicIfErr(err)
+	base, err := repo.GetNoteByID(ctx, noteID)
+	u.PanicIfErr(err)
+
+	tab1 := &NewNote{
+		hashID:        hashInt(noteID),
+		title:         "merge",
+		format:        formatText,
+		content:       []byte("ONE\ntwo\nthree\nfour\n"),
+		tags:          []string{"tab1"},
+		baseVersionID: base.CurrVersionID,
+	}
+	_, err = repo.CreateOrUpdateNote(ctx, user.ID, tab1)
+	u.PanicIfErr(err)
+	tab2 := &NewNote{
+		hashID:        hashInt(noteID),
+		title:         "merged",
+		format:        formatText,
+		content:       []byte("one\ntwo\nthree\nFOUR\n"),
+		tags:          []string{"base"},
+		baseVersionID: base.CurrVersionID,
+	}
+	_, err = repo.CreateOrUpdateNote(ctx, user.ID, tab2)
+	u.PanicIfErr(err)
+
+	n, err := repo.GetNoteByID(ctx, noteID)
+	u.PanicIfErr(err)
+	if n.Content() != "ONE\ntwo\nthree\nFOUR\n" {
+		t.Fatalf("unexpected merged content '%s'", n.Content())
+	}
+	if n.Title != "merged" || !reflect.DeepEqual(n.Tags, []string{"tab1"}) {
+		t.Fatalf("unexpected merged note %#v", n)
+	}
+	versions, err := repo.GetNoteVersions(ctx, noteID)
+	u.PanicIfErr(err)
+	if len(versions) != 3 {
+		t.Fatalf("expected 3 versions, got %d", len(versions))
+	}
+	if tab1.merged || !tab2.merged || tab2.currVersionID != n.CurrVersionID {
+		t.Fatalf("unexpected merged: %v %v, version: %d", tab1.merged, tab2.merged, tab2.currVersionID)
+	}
+
+	// the client gets the merged note so that it can continue editing it
+	reqCtx := &ReqContext{User: userSummaryFromDbUser(user)}
+	noteJSON := fmt.Sprintf(`{"HashID":"%s","Title":"renamed","Format":"%s","Content":"one\ntwo\nthree\nfour\n","Tags":["base"],"BaseVersionID":%d}`, hashInt(noteID), formatText, base.CurrVersionID)
+	res, err := wsCreateOrUpdateNote(reqCtx, map[string]interface{}{"noteJSON": noteJSON})
+	u.PanicIfErr(err)
+	rsp := res.(*CreateOrUpdateNoteRsp)
+	n, err = repo.GetNoteByID(ctx, noteID)
+	u.PanicIfErr(err)
+	if !rsp.Merged || rsp.CurrVersionID != n.CurrVersionID || rsp.Content != "ONE\ntwo\nthree\nFOUR\n" || rsp.Title != "renamed" || !reflect.DeepEqual(rsp.Tags, []string{"tab1"}) {
+		t.Fatalf("unexpected response %#v", rsp)
+	}
+}
+
+func TestUpdateNoteWithConcurrentUpdate(t *testing.T) {
+	defer openTestDbMust()()
+
+	user, err := repo.GetOrCreateUser(context.Background(), "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	ctx := context.Background()
+	noteID, err := repo.CreateOrUpdateNote(ctx, user.ID, &NewNote{
+		title:   "starred",
+		format:  formatText,
+		content: []byte("content"),
+	})
+	u.PanicIfErr(err)
+
+	// the note is renamed after starring read it, starring must not undo
+	// the rename
+	nCalls := 0
+	err = repo.UpdateNoteWith(ctx, user.ID, noteID, false, func(note *NewNote) bool {
+		nCalls++
+		if nCalls == 1 {
+			u.PanicIfErr(repo.UpdateNoteTitle(ctx, user.ID, noteID, "renamed"))
+		}
+		note.isStarred = true
+		return true
+	})
+	u.PanicIfErr(err)
+	n, err := repo.GetNoteByID(ctx, noteID)
+	u.PanicIfErr(err)
+	if nCalls != 2 || !n.IsStarred || n.Title != "renamed" {
+		t.Fatalf("unexpected note after %d calls: starred: %v, title: '%s'", nCalls, n.IsStarred, n.Title)
+	}
+}
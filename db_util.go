@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"strings"
 
@@ -49,9 +50,9 @@ func (v *DbVals) genInsertQuery() string {
 }
 
 // TxInsert executes an insert within a transaction
-func (v *DbVals) TxInsert(tx *sql.Tx) (sql.Result, error) {
+func (v *DbVals) TxInsert(ctx context.Context, tx *sql.Tx) (sql.Result, error) {
 	v.Query = v.genInsertQuery()
-	res, err := tx.Exec(v.Query, v.ColValues...)
+	res, err := tx.ExecContext(ctx, v.Query, v.ColValues...)
 	if err != nil {
 		log.Errorf("tx.Exec('%s', %v) failed with '%s'\n", v.Query, v.ColValues, err)
 	}
@@ -59,26 +60,26 @@ func (v *DbVals) TxInsert(tx *sql.Tx) (sql.Result, error) {
 }
 
 // Insert executes an insert
-func (v *DbVals) Insert(db *sql.DB) (sql.Result, error) {
+func (v *DbVals) Insert(ctx context.Context, db *sql.DB) (sql.Result, error) {
 	v.Query = v.genInsertQuery()
-	res, err := db.Exec(v.Query, v.ColValues...)
+	res, err := db.ExecContext(ctx, v.Query, v.ColValues...)
 	if err != nil {
 		log.Errorf("db.Exec('%s', %v) failed with '%s'\n", v.Query, v.ColValues, err)
 	}
 	return res, err
 }
 
+// splits SQL into statements. Each statement must end with ; at the end
+// of a line
 func dbSplitMultiStatements(s string) []string {
-	a := strings.Split(s, ");\n\n")
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	a := strings.Split(s+"\n", ";\n")
 	var res []string
 	for _, s := range a {
 		s = strings.TrimSpace(s)
 		if len(s) == 0 {
 			continue
 		}
-		if !strings.HasSuffix(s, ");") {
-			s += "\n);"
-		}
 		res = append(res, s)
 	}
 	return res
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+)
+
+/*
+Delta encoding of content against a base, used to store note versions.
+
+Delta is:
+- uvarint size of the result
+- a sequence of operations:
+  - deltaOpCopy, uvarint offset, uvarint length: copy bytes from base
+  - deltaOpInsert, uvarint length, bytes: insert bytes
+
+To find matches we index the base by blocks of deltaBlockSize bytes and
+look up every position of the target in that index. Matches are extended
+in both directions.
+*/
+
+const (
+	deltaOpCopy   = 0
+	deltaOpInsert = 1
+
+	deltaBlockSize = 16
+)
+
+var (
+	errInvalidDelta = errors.New("invalid delta")
+)
+
+func hashDeltaBlock(d []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(d)
+	return h.Sum32()
+}
+
+type deltaWriter struct {
+	buf bytes.Buffer
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *deltaWriter) writeUvarint(n int) {
+	i := binary.PutUvarint(w.tmp[:], uint64(n))
+	w.buf.Write(w.tmp[:i])
+}
+
+func (w *deltaWriter) insert(d []byte) {
+	if len(d) == 0 {
+		return
+	}
+	w.buf.WriteByte(deltaOpInsert)
+	w.writeUvarint(len(d))
+	w.buf.Write(d)
+}
+
+func (w *deltaWriter) copy(offset, n int) {
+	w.buf.WriteByte(deltaOpCopy)
+	w.writeUvarint(offset)
+	w.writeUvarint(n)
+}
+
+// computeDelta returns delta that turns base into target
+func computeDelta(base, target []byte) []byte {
+	w := &deltaWriter{}
+	w.writeUvarint(len(target))
+
+	blocks := map[uint32]int{}
+	for off := 0; off+deltaBlockSize <= len(base); off += deltaBlockSize {
+		h := hashDeltaBlock(base[off : off+deltaBlockSize])
+		if _, ok := blocks[h]; !ok {
+			blocks[h] = off
+		}
+	}
+
+	insertStart := 0
+	i := 0
+	for i+deltaBlockSize <= len(target) {
+		block := target[i : i+deltaBlockSize]
+		off, ok := blocks[hashDeltaBlock(block)]
+		if !ok || !bytes.Equal(base[off:off+deltaBlockSize], block) {
+			i++
+			continue
+		}
+		// extend the match backwards into not yet emitted bytes
+		for off > 0 && i > insertStart && base[off-1] == target[i-1] {
+			off--
+			i--
+		}
+		n := 0
+		for off+n < len(base) && i+n < len(target) && base[off+n] == target[i+n] {
+			n++
+		}
+		w.insert(target[insertStart:i])
+		w.copy(off, n)
+		i += n
+		insertStart = i
+	}
+	w.insert(target[insertStart:])
+	return w.buf.Bytes()
+}
+
+// applyDelta reconstructs content from base and delta created by computeDelta
+func applyDelta(base, delta []byte) ([]byte, error) {
+	r := bytes.NewReader(delta)
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errInvalidDelta
+	}
+	// don't trust size from possibly corrupted delta for pre-allocation
+	capacity := len(base) + len(delta)
+	if size < uint64(capacity) {
+		capacity = int(size)
+	}
+	res := make([]byte, 0, capacity)
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		switch op {
+		case deltaOpCopy:
+			off, err1 := binary.ReadUvarint(r)
+			n, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil || off+n > uint64(len(base)) {
+				return nil, errInvalidDelta
+			}
+			res = append(res, base[off:off+n]...)
+		case deltaOpInsert:
+			n, err := binary.ReadUvarint(r)
+			if err != nil || n > uint64(r.Len()) {
+				return nil, errInvalidDelta
+			}
+			d := make([]byte, int(n))
+			io.ReadFull(r, d)
+			res = append(res, d...)
+		default:
+			return nil, errInvalidDelta
+		}
+	}
+	if uint64(len(res)) != size {
+		return nil, errInvalidDelta
+	}
+	return res, nil
+}
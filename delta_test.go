@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	base := make([]byte, 4000)
+	for i := range base {
+		base[i] = byte('a' + r.Intn(26))
+	}
+	edit := func(d []byte) []byte {
+		pos := r.Intn(len(d))
+		res := append([]byte(nil), d[:pos]...)
+		res = append(res, []byte("inserted text")...)
+		end := pos + r.Intn(50)
+		if end > len(d) {
+			end = len(d)
+		}
+		return append(res, d[end:]...)
+	}
+	tests := [][2][]byte{
+		{nil, nil},
+		{nil, []byte("new content")},
+		{base, nil},
+		{base, base},
+		{base, base[1000:2000]},
+		{[]byte("short"), []byte("short but longer")},
+	}
+	d := base
+	for i := 0; i < 20; i++ {
+		d2 := edit(d)
+		tests = append(tests, [2][]byte{d, d2})
+		d = d2
+	}
+	for i, test := range tests {
+		delta := computeDelta(test[0], test[1])
+		got, err := applyDelta(test[0], delta)
+		if err != nil {
+			t.Fatalf("%d: applyDelta() failed with %s", i, err)
+		}
+		if !bytes.Equal(got, test[1]) {
+			t.Fatalf("%d: applyDelta() returned wrong content", i)
+		}
+		if len(test[0]) == len(base) && len(test[1]) > 1000 && len(delta) > 200 {
+			t.Fatalf("%d: delta too big: %d", i, len(delta))
+		}
+	}
+	if _, err := applyDelta(base, []byte{10, deltaOpCopy, 100, 200}); err == nil {
+		t.Fatalf("applyDelta() should fail for invalid delta")
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+/*
+Line-based diff of text, used to compare versions of a note.
+
+We compute the shortest edit script with Myers' O(ND) algorithm and group
+changes into hunks with diffContextLines lines of context, like unified
+diff. Optionally, changed lines are refined into word-level changes by
+pairing deleted lines with lines inserted in their place.
+
+Trace of Myers' algorithm uses O(D^2) memory, so if the texts differ by
+more than diffMaxEdits lines (or words) we give up and report everything
+between common prefix and suffix as changed.
+*/
+
+const (
+	diffOpEqual  = "="
+	diffOpInsert = "+"
+	diffOpDelete = "-"
+
+	diffContextLines = 3
+	diffMaxEdits     = 1000
+)
+
+// DiffWord is a part of a changed line
+type DiffWord struct {
+	Op   string
+	Text string
+}
+
+// DiffLine is a line in a hunk. Words is only set for changed lines if
+// word-level refinement was requested and the line was paired with a line
+// on the other side
+type DiffLine struct {
+	Op    string
+	Text  string
+	Words []*DiffWord `json:",omitempty"`
+}
+
+// DiffHunk is a group of changed lines with surrounding context. Starts
+// are 1-based line numbers of the first line of the hunk
+type DiffHunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	Lines    []*DiffLine
+}
+
+type diffEdit struct {
+	op   string
+	aIdx int // index in a, -1 for insert
+	bIdx int // index in b, -1 for delete
+}
+
+// myersDiff returns an edit script transforming a into b
+func myersDiff(a, b []string) []diffEdit {
+	var res []diffEdit
+	// trimming common prefix and suffix is cheap and makes the expensive
+	// part smaller
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		res = append(res, diffEdit{diffOpEqual, prefix, prefix})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	midA := a[prefix : len(a)-suffix]
+	midB := b[prefix : len(b)-suffix]
+	for _, e := range myersDiffMiddle(midA, midB) {
+		if e.aIdx != -1 {
+			e.aIdx += prefix
+		}
+		if e.bIdx != -1 {
+			e.bIdx += prefix
+		}
+		res = append(res, e)
+	}
+	for i := suffix; i > 0; i-- {
+		res = append(res, diffEdit{diffOpEqual, len(a) - i, len(b) - i})
+	}
+	return res
+}
+
+func diffReplaceAll(a, b []string) []diffEdit {
+	var res []diffEdit
+	for i := range a {
+		res = append(res, diffEdit{diffOpDelete, i, -1})
+	}
+	for i := range b {
+		res = append(res, diffEdit{diffOpInsert, -1, i})
+	}
+	return res
+}
+
+func myersDiffMiddle(a, b []string) []diffEdit {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return diffReplaceAll(a, b)
+	}
+	maxD := n + m
+	if maxD > diffMaxEdits {
+		maxD = diffMaxEdits
+	}
+	// v[off+k] is the furthest x reached on diagonal k
+	off := maxD + 1
+	v := make([]int, 2*maxD+3)
+	// trace[d] is v[-d-1..d+1] before step d
+	var trace [][]int
+	found := false
+	for d := 0; d <= maxD && !found; d++ {
+		trace = append(trace, append([]int(nil), v[off-d-1:off+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return diffReplaceAll(a, b)
+	}
+
+	var res []diffEdit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		vd := trace[d]
+		get := func(k int) int {
+			return vd[k+d+1]
+		}
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && get(k-1) < get(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := get(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			res = append(res, diffEdit{diffOpEqual, x, y})
+		}
+		if d > 0 {
+			if x == prevX {
+				res = append(res, diffEdit{diffOpInsert, -1, y - 1})
+			} else {
+				res = append(res, diffEdit{diffOpDelete, x - 1, -1})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	s = strings.TrimSuffix(s, "\n")
+	return strings.Split(s, "\n")
+}
+
+// splits s into runs of letters and digits, runs of whitespace and single
+// other characters. Joining the result gives back s
+func splitWords(s string) []string {
+	var res []string
+	class := func(r rune) int {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			return 1
+		}
+		if unicode.IsSpace(r) {
+			return 2
+		}
+		return 3
+	}
+	start := 0
+	prevClass := 0
+	for i, r := range s {
+		c := class(r)
+		if i > start && (c != prevClass || c == 3) {
+			res = append(res, s[start:i])
+			start = i
+		}
+		prevClass = c
+	}
+	if start < len(s) {
+		res = append(res, s[start:])
+	}
+	return res
+}
+
+func appendDiffWord(words []*DiffWord, op string, text string) []*DiffWord {
+	if n := len(words); n > 0 && words[n-1].Op == op {
+		words[n-1].Text += text
+		return words
+	}
+	return append(words, &DiffWord{Op: op, Text: text})
+}
+
+// sets Words of a deleted line and the line inserted in its place
+func refineDiffLines(del, ins *DiffLine) {
+	a := splitWords(del.Text)
+	b := splitWords(ins.Text)
+	for _, e := range myersDiff(a, b) {
+		switch e.op {
+		case diffOpEqual:
+			del.Words = appendDiffWord(del.Words, diffOpEqual, a[e.aIdx])
+			ins.Words = appendDiffWord(ins.Words, diffOpEqual, b[e.bIdx])
+		case diffOpDelete:
+			del.Words = appendDiffWord(del.Words, diffOpDelete, a[e.aIdx])
+		case diffOpInsert:
+			ins.Words = appendDiffWord(ins.Words, diffOpInsert, b[e.bIdx])
+		}
+	}
+}
+
+// pairs runs of deleted lines with inserted lines that follow them
+func refineDiffHunk(h *DiffHunk) {
+	lines := h.Lines
+	for i := 0; i < len(lines); {
+		if lines[i].Op != diffOpDelete {
+			i++
+			continue
+		}
+		delStart := i
+		for i < len(lines) && lines[i].Op == diffOpDelete {
+			i++
+		}
+		insStart := i
+		for i < len(lines) && lines[i].Op == diffOpInsert {
+			i++
+		}
+		nDel := insStart - delStart
+		nIns := i - insStart
+		for j := 0; j < nDel && j < nIns; j++ {
+			refineDiffLines(lines[delStart+j], lines[insStart+j])
+		}
+	}
+}
+
+// diffText returns hunks of changes between a and b
+func diffText(a, b string, refineWords bool) []*DiffHunk {
+	aLines := splitLines(a)
+	bLines := splitLines(b)
+	edits := myersDiff(aLines, bLines)
+
+	var changes []int
+	for i, e := range edits {
+		if e.op != diffOpEqual {
+			changes = append(changes, i)
+		}
+	}
+
+	var res []*DiffHunk
+	for ci := 0; ci < len(changes); {
+		start := changes[ci] - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+		end := changes[ci]
+		ci++
+		// merge changes separated by no more than 2*context equal lines
+		for ci < len(changes) && changes[ci]-end <= 2*diffContextLines+1 {
+			end = changes[ci]
+			ci++
+		}
+		end += diffContextLines + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+
+		h := &DiffHunk{}
+		// line numbers of the first line of the hunk
+		oldLine, newLine := 1, 1
+		for _, e := range edits[:start] {
+			if e.aIdx != -1 {
+				oldLine = e.aIdx + 2
+			}
+			if e.bIdx != -1 {
+				newLine = e.bIdx + 2
+			}
+		}
+		h.OldStart = oldLine
+		h.NewStart = newLine
+		for _, e := range edits[start:end] {
+			line := &DiffLine{Op: e.op}
+			switch e.op {
+			case diffOpEqual:
+				line.Text = aLines[e.aIdx]
+				h.OldLines++
+				h.NewLines++
+			case diffOpDelete:
+				line.Text = aLines[e.aIdx]
+				h.OldLines++
+			case diffOpInsert:
+				line.Text = bLines[e.bIdx]
+				h.NewLines++
+			}
+			h.Lines = append(h.Lines, line)
+		}
+		if refineWords {
+			refineDiffHunk(h)
+		}
+		res = append(res, h)
+	}
+	return res
+}
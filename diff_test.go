@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// applies edits to a, checking they're consistent with a and b
+func applyDiffEdits(t *testing.T, a, b []string, edits []diffEdit) []string {
+	var res []string
+	nextA := 0
+	for _, e := range edits {
+		switch e.op {
+		case diffOpEqual:
+			if e.aIdx != nextA || a[e.aIdx] != b[e.bIdx] {
+				t.Fatalf("invalid equal edit %v", e)
+			}
+			res = append(res, a[e.aIdx])
+			nextA++
+		case diffOpDelete:
+			if e.aIdx != nextA {
+				t.Fatalf("invalid delete edit %v", e)
+			}
+			nextA++
+		case diffOpInsert:
+			res = append(res, b[e.bIdx])
+		}
+	}
+	if nextA != len(a) {
+		t.Fatalf("edits consumed %d of %d tokens", nextA, len(a))
+	}
+	return res
+}
+
+func countDiffChanges(edits []diffEdit) int {
+	n := 0
+	for _, e := range edits {
+		if e.op != diffOpEqual {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMyersDiff(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		nChanges int
+	}{
+		{"", "", 0},
+		{"abc", "abc", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"abcabba", "cbabac", 5},
+		{"abcd", "acbd", 2},
+		{"xaby", "xy", 2},
+	}
+	for _, test := range tests {
+		a := strings.Split(test.a, "")
+		b := strings.Split(test.b, "")
+		edits := myersDiff(a, b)
+		got := applyDiffEdits(t, a, b, edits)
+		if strings.Join(got, "") != test.b {
+			t.Fatalf("diff of '%s' and '%s' produced '%s'", test.a, test.b, strings.Join(got, ""))
+		}
+		if n := countDiffChanges(edits); n != test.nChanges {
+			t.Fatalf("diff of '%s' and '%s' has %d changes, expected %d", test.a, test.b, n, test.nChanges)
+		}
+	}
+
+	r := rand.New(rand.NewSource(1))
+	randomTokens := func(n int) []string {
+		var res []string
+		for i := 0; i < n; i++ {
+			res = append(res, string(rune('a'+r.Intn(4))))
+		}
+		return res
+	}
+	for i := 0; i < 100; i++ {
+		a := randomTokens(r.Intn(40))
+		b := randomTokens(r.Intn(40))
+		got := applyDiffEdits(t, a, b, myersDiff(a, b))
+		if !reflect.DeepEqual(strings.Join(got, ""), strings.Join(b, "")) {
+			t.Fatalf("diff of %v and %v produced %v", a, b, got)
+		}
+	}
+
+	// too many changes are reported as replacing everything
+	a := randomTokens(3 * diffMaxEdits)
+	b := randomTokens(3 * diffMaxEdits)
+	got := applyDiffEdits(t, a, b, myersDiff(a, b))
+	if strings.Join(got, "") != strings.Join(b, "") {
+		t.Fatalf("diff of long inputs failed")
+	}
+}
+
+func TestDiffText(t *testing.T) {
+	var lines []string
+	for i := 1; i <= 20; i++ {
+		lines = append(lines, "line "+strings.Repeat("x", i))
+	}
+	a := strings.Join(lines, "\n") + "\n"
+	lines[1] = "changed line"
+	lines[18] = "line with a new word"
+	b := strings.Join(lines, "\n") + "\n"
+
+	hunks := diffText(a, b, true)
+	if len(hunks) != 2 {
+		t.Fatalf("expected 2 hunks, got %d", len(hunks))
+	}
+	h := hunks[0]
+	if h.OldStart != 1 || h.OldLines != 5 || h.NewStart != 1 || h.NewLines != 5 {
+		t.Fatalf("unexpected hunk %#v", h)
+	}
+	if h.Lines[1].Op != diffOpDelete || h.Lines[2].Op != diffOpInsert || h.Lines[2].Text != "changed line" {
+		t.Fatalf("unexpected lines %#v", h.Lines)
+	}
+	h = hunks[1]
+	if h.OldStart != 16 || h.OldLines != 5 || h.NewStart != 16 || h.NewLines != 5 {
+		t.Fatalf("unexpected hunk %#v", h)
+	}
+	ins := h.Lines[4]
+	expWords := []*DiffWord{
+		{diffOpEqual, "line "},
+		{diffOpInsert, "with a new word"},
+	}
+	if ins.Op != diffOpInsert || !reflect.DeepEqual(ins.Words, expWords) {
+		t.Fatalf("unexpected words %#v", ins.Words)
+	}
+
+	// changes close to each other are in the same hunk
+	lines[5] = "another change"
+	b = strings.Join(lines, "\n")
+	hunks = diffText(a, b, false)
+	if len(hunks) != 2 || hunks[0].OldLines != 9 || hunks[0].Lines[1].Words != nil {
+		t.Fatalf("unexpected hunks %#v", hunks)
+	}
+
+	if len(diffText(a, a, true)) != 0 {
+		t.Fatalf("no changes should produce no hunks")
+	}
+	hunks = diffText("", "new\n", false)
+	if len(hunks) != 1 || hunks[0].NewLines != 1 || hunks[0].OldLines != 0 {
+		t.Fatalf("unexpected hunks %#v", hunks)
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	got := splitWords("hello,  world foo_bar!")
+	exp := []string{"hello", ",", "  ", "world", " ", "foo_bar", "!"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got %#v", got)
+	}
+}
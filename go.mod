@@ -22,6 +22,7 @@ require (
 	github.com/kjk/simplenote v0.0.0-20160130024859-0e74999e50b7
 	github.com/kjk/stackoverflow v0.0.0-20150613030704-2a5d8a2c4b2a
 	github.com/kjk/u v0.0.0-20170711051841-93181be023c9
+	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/onsi/ginkgo v1.10.1 // indirect
 	github.com/onsi/gomega v1.7.0 // indirect
 	github.com/smartystreets/goconvey v0.0.0-20190731233626-505e41936337 // indirect
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"io/ioutil"
 	"time"
 
@@ -19,81 +18,62 @@ const (
 	quicknotesBucket = "quicknotes"
 )
 
-var (
-	googleStorageClient *storage.Client
-	// if true, don't save notes to Google Storage. Enabled when running locally
-	onlyLocalStorage bool
-)
-
-func loadGoogleStorageCredentialsMust() []byte {
-	d, err := ioutil.ReadFile("credentials.json")
-	u.PanicIfErr(err)
-	return d
+// GoogleStorageStore is a BlobStore backed by Google Storage bucket
+type GoogleStorageStore struct {
+	client *storage.Client
+	bucket string
 }
 
-func initGoogleStorageMust() {
+// NewGoogleStorageStore creates a store for a given bucket. Credentials are
+// read from credentials.json
+func NewGoogleStorageStore(bucket string) (*GoogleStorageStore, error) {
 	// http://godoc.org/golang.org/x/oauth2/google
 	// another way: https://godoc.org/google.golang.org/cloud/storage#example-package--Auth
-	d := loadGoogleStorageCredentialsMust()
+	d, err := ioutil.ReadFile("credentials.json")
+	if err != nil {
+		return nil, err
+	}
 	conf, err := google.JWTConfigFromJSON(
 		d,
 		storage.ScopeReadWrite,
 	)
-	u.PanicIfErr(err, "google.JWTConfigFromJSON")
+	if err != nil {
+		return nil, err
+	}
 	ctx := context.Background()
 	opt := option.WithTokenSource(conf.TokenSource(ctx))
-	googleStorageClient, err = storage.NewClient(ctx, opt)
-	u.PanicIfErr(err, "storage.NewClient")
+	client, err := storage.NewClient(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	return &GoogleStorageStore{client: client, bucket: bucket}, nil
 }
 
-func testListObjects() {
-	ctx := context.Background()
-	var query *storage.Query
-	nTotal := 0
-	timeStart := time.Now()
-
-	it := googleStorageClient.Bucket(quicknotesBucket).Objects(ctx, query)
-	for {
-		_, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			log.Errorf("testListObjects: it.Next() failed with '%s'\n", err)
-			break
-		}
-		nTotal++
-		//log.Verbosef("%d objects\n", len(objects.Results))
-		//for _, obj := range objects.Results {
-		//	fmt.Printf("name: %s, size: %v\n", obj.Name, obj.Size)
-		//}
-	}
-	log.Verbosef("listed %d objects in %s\n", nTotal, time.Since(timeStart))
+// Name returns name of the store
+func (s *GoogleStorageStore) Name() string {
+	return "gcs"
 }
 
-func noteGoogleStoragePath(sha1 []byte) string {
-	return fmt.Sprintf("notes_sha1/%02x/%02x/%02x/%x", sha1[0], sha1[1], sha1[2], sha1)
+func (s *GoogleStorageStore) object(sha1 []byte) *storage.ObjectHandle {
+	return s.client.Bucket(s.bucket).Object(blobStoragePath(sha1))
 }
 
+// Put saves d in the bucket unless it's already there
 // TODO: remember timing of requests somewhere for analysis
-func saveNoteToGoogleStorage(sha1 []byte, d []byte) error {
-	if onlyLocalStorage {
-		return nil
-	}
+func (s *GoogleStorageStore) Put(d []byte) ([]byte, error) {
 	timeStart := time.Now()
-	path := noteGoogleStoragePath(sha1)
+	sha1 := u.Sha1OfBytes(d)
+	path := blobStoragePath(sha1)
 	ctx := context.Background()
-	objHandle := googleStorageClient.Bucket(quicknotesBucket).Object(path)
+	objHandle := s.object(sha1)
 	_, err := objHandle.Attrs(ctx)
 	if err == nil {
 		// already exists
-		return nil
+		return sha1, nil
 	}
-	if err != nil {
-		if err != storage.ErrObjectNotExist {
-			log.Errorf("storage.Attrs('%s') failed with %s", path, err)
-			return err
-		}
+	if err != storage.ErrObjectNotExist {
+		log.Errorf("storage.Attrs('%s') failed with %s", path, err)
+		return nil, err
 	}
 	w := objHandle.NewWriter(ctx)
 	w.ContentType = "text/plain"
@@ -106,21 +86,28 @@ func saveNoteToGoogleStorage(sha1 []byte, d []byte) error {
 		log.Errorf("w.Close() failed with %s\n", err2)
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if err2 != nil {
-		return err2
+		return nil, err2
 	}
 	log.Verbosef("saved %d bytes in %s, file: '%s'\n", len(d), time.Since(timeStart), path)
-	return nil
+	return sha1, nil
 }
 
-func readNoteFromGoogleStorage(sha1 []byte) ([]byte, error) {
+// Get downloads the blob
+func (s *GoogleStorageStore) Get(sha1 []byte) ([]byte, error) {
+	return s.GetLimited(sha1, -1)
+}
+
+// GetLimited downloads up to limit bytes of the blob
+func (s *GoogleStorageStore) GetLimited(sha1 []byte, limit int) ([]byte, error) {
 	timeStart := time.Now()
-	path := noteGoogleStoragePath(sha1)
 	ctx := context.Background()
-	objHandle := googleStorageClient.Bucket(quicknotesBucket).Object(path)
-	r, err := objHandle.NewReader(ctx)
+	r, err := s.object(sha1).NewRangeReader(ctx, 0, int64(limit))
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrBlobNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -129,6 +116,49 @@ func readNoteFromGoogleStorage(sha1 []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	log.Verbosef("downloaded %s from google storage in %s\n", path, time.Since(timeStart))
+	log.Verbosef("downloaded %s from google storage in %s\n", blobStoragePath(sha1), time.Since(timeStart))
 	return d, nil
 }
+
+// Has returns true if the blob is in the bucket
+func (s *GoogleStorageStore) Has(sha1 []byte) (bool, error) {
+	_, err := s.object(sha1).Attrs(context.Background())
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete deletes the blob from the bucket
+func (s *GoogleStorageStore) Delete(sha1 []byte) error {
+	err := s.object(sha1).Delete(context.Background())
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	return err
+}
+
+// List lists all blobs in the bucket
+func (s *GoogleStorageStore) List(fn func(sha1 []byte) error) error {
+	ctx := context.Background()
+	query := &storage.Query{Prefix: "notes_sha1/"}
+	it := s.client.Bucket(s.bucket).Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			log.Errorf("GoogleStorageStore.List: it.Next() failed with '%s'\n", err)
+			return err
+		}
+		sha1 := sha1FromHex(attrs.Name)
+		if sha1 == nil {
+			continue
+		}
+		err = fn(sha1)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -41,6 +42,7 @@ type SimpleNoteImport struct {
 	// data owned exclusively by import goroutine
 	importID            int
 	userID              int
+	ctx                 context.Context // outlives the request that started the import
 	client              *simplenote.Client
 	shouldConvertPublic bool
 	alreadyImported     map[string]ImportedSimpleNote
@@ -139,26 +141,11 @@ func snKey(id string, ver int) string {
 	return fmt.Sprintf("%s-%d", id, ver)
 }
 
-func getSimpleNoteImportsForUser(userID int) (map[string]ImportedSimpleNote, error) {
-	db := getDbMust()
-	q := `SELECT note_id, simplenote_id, simplenote_version FROM simplenote_imports WHERE user_id = ?`
-	rows, err := db.Query(q, userID)
+func getSimpleNoteImportsForUser(ctx context.Context, userID int) (map[string]ImportedSimpleNote, error) {
+	arr, err := repo.GetSimpleNoteImports(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	var arr []ImportedSimpleNote
-	for rows.Next() {
-		var sni ImportedSimpleNote
-		err = rows.Scan(&sni.NoteID, &sni.SimpleNoteID, &sni.SimpleNoteVersion)
-		if err != nil {
-			return nil, err
-		}
-		arr = append(arr, sni)
-	}
-	if rows.Err() != nil {
-		return nil, rows.Err()
-	}
 	res := make(map[string]ImportedSimpleNote)
 	for _, sni := range arr {
 		key := snKey(sni.SimpleNoteID, sni.SimpleNoteVersion)
@@ -168,11 +155,8 @@ func getSimpleNoteImportsForUser(userID int) (map[string]ImportedSimpleNote, err
 }
 
 func markSimpleNoteImported(state *SimpleNoteImport, noteID int, simplenoteID string, simplenoteVersion int) error {
-	db := getDbMust()
-	q := `INSERT INTO simplenote_imports (user_id, note_id, simplenote_id, simplenote_version) VALUES (?, ?, ?, ?)`
-	_, err := db.Exec(q, state.userID, noteID, simplenoteID, simplenoteVersion)
+	err := repo.MarkSimpleNoteImported(state.ctx, state.userID, noteID, simplenoteID, simplenoteVersion)
 	if err != nil {
-		log.Errorf("db.Exec('%s') (%v, %v, %v, %v) failed with '%s'\n", q, state.userID, noteID, simplenoteID, simplenoteVersion, err)
 		return err
 	}
 	key := snKey(simplenoteID, simplenoteVersion)
@@ -185,8 +169,8 @@ func markSimpleNoteImported(state *SimpleNoteImport, noteID int, simplenoteID st
 	return nil
 }
 
-func dbIsUserMe(userID int) bool {
-	userDb, err := dbGetUserByIDCached(userID)
+func isUserMe(ctx context.Context, userID int) bool {
+	userDb, err := getUserByIDCached(ctx, userID)
 	if err != nil {
 		return false
 	}
@@ -265,9 +249,9 @@ func importOneNote(state *SimpleNoteImport, note *simplenote.Note) error {
 		return nil
 	}
 
-	noteID, err := dbCreateOrUpdateNote(state.userID, &newNote)
+	noteID, err := repo.CreateOrUpdateNote(state.ctx, state.userID, &newNote)
 	if err != nil {
-		log.Errorf("dbCreateOrUpdateNote() failed with %s\n", err)
+		log.Errorf("repo.CreateOrUpdateNote() failed with %s\n", err)
 		return err
 	}
 	if newNote.isDeleted {
@@ -312,10 +296,10 @@ func importPreviousVersions(state *SimpleNoteImport, noteLastVer *simplenote.Not
 
 func importSimpleNote(state *SimpleNoteImport, email, password string) {
 	id := state.importID
-	state.shouldConvertPublic = dbIsUserMe(state.userID)
+	state.shouldConvertPublic = isUserMe(state.ctx, state.userID)
 	// for now only import previous versions for me
 	// Maybe: enable for everyone with a checkbox in import dialog
-	importPrevious := dbIsUserMe(state.userID)
+	importPrevious := isUserMe(state.ctx, state.userID)
 	state.client = simplenote.NewClient(simplenoteAPIKey, email, password)
 	notes, err := state.client.List()
 	if err != nil {
@@ -328,7 +312,7 @@ func importSimpleNote(state *SimpleNoteImport, email, password string) {
 		return
 	}
 
-	state.alreadyImported, err = getSimpleNoteImportsForUser(state.userID)
+	state.alreadyImported, err = getSimpleNoteImportsForUser(state.ctx, state.userID)
 	if err != nil {
 		log.Errorf("getSimpleNoteImportsForUser() failed with '%s'\n", err)
 		importSetError(id, err.Error())
@@ -409,6 +393,7 @@ func handleAPIImportSimpleNoteStart(ctx *ReqContext, w http.ResponseWriter, r *h
 	}
 	log.Verbosef("importing for user: %s (%d), email: '%s', pwd: '%s'\n", ctx.User.Handle, ctx.User.id, email, password)
 	state := startNewImport(ctx.User.id)
+	state.ctx = serverCtx
 	id := state.importID
 	go importSimpleNote(state, email, password)
 	v := struct {
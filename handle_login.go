@@ -169,9 +169,9 @@ func getDbUserFromCookie(w http.ResponseWriter, r *http.Request) *DbUser {
 	if sc == nil {
 		return nil
 	}
-	user, err := dbGetUserByID(sc.UserID)
+	user, err := repo.GetUserByID(r.Context(), sc.UserID)
 	if err != nil {
-		log.Errorf("dbGetUserById(%d) failed with %s\n", sc.UserID, err)
+		log.Errorf("repo.GetUserByID(%d) failed with %s\n", sc.UserID, err)
 		return nil
 	}
 	return user
@@ -277,9 +277,9 @@ func handleOauthTwitterCallback(w http.ResponseWriter, r *http.Request) {
 	// avatar_url
 	userLogin := "twitter:" + twitterHandle
 	// TODO: oauthJSON
-	dbUser, err := dbGetOrCreateUser(userLogin, fullName)
+	dbUser, err := repo.GetOrCreateUser(r.Context(), userLogin, fullName)
 	if err != nil {
-		log.Errorf("dbGetOrCreateUser('%s', '%s') failed with '%s'\n", userLogin, fullName, err)
+		log.Errorf("repo.GetOrCreateUser('%s', '%s') failed with '%s'\n", userLogin, fullName, err)
 		// TODO: show error to the user
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
@@ -371,9 +371,9 @@ func handleOauthGitHubCallback(w http.ResponseWriter, r *http.Request) {
 	// profile_image_url
 	// profile_image_url_https
 	userLogin := "github:" + githubLogin
-	dbUser, err := dbGetOrCreateUser(userLogin, fullName)
+	dbUser, err := repo.GetOrCreateUser(r.Context(), userLogin, fullName)
 	if err != nil {
-		log.Errorf("dbGetOrCreateUser('%s', '%s') failed with '%s'\n", userLogin, fullName, err)
+		log.Errorf("repo.GetOrCreateUser('%s', '%s') failed with '%s'\n", userLogin, fullName, err)
 		// TODO: show error to the user
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
@@ -452,9 +452,9 @@ func handleOauthGoogleCallback(w http.ResponseWriter, r *http.Request) {
 	// also might be useful:
 	// Picture
 	userLogin := "google:" + nameFromEmail(userInfo.Email)
-	dbUser, err := dbGetOrCreateUser(userLogin, fullName)
+	dbUser, err := repo.GetOrCreateUser(r.Context(), userLogin, fullName)
 	if err != nil {
-		log.Errorf("dbGetOrCreateUser('%s', '%s') failed with '%s'\n", userLogin, fullName, err)
+		log.Errorf("repo.GetOrCreateUser('%s', '%s') failed with '%s'\n", userLogin, fullName, err)
 		// TODO: show error to the user
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
@@ -29,7 +29,9 @@ type SearchResult struct {
 	Items      []SearchResultItem
 }
 
-func searchUserNotes(ctx *ReqContext, userIDHash string, searchTerm string) (interface{}, error) {
+// searchUserNotes searches notes of the user. If tag is given, only notes with
+// the tag or its descendants are searched
+func searchUserNotes(ctx *ReqContext, userIDHash string, searchTerm string, tag string) (interface{}, error) {
 	if userIDHash == "" {
 		return nil, fmt.Errorf("missing 'userIDHash' arg")
 	}
@@ -43,9 +45,9 @@ func searchUserNotes(ctx *ReqContext, userIDHash string, searchTerm string) (int
 	}
 	searchPrivate := ctx.User != nil && userID == ctx.User.id
 
-	log.Verbosef("userID: '%d', term: '%s', private: %v\n", userID, searchTerm, searchPrivate)
+	log.Verbosef("userID: '%d', term: '%s', tag: '%s', private: %v\n", userID, searchTerm, tag, searchPrivate)
 
-	i, err := getCachedUserInfo(userID)
+	i, err := getCachedUserInfo(ctx.Context(), userID)
 	if err != nil {
 		return nil, err
 	}
@@ -54,6 +56,9 @@ func searchUserNotes(ctx *ReqContext, userIDHash string, searchTerm string) (int
 	}
 	var notes []*Note
 	for _, note := range i.notes {
+		if tag != "" && !noteHasTagInSubtree(note, tag) {
+			continue
+		}
 		if note.IsPublic || searchPrivate {
 			notes = append(notes, note)
 		}
@@ -92,5 +97,6 @@ func searchUserNotes(ctx *ReqContext, userIDHash string, searchTerm string) (int
 func wsSearchUserNotes(ctx *ReqContext, args map[string]interface{}) (interface{}, error) {
 	userIDHash, _ := jsonMapGetString(args, "userIDHash")
 	searchTerm, _ := jsonMapGetString(args, "searchTerm")
-	return searchUserNotes(ctx, userIDHash, searchTerm)
+	tag, _ := jsonMapGetString(args, "tag")
+	return searchUserNotes(ctx, userIDHash, searchTerm, tag)
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -17,16 +19,24 @@ const (
 	writeTimeout = 30 * time.Second
 	readTimeout  = time.Minute
 	cmdPing      = "ping"
+	// number of responses queued for writing to a connection
+	wsSendQueueSize = 256
 )
 
 // NewNoteFromBrowser represents format of the note sent by the browser
 type NewNoteFromBrowser struct {
-	HashID   string
-	Title    string
-	Format   string
-	Content  string
-	Tags     []string
-	IsPublic bool
+	HashID      string
+	Title       string
+	Format      string
+	Content     string
+	Tags        []string
+	IsPublic    bool
+	IsEncrypted bool
+	// version of the note the edit is based on, 0 to overwrite the note
+	// without checking for conflicts
+	BaseVersionID int
+	// if the title changes, update [[title]] links to the note in other notes
+	RewriteLinks bool `json:",omitempty"`
 }
 
 type wsGenericReq struct {
@@ -40,6 +50,40 @@ type wsResponse struct {
 	Cmd    string      `json:"cmd"`
 	Result interface{} `json:"result"`
 	Err    string      `json:"error,omitempty"`
+	// set if createOrUpdateNote failed because the note was changed since
+	// the version the edit is based on
+	Conflict *NoteConflictRsp `json:"conflict,omitempty"`
+}
+
+// NoteConflictRsp describes the current version of a note that was changed
+// since the version an edit is based on. Note is in compact format, with
+// content. Merged is the content with both sides of Conflicts overlapping
+// changes between conflict markers, empty if the edit couldn't be merged
+type NoteConflictRsp struct {
+	NoteHashID       string
+	BaseVersionID    int
+	CurrentVersionID int
+	Note             []interface{}
+	Merged           string
+	Conflicts        int
+}
+
+func newNoteConflictRsp(e *NoteConflictError) *NoteConflictRsp {
+	current := e.Current
+	current.HashID = hashInt(current.id)
+	compactNote, err := noteToCompact(current, true)
+	if err != nil {
+		log.Errorf("noteToCompact() of note %d failed with %s\n", current.id, err)
+		compactNote, _ = noteToCompact(current, false)
+	}
+	return &NoteConflictRsp{
+		NoteHashID:       current.HashID,
+		BaseVersionID:    e.BaseVersionID,
+		CurrentVersionID: current.CurrVersionID,
+		Note:             compactNote,
+		Merged:           e.Merged,
+		Conflicts:        e.Conflicts,
+	}
 }
 
 var (
@@ -84,6 +128,23 @@ func wsBroadcastToUser(userID int, v *wsResponse) {
 	}
 }
 
+// broadcastUserNotes sends notes of the logged in user changed since
+// sinceVersion to all connections of the user
+func broadcastUserNotes(ctx *ReqContext, sinceVersion int) {
+	res, err := getNotesForUser(ctx, ctx.User.id, sinceVersion)
+	rsp := &wsResponse{
+		ID:     -1,
+		Cmd:    "broadcastUserNotes",
+		Result: res,
+	}
+	if err != nil {
+		rsp.Err = err.Error()
+		rsp.Result = nil
+		log.Errorf("getNotesForUser() of user %d failed with '%s'\n", ctx.User.id, err)
+	}
+	wsBroadcastToUser(ctx.User.id, rsp)
+}
+
 func jsonMapGetString(m map[string]interface{}, key string) (string, error) {
 	v, ok := m[key]
 	if !ok {
@@ -126,7 +187,7 @@ func getUserNoteByHashID(ctx *ReqContext, noteHashIDStr string) (int, error) {
 		return -1, err
 	}
 	log.Verbosef("note id hash: '%s', id: %d\n", noteHashIDStr, noteID)
-	note, err := dbGetNoteByID(noteID)
+	note, err := repo.GetNoteByID(ctx.Context(), noteID)
 	if err != nil {
 		return -1, err
 	}
@@ -141,7 +202,7 @@ type getUserInfoRsp struct {
 	UserInfo *UserSummary
 }
 
-func wsGetUserInfo(args map[string]interface{}) (*getUserInfoRsp, error) {
+func wsGetUserInfo(ctx *ReqContext, args map[string]interface{}) (*getUserInfoRsp, error) {
 	userIDHash, err := jsonMapGetString(args, "userIDHash")
 	if err != nil {
 		return nil, fmt.Errorf("'userIDHash' argument missing in '%v'", args)
@@ -151,7 +212,7 @@ func wsGetUserInfo(args map[string]interface{}) (*getUserInfoRsp, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid userID: '%s'", userIDHash)
 	}
-	i, err := getCachedUserInfo(userID)
+	i, err := getCachedUserInfo(ctx.Context(), userID)
 	if err != nil || i == nil {
 		return nil, fmt.Errorf("no user '%d', err: '%s'", userID, err)
 	}
@@ -159,11 +220,11 @@ func wsGetUserInfo(args map[string]interface{}) (*getUserInfoRsp, error) {
 	return &getUserInfoRsp{userInfo}, nil
 }
 
-func wsGetRecentNotes(limit int) (interface{}, error) {
+func wsGetRecentNotes(ctx *ReqContext, limit int) (interface{}, error) {
 	if limit > 300 {
 		limit = 300
 	}
-	recentNotes, err := getRecentPublicNotesCached(limit)
+	recentNotes, err := getRecentPublicNotesCached(ctx.Context(), limit)
 	if err != nil {
 		return nil, fmt.Errorf("getRecentPublicNotesCached() failed with '%s'", err)
 	}
@@ -180,18 +241,56 @@ func wsGetRecentNotes(limit int) (interface{}, error) {
 	return &res, nil
 }
 
-func getNotesForUser(ctx *ReqContext, userID int, latestVersion int) (interface{}, error) {
-	i, err := getCachedUserInfo(userID)
+// GetNotesRsp is a result of getNotes and broadcastUserNotes. If
+// SinceVersion is > 0, it's incremental: Notes only has notes changed after
+// SinceVersion and DeletedNotes has hashed ids of notes that were deleted
+// (or are no longer visible) since then. TagTree is always for all visible
+// notes
+type GetNotesRsp struct {
+	LoggedUser    *UserSummary
+	Notes         [][]interface{}
+	DeletedNotes  []string `json:",omitempty"`
+	TagTree       []*TagNode
+	LatestVersion int
+	SinceVersion  int `json:",omitempty"`
+}
+
+// returns notes of the user changed after latestVersion, which is the
+// latest version the client has. 0 means the client has nothing and we
+// return all notes
+func getNotesForUser(ctx *ReqContext, userID int, latestVersion int) (*GetNotesRsp, error) {
+	i, err := getCachedUserInfo(ctx.Context(), userID)
 	if err != nil || i == nil {
 		return nil, fmt.Errorf("getCachedUserInfo('%d') failed with '%s'", userID, err)
 	}
 
+	// if client claims to have a version we don't know about (e.g. the
+	// database was restored from backup), it needs all notes
+	incremental := latestVersion > 0 && latestVersion <= i.latestVersion
 	showPrivate := ctx.User != nil && userID == ctx.User.id
 	var notes [][]interface{}
+	var deletedNotes []string
+	var visibleNotes []*Note
 	for _, note := range i.notes {
+		if note.IsPublic || showPrivate {
+			visibleNotes = append(visibleNotes, note)
+		}
+		if incremental && note.CurrVersionID <= latestVersion {
+			continue
+		}
 		if note.IsPublic || showPrivate {
 			compactNote, _ := noteToCompact(note, false)
 			notes = append(notes, compactNote)
+		} else if incremental {
+			// was made private since
+			deletedNotes = append(deletedNotes, note.HashID)
+		}
+	}
+	if incremental {
+		for _, t := range i.tombstones {
+			if t.VersionID > latestVersion {
+				deletedNotes = append(deletedNotes, hashInt(t.NoteID))
+			}
 		}
 	}
 
@@ -201,26 +300,33 @@ func getNotesForUser(ctx *ReqContext, userID int, latestVersion int) (interface{
 		loggedUserHandle = ctx.User.Handle
 		loggedUserID = ctx.User.id
 	}
-	log.Verbosef("%d notes of user '%d' ('%s'), logged in user: %d ('%s'), showPrivate: %v\n", len(notes), userID, i.user.Login, loggedUserID, loggedUserHandle, showPrivate)
-
-	// optimization: if our latest version is the same as the
-	// version on the client, we don't return notes
-	if latestVersion == i.latestVersion {
-		notes = nil
-	}
+	log.Verbosef("%d notes (%d deleted) of user '%d' ('%s') since version %d, logged in user: %d ('%s'), showPrivate: %v\n", len(notes), len(deletedNotes), userID, i.user.Login, latestVersion, loggedUserID, loggedUserHandle, showPrivate)
 
-	v := struct {
-		LoggedUser    *UserSummary
-		Notes         [][]interface{}
-		LatestVersion int
-	}{
+	v := &GetNotesRsp{
 		LoggedUser:    ctx.User,
 		Notes:         notes,
+		DeletedNotes:  deletedNotes,
+		TagTree:       buildTagTree(visibleNotes),
 		LatestVersion: i.latestVersion,
 	}
+	if incremental {
+		v.SinceVersion = latestVersion
+	}
 	return v, nil
 }
 
+// returns the latest version of notes of the logged in user
+func getLatestVersionForUser(ctx *ReqContext) int {
+	if ctx.User == nil {
+		return 0
+	}
+	i, err := getCachedUserInfo(ctx.Context(), ctx.User.id)
+	if err != nil || i == nil {
+		return 0
+	}
+	return i.latestVersion
+}
+
 func wsGetNotes(ctx *ReqContext, args map[string]interface{}) (interface{}, error) {
 	userIDHash, err := jsonMapGetString(args, "userIDHash")
 	if err != nil {
@@ -246,7 +352,7 @@ func userCanAccessNote(loggedUser *UserSummary, note *Note) bool {
 }
 
 func getNoteByID(ctx *ReqContext, noteID int) (*Note, error) {
-	note, err := dbGetNoteByID(noteID)
+	note, err := repo.GetNoteByID(ctx.Context(), noteID)
 	if err != nil {
 		return nil, err
 	}
@@ -282,10 +388,179 @@ func wsGetNote(ctx *ReqContext, args map[string]interface{}) ([]interface{}, err
 	if !userCanAccessNote(ctx.User, note) {
 		return nil, fmt.Errorf("access of user '%s' denied for note '%s'", ctx.User.HashID, noteHashIDStr)
 	}
-	return noteToCompact(note, true)
+	res, err := noteToCompact(note, true)
+	if err != nil {
+		return nil, err
+	}
+	backlinks, err := getBacklinksForUser(ctx, note)
+	if err != nil {
+		return nil, err
+	}
+	return append(res, backlinks), nil
+}
+
+// NoteVersionsRsp is a result of getNoteVersions. Versions are in the same
+// compact format as notes, newest first, without snippets. Version id is
+// part of noteIDVerIdx
+type NoteVersionsRsp struct {
+	NoteHashID string
+	Versions   [][]interface{}
+}
+
+// getNoteForHistory returns a note whose history the user can see. Earlier
+// versions of a public note might have been private so access to each
+// version must be checked with userCanAccessNote as well
+func getNoteForHistory(ctx *ReqContext, noteHashIDStr string) (*Note, error) {
+	note, err := getNoteByIDHash(ctx, noteHashIDStr)
+	if err != nil || note == nil {
+		return nil, fmt.Errorf("no note with noteHashID '%s'", noteHashIDStr)
+	}
+	return note, nil
+}
+
+func wsGetNoteVersions(ctx *ReqContext, args map[string]interface{}) (interface{}, error) {
+	noteHashIDStr, err := jsonMapGetString(args, "noteHashID")
+	if err != nil {
+		return nil, fmt.Errorf("'noteHashID' argument missing in '%v'", args)
+	}
+	note, err := getNoteForHistory(ctx, noteHashIDStr)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := repo.GetNoteVersions(ctx.Context(), note.id)
+	if err != nil {
+		return nil, err
+	}
+	res := &NoteVersionsRsp{
+		NoteHashID: note.HashID,
+	}
+	for _, v := range versions {
+		if !userCanAccessNote(ctx.User, v) {
+			continue
+		}
+		compactNote, _ := noteToCompact(v, false)
+		res.Versions = append(res.Versions, compactNote)
+	}
+	return res, nil
+}
+
+func wsGetNoteVersion(ctx *ReqContext, args map[string]interface{}) ([]interface{}, error) {
+	noteHashIDStr, err := jsonMapGetString(args, "noteHashID")
+	if err != nil {
+		return nil, fmt.Errorf("'noteHashID' argument missing in '%v'", args)
+	}
+	versionID, err := jsonMapGetInt(args, "versionID")
+	if err != nil {
+		return nil, err
+	}
+	note, err := getNoteForHistory(ctx, noteHashIDStr)
+	if err != nil {
+		return nil, err
+	}
+	version, err := repo.GetNoteVersion(ctx.Context(), note.id, versionID)
+	if err != nil {
+		return nil, err
+	}
+	if !userCanAccessNote(ctx.User, version) {
+		return nil, fmt.Errorf("no access to version %d of note '%s'", versionID, noteHashIDStr)
+	}
+	return noteToCompact(version, true)
+}
+
+// NoteDiffRsp is a result of getNoteDiff
+type NoteDiffRsp struct {
+	NoteHashID    string
+	FromVersionID int
+	ToVersionID   int
+	Hunks         []*DiffHunk
 }
 
-func execNoteOp(ctx *ReqContext, args map[string]interface{}, noteOp func(int, int) error) ([]interface{}, error) {
+// returns content of a given version of a note, the current version if
+// versionID is 0
+func getNoteVersionContent(ctx *ReqContext, note *Note, versionID int) (int, string, error) {
+	version := note
+	if versionID != 0 && versionID != note.CurrVersionID {
+		var err error
+		version, err = repo.GetNoteVersion(ctx.Context(), note.id, versionID)
+		if err != nil {
+			return 0, "", err
+		}
+		if !userCanAccessNote(ctx.User, version) {
+			return 0, "", fmt.Errorf("no access to version %d of note '%s'", versionID, note.HashID)
+		}
+	}
+	if version.IsEncrypted {
+		return 0, "", fmt.Errorf("version %d of note '%s' is encrypted", version.CurrVersionID, note.HashID)
+	}
+	content, err := getCachedContent(version.ContentSha1)
+	if err != nil {
+		return 0, "", err
+	}
+	return version.CurrVersionID, string(content), nil
+}
+
+// args: noteHashID, fromVersionID, toVersionID (optional, current version
+// if not given), words (optional, for word-level refinement of changed lines)
+func wsGetNoteDiff(ctx *ReqContext, args map[string]interface{}) (interface{}, error) {
+	noteHashIDStr, err := jsonMapGetString(args, "noteHashID")
+	if err != nil {
+		return nil, fmt.Errorf("'noteHashID' argument missing in '%v'", args)
+	}
+	fromVersionID, err := jsonMapGetInt(args, "fromVersionID")
+	if err != nil {
+		return nil, err
+	}
+	toVersionID := 0
+	if _, ok := args["toVersionID"]; ok {
+		toVersionID, err = jsonMapGetInt(args, "toVersionID")
+		if err != nil {
+			return nil, err
+		}
+	}
+	refineWords, _ := args["words"].(bool)
+
+	note, err := getNoteForHistory(ctx, noteHashIDStr)
+	if err != nil {
+		return nil, err
+	}
+	fromVersionID, from, err := getNoteVersionContent(ctx, note, fromVersionID)
+	if err != nil {
+		return nil, err
+	}
+	toVersionID, to, err := getNoteVersionContent(ctx, note, toVersionID)
+	if err != nil {
+		return nil, err
+	}
+	res := &NoteDiffRsp{
+		NoteHashID:    note.HashID,
+		FromVersionID: fromVersionID,
+		ToVersionID:   toVersionID,
+		Hunks:         diffText(from, to, refineWords),
+	}
+	return res, nil
+}
+
+func wsRestoreNoteVersion(ctx *ReqContext, args map[string]interface{}) ([]interface{}, error) {
+	noteHashID, err := jsonMapGetString(args, "noteHashID")
+	if err != nil {
+		return nil, err
+	}
+	versionID, err := jsonMapGetInt(args, "versionID")
+	if err != nil {
+		return nil, err
+	}
+	noteID, err := getUserNoteByHashID(ctx, noteHashID)
+	if err != nil {
+		return nil, err
+	}
+	err = repo.RestoreNoteVersion(ctx.Context(), ctx.User.id, noteID, versionID)
+	if err != nil {
+		return nil, err
+	}
+	return getNoteCompact(ctx, noteID)
+}
+
+func execNoteOp(ctx *ReqContext, args map[string]interface{}, noteOp func(context.Context, int, int) error) ([]interface{}, error) {
 	var err error
 	noteHashID, err := jsonMapGetString(args, "noteHashID")
 	if err != nil {
@@ -295,7 +570,7 @@ func execNoteOp(ctx *ReqContext, args map[string]interface{}, noteOp func(int, i
 	if err != nil {
 		return nil, err
 	}
-	err = noteOp(ctx.User.id, noteID)
+	err = noteOp(ctx.Context(), ctx.User.id, noteID)
 	if err != nil {
 		return nil, err
 	}
@@ -311,7 +586,7 @@ func wsPermanentDeleteNote(ctx *ReqContext, args map[string]interface{}) (interf
 	if err != nil {
 		return nil, err
 	}
-	err = dbPermanentDeleteNote(ctx.User.id, noteID)
+	err = repo.PermanentDeleteNote(ctx.Context(), ctx.User.id, noteID)
 	if err != nil {
 		return nil, err
 	}
@@ -334,13 +609,36 @@ func newNoteFromBrowserNote(note *NewNoteFromBrowser) (*NewNote, error) {
 	newNote.format = note.Format
 	newNote.tags = note.Tags
 	newNote.isPublic = note.IsPublic
+	newNote.isEncrypted = note.IsEncrypted
+	newNote.baseVersionID = note.BaseVersionID
+	newNote.rewriteLinks = note.RewriteLinks
+	if newNote.isEncrypted && newNote.isPublic {
+		return nil, errEncryptedNotePublic
+	}
 
-	if newNote.title == "" && newNote.format == formatText {
+	// we can't look inside encrypted content
+	if newNote.title == "" && newNote.format == formatText && !newNote.isEncrypted {
 		newNote.title, newNote.content = noteToTitleContent(newNote.content)
 	}
 	return &newNote, nil
 }
 
+// CreateOrUpdateNoteRsp is a result of createOrUpdateNote. If the edit was
+// merged with changes made since its BaseVersionID, Merged is true and the
+// rest describes the saved note. LinksRewritten is the number of notes whose
+// links to a renamed note were changed because of RewriteLinks
+type CreateOrUpdateNoteRsp struct {
+	HashID         string
+	CurrVersionID  int
+	Merged         bool
+	LinksRewritten int      `json:",omitempty"`
+	Title          string   `json:",omitempty"`
+	Content        string   `json:",omitempty"`
+	Tags           []string `json:",omitempty"`
+	Format         string   `json:",omitempty"`
+	IsPublic       bool     `json:",omitempty"`
+}
+
 func wsCreateOrUpdateNote(ctx *ReqContext, args map[string]interface{}) (interface{}, error) {
 	noteJSONStr, err := jsonMapGetString(args, "noteJSON")
 	if err != nil {
@@ -358,18 +656,60 @@ func wsCreateOrUpdateNote(ctx *ReqContext, args map[string]interface{}) (interfa
 		return nil, err
 	}
 
-	noteID, err := dbCreateOrUpdateNote(ctx.User.id, note)
+	noteID, err := repo.CreateOrUpdateNote(ctx.Context(), ctx.User.id, note)
+	if _, ok := err.(*NoteConflictError); ok {
+		return nil, err
+	}
 	if err != nil {
-		return nil, fmt.Errorf("dbCreateNewNote() failed with %s", err)
+		return nil, fmt.Errorf("repo.CreateOrUpdateNote() failed with %s", err)
+	}
+	res := &CreateOrUpdateNoteRsp{
+		HashID:         hashInt(noteID),
+		CurrVersionID:  note.currVersionID,
+		Merged:         note.merged,
+		LinksRewritten: note.linksRewritten,
+	}
+	if note.merged {
+		res.Title = note.title
+		res.Content = string(note.content)
+		res.Tags = note.tags
+		res.Format = note.format
+		res.IsPublic = note.isPublic
+	}
+	return res, nil
+}
+
+func wsGetEncryptedSample(ctx *ReqContext) (interface{}, error) {
+	if ctx.User == nil {
+		return nil, errors.New("user not logged in")
+	}
+	sample, err := repo.GetUserEncryptedSample(ctx.Context(), ctx.User.id)
+	if err != nil {
+		return nil, err
 	}
 	v := struct {
-		HashID string
+		EncryptedSample string
 	}{
-		HashID: hashInt(noteID),
+		EncryptedSample: string(sample),
 	}
 	return &v, nil
 }
 
+func wsSetEncryptedSample(ctx *ReqContext, args map[string]interface{}) (interface{}, error) {
+	if ctx.User == nil {
+		return nil, errors.New("user not logged in")
+	}
+	sample, err := jsonMapGetString(args, "encryptedSample")
+	if err != nil {
+		return nil, err
+	}
+	err = repo.SetUserEncryptedSample(ctx.Context(), ctx.User.id, []byte(sample))
+	if err != nil {
+		return nil, err
+	}
+	return wsGetEncryptedSample(ctx)
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  8 * 1024,
 	WriteBufferSize: 8 * 1024,
@@ -388,10 +728,15 @@ func handleWs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	c := make(chan *wsResponse)
+	// the request's context is done once the connection is hijacked so
+	// requests on the connection use their own, cancelled when it's closed
+	connCtx, cancelConnCtx := context.WithCancel(serverCtx)
+
+	c := make(chan *wsResponse, wsSendQueueSize)
 	if user != nil {
 		wsRememberConnection(user.id, c)
 	}
+	collab := newCollabClient(user, c)
 
 	var writeError error
 	var muWriteError sync.Mutex
@@ -420,7 +765,8 @@ func handleWs(w http.ResponseWriter, r *http.Request) {
 
 	for {
 		ctx := ReqContext{
-			User: user,
+			User:    user,
+			context: connCtx,
 		}
 		// we rely on the client send us periodic pings so we don't
 		// want to wait forever for the next message
@@ -454,49 +800,74 @@ func handleWs(w http.ResponseWriter, r *http.Request) {
 		args := req.Args
 
 		broadcastGetNotes := false
+		responseSent := false
+		// we only broadcast notes changed by this request
+		var prevLatestVersion int
+		if req.Cmd != cmdPing {
+			prevLatestVersion = getLatestVersionForUser(&ctx)
+		}
 
 		switch req.Cmd {
 		case cmdPing:
 			res = "pong"
 
 		case "getUserInfo":
-			res, err = wsGetUserInfo(args)
+			res, err = wsGetUserInfo(&ctx, args)
 
 		case "getNotes":
 			res, err = wsGetNotes(&ctx, args)
 
 		case "getRecentNotes":
-			res, err = wsGetRecentNotes(25)
+			res, err = wsGetRecentNotes(&ctx, 25)
 
 		case "getNote":
 			res, err = wsGetNote(&ctx, args)
 
+		case "getAttachments":
+			res, err = wsGetAttachments(&ctx, args)
+
+		case "getBacklinks":
+			res, err = wsGetBacklinks(&ctx, args)
+
+		case "getNoteVersions":
+			res, err = wsGetNoteVersions(&ctx, args)
+
+		case "getNoteVersion":
+			res, err = wsGetNoteVersion(&ctx, args)
+
+		case "getNoteDiff":
+			res, err = wsGetNoteDiff(&ctx, args)
+
+		case "restoreNoteVersion":
+			res, err = wsRestoreNoteVersion(&ctx, args)
+			broadcastGetNotes = true
+
 		case "permanentDeleteNote":
 			res, err = wsPermanentDeleteNote(&ctx, args)
 			broadcastGetNotes = true
 
 		case "undeleteNote":
-			res, err = execNoteOp(&ctx, args, dbUndeleteNote)
+			res, err = execNoteOp(&ctx, args, repo.UndeleteNote)
 			broadcastGetNotes = true
 
 		case "deleteNote":
-			res, err = execNoteOp(&ctx, args, dbDeleteNote)
+			res, err = execNoteOp(&ctx, args, repo.DeleteNote)
 			broadcastGetNotes = true
 
 		case "makeNotePrivate":
-			res, err = execNoteOp(&ctx, args, dbMakeNotePrivate)
+			res, err = execNoteOp(&ctx, args, repo.MakeNotePrivate)
 			broadcastGetNotes = true
 
 		case "makeNotePublic":
-			res, err = execNoteOp(&ctx, args, dbMakeNotePublic)
+			res, err = execNoteOp(&ctx, args, repo.MakeNotePublic)
 			broadcastGetNotes = true
 
 		case "starNote":
-			res, err = execNoteOp(&ctx, args, dbStarNote)
+			res, err = execNoteOp(&ctx, args, repo.StarNote)
 			broadcastGetNotes = true
 
 		case "unstarNote":
-			res, err = execNoteOp(&ctx, args, dbUnstarNote)
+			res, err = execNoteOp(&ctx, args, repo.UnstarNote)
 			broadcastGetNotes = true
 
 		case "createOrUpdateNote":
@@ -506,6 +877,23 @@ func handleWs(w http.ResponseWriter, r *http.Request) {
 		case "searchUserNotes":
 			res, err = wsSearchUserNotes(&ctx, args)
 
+		case "getEncryptedSample":
+			res, err = wsGetEncryptedSample(&ctx)
+
+		case "setEncryptedSample":
+			res, err = wsSetEncryptedSample(&ctx, args)
+
+		case "renameTag", "mergeTags", "deleteTag":
+			var tagsRsp *UpdateTagsRsp
+			tagsRsp, err = wsUpdateTags(&ctx, req.Cmd, args)
+			res = tagsRsp
+			broadcastGetNotes = err == nil && !tagsRsp.DryRun && tagsRsp.NotesCount > 0
+
+		case "collabJoin", "collabOp", "collabSelect", "collabResolve", "collabLeave":
+			err = wsCollab(&ctx, collab, &req)
+			// response has already been sent
+			responseSent = err == nil
+
 		default:
 			log.Errorf("unknown type '%s' in request '%s'\n", req.Cmd, string(reqBytes))
 			continue
@@ -517,30 +905,24 @@ func handleWs(w http.ResponseWriter, r *http.Request) {
 			Result: res,
 		}
 
-		if err != nil {
+		if conflict, ok := err.(*NoteConflictError); ok {
+			rsp.Err = err.Error()
+			rsp.Result = nil
+			rsp.Conflict = newNoteConflictRsp(conflict)
+			log.Infof("request '%s' failed with '%s'\n", req.Cmd, err)
+		} else if err != nil {
 			rsp.Err = err.Error()
 			rsp.Result = nil
 			log.Errorf("handling request '%s' failed with '%s'\n", string(reqBytes), err)
 		}
 
-		c <- &rsp
+		if !responseSent {
+			c <- &rsp
+		}
 
 		if broadcastGetNotes {
 			log.Infof("broadcastGetNotes because handled '%s'\n", req.Cmd)
-			res, err = getNotesForUser(&ctx, ctx.User.id, 0)
-			rsp := wsResponse{
-				ID:     -1,
-				Cmd:    "broadcastUserNotes",
-				Result: res,
-			}
-
-			if err != nil {
-				rsp.Err = err.Error()
-				rsp.Result = nil
-				log.Errorf("handling request '%s' failed with '%s'\n", string(reqBytes), err)
-			}
-
-			wsBroadcastToUser(ctx.User.id, &rsp)
+			broadcastUserNotes(&ctx, prevLatestVersion)
 		}
 		err = getWriteError()
 		if err != nil {
@@ -549,6 +931,8 @@ func handleWs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Infof("closed connection for user %d\n", userID)
+	cancelConnCtx()
 	conn.Close()
+	collab.leaveAll()
 	wsRemoveConnection(userID, c)
 }
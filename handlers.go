@@ -2,8 +2,10 @@ package main
 
 import (
 	"archive/zip"
+	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"path/filepath"
 	"strconv"
@@ -15,6 +17,10 @@ import (
 )
 
 var (
+	// parent of contexts of all requests, cancelled when the server
+	// shuts down
+	serverCtx, cancelServerCtx = context.WithCancel(context.Background())
+
 	bundleJSPath       = "s/dist/bundle.js"
 	bundleJSPathIsSha1 = false
 	mainCSSPath        = "s/dist/main.css"
@@ -72,6 +78,18 @@ func (t *Timing) Finished() time.Duration {
 type ReqContext struct {
 	User    *UserSummary // nil if not logged in
 	Timings []*Timing
+
+	// cancelled when the client goes away or the server shuts down
+	context context.Context
+}
+
+// Context returns context for database queries done on behalf of
+// the request
+func (ctx *ReqContext) Context() context.Context {
+	if ctx.context == nil {
+		return context.Background()
+	}
+	return ctx.context
 }
 
 // NewTimingf starts to time a new event
@@ -85,7 +103,7 @@ func (ctx *ReqContext) NewTimingf(format string, args ...interface{}) *Timing {
 func withCtx(f HandlerWithCtxFunc, opts ReqOpts) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		uri := r.URL.Path
-		ctx := &ReqContext{}
+		ctx := &ReqContext{context: r.Context()}
 		timing := ctx.NewTimingf("uri: %s", uri)
 		rrw := NewRecordingResponseWriter(w)
 		defer func() {
@@ -134,6 +152,36 @@ func withCtx(f HandlerWithCtxFunc, opts ReqOpts) http.HandlerFunc {
 	}
 }
 
+// implemented by http.ResponseWriter of the server since Go 1.20
+type deadlineSetter interface {
+	SetReadDeadline(time.Time) error
+	SetWriteDeadline(time.Time) error
+}
+
+// extendDeadlines lets a handler read the request and write the response
+// for longer than server's ReadTimeout and WriteTimeout. It does nothing
+// if w doesn't support deadlines e.g. if built with older Go
+func extendDeadlines(w http.ResponseWriter, timeout time.Duration) {
+	for {
+		if ds, ok := w.(deadlineSetter); ok {
+			deadline := time.Now().Add(timeout)
+			err := ds.SetReadDeadline(deadline)
+			if err == nil {
+				err = ds.SetWriteDeadline(deadline)
+			}
+			if err != nil {
+				log.Errorf("extending deadlines failed with %s\n", err)
+			}
+			return
+		}
+		uw, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = uw.Unwrap()
+	}
+}
+
 var (
 	// loaded only once at startup. maps a file path of the resource
 	// to its data
@@ -364,7 +412,7 @@ func handleIndex(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
 			http.NotFound(w, r)
 			return
 		}
-		i, err := getCachedUserInfo(userID)
+		i, err := getCachedUserInfo(ctx.Context(), userID)
 		if err != nil || i == nil {
 			log.Errorf("no user '%d', url: '%s', err: %s\n", userID, r.URL, err)
 			http.NotFound(w, r)
@@ -395,9 +443,9 @@ func handleIndex(ctx *ReqContext, w http.ResponseWriter, r *http.Request) {
 			httpErrorf(w, "noteToCompact() failed with %s", err)
 			return
 		}
-		dbNoteUser, err := dbGetUserByID(note.userID)
+		dbNoteUser, err := repo.GetUserByID(ctx.Context(), note.userID)
 		if err != nil {
-			httpErrorf(w, "dbGetUserByID(%d) failed with %s", note.userID, err)
+			httpErrorf(w, "repo.GetUserByID(%d) failed with %s", note.userID, err)
 			return
 		}
 		noteUser := userSummaryFromDbUser(dbNoteUser)
@@ -428,6 +476,8 @@ const (
 	noteSnippetIdx   = 8
 	noteFieldsCount  = 9
 	noteContentIdx   = 9
+	// only in getNote
+	noteBacklinksIdx = 10
 )
 
 // must match Note.js
@@ -437,6 +487,7 @@ const (
 	flagPublicBit    = 2
 	flagPartialBit   = 3
 	flagTruncatedBit = 4
+	flagEncryptedBit = 5
 )
 
 func boolToInt(b bool) int {
@@ -453,6 +504,7 @@ func encodeNoteFlags(n *Note) int {
 	res += (1 << flagPublicBit) * boolToInt(n.IsPublic)
 	res += (1 << flagPartialBit) * boolToInt(n.IsPartial)
 	res += (1 << flagTruncatedBit) * boolToInt(n.IsTruncated)
+	res += (1 << flagEncryptedBit) * boolToInt(n.IsEncrypted)
 	return res
 }
 
@@ -515,7 +567,7 @@ func handleRawNote(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	note, err := dbGetNoteByID(noteID)
+	note, err := repo.GetNoteByID(r.Context(), noteID)
 	if err != nil {
 		http.NotFound(w, r)
 		return
@@ -595,6 +647,10 @@ func handleDebug(w http.ResponseWriter, r *http.Request) {
 
 	a = append(a, "")
 	a = append(a, fmt.Sprintf("ver: https://github.com/kjk/quicknotes/commit/%s", sha1ver))
+	a = append(a, fmt.Sprintf("content cache: %s", contentCache.Stats()))
+	if status, err := uploadQueue.Status(); err == nil {
+		a = append(a, fmt.Sprintf("upload queue: %d pending, %d failed, %d uploaded", status.Count(), len(status.Failed), status.Uploaded))
+	}
 
 	s = strings.Join(a, "\n")
 	servePlainText(w, 200, s)
@@ -627,6 +683,7 @@ func makeHTTPServer() *http.Server {
 	mux.HandleFunc("/app/debug", handleDebug)
 	mux.HandleFunc("/s/", handleStatic)
 	mux.HandleFunc("/raw/n/", handleRawNote)
+	mux.HandleFunc("/a/", withCtx(handleAttachment, OnlyGet))
 	mux.HandleFunc("/idx/allnotes", withCtx(handleIndexAllNotes, OnlyGet))
 	mux.HandleFunc("/logintwitter", handleLoginTwitter)
 	mux.HandleFunc("/logintwittercb", handleOauthTwitterCallback)
@@ -639,12 +696,16 @@ func makeHTTPServer() *http.Server {
 	mux.HandleFunc("/api/ws", handleWs)
 	mux.HandleFunc("/api/import_simplenote_start", withCtx(handleAPIImportSimpleNoteStart, OnlyLoggedIn|IsJSON))
 	mux.HandleFunc("/api/import_simplenote_status", withCtx(handleAPIImportSimpleNotesStatus, OnlyLoggedIn|IsJSON))
+	mux.HandleFunc("/api/upload_attachment", withCtx(handleAPIUploadAttachment, OnlyLoggedIn|OnlyPost|IsJSON))
 
 	srv := &http.Server{
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
 		IdleTimeout:  120 * time.Second, // introduced in Go 1.8
 		Handler:      mux,
+		BaseContext: func(net.Listener) context.Context {
+			return serverCtx
+		},
 	}
 	return srv
 }
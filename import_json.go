@@ -2,6 +2,7 @@ package main
 
 import (
 	"compress/bzip2"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -42,9 +43,9 @@ func importNotesFromJSON(path, userLogin string) {
 		log.Fatalf("missing path ('%s') or user handle ('%s')\n", path, userLogin)
 	}
 	isBlog := strings.Contains(path, "blog.json")
-	dbUser, err := dbGetUserByLogin(userLogin)
+	dbUser, err := repo.GetUserByLogin(context.Background(), userLogin)
 	if err != nil && err != sql.ErrNoRows {
-		log.Fatalf("dbGetUserByLogin() failed with '%s'\n", err)
+		log.Fatalf("repo.GetUserByLogin() failed with '%s'\n", err)
 	}
 	if dbUser == nil {
 		log.Fatalf("no user with handle '%s'\n", userLogin)
@@ -70,9 +71,9 @@ func importNotesFromJSON(path, userLogin string) {
 		if isBlog {
 			newNote.tags = append(newNote.tags, "blog")
 		}
-		_, err = dbCreateOrUpdateNote(dbUser.ID, &newNote)
+		_, err = repo.CreateOrUpdateNote(context.Background(), dbUser.ID, &newNote)
 		if err != nil {
-			log.Fatalf("dbCreateOrUpdateNote() failed with '%s'", err)
+			log.Fatalf("repo.CreateOrUpdateNote() failed with '%s'", err)
 		}
 		nImported++
 		fmt.Printf("imported note %d, %s\n", nImported, n.Title)
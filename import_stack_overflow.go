@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"path/filepath"
@@ -180,8 +181,8 @@ func loadHistory(siteName string) {
 			}
 			userIDToInfo[ph.UserID] = userInfo
 			login := "test:" + strconv.Itoa(ph.UserID)
-			user, err := dbGetOrCreateUser(login, userInfo.name)
-			u.PanicIfErr(err, "dbGetOrCreateUser()")
+			user, err := repo.GetOrCreateUser(context.Background(), login, userInfo.name)
+			u.PanicIfErr(err, "repo.GetOrCreateUser()")
 			userInfo.dbUserID = user.ID
 		}
 		historyTypeCounts[ph.PostHistoryTypeID]++
@@ -341,15 +342,15 @@ func importPosts() (int, int) {
 		detectFormat(note)
 		nVersions++
 		note.isPublic = rand.Intn(1000) > 100 // make 90% of notes public
-		_, err := dbCreateOrUpdateNote(userID, note)
-		u.PanicIfErr(err, "dbCreateOrUpdateNote()")
+		_, err := repo.CreateOrUpdateNote(context.Background(), userID, note)
+		u.PanicIfErr(err, "repo.CreateOrUpdateNote()")
 
 		for currPost != nil {
 			updateNoteValue(currPost, note)
 			detectFormat(note)
 			if len(note.content) > 0 {
-				_, err := dbCreateOrUpdateNote(userID, note)
-				u.PanicIfErr(err, "dbCreateOrUpdateNote()")
+				_, err := repo.CreateOrUpdateNote(context.Background(), userID, note)
+				u.PanicIfErr(err, "repo.CreateOrUpdateNote()")
 				nVersions++
 			}
 			currPost = currPost.next
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+Notes can link to other notes with:
+- [[Note title]] or [[Note title|text]]
+- markdown links to note urls: [text](/n/{note_id_hash}-rest)
+- bare note urls: https://{host}/n/{note_id_hash}-rest
+
+Links are parsed from content of text and markdown notes when a note is
+saved and stored in note_links table. [[Note title]] is resolved to the most
+recently updated note of the user with that title (case-insensitive). Links
+to notes of other users and to note urls that don't exist are not stored.
+
+[[Note title]] links to notes that don't exist yet are stored in
+unresolved_note_links table and are moved to note_links when a note with
+that title is created or a note is renamed to it.
+
+-rebuild-links re-parses all notes, e.g. after upgrading.
+*/
+
+const (
+	// max length of anchor text, in characters
+	maxLinkAnchorLen = 255
+)
+
+var (
+	rxWikiLink = regexp.MustCompile(`\[\[([^\[\]|\n]+)(?:\|([^\[\]\n]*))?\]\]`)
+	// markdown link to a note url or a bare absolute note url
+	rxNoteURLLink = regexp.MustCompile(`\[([^\]\n]*)\]\((?:https?://[^\s/)]+)?/n/([0-9a-zA-Z]+)[^\s)]*\)|https?://[^\s/]+/n/([0-9a-zA-Z]+)[^\s)]*`)
+)
+
+// noteLinkRef is a link parsed from content, before it's resolved to a note.
+// Either title or noteID is set
+type noteLinkRef struct {
+	title  string
+	noteID int
+	anchor string
+}
+
+// NoteLink is a link to or from a note, as sent to the client
+type NoteLink struct {
+	NoteHashID string
+	Title      string
+	Anchor     string
+}
+
+func truncateAnchor(s string) string {
+	s = strings.TrimSpace(s)
+	r := []rune(s)
+	if len(r) > maxLinkAnchorLen {
+		s = string(r[:maxLinkAnchorLen])
+	}
+	return s
+}
+
+// parseNoteLinks returns links to other notes in content, without
+// duplicates
+func parseNoteLinks(content string) []noteLinkRef {
+	var res []noteLinkRef
+	seen := map[noteLinkRef]bool{}
+	add := func(ref noteLinkRef) {
+		ref.anchor = truncateAnchor(ref.anchor)
+		if !seen[ref] {
+			seen[ref] = true
+			res = append(res, ref)
+		}
+	}
+	for _, m := range rxWikiLink.FindAllStringSubmatch(content, -1) {
+		title := strings.TrimSpace(m[1])
+		if title == "" {
+			continue
+		}
+		anchor := m[2]
+		if strings.TrimSpace(anchor) == "" {
+			anchor = title
+		}
+		add(noteLinkRef{title: title, anchor: anchor})
+	}
+	for _, m := range rxNoteURLLink.FindAllStringSubmatch(content, -1) {
+		hashID, anchor := m[2], m[1]
+		if hashID == "" {
+			hashID, anchor = m[3], m[0]
+		}
+		noteID, err := dehashInt(hashID)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(anchor) == "" {
+			anchor = m[0]
+		}
+		add(noteLinkRef{noteID: noteID, anchor: anchor})
+	}
+	return res
+}
+
+// we can't look inside encrypted content and other formats don't have links
+func noteCanHaveLinks(format string, isEncrypted bool) bool {
+	return !isEncrypted && (format == formatText || format == formatMarkdown)
+}
+
+// rewriteWikiLinks changes [[oldTitle]] links in content to [[newTitle]].
+// Returns false if there were none
+func rewriteWikiLinks(content, oldTitle, newTitle string) (string, bool) {
+	changed := false
+	res := rxWikiLink.ReplaceAllStringFunc(content, func(s string) string {
+		m := rxWikiLink.FindStringSubmatch(s)
+		if !strings.EqualFold(strings.TrimSpace(m[1]), oldTitle) {
+			return s
+		}
+		changed = true
+		if strings.Contains(s, "|") {
+			return "[[" + newTitle + "|" + m[2] + "]]"
+		}
+		return "[[" + newTitle + "]]"
+	})
+	return res, changed
+}
+
+// saveNoteLinksTx replaces links from the note with links in its content
+// and resolves links to the note by its title that were unresolved
+func (r *Repository) saveNoteLinksTx(ctx context.Context, tx *sql.Tx, userID int, note *NewNote) error {
+	err := resolveLinksToNoteTx(ctx, tx, userID, note)
+	if err != nil {
+		return err
+	}
+	for _, q := range []string{
+		`DELETE FROM note_links WHERE source_note_id=?`,
+		`DELETE FROM unresolved_note_links WHERE source_note_id=?`,
+	} {
+		_, err = tx.ExecContext(ctx, q, note.id)
+		if err != nil {
+			log.Errorf("tx.Exec('%s') failed with %s\n", q, err)
+			return err
+		}
+	}
+	if !noteCanHaveLinks(note.format, note.isEncrypted) {
+		return nil
+	}
+	for _, ref := range parseNoteLinks(string(note.content)) {
+		targetID, err := resolveNoteLinkTx(ctx, tx, userID, ref)
+		if err != nil {
+			return err
+		}
+		if targetID == 0 && ref.title != "" {
+			vals := NewDbVals("unresolved_note_links", 4)
+			vals.Add("source_note_id", note.id)
+			vals.Add("user_id", userID)
+			vals.Add("title", ref.title)
+			vals.Add("anchor", ref.anchor)
+			_, err = vals.TxInsert(ctx, tx)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if targetID == 0 || targetID == note.id {
+			continue
+		}
+		vals := NewDbVals("note_links", 3)
+		vals.Add("source_note_id", note.id)
+		vals.Add("target_note_id", targetID)
+		vals.Add("anchor", ref.anchor)
+		_, err = vals.TxInsert(ctx, tx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveLinksToNoteTx moves [[title]] links from unresolved_note_links to
+// note_links when the note gets the title, by being created or renamed
+func resolveLinksToNoteTx(ctx context.Context, tx *sql.Tx, userID int, note *NewNote) error {
+	// same as in resolveNoteLinkTx
+	if note.title == "" || note.isEncrypted {
+		return nil
+	}
+	q := `
+SELECT source_note_id, anchor FROM unresolved_note_links
+WHERE user_id=? AND LOWER(title)=LOWER(?)`
+	rows, err := tx.QueryContext(ctx, q, userID, note.title)
+	if err != nil {
+		log.Errorf("tx.Query('%s') failed with %s\n", q, err)
+		return err
+	}
+	var links []noteLinkRef
+	for rows.Next() {
+		var ref noteLinkRef
+		err = rows.Scan(&ref.noteID, &ref.anchor)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		links = append(links, ref)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(links) == 0 {
+		return nil
+	}
+
+	for _, ref := range links {
+		// links of the note to itself are never stored
+		if ref.noteID == note.id {
+			continue
+		}
+		vals := NewDbVals("note_links", 3)
+		vals.Add("source_note_id", ref.noteID)
+		vals.Add("target_note_id", note.id)
+		vals.Add("anchor", ref.anchor)
+		_, err = vals.TxInsert(ctx, tx)
+		if err != nil {
+			return err
+		}
+	}
+	q = `
+DELETE FROM unresolved_note_links
+WHERE user_id=? AND LOWER(title)=LOWER(?)`
+	_, err = tx.ExecContext(ctx, q, userID, note.title)
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with %s\n", q, err)
+	}
+	return err
+}
+
+// returns ids of notes that link to the note
+func getLinkSourcesTx(ctx context.Context, tx *sql.Tx, noteID int) ([]int, error) {
+	q := `SELECT DISTINCT source_note_id FROM note_links WHERE target_note_id=?`
+	rows, err := tx.QueryContext(ctx, q, noteID)
+	if err != nil {
+		log.Errorf("tx.Query('%s') failed with %s\n", q, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var res []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+	}
+	return res, rows.Err()
+}
+
+// relinkNotesTx re-resolves links of the notes of the user e.g. after a note
+// they linked to was permanently deleted, so that [[title]] links to it
+// become unresolved or point to another note with that title
+func (r *Repository) relinkNotesTx(ctx context.Context, tx *sql.Tx, userID int, noteIDs []int) error {
+	for _, id := range noteIDs {
+		n, err := scanNote(tx.QueryRowContext(ctx, `SELECT `+noteColumns+` FROM notes WHERE id=?`, id))
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		note, err := newNoteFromNote(n)
+		if err != nil {
+			log.Errorf("newNoteFromNote() of note %d failed with %s\n", n.id, err)
+			continue
+		}
+		err = r.saveNoteLinksTx(ctx, tx, userID, note)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns id of the note of the user the link points to, 0 if it doesn't
+// exist
+func resolveNoteLinkTx(ctx context.Context, tx *sql.Tx, userID int, ref noteLinkRef) (int, error) {
+	var id int
+	var err error
+	if ref.title != "" {
+		q := `
+SELECT id FROM notes
+WHERE user_id=? AND LOWER(title)=LOWER(?) AND is_encrypted=false
+ORDER BY is_deleted, updated_at DESC
+LIMIT 1`
+		err = tx.QueryRowContext(ctx, q, userID, ref.title).Scan(&id)
+	} else {
+		q := `SELECT id FROM notes WHERE id=? AND user_id=?`
+		err = tx.QueryRowContext(ctx, q, ref.noteID, userID).Scan(&id)
+	}
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// links to a note from notes that are not deleted, as noteColumns of the
+// source note followed by anchor
+const qGetBacklinks = `
+SELECT ` + noteColumns + `, anchor
+FROM note_links
+JOIN notes ON notes.id = note_links.source_note_id
+WHERE note_links.target_note_id=? AND notes.is_deleted=false
+ORDER BY notes.updated_at DESC, notes.id DESC`
+
+// rowScanner for a row of noteColumns followed by anchor of a link
+type backlinkScanner struct {
+	rows   *sql.Rows
+	anchor *string
+}
+
+func (s backlinkScanner) Scan(dest ...interface{}) error {
+	return s.rows.Scan(append(dest, s.anchor)...)
+}
+
+// GetBacklinks returns links to the note from notes that are not deleted,
+// most recently updated first
+func (r *Repository) GetBacklinks(ctx context.Context, noteID int) ([]*Note, []string, error) {
+	rows, err := r.db.QueryContext(ctx, qGetBacklinks, noteID)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with %s\n", qGetBacklinks, err)
+		return nil, nil, err
+	}
+	return scanBacklinks(rows)
+}
+
+// returns source notes and anchors of links from rows of qGetBacklinks
+func scanBacklinks(rows *sql.Rows) ([]*Note, []string, error) {
+	defer rows.Close()
+	var notes []*Note
+	var anchors []string
+	for rows.Next() {
+		var anchor string
+		note, err := scanNote(backlinkScanner{rows: rows, anchor: &anchor})
+		if err != nil {
+			return nil, nil, err
+		}
+		note.SetCalculatedProperties()
+		notes = append(notes, note)
+		anchors = append(anchors, anchor)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	return notes, anchors, nil
+}
+
+// RebuildNoteLinks re-parses links of all notes. Returns number of links
+func (r *Repository) RebuildNoteLinks(ctx context.Context) (int, error) {
+	notes, err := r.GetAllNotes(ctx)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer rollbackUnlessCommitted(&tx)
+	for _, n := range notes {
+		note, err := newNoteFromNote(n)
+		if err != nil {
+			// -fsck reports missing content
+			log.Errorf("newNoteFromNote() of note %d failed with %s\n", n.id, err)
+			continue
+		}
+		err = r.saveNoteLinksTx(ctx, tx, n.userID, note)
+		if err != nil {
+			return 0, err
+		}
+	}
+	var nLinks int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM note_links`).Scan(&nLinks)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	tx = nil
+	return nLinks, err
+}
+
+// updateNoteRewritingLinks is updateNote of a renamed note that also changes
+// [[oldTitle]] links to it in other notes of the user, in one transaction
+func (r *Repository) updateNoteRewritingLinks(ctx context.Context, userID int, note *NewNote, oldTitle string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rollbackUnlessCommitted(&tx)
+	err = r.updateNoteTx(ctx, tx, userID, note, true)
+	if err != nil {
+		return err
+	}
+	n, err := r.rewriteLinksToNoteTx(ctx, tx, userID, note.id, oldTitle, note.title)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	tx = nil
+	if err != nil {
+		return err
+	}
+	note.linksRewritten = n
+	log.Verbosef("rewrote links to note %d in %d notes\n", note.id, n)
+	return nil
+}
+
+// rewriteLinksToNoteTx changes [[oldTitle]] links to the note in notes of
+// the user. Returns the number of changed notes
+func (r *Repository) rewriteLinksToNoteTx(ctx context.Context, tx *sql.Tx, userID, noteID int, oldTitle, newTitle string) (int, error) {
+	rows, err := tx.QueryContext(ctx, qGetBacklinks, noteID)
+	if err != nil {
+		log.Errorf("tx.Query('%s') failed with %s\n", qGetBacklinks, err)
+		return 0, err
+	}
+	sources, _, err := scanBacklinks(rows)
+	if err != nil {
+		return 0, err
+	}
+	nRewritten := 0
+	seen := map[int]bool{}
+	for _, source := range sources {
+		if seen[source.id] || source.userID != userID || !noteCanHaveLinks(source.Format, source.IsEncrypted) {
+			continue
+		}
+		seen[source.id] = true
+		note, err := newNoteFromNote(source)
+		if err != nil {
+			return 0, err
+		}
+		content, changed := rewriteWikiLinks(string(note.content), oldTitle, newTitle)
+		if !changed {
+			continue
+		}
+		note.content = []byte(content)
+		note.contentSha1, err = saveContent(note.content, source.ContentSha1)
+		if err != nil {
+			log.Errorf("saveContent() failed with %s\n", err)
+			return 0, err
+		}
+		err = r.updateNoteTx(ctx, tx, userID, note, true)
+		if err != nil {
+			return 0, err
+		}
+		nRewritten++
+	}
+	return nRewritten, nil
+}
+
+// BacklinksRsp is a result of getBacklinks
+type BacklinksRsp struct {
+	NoteHashID string
+	Backlinks  []NoteLink
+}
+
+// returns links to the note from notes the user can see
+func getBacklinksForUser(ctx *ReqContext, note *Note) ([]NoteLink, error) {
+	sources, anchors, err := repo.GetBacklinks(ctx.Context(), note.id)
+	if err != nil {
+		return nil, err
+	}
+	res := []NoteLink{}
+	for i, source := range sources {
+		if !userCanAccessNote(ctx.User, source) {
+			continue
+		}
+		res = append(res, NoteLink{
+			NoteHashID: source.HashID,
+			Title:      source.Title,
+			Anchor:     anchors[i],
+		})
+	}
+	return res, nil
+}
+
+func wsGetBacklinks(ctx *ReqContext, args map[string]interface{}) (interface{}, error) {
+	noteHashIDStr, err := jsonMapGetString(args, "noteHashID")
+	if err != nil {
+		return nil, fmt.Errorf("'noteHashID' argument missing in '%v'", args)
+	}
+	note, err := getNoteByIDHash(ctx, noteHashIDStr)
+	if err != nil || note == nil {
+		return nil, fmt.Errorf("no note with noteHashID '%s'", noteHashIDStr)
+	}
+	if !userCanAccessNote(ctx.User, note) {
+		return nil, fmt.Errorf("access denied for note '%s'", noteHashIDStr)
+	}
+	backlinks, err := getBacklinksForUser(ctx, note)
+	if err != nil {
+		return nil, err
+	}
+	return &BacklinksRsp{
+		NoteHashID: note.HashID,
+		Backlinks:  backlinks,
+	}, nil
+}
+
+func runRebuildLinks() error {
+	n, err := repo.RebuildNoteLinks(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d links between notes\n", n)
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/kjk/u"
+)
+
+func TestParseNoteLinks(t *testing.T) {
+	id1, id2 := hashInt(1), hashInt(2)
+	content := "see [[Shopping list]] and [[ todo | things to do ]]\n" +
+		"[[]] [[Shopping List]] [[Shopping list]]\n" +
+		"[first](/n/" + id1 + "-first-note) and https://quicknotes.io/n/" + id2 + "-second.\n" +
+		"[abs](https://quicknotes.io/n/" + id2 + ") /n/" + id1 + " [bad](/n/-)"
+	got := parseNoteLinks(content)
+	exp := []noteLinkRef{
+		{title: "Shopping list", anchor: "Shopping list"},
+		{title: "todo", anchor: "things to do"},
+		{title: "Shopping List", anchor: "Shopping List"},
+		{noteID: 1, anchor: "first"},
+		{noteID: 2, anchor: "https://quicknotes.io/n/" + id2 + "-second."},
+		{noteID: 2, anchor: "abs"},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got %#v, expected %#v", got, exp)
+	}
+}
+
+func TestRewriteWikiLinks(t *testing.T) {
+	tests := []struct {
+		content string
+		exp     string
+		changed bool
+	}{
+		{"[[Old]] and [[old|text]] but not [[Older]]", "[[New]] and [[New|text]] but not [[Older]]", true},
+		{"[[Other]] [Old](/n/x)", "[[Other]] [Old](/n/x)", false},
+	}
+	for _, test := range tests {
+		got, changed := rewriteWikiLinks(test.content, "Old", "New")
+		if got != test.exp || changed != test.changed {
+			t.Fatalf("rewriting '%s' gave '%s' (%v), expected '%s'", test.content, got, changed, test.exp)
+		}
+	}
+}
+
+func TestNoteLinks(t *testing.T) {
+	defer openTestDbMust()()
+
+	user, err := repo.GetOrCreateUser(context.Background(), "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	ctx := &ReqContext{User: userSummaryFromDbUser(user)}
+	create := func(title, content string) int {
+		noteID, err := repo.CreateOrUpdateNote(ctx.Context(), user.ID, &NewNote{
+			title:   title,
+			format:  formatMarkdown,
+			content: []byte(content),
+		})
+		u.PanicIfErr(err)
+		return noteID
+	}
+	getBacklinks := func(noteID int) []NoteLink {
+		note, err := repo.GetNoteByID(ctx.Context(), noteID)
+		u.PanicIfErr(err)
+		links, err := getBacklinksForUser(ctx, note)
+		u.PanicIfErr(err)
+		return links
+	}
+
+	target := create("Target", "target")
+	source1 := create("Source 1", "links to [[target]] and [[Missing]]")
+	// the second link is to source2 itself
+	source2 := create("Source 2", "[text](/n/"+hashInt(target)+"-target) [self](/n/"+hashInt(target+2)+")")
+	exp := []NoteLink{
+		{hashInt(source2), "Source 2", "text"},
+		{hashInt(source1), "Source 1", "target"},
+	}
+	if got := getBacklinks(target); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got %#v, expected %#v", got, exp)
+	}
+	compact, err := wsGetNote(ctx, map[string]interface{}{"noteHashID": hashInt(target)})
+	u.PanicIfErr(err)
+	if !reflect.DeepEqual(compact[noteBacklinksIdx], exp) {
+		t.Fatalf("unexpected backlinks in getNote %#v", compact[noteBacklinksIdx])
+	}
+
+	// renaming with rewriteLinks updates [[target]] in source1
+	renamed := &NewNote{
+		hashID:       hashInt(target),
+		title:        "Renamed",
+		format:       formatMarkdown,
+		content:      []byte("target"),
+		rewriteLinks: true,
+	}
+	_, err = repo.CreateOrUpdateNote(ctx.Context(), user.ID, renamed)
+	u.PanicIfErr(err)
+	n, err := repo.GetNoteByID(ctx.Context(), source1)
+	u.PanicIfErr(err)
+	if renamed.linksRewritten != 1 || n.Content() != "links to [[Renamed]] and [[Missing]]" {
+		t.Fatalf("unexpected content '%s'", n.Content())
+	}
+	if len(getBacklinks(target)) != 2 {
+		t.Fatalf("links should point to the renamed note")
+	}
+
+	// [[Missing]] is resolved when a note gets that title
+	missing := create("Draft", "draft")
+	_, err = repo.CreateOrUpdateNote(ctx.Context(), user.ID, &NewNote{
+		hashID:  hashInt(missing),
+		title:   "missing",
+		format:  formatMarkdown,
+		content: []byte("draft"),
+	})
+	u.PanicIfErr(err)
+	exp = []NoteLink{{hashInt(source1), "Source 1", "Missing"}}
+	if got := getBacklinks(missing); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got %#v, expected %#v", got, exp)
+	}
+	// and becomes unresolved again when the note is permanently deleted
+	u.PanicIfErr(repo.PermanentDeleteNote(ctx.Context(), user.ID, missing))
+	missing = create("Missing", "again")
+	if got := getBacklinks(missing); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("got %#v, expected %#v", got, exp)
+	}
+	u.PanicIfErr(repo.PermanentDeleteNote(ctx.Context(), user.ID, missing))
+
+	// links to notes of other users are not stored
+	other, err := repo.GetOrCreateUser(ctx.Context(), "twitter:other", "Other User")
+	u.PanicIfErr(err)
+	_, err = repo.CreateOrUpdateNote(ctx.Context(), other.ID, &NewNote{
+		title:    "Other",
+		format:   formatMarkdown,
+		content:  []byte("[theirs](/n/" + hashInt(target) + ")"),
+		isPublic: true,
+	})
+	u.PanicIfErr(err)
+	if len(getBacklinks(target)) != 2 {
+		t.Fatalf("link from a note of another user shouldn't be stored")
+	}
+
+	// links from deleted notes are not shown
+	u.PanicIfErr(repo.DeleteNote(ctx.Context(), user.ID, source2))
+	if got := getBacklinks(target); len(got) != 1 || got[0].NoteHashID != hashInt(source1) {
+		t.Fatalf("unexpected backlinks %#v", got)
+	}
+
+	nLinks, err := repo.RebuildNoteLinks(ctx.Context())
+	u.PanicIfErr(err)
+	if nLinks != 2 {
+		t.Fatalf("expected 2 links, got %d", nLinks)
+	}
+	u.PanicIfErr(repo.PermanentDeleteNote(ctx.Context(), user.ID, target))
+	nLinks, err = repo.RebuildNoteLinks(ctx.Context())
+	u.PanicIfErr(err)
+	if nLinks != 0 {
+		t.Fatalf("expected no links, got %d", nLinks)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -14,6 +17,8 @@ import (
 	"github.com/kjk/quicknotes/pkg/log"
 	"github.com/kjk/u"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 /*
@@ -29,15 +34,33 @@ High-level overview:
 - goleveldb database stores association of sha1 to a file path where the content
   is stored. For large files it's file path. For small files it's path to the
   segment file plus size and offset in segment file, in the form {path}:{offset}:{size}
+- content can be compressed. Compressed (encoded) content starts with a byte
+  describing the encoding (blobEncodingRaw or blobEncodingDeflate). Encoded
+  content is marked in the index: separate files have .enc extension and
+  segment entries have :e suffix. Old entries are not encoded and are read as is
+- content can be stored as a delta (see delta.go) against other content, the
+  base. Such entries are in segment files and have :e:{base sha1 in hex}
+  suffix. Every DeltaKeyframeInterval-th content in a chain of deltas is
+  stored in full to limit the cost of reading
 */
 
 const (
 	defaultMaxSegmentSize           = 1024 * 1024 * 1024 * 1 // 1 GB
 	defaultFileSizeSegmentThreshold = 1024 * 1024 * 1        // 1 MB, bigger than this will be saved to a separate file
+	defaultDeltaKeyframeInterval    = 16
+
+	// first byte of encoded content
+	blobEncodingRaw     = 0
+	blobEncodingDeflate = 1
+
+	// extension of separate files with encoded content
+	encodedFileExt = ".enc"
 )
 
 var (
 	dbKeyPrefixSha1 = []byte("sha1:")
+	// content marked for deletion by MarkForDeletion
+	dbKeyPrefixDelete = []byte("delete:")
 	// ErrInvalidSegmentFilePath describes an error about invalid segment file
 	ErrInvalidSegmentFilePath = errors.New("invalid segment file path")
 )
@@ -55,6 +78,39 @@ type LocalStore struct {
 	// can be changed right after NewLocalStore
 	MaxSegmentSize           int
 	FileSizeSegmentThreshold int
+	// if false, new content is saved without encoding, like in old versions
+	Compress bool
+	// max length of a chain of deltas
+	DeltaKeyframeInterval int
+}
+
+// indexEntry describes where the content is stored. It's a parsed value
+// of sha1: key in the index
+type indexEntry struct {
+	// for content in segment files
+	segment string
+	offset  int
+	size    int
+	// for content in separate files, relative to filesDir
+	path string
+	// if true, content starts with blobEncoding* byte
+	encoded bool
+	// if not nil, decoded content is a delta against content with this sha1
+	deltaBase []byte
+}
+
+func (e *indexEntry) String() string {
+	if e.segment == "" {
+		return e.path
+	}
+	s := fmt.Sprintf("%s:%d:%d", e.segment, e.offset, e.size)
+	if e.encoded {
+		s += ":e"
+	}
+	if e.deltaBase != nil {
+		s += fmt.Sprintf(":%x", e.deltaBase)
+	}
+	return s
 }
 
 func closeFilePtr(filePtr **os.File) (err error) {
@@ -84,21 +140,79 @@ func NewLocalStore(dir string) (*LocalStore, error) {
 		filesDir:                 filesDir,
 		MaxSegmentSize:           defaultMaxSegmentSize,
 		FileSizeSegmentThreshold: defaultFileSizeSegmentThreshold,
+		Compress:                 true,
+		DeltaKeyframeInterval:    defaultDeltaKeyframeInterval,
 	}
 	return store, nil
 }
 
+// saves atomically, overwriting existing file (which might be corrupted)
 func saveToFile(path string, d []byte) error {
-	if u.PathExists(path) {
-		return nil
-	}
 	dir := filepath.Dir(path)
 	err := os.MkdirAll(dir, 0755)
 	if err != nil {
 		log.Errorf("os.MkdirAll('%s') failed with %s\n", dir, err)
 		return err
 	}
-	return ioutil.WriteFile(path, d, 0644)
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(d)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// encodeBlob compresses d and prefixes it with encoding byte. If compression
+// doesn't help, d is stored as is
+func encodeBlob(d []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(blobEncodingDeflate)
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	u.PanicIfErr(err)
+	_, err = w.Write(d)
+	u.PanicIfErr(err)
+	u.PanicIfErr(w.Close())
+	if buf.Len() < len(d)+1 {
+		return buf.Bytes()
+	}
+	res := make([]byte, 0, len(d)+1)
+	res = append(res, blobEncodingRaw)
+	return append(res, d...)
+}
+
+// decodeBlobLimited reads encoded content from r and returns up to limit
+// bytes of decoded content (-1 means no limit)
+func decodeBlobLimited(r io.Reader, limit int) ([]byte, error) {
+	var hdr [1]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	switch hdr[0] {
+	case blobEncodingRaw:
+		// no decoding necessary
+	case blobEncodingDeflate:
+		fr := flate.NewReader(r)
+		defer fr.Close()
+		r = fr
+	default:
+		return nil, fmt.Errorf("unknown blob encoding %d", hdr[0])
+	}
+	if limit != -1 {
+		r = io.LimitReader(r, int64(limit))
+	}
+	return ioutil.ReadAll(r)
 }
 
 func fileNameForSha1(sha1 []byte) string {
@@ -144,8 +258,8 @@ func getSegmentFileName(dir string, maxSegmentSize int) (string, error) {
 	return fmt.Sprintf("segment.%d.txt", maxSegmentFileNo+1), nil
 }
 
-// returns name used to read the content back
-func (store *LocalStore) saveToSegmentFile(d []byte) ([]byte, error) {
+// returns index entry used to read the content back
+func (store *LocalStore) saveToSegmentFile(d []byte) (*indexEntry, error) {
 	if store.currSegmentFile == nil {
 		segmentFileName, err := getSegmentFileName(store.filesDir, store.MaxSegmentSize)
 		if err != nil {
@@ -201,8 +315,12 @@ func (store *LocalStore) saveToSegmentFile(d []byte) ([]byte, error) {
 		}
 		log.Verbosef("closed segment file '%s' because reached size limit (%d > %d)\n", store.currSegmentFileName, store.currSegmentSize, store.MaxSegmentSize)
 	}
-	name := fmt.Sprintf("%s:%d:%d", store.currSegmentFileName, offset, size)
-	return []byte(name), nil
+	e := &indexEntry{
+		segment: store.currSegmentFileName,
+		offset:  offset,
+		size:    size,
+	}
+	return e, nil
 }
 
 func dbKey(keyPrefix, keySuffix []byte) []byte {
@@ -215,39 +333,142 @@ func dbKeyForContentSha1(sha1 []byte) []byte {
 	return dbKey(dbKeyPrefixSha1, sha1)
 }
 
-// PutContent returns sha1 of d
+// PutContent saves d (unless already stored) and returns its sha1
 func (store *LocalStore) PutContent(d []byte) ([]byte, error) {
-	var err error
-	var val []byte
 	sha1 := u.Sha1OfBytes(d)
-
 	key := dbKeyForContentSha1(sha1)
 
 	store.mu.Lock()
 	defer store.mu.Unlock()
 
+	err := store.unmarkForDeletionLocked(sha1)
+	if err != nil {
+		return nil, err
+	}
+	has, err := store.db.Has(key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if has {
+		return sha1, nil
+	}
+	_, err = store.putContentLocked(sha1, d)
+	if err != nil {
+		return nil, err
+	}
+	return sha1, nil
+}
+
+// saves d even if we already have it (useful for replacing a corrupted entry)
+// must be called with store.mu locked
+// returns index entry of saved content
+func (store *LocalStore) putContentLocked(sha1, d []byte) (*indexEntry, error) {
+	if !store.Compress {
+		return store.saveEntryLocked(sha1, d, false)
+	}
+	return store.saveEntryLocked(sha1, encodeBlob(d), true)
+}
+
+// index entries are synced, like content they point to, so that after
+// a crash upload queue items (also synced) don't refer to content missing
+// from the index
+var syncIndexWrite = &opt.WriteOptions{Sync: true}
+
+// saves d, which was already encoded if encode is true, and adds it to
+// the index
+func (store *LocalStore) saveEntryLocked(sha1, d []byte, encode bool) (*indexEntry, error) {
+	var err error
+	var e *indexEntry
 	if len(d) > store.FileSizeSegmentThreshold {
-		err = saveToFile(store.pathForSha1(sha1), d)
-		if err != nil {
-			return nil, err
+		e = &indexEntry{path: fileNameForSha1(sha1)}
+		if encode {
+			e.path += encodedFileExt
 		}
-		val = []byte(fileNameForSha1(sha1))
+		err = saveToFile(store.entryFilePath(e), d)
 	} else {
-		val, err = store.saveToSegmentFile(d)
+		e, err = store.saveToSegmentFile(d)
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.encoded = encode
+	err = store.db.Put(dbKeyForContentSha1(sha1), []byte(e.String()), syncIndexWrite)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// returns number of deltas that need to be applied to get content of sha1
+// must be called with store.mu locked
+func (store *LocalStore) deltaDepthLocked(sha1 []byte) (int, error) {
+	depth := 0
+	for {
+		e, err := store.getIndexEntry(sha1)
 		if err != nil {
-			return nil, err
+			return 0, err
+		}
+		if e.deltaBase == nil {
+			return depth, nil
 		}
+		depth++
+		sha1 = e.deltaBase
 	}
-	err = store.db.Put(key, val, nil)
+}
+
+// PutContentDelta saves d (unless already stored) as a delta against
+// content with baseSha1 if that takes less space than saving it in full
+func (store *LocalStore) PutContentDelta(d, baseSha1 []byte) ([]byte, error) {
+	sha1 := u.Sha1OfBytes(d)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	err := store.unmarkForDeletionLocked(sha1)
 	if err != nil {
 		return nil, err
 	}
-	return sha1, nil
-}
+	has, err := store.db.Has(dbKeyForContentSha1(sha1), nil)
+	if err != nil {
+		return nil, err
+	}
+	if has {
+		return sha1, nil
+	}
+	if !store.Compress {
+		_, err = store.putContentLocked(sha1, d)
+		return sha1, err
+	}
 
-// GetSnippet reads snippet from the database
-func (store *LocalStore) GetSnippet(sha1Content []byte) ([]byte, error) {
-	return store.getContentBySha1Limited(sha1Content, snippetSizeThreshold)
+	full := encodeBlob(d)
+	depth, err := store.deltaDepthLocked(baseSha1)
+	if err != nil || depth+1 >= store.DeltaKeyframeInterval {
+		// no base or time for a keyframe
+		_, err = store.saveEntryLocked(sha1, full, true)
+		return sha1, err
+	}
+	base, err := store.getContentBySha1LimitedRaw(baseSha1, -1)
+	if err != nil {
+		log.Errorf("reading delta base %x failed with %s\n", baseSha1, err)
+		_, err = store.saveEntryLocked(sha1, full, true)
+		return sha1, err
+	}
+	delta := encodeBlob(computeDelta(base, d))
+	if len(delta) >= len(full) || len(delta) > store.FileSizeSegmentThreshold {
+		_, err = store.saveEntryLocked(sha1, full, true)
+		return sha1, err
+	}
+	e, err := store.saveToSegmentFile(delta)
+	if err != nil {
+		return nil, err
+	}
+	e.encoded = true
+	e.deltaBase = append([]byte(nil), baseSha1...)
+	err = store.db.Put(dbKeyForContentSha1(sha1), []byte(e.String()), syncIndexWrite)
+	if err != nil {
+		return nil, err
+	}
+	return sha1, nil
 }
 
 func readFromFile(file *os.File, offset, size int) ([]byte, error) {
@@ -267,76 +488,210 @@ func readFromFilePath(path string, offset, size int) ([]byte, error) {
 	return readFromFile(f, offset, size)
 }
 
-// TODO: could cache N fds to segment file to save the cost of opening the file
-// not sure if that's important
-func (store *LocalStore) readFromSegmentFileLimited(fileName string, limit int) ([]byte, error) {
-	parts := strings.Split(fileName, ":")
+// parses a value we store in the index
+func parseIndexEntry(s string) (*indexEntry, error) {
+	if !strings.HasPrefix(s, "segment.") {
+		e := &indexEntry{
+			path:    s,
+			encoded: strings.HasSuffix(s, encodedFileExt),
+		}
+		return e, nil
+	}
+	parts := strings.Split(s, ":")
+	var deltaBase []byte
+	if len(parts) == 5 {
+		deltaBase = sha1FromHex(parts[4])
+		if deltaBase == nil {
+			log.Errorf("invalid delta base '%s' in segment file path '%s'\n", parts[4], s)
+			return nil, ErrInvalidSegmentFilePath
+		}
+		parts = parts[:4]
+	}
+	encoded := len(parts) == 4 && parts[3] == "e"
+	if encoded {
+		parts = parts[:3]
+	}
 	if len(parts) != 3 {
-		log.Errorf("invalid segment file path '%s'\n", fileName)
+		log.Errorf("invalid segment file path '%s'\n", s)
 		return nil, ErrInvalidSegmentFilePath
 	}
-	fileName = parts[0]
 	offset, err := strconv.Atoi(parts[1])
 	if err != nil {
-		log.Errorf("invalid offset '%s' in segment file path '%s'\n", parts[1], fileName)
+		log.Errorf("invalid offset '%s' in segment file path '%s'\n", parts[1], s)
 		return nil, ErrInvalidSegmentFilePath
 	}
 	size, err := strconv.Atoi(parts[2])
 	if err != nil {
-		log.Errorf("invalid size '%s' in segment file path '%s'\n", parts[1], fileName)
+		log.Errorf("invalid size '%s' in segment file path '%s'\n", parts[2], s)
 		return nil, ErrInvalidSegmentFilePath
 	}
-	path := filepath.Join(store.filesDir, fileName)
-	if limit != -1 && size > limit {
-		size = limit
+	e := &indexEntry{
+		segment:   parts[0],
+		offset:    offset,
+		size:      size,
+		encoded:   encoded,
+		deltaBase: deltaBase,
 	}
-	return readFromFilePath(path, offset, size)
+	return e, nil
 }
 
-func (store *LocalStore) getContentBySha1LimitedRaw(sha1 []byte, limit int) ([]byte, error) {
-	key := dbKeyForContentSha1(sha1)
-	name, err := store.db.Get(key, nil)
+func (store *LocalStore) getIndexEntry(sha1 []byte) (*indexEntry, error) {
+	val, err := store.db.Get(dbKeyForContentSha1(sha1), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrBlobNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
-	fileName := string(name)
-	if strings.HasPrefix(fileName, "segment.") {
-		return store.readFromSegmentFileLimited(fileName, limit)
-	}
-	path := store.pathForSha1(sha1)
-	if -1 == limit {
-		return ioutil.ReadFile(path)
+	return parseIndexEntry(string(val))
+}
+
+// returns path of the file with content of e
+func (store *LocalStore) entryFilePath(e *indexEntry) string {
+	if e.segment != "" {
+		return filepath.Join(store.filesDir, e.segment)
 	}
-	return readFileLimited(path, limit)
+	return filepath.Join(store.filesDir, e.path)
 }
 
-func (store *LocalStore) getContentBySha1Limited(sha1 []byte, limit int) ([]byte, error) {
-	d, err := store.getContentBySha1LimitedRaw(sha1, limit)
-	if err != nil {
-		log.Errorf("LocalStore.getContentBySha1LimitedRaw(%x) failed with %s\n", sha1, err)
-		d, err = readNoteFromGoogleStorage(sha1)
-		if err != nil {
-			log.Errorf("LocalStore.getContentBySha1Limited: readNoteFromGoogleStorage() failed with %s\n", err)
-			return nil, err
+// reads up to limit bytes of content (-1 means no limit), decoding it if
+// necessary
+// TODO: could cache N fds to segment file to save the cost of opening the file
+// not sure if that's important
+func (store *LocalStore) readEntryLimited(e *indexEntry, limit int) ([]byte, error) {
+	if e.deltaBase != nil {
+		return store.readDeltaEntryLimited(e, limit)
+	}
+	path := store.entryFilePath(e)
+	if !e.encoded {
+		if e.segment != "" {
+			size := e.size
+			if limit != -1 && size > limit {
+				size = limit
+			}
+			return readFromFilePath(path, e.offset, size)
 		}
-		// cache locally
-		_, err = localStore.PutContent(d)
-		if err != nil {
-			log.Errorf("LocalStore.getContentBySha1Limited: localStore.PutContent() failed with %s\n", err)
+		if -1 == limit {
+			return ioutil.ReadFile(path)
 		}
+		return readFileLimited(path, limit)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if e.segment != "" {
+		r = io.NewSectionReader(f, int64(e.offset), int64(e.size))
+	}
+	return decodeBlobLimited(bufio.NewReader(r), limit)
+}
+
+func (store *LocalStore) readDeltaEntryLimited(e *indexEntry, limit int) ([]byte, error) {
+	delta := *e
+	delta.deltaBase = nil
+	d, err := store.readEntryLimited(&delta, -1)
+	if err != nil {
+		return nil, err
+	}
+	base, err := store.getContentBySha1LimitedRaw(e.deltaBase, -1)
+	if err != nil {
+		log.Errorf("reading delta base %x failed with %s\n", e.deltaBase, err)
+		return nil, err
 	}
-	if len(d) == 0 {
-		log.Errorf("LocalStore.getContentBySha1Limited: len(d) for %x is 0!\n", sha1)
+	d, err = applyDelta(base, d)
+	if err != nil {
+		return nil, err
 	}
-	if limit > 0 && len(d) > limit {
-		d = d[:limit]
+	return truncateBlob(d, limit), nil
+}
+
+func (store *LocalStore) getContentBySha1LimitedRaw(sha1 []byte, limit int) ([]byte, error) {
+	e, err := store.getIndexEntry(sha1)
+	if err != nil {
+		return nil, err
 	}
-	return d, nil
+	return store.readEntryLimited(e, limit)
 }
 
 // GetContentBySha1 reads the content by sha1
 func (store *LocalStore) GetContentBySha1(sha1 []byte) ([]byte, error) {
-	return store.getContentBySha1Limited(sha1, -1)
+	return store.getContentBySha1LimitedRaw(sha1, -1)
+}
+
+// Name returns name of the store
+func (store *LocalStore) Name() string {
+	return "local"
+}
+
+// Put is PutContent, implements BlobStore
+func (store *LocalStore) Put(d []byte) ([]byte, error) {
+	return store.PutContent(d)
+}
+
+// PutDelta is PutContentDelta, implements deltaPutter
+func (store *LocalStore) PutDelta(d, baseSha1 []byte) ([]byte, error) {
+	return store.PutContentDelta(d, baseSha1)
+}
+
+// Get is GetContentBySha1, implements BlobStore
+func (store *LocalStore) Get(sha1 []byte) ([]byte, error) {
+	return store.GetContentBySha1(sha1)
+}
+
+// GetLimited returns up to limit first bytes of content
+func (store *LocalStore) GetLimited(sha1 []byte, limit int) ([]byte, error) {
+	return store.getContentBySha1LimitedRaw(sha1, limit)
+}
+
+// Has returns true if we have content with a given sha1
+func (store *LocalStore) Has(sha1 []byte) (bool, error) {
+	return store.db.Has(dbKeyForContentSha1(sha1), nil)
+}
+
+// Delete removes content from the index. For content stored in segment
+// files the space is not reclaimed. Content stored as a delta against
+// the deleted content can no longer be read, use CollectGarbage instead
+// of Delete() if deltas are used
+func (store *LocalStore) Delete(sha1 []byte) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	e, err := store.getIndexEntry(sha1)
+	if err == ErrBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = store.db.Delete(dbKeyForContentSha1(sha1), nil)
+	if err != nil {
+		return err
+	}
+	if e.segment == "" {
+		err = os.Remove(store.entryFilePath(e))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	return err
+}
+
+// List calls fn for sha1 of each content in the store
+func (store *LocalStore) List(fn func(sha1 []byte) error) error {
+	iter := store.db.NewIterator(util.BytesPrefix(dbKeyPrefixSha1), nil)
+	defer iter.Release()
+	for iter.Next() {
+		key := iter.Key()
+		sha1 := make([]byte, len(key)-len(dbKeyPrefixSha1))
+		copy(sha1, key[len(dbKeyPrefixSha1):])
+		err := fn(sha1)
+		if err != nil {
+			return err
+		}
+	}
+	return iter.Error()
 }
 
 // Close closes the store
@@ -366,6 +721,6 @@ func readFileLimited(path string, limit int) ([]byte, error) {
 	}
 
 	buf := bytes.NewBuffer(make([]byte, 0, n))
-	_, err = buf.ReadFrom(f)
+	_, err = buf.ReadFrom(io.LimitReader(f, int64(limit)))
 	return buf.Bytes(), err
 }
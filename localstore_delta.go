@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// DeltaStats describes how much space versions of notes take in LocalStore
+type DeltaStats struct {
+	VersionsCount int
+	// number of distinct blobs
+	BlobsCount int
+	// number of blobs stored as a delta
+	DeltaCount int
+	// space taken now
+	StoredBytes int64
+	// estimated space if all versions were saved with PutContentDelta
+	DeltaBytes int64
+}
+
+// returns how many bytes content takes on disk
+func (store *LocalStore) storedSize(sha1 []byte) (int64, error) {
+	e, err := store.getIndexEntry(sha1)
+	if err != nil {
+		return 0, err
+	}
+	if e.segment != "" {
+		return int64(e.size), nil
+	}
+	fi, err := os.Stat(store.entryFilePath(e))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (store *LocalStore) isDelta(sha1 []byte) bool {
+	e, err := store.getIndexEntry(sha1)
+	return err == nil && e.deltaBase != nil
+}
+
+// DeltaStats calculates storage stats for versions of notes. versions is
+// content sha1 of versions of each note, oldest first
+func (store *LocalStore) DeltaStats(versions map[int][][]byte) (*DeltaStats, error) {
+	stats := &DeltaStats{}
+	seen := map[string]bool{}
+	for _, sha1s := range versions {
+		var prev []byte
+		depth := 0
+		for _, sha1 := range sha1s {
+			stats.VersionsCount++
+			if seen[string(sha1)] {
+				continue
+			}
+			seen[string(sha1)] = true
+			size, err := store.storedSize(sha1)
+			if err == ErrBlobNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			stats.BlobsCount++
+			stats.StoredBytes += size
+			if store.isDelta(sha1) {
+				stats.DeltaCount++
+			}
+
+			// simulate PutContentDelta
+			d, err := store.GetContentBySha1(sha1)
+			if err != nil {
+				return nil, err
+			}
+			full := encodeBlob(d)
+			n := len(full)
+			depth++
+			if prev != nil && depth < store.DeltaKeyframeInterval {
+				delta := encodeBlob(computeDelta(prev, d))
+				if len(delta) < n {
+					n = len(delta)
+				} else {
+					depth = 0
+				}
+			} else {
+				depth = 0
+			}
+			stats.DeltaBytes += int64(n)
+			prev = d
+		}
+	}
+	return stats, nil
+}
+
+// runDeltaStats shows space taken by versions of notes in localStore and
+// how much they would take with -delta-versions
+func runDeltaStats() error {
+	timeStart := time.Now()
+	versions, err := repo.GetAllVersionsContentSha1(context.Background())
+	if err != nil {
+		return err
+	}
+	stats, err := localStore.DeltaStats(versions)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("delta stats took %s\n", time.Since(timeStart))
+	fmt.Printf("notes: %d, versions: %d, blobs: %d, stored as delta: %d\n", len(versions), stats.VersionsCount, stats.BlobsCount, stats.DeltaCount)
+	fmt.Printf("stored now: %s\n", humanize.Bytes(uint64(stats.StoredBytes)))
+	fmt.Printf("stored as deltas: %s (keyframe every %d versions)\n", humanize.Bytes(uint64(stats.DeltaBytes)), localStore.DeltaKeyframeInterval)
+	return nil
+}
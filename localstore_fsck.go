@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+	"github.com/kjk/u"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// kinds of problems found by fsck
+const (
+	fsckMissing   = "missing"   // file with the content doesn't exist
+	fsckTruncated = "truncated" // segment file is shorter than the entry
+	fsckCorrupt   = "corrupt"   // sha1 of the content doesn't match
+	fsckInvalid   = "invalid"   // can't parse index entry
+	fsckDangling  = "dangling"  // referenced from the database but not in the store
+)
+
+// FsckProblem describes a problem with a single blob
+type FsckProblem struct {
+	Sha1     []byte
+	Kind     string
+	Details  string
+	Repaired bool
+}
+
+func (p *FsckProblem) String() string {
+	s := fmt.Sprintf("%x: %s, %s", p.Sha1, p.Kind, p.Details)
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// FsckResult is the result of checking LocalStore
+type FsckResult struct {
+	CheckedCount int
+	Problems     []*FsckProblem
+}
+
+func (r *FsckResult) addProblem(sha1 []byte, kind, format string, args ...interface{}) {
+	p := &FsckProblem{
+		Sha1:    append([]byte(nil), sha1...),
+		Kind:    kind,
+		Details: fmt.Sprintf(format, args...),
+	}
+	r.Problems = append(r.Problems, p)
+}
+
+// checks a single index entry
+func (store *LocalStore) fsckEntry(res *FsckResult, sha1 []byte, val string, segmentSizes map[string]int64) {
+	e, err := parseIndexEntry(val)
+	if err != nil {
+		res.addProblem(sha1, fsckInvalid, "invalid index entry '%s'", val)
+		return
+	}
+	if e.segment != "" {
+		segmentSize, ok := segmentSizes[e.segment]
+		if !ok {
+			res.addProblem(sha1, fsckMissing, "segment file '%s' doesn't exist", e.segment)
+			return
+		}
+		if int64(e.offset+e.size) > segmentSize {
+			res.addProblem(sha1, fsckTruncated, "entry %d:%d is outside of '%s' of size %d", e.offset, e.size, e.segment, segmentSize)
+			return
+		}
+	}
+	d, err := store.readEntryLimited(e, -1)
+	if e.segment == "" && os.IsNotExist(err) {
+		res.addProblem(sha1, fsckMissing, "file '%s' doesn't exist", store.entryFilePath(e))
+		return
+	}
+	if err != nil {
+		// corrupted compressed content can't be decoded
+		res.addProblem(sha1, fsckCorrupt, "reading '%s' failed with %s", val, err)
+		return
+	}
+	if !bytes.Equal(u.Sha1OfBytes(d), sha1) {
+		res.addProblem(sha1, fsckCorrupt, "sha1 of content in '%s' doesn't match", val)
+	}
+}
+
+// Fsck verifies that every blob in the store matches its sha1
+func (store *LocalStore) Fsck() (*FsckResult, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	segments, _, err := listSegmentFiles(store.filesDir)
+	if err != nil {
+		return nil, err
+	}
+	segmentSizes := map[string]int64{}
+	for name, si := range segments {
+		segmentSizes[name] = si.size
+	}
+
+	res := &FsckResult{}
+	iter := store.db.NewIterator(util.BytesPrefix(dbKeyPrefixSha1), nil)
+	defer iter.Release()
+	for iter.Next() {
+		sha1 := iter.Key()[len(dbKeyPrefixSha1):]
+		store.fsckEntry(res, sha1, string(iter.Value()), segmentSizes)
+		res.CheckedCount++
+		if res.CheckedCount%10000 == 0 {
+			log.Verbosef("checked %d blobs\n", res.CheckedCount)
+		}
+	}
+	return res, iter.Error()
+}
+
+// FsckReferenced adds dangling problem for every sha1 in referenced that
+// is not in the store
+func (store *LocalStore) FsckReferenced(res *FsckResult, referenced map[string]bool) error {
+	for s := range referenced {
+		sha1 := []byte(s)
+		has, err := store.Has(sha1)
+		if err != nil {
+			return err
+		}
+		if !has {
+			res.addProblem(sha1, fsckDangling, "referenced from the database but not in local store")
+		}
+	}
+	return nil
+}
+
+// Repair re-fetches content for problems from src and saves it in the store
+func (store *LocalStore) Repair(res *FsckResult, src BlobStore) {
+	for _, p := range res.Problems {
+		d, err := src.Get(p.Sha1)
+		if err != nil {
+			log.Errorf("%s.Get(%x) failed with %s\n", src.Name(), p.Sha1, err)
+			continue
+		}
+		if !bytes.Equal(u.Sha1OfBytes(d), p.Sha1) {
+			log.Errorf("content of %x in %s is also corrupted\n", p.Sha1, src.Name())
+			continue
+		}
+		store.mu.Lock()
+		_, err = store.putContentLocked(p.Sha1, d)
+		store.mu.Unlock()
+		if err != nil {
+			log.Errorf("putContentLocked(%x) failed with %s\n", p.Sha1, err)
+			continue
+		}
+		p.Repaired = true
+	}
+}
+
+// returns stores after local store in -blob-stores chain, as a read-only
+// chain. Returns nil if there are none
+func getSecondaryBlobStore() BlobStore {
+	res := NewTieredStore()
+	for _, store := range blobStore.Stores() {
+		if store != BlobStore(localStore) {
+			res.Add(store, true)
+		}
+	}
+	if len(res.tiers) == 0 {
+		return nil
+	}
+	return res
+}
+
+// runLocalStoreFsck checks localStore and content referenced from the
+// database. If repair is true, fixes problems by re-fetching content from
+// secondary stores
+func runLocalStoreFsck(repair bool) error {
+	timeStart := time.Now()
+	res, err := localStore.Fsck()
+	if err != nil {
+		return err
+	}
+	referenced, err := repo.GetAllContentSha1(context.Background())
+	if err != nil {
+		return err
+	}
+	err = localStore.FsckReferenced(res, referenced)
+	if err != nil {
+		return err
+	}
+	if repair && len(res.Problems) > 0 {
+		src := getSecondaryBlobStore()
+		if src == nil {
+			return fmt.Errorf("no secondary store to repair from in '%s'", blobStore.Name())
+		}
+		localStore.Repair(res, src)
+	}
+
+	nRepaired := 0
+	for _, p := range res.Problems {
+		fmt.Printf("%s\n", p)
+		if p.Repaired {
+			nRepaired++
+		}
+	}
+	fmt.Printf("fsck took %s\n", time.Since(timeStart))
+	fmt.Printf("checked %d blobs, %d referenced from the database, %d problems, %d repaired\n", res.CheckedCount, len(referenced), len(res.Problems), nRepaired)
+	return nil
+}
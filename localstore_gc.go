@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/kjk/quicknotes/pkg/log"
+	"github.com/kjk/u"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+/*
+Garbage collection of LocalStore.
+
+Content is never deleted during normal operation: segment files are
+append-only and permanently deleting a note only deletes rows from the
+database. GC:
+- takes a set of live sha1s (computed from the database by the caller)
+- deletes index entries for content that is not live
+- copies live content from segment files that contain garbage to new segment
+  files
+- atomically (single leveldb batch) updates index to point to new locations
+- only then deletes old segment files and large files that are not live
+
+If we crash before updating the index, new segment files are not referenced
+by anything and will be deleted by the next GC. If we crash after, old
+segment files are not referenced and will be deleted by the next GC.
+
+GC holds the store lock for the whole time so it should be run when the
+server is not running (-gc flag). It's not safe to run it concurrently with
+saving notes because content is saved before the database row referencing
+it is created.
+
+The exception is content marked for deletion with MarkForDeletion (e.g. by
+pruning versions). Saving content again removes the mark, with the store
+lock held, before the database row is created so CollectMarkedForDeletion
+can be run by the server: content that is still marked when we hold the
+lock and wasn't referenced from the database before we took it isn't
+referenced by anything.
+*/
+
+// GCStats describes the result of garbage collection
+type GCStats struct {
+	LiveCount          int
+	DeletedCount       int
+	SegmentsRewritten  int
+	SegmentsDeleted    int
+	FilesDeleted       int
+	SegmentBytesBefore int64
+	SegmentBytesAfter  int64
+}
+
+type segmentEntry struct {
+	key []byte
+	e   *indexEntry
+}
+
+type segmentInfo struct {
+	name      string
+	size      int64
+	liveBytes int64
+	entries   []segmentEntry
+}
+
+func isSegmentFileName(name string) (int, bool) {
+	parts := strings.Split(name, ".")
+	if len(parts) != 3 || parts[0] != "segment" || parts[2] != "txt" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// returns info about all segment files in the directory and the biggest
+// segment file number
+func listSegmentFiles(dir string) (map[string]*segmentInfo, int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	res := map[string]*segmentInfo{}
+	maxNo := 0
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		n, ok := isSegmentFileName(fi.Name())
+		if !ok {
+			continue
+		}
+		if n > maxNo {
+			maxNo = n
+		}
+		res[fi.Name()] = &segmentInfo{name: fi.Name(), size: fi.Size()}
+	}
+	return res, maxNo, nil
+}
+
+// segmentWriter writes live content to new segment files during gc
+type segmentWriter struct {
+	store  *LocalStore
+	nextNo int
+	f      *os.File
+	name   string
+	size   int
+	// all files we've created, so that we can clean up on error
+	created []string
+}
+
+func (w *segmentWriter) closeCurrent() error {
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Sync()
+	if err != nil {
+		return err
+	}
+	return closeFilePtr(&w.f)
+}
+
+// write d and return new index entry for it
+func (w *segmentWriter) write(d []byte) (*indexEntry, error) {
+	if w.f != nil && w.size+len(d) > w.store.MaxSegmentSize {
+		err := w.closeCurrent()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if w.f == nil {
+		w.name = fmt.Sprintf("segment.%d.txt", w.nextNo)
+		w.nextNo++
+		path := filepath.Join(w.store.filesDir, w.name)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w.f = f
+		w.size = 0
+		w.created = append(w.created, path)
+	}
+	offset := w.size
+	_, err := w.f.Write(d)
+	if err != nil {
+		return nil, err
+	}
+	w.size += len(d)
+	e := &indexEntry{
+		segment: w.name,
+		offset:  offset,
+		size:    len(d),
+	}
+	return e, nil
+}
+
+func (w *segmentWriter) removeCreated() {
+	closeFilePtr(&w.f)
+	for _, path := range w.created {
+		os.Remove(path)
+	}
+}
+
+func (store *LocalStore) copySegmentEntries(si *segmentInfo, w *segmentWriter, batch *leveldb.Batch) error {
+	f, err := os.Open(filepath.Join(store.filesDir, si.name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, se := range si.entries {
+		e := se.e
+		d, err := readFromFile(f, e.offset, e.size)
+		if err != nil {
+			log.Errorf("LocalStore.CollectGarbage: reading %d:%d from '%s' failed with %s\n", e.offset, e.size, si.name, err)
+			return err
+		}
+		ne, err := w.write(d)
+		if err != nil {
+			return err
+		}
+		ne.encoded = e.encoded
+		ne.deltaBase = e.deltaBase
+		batch.Put(se.key, []byte(ne.String()))
+	}
+	return nil
+}
+
+// content stored as a delta needs its base so we extend isLive to also
+// return true for bases of live content
+func (store *LocalStore) withLiveDeltaBases(isLive func(sha1 []byte) bool) (func(sha1 []byte) bool, error) {
+	deltaBases := map[string][]byte{}
+	iter := store.db.NewIterator(util.BytesPrefix(dbKeyPrefixSha1), nil)
+	for iter.Next() {
+		e, err := parseIndexEntry(string(iter.Value()))
+		if err == nil && e.deltaBase != nil {
+			sha1 := string(iter.Key()[len(dbKeyPrefixSha1):])
+			deltaBases[sha1] = e.deltaBase
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if len(deltaBases) == 0 {
+		return isLive, nil
+	}
+
+	liveBases := map[string]bool{}
+	for sha1, base := range deltaBases {
+		if !isLive([]byte(sha1)) {
+			continue
+		}
+		for base != nil && !liveBases[string(base)] {
+			liveBases[string(base)] = true
+			base = deltaBases[string(base)]
+		}
+	}
+	res := func(sha1 []byte) bool {
+		return liveBases[string(sha1)] || isLive(sha1)
+	}
+	return res, nil
+}
+
+// CollectGarbage deletes content for which isLive returns false and
+// compacts segment files. Content that is a base of a delta of live
+// content is also live
+func (store *LocalStore) CollectGarbage(isLive func(sha1 []byte) bool) (*GCStats, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stats := &GCStats{}
+	// new content will go to a new segment file after we're done
+	err := closeFilePtr(&store.currSegmentFile)
+	if err != nil {
+		return nil, err
+	}
+	isLive, err = store.withLiveDeltaBases(isLive)
+	if err != nil {
+		return nil, err
+	}
+
+	segments, maxSegmentNo, err := listSegmentFiles(store.filesDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, si := range segments {
+		stats.SegmentBytesBefore += si.size
+	}
+
+	batch := new(leveldb.Batch)
+	liveFiles := map[string]bool{}
+	var deadFiles []string
+	iter := store.db.NewIterator(util.BytesPrefix(dbKeyPrefixSha1), nil)
+	for iter.Next() {
+		key := append([]byte(nil), iter.Key()...)
+		val := string(iter.Value())
+		sha1 := key[len(dbKeyPrefixSha1):]
+		live := isLive(sha1)
+		if live {
+			stats.LiveCount++
+		} else {
+			stats.DeletedCount++
+			batch.Delete(key)
+		}
+		e, err := parseIndexEntry(val)
+		if err != nil {
+			iter.Release()
+			return nil, err
+		}
+		if e.segment == "" {
+			path := store.entryFilePath(e)
+			if live {
+				liveFiles[path] = true
+			} else {
+				deadFiles = append(deadFiles, path)
+			}
+			continue
+		}
+		if !live {
+			continue
+		}
+		si := segments[e.segment]
+		if si == nil {
+			log.Errorf("LocalStore.CollectGarbage: segment file '%s' for %x doesn't exist\n", e.segment, sha1)
+			continue
+		}
+		si.liveBytes += int64(e.size)
+		si.entries = append(si.entries, segmentEntry{key: key, e: e})
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return nil, err
+	}
+
+	// copy live content from segment files that have garbage
+	w := &segmentWriter{store: store, nextNo: maxSegmentNo + 1}
+	var segmentsToDelete []string
+	for _, si := range segments {
+		if si.liveBytes == si.size {
+			continue
+		}
+		segmentsToDelete = append(segmentsToDelete, si.name)
+		if len(si.entries) == 0 {
+			continue
+		}
+		stats.SegmentsRewritten++
+		err = store.copySegmentEntries(si, w, batch)
+		if err != nil {
+			w.removeCreated()
+			return nil, err
+		}
+	}
+	err = w.closeCurrent()
+	if err != nil {
+		w.removeCreated()
+		return nil, err
+	}
+
+	// this is the commit point
+	err = store.db.Write(batch, &opt.WriteOptions{Sync: true})
+	if err != nil {
+		w.removeCreated()
+		return nil, err
+	}
+
+	for _, name := range segmentsToDelete {
+		path := filepath.Join(store.filesDir, name)
+		err = os.Remove(path)
+		if err != nil {
+			log.Errorf("os.Remove('%s') failed with %s\n", path, err)
+			continue
+		}
+		stats.SegmentsDeleted++
+	}
+	for _, path := range deadFiles {
+		err = os.Remove(path)
+		if err == nil {
+			stats.FilesDeleted++
+		}
+	}
+
+	// remove large files that are not referenced from the index at all
+	err = filepath.Walk(store.filesDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		if sha1FromHex(strings.TrimSuffix(path, encodedFileExt)) == nil || liveFiles[path] {
+			return nil
+		}
+		log.Verbosef("removing orphaned file '%s'\n", path)
+		err = os.Remove(path)
+		if err == nil {
+			stats.FilesDeleted++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	segments, _, err = listSegmentFiles(store.filesDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, si := range segments {
+		stats.SegmentBytesAfter += si.size
+	}
+	return stats, nil
+}
+
+func dbKeyForDelete(sha1 []byte) []byte {
+	return dbKey(dbKeyPrefixDelete, sha1)
+}
+
+// MarkForDeletion marks content to be deleted by the next
+// CollectMarkedForDeletion unless it's saved again before that
+func (store *LocalStore) MarkForDeletion(sha1s [][]byte) error {
+	if len(sha1s) == 0 {
+		return nil
+	}
+	batch := new(leveldb.Batch)
+	for _, sha1 := range sha1s {
+		batch.Put(dbKeyForDelete(sha1), nil)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.db.Write(batch, syncIndexWrite)
+}
+
+// must be called with store.mu locked
+func (store *LocalStore) unmarkForDeletionLocked(sha1 []byte) error {
+	key := dbKeyForDelete(sha1)
+	has, err := store.db.Has(key, nil)
+	if err != nil || !has {
+		return err
+	}
+	return store.db.Delete(key, syncIndexWrite)
+}
+
+// returns sha1 of all content marked for deletion
+func (store *LocalStore) markedForDeletion() ([][]byte, error) {
+	var res [][]byte
+	iter := store.db.NewIterator(util.BytesPrefix(dbKeyPrefixDelete), nil)
+	for iter.Next() {
+		sha1 := append([]byte(nil), iter.Key()[len(dbKeyPrefixDelete):]...)
+		res = append(res, sha1)
+	}
+	iter.Release()
+	return res, iter.Error()
+}
+
+// CollectMarkedForDeletion deletes content marked for deletion for which
+// isReferenced returns false and clears all marks. isReferenced must be
+// computed before the call. Returns sha1 of deleted content. Unlike
+// CollectGarbage it's safe to call while the server is running
+func (store *LocalStore) CollectMarkedForDeletion(isReferenced func(sha1 []byte) bool) (*GCStats, [][]byte, error) {
+	marked, err := store.markedForDeletion()
+	if err != nil || len(marked) == 0 {
+		return &GCStats{}, nil, err
+	}
+	isMarked := map[string]bool{}
+	for _, sha1 := range marked {
+		isMarked[string(sha1)] = true
+	}
+	// called with store.mu locked so marks can't change while we decide
+	var deleted [][]byte
+	isDeleted := map[string]bool{}
+	isLive := func(sha1 []byte) bool {
+		k := string(sha1)
+		if !isMarked[k] || isReferenced(sha1) {
+			return true
+		}
+		if !isDeleted[k] {
+			has, err := store.db.Has(dbKeyForDelete(sha1), nil)
+			if err != nil || !has {
+				// saved again since we listed the marks
+				isMarked[k] = false
+				return true
+			}
+			isDeleted[k] = true
+			deleted = append(deleted, append([]byte(nil), sha1...))
+		}
+		return false
+	}
+	stats, err := store.CollectGarbage(isLive)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	batch := new(leveldb.Batch)
+	for _, sha1 := range marked {
+		batch.Delete(dbKeyForDelete(sha1))
+	}
+	store.mu.Lock()
+	err = store.db.Write(batch, syncIndexWrite)
+	store.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	return stats, deleted, nil
+}
+
+// RecompressStats describes the result of Recompress
+type RecompressStats struct {
+	RecompressedCount int
+	// size of recompressed content before and after
+	BytesBefore int64
+	BytesAfter  int64
+	GC          *GCStats
+}
+
+// Recompress re-saves content that was saved without compression and
+// compacts segment files to reclaim the space
+func (store *LocalStore) Recompress() (*RecompressStats, error) {
+	if !store.Compress {
+		return nil, errors.New("compression is disabled")
+	}
+	store.mu.Lock()
+	var sha1s [][]byte
+	iter := store.db.NewIterator(util.BytesPrefix(dbKeyPrefixSha1), nil)
+	for iter.Next() {
+		e, err := parseIndexEntry(string(iter.Value()))
+		if err == nil && !e.encoded {
+			sha1 := append([]byte(nil), iter.Key()[len(dbKeyPrefixSha1):]...)
+			sha1s = append(sha1s, sha1)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		store.mu.Unlock()
+		return nil, err
+	}
+
+	stats := &RecompressStats{}
+	for _, sha1 := range sha1s {
+		e, err := store.getIndexEntry(sha1)
+		if err == nil {
+			err = store.recompressEntryLocked(stats, sha1, e)
+		}
+		if err != nil {
+			store.mu.Unlock()
+			return nil, err
+		}
+	}
+	store.mu.Unlock()
+
+	// old, uncompressed content is now garbage
+	var err error
+	stats.GC, err = store.CollectGarbage(func(sha1 []byte) bool {
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (store *LocalStore) recompressEntryLocked(stats *RecompressStats, sha1 []byte, e *indexEntry) error {
+	d, err := store.readEntryLimited(e, -1)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(u.Sha1OfBytes(d), sha1) {
+		log.Errorf("LocalStore.Recompress: content of %x is corrupted, skipping\n", sha1)
+		return nil
+	}
+	e, err = store.putContentLocked(sha1, d)
+	if err != nil {
+		return err
+	}
+	size := int64(e.size)
+	if e.segment == "" {
+		fi, err := os.Stat(store.entryFilePath(e))
+		if err != nil {
+			return err
+		}
+		size = fi.Size()
+	}
+	stats.RecompressedCount++
+	stats.BytesBefore += int64(len(d))
+	stats.BytesAfter += size
+	return nil
+}
+
+// runLocalStoreRecompress compresses content in localStore saved by
+// versions that didn't support compression
+func runLocalStoreRecompress() error {
+	timeStart := time.Now()
+	stats, err := localStore.Recompress()
+	if err != nil {
+		return err
+	}
+	saved := stats.BytesBefore - stats.BytesAfter
+	fmt.Printf("recompress took %s\n", time.Since(timeStart))
+	fmt.Printf("recompressed %d blobs: %s => %s, saved %s\n", stats.RecompressedCount, humanize.Bytes(uint64(stats.BytesBefore)), humanize.Bytes(uint64(stats.BytesAfter)), humanize.Bytes(uint64(saved)))
+	fmt.Printf("segment files size: %s => %s\n", humanize.Bytes(uint64(stats.GC.SegmentBytesBefore)), humanize.Bytes(uint64(stats.GC.SegmentBytesAfter)))
+	return nil
+}
+
+// collectContentMarkedForDeletion deletes content marked for deletion that
+// is no longer referenced from the database from localStore and from other
+// writable blob stores
+func collectContentMarkedForDeletion(ctx context.Context) error {
+	timeStart := time.Now()
+	live, err := repo.GetAllContentSha1(ctx)
+	if err != nil {
+		return err
+	}
+	isReferenced := func(sha1 []byte) bool {
+		return live[string(sha1)]
+	}
+	stats, deleted, err := localStore.CollectMarkedForDeletion(isReferenced)
+	if err != nil {
+		return err
+	}
+	nFailed := 0
+	for _, sha1 := range deleted {
+		err = blobStore.DeleteExcept(localStore, sha1)
+		if err != nil {
+			log.Errorf("deleting %x from %s failed with %s\n", sha1, blobStore.Name(), err)
+			nFailed++
+		}
+	}
+	log.Infof("deleted %d blobs marked for deletion (%d failed in other stores), segment files size: %s => %s, took %s\n", len(deleted), nFailed, humanize.Bytes(uint64(stats.SegmentBytesBefore)), humanize.Bytes(uint64(stats.SegmentBytesAfter)), time.Since(timeStart))
+	return nil
+}
+
+// runLocalStoreGC runs garbage collection of localStore, treating content
+// referenced from the database as live
+func runLocalStoreGC() error {
+	timeStart := time.Now()
+	live, err := repo.GetAllContentSha1(context.Background())
+	if err != nil {
+		return err
+	}
+	isLive := func(sha1 []byte) bool {
+		return live[string(sha1)]
+	}
+	stats, err := localStore.CollectGarbage(isLive)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("gc took %s\n", time.Since(timeStart))
+	fmt.Printf("live: %d, deleted: %d, deleted files: %d\n", stats.LiveCount, stats.DeletedCount, stats.FilesDeleted)
+	fmt.Printf("segments rewritten: %d, deleted: %d\n", stats.SegmentsRewritten, stats.SegmentsDeleted)
+	fmt.Printf("segment files size: %s => %s\n", humanize.Bytes(uint64(stats.SegmentBytesBefore)), humanize.Bytes(uint64(stats.SegmentBytesAfter)))
+	return nil
+}
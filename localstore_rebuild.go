@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/kjk/quicknotes/pkg/log"
+	"github.com/kjk/u"
+)
+
+/*
+Rebuilding LocalStore downloads all content referenced from the database
+that is missing in LocalStore from secondary stores (e.g. Google Storage),
+using multiple concurrent downloads.
+
+Content that is already in LocalStore is skipped, so an interrupted rebuild
+can be resumed by running it again.
+*/
+
+const (
+	defaultRebuildConcurrency = 8
+)
+
+// RebuildStats describes the result of rebuilding LocalStore
+type RebuildStats struct {
+	mu              sync.Mutex
+	TotalCount      int
+	PresentCount    int
+	DownloadedCount int
+	DownloadedBytes int64
+	// sha1 of content we failed to download
+	Failed [][]byte
+}
+
+func (s *RebuildStats) done() int {
+	return s.PresentCount + s.DownloadedCount + len(s.Failed)
+}
+
+// downloads content with sha1 from src to dst unless dst already has it
+func rebuildOne(dst *LocalStore, src BlobStore, sha1 []byte, stats *RebuildStats) {
+	has, err := dst.Has(sha1)
+	if err == nil && has {
+		stats.mu.Lock()
+		stats.PresentCount++
+		stats.mu.Unlock()
+		return
+	}
+	d, err := src.Get(sha1)
+	if err == nil && !bytes.Equal(u.Sha1OfBytes(d), sha1) {
+		err = fmt.Errorf("content doesn't match sha1")
+	}
+	if err == nil {
+		_, err = dst.Put(d)
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if err != nil {
+		log.Errorf("downloading %x from %s failed with %s\n", sha1, src.Name(), err)
+		stats.Failed = append(stats.Failed, sha1)
+		return
+	}
+	stats.DownloadedCount++
+	stats.DownloadedBytes += int64(len(d))
+}
+
+// rebuildLocalStore downloads content with given sha1s missing in dst
+// from src, using up to concurrency parallel downloads
+func rebuildLocalStore(dst *LocalStore, src BlobStore, sha1s [][]byte, concurrency int) *RebuildStats {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	stats := &RebuildStats{TotalCount: len(sha1s)}
+	c := make(chan []byte)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			for sha1 := range c {
+				rebuildOne(dst, src, sha1, stats)
+			}
+			wg.Done()
+		}()
+	}
+
+	lastProgress := time.Now()
+	for _, sha1 := range sha1s {
+		c <- sha1
+		if time.Since(lastProgress) > 10*time.Second {
+			stats.mu.Lock()
+			log.Infof("%d of %d done, downloaded %d (%s), failed %d\n", stats.done(), stats.TotalCount, stats.DownloadedCount, humanize.Bytes(uint64(stats.DownloadedBytes)), len(stats.Failed))
+			stats.mu.Unlock()
+			lastProgress = time.Now()
+		}
+	}
+	close(c)
+	wg.Wait()
+	return stats
+}
+
+// returns sha1 of content of all versions of notes of all users
+func getAllVersionsSha1() ([][]byte, error) {
+	users, err := repo.GetAllUsers(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	var res [][]byte
+	seen := map[string]bool{}
+	for _, user := range users {
+		sha1s, err := repo.GetAllVersionsSha1ForUser(context.Background(), user.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, sha1 := range sha1s {
+			if !seen[string(sha1)] {
+				seen[string(sha1)] = true
+				res = append(res, sha1)
+			}
+		}
+	}
+	return res, nil
+}
+
+// runRebuildLocalStore downloads content missing in localStore from
+// secondary stores in -blob-stores
+func runRebuildLocalStore(concurrency int) error {
+	timeStart := time.Now()
+	src := getSecondaryBlobStore()
+	if src == nil {
+		return fmt.Errorf("no secondary store to rebuild from in '%s'", blobStore.Name())
+	}
+	sha1s, err := getAllVersionsSha1()
+	if err != nil {
+		return err
+	}
+	log.Infof("rebuilding local store from %s, %d blobs referenced from the database\n", src.Name(), len(sha1s))
+	stats := rebuildLocalStore(localStore, src, sha1s, concurrency)
+	for _, sha1 := range stats.Failed {
+		fmt.Printf("failed: %x\n", sha1)
+	}
+	fmt.Printf("rebuild took %s\n", time.Since(timeStart))
+	fmt.Printf("blobs: %d, already present: %d, downloaded: %d (%s), failed: %d\n", stats.TotalCount, stats.PresentCount, stats.DownloadedCount, humanize.Bytes(uint64(stats.DownloadedBytes)), len(stats.Failed))
+	if len(stats.Failed) > 0 {
+		fmt.Printf("run again to retry failed downloads\n")
+	}
+	return nil
+}
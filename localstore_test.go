@@ -2,9 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/kjk/quicknotes/pkg/log"
@@ -61,3 +65,357 @@ func TestLocalStore(t *testing.T) {
 		}
 	}
 }
+
+func TestLocalStoreGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quicknotes_gc")
+	u.PanicIfErr(err)
+	defer os.RemoveAll(dir)
+	store, err := NewLocalStore(dir)
+	u.PanicIfErr(err)
+	defer store.Close()
+	store.MaxSegmentSize = 1024
+	store.FileSizeSegmentThreshold = 200
+
+	var sha1s [][]byte
+	for i := 0; i < 40; i++ {
+		// every 5th is big enough to be stored in a separate file
+		size := 50
+		if i%5 == 0 {
+			size = 300
+		}
+		d := bytes.Repeat([]byte{byte('a' + i%26)}, size)
+		d = append(d, []byte(fmt.Sprintf("%d", i))...)
+		sha1, err := store.PutContent(d)
+		u.PanicIfErr(err)
+		sha1s = append(sha1s, sha1)
+	}
+	// an orphaned file that is not in the index
+	orphan := store.pathForSha1(u.Sha1OfBytes([]byte("orphan")))
+	u.PanicIfErr(saveToFile(orphan, []byte("orphan")))
+
+	live := map[string]bool{}
+	for i, sha1 := range sha1s {
+		if i%2 == 0 {
+			live[string(sha1)] = true
+		}
+	}
+	isLive := func(sha1 []byte) bool {
+		return live[string(sha1)]
+	}
+	stats, err := store.CollectGarbage(isLive)
+	u.PanicIfErr(err)
+	if stats.LiveCount != 20 || stats.DeletedCount != 20 {
+		t.Fatalf("unexpected stats: %#v", stats)
+	}
+	if stats.SegmentBytesAfter >= stats.SegmentBytesBefore {
+		t.Fatalf("segments didn't shrink: %#v", stats)
+	}
+	if u.FileExists(orphan) {
+		t.Fatalf("orphaned file '%s' wasn't deleted", orphan)
+	}
+	for i, sha1 := range sha1s {
+		d, err := store.GetContentBySha1(sha1)
+		if i%2 == 1 {
+			if err != ErrBlobNotFound {
+				t.Fatalf("%d: expected ErrBlobNotFound, got %v", i, err)
+			}
+			continue
+		}
+		u.PanicIfErr(err)
+		if !bytes.Equal(u.Sha1OfBytes(d), sha1) {
+			t.Fatalf("%d: invalid content after gc", i)
+		}
+	}
+
+	// nothing to collect the second time and we can still save content
+	stats, err = store.CollectGarbage(isLive)
+	u.PanicIfErr(err)
+	if stats.DeletedCount != 0 || stats.SegmentsRewritten != 0 {
+		t.Fatalf("unexpected stats: %#v", stats)
+	}
+	_, err = store.PutContent([]byte("new content"))
+	u.PanicIfErr(err)
+}
+
+func TestLocalStoreMarkForDeletion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quicknotes_gc")
+	u.PanicIfErr(err)
+	defer os.RemoveAll(dir)
+	store, err := NewLocalStore(dir)
+	u.PanicIfErr(err)
+	defer store.Close()
+
+	var sha1s [][]byte
+	for i := 0; i < 4; i++ {
+		sha1, err := store.PutContent([]byte(fmt.Sprintf("content %d", i)))
+		u.PanicIfErr(err)
+		sha1s = append(sha1s, sha1)
+	}
+	u.PanicIfErr(store.MarkForDeletion(sha1s[:3]))
+	// saving again keeps the content
+	_, err = store.PutContent([]byte("content 1"))
+	u.PanicIfErr(err)
+	// still referenced
+	isReferenced := func(sha1 []byte) bool {
+		return bytes.Equal(sha1, sha1s[2])
+	}
+	_, deleted, err := store.CollectMarkedForDeletion(isReferenced)
+	u.PanicIfErr(err)
+	if len(deleted) != 1 || !bytes.Equal(deleted[0], sha1s[0]) {
+		t.Fatalf("expected only %x to be deleted, got %x", sha1s[0], deleted)
+	}
+	for i, sha1 := range sha1s {
+		has, err := store.Has(sha1)
+		u.PanicIfErr(err)
+		if has != (i != 0) {
+			t.Fatalf("%d: unexpected Has() %v", i, has)
+		}
+	}
+
+	// marks are cleared
+	_, deleted, err = store.CollectMarkedForDeletion(func([]byte) bool { return false })
+	u.PanicIfErr(err)
+	if len(deleted) != 0 {
+		t.Fatalf("expected nothing to be deleted, got %x", deleted)
+	}
+}
+
+func TestLocalStoreFsck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quicknotes_fsck")
+	u.PanicIfErr(err)
+	defer os.RemoveAll(dir)
+	store, err := NewLocalStore(filepath.Join(dir, "local"))
+	u.PanicIfErr(err)
+	defer store.Close()
+	store.FileSizeSegmentThreshold = 100
+	backup, err := NewFileStore(filepath.Join(dir, "backup"))
+	u.PanicIfErr(err)
+
+	small := []byte("small content stored in a segment file")
+	// random so that it doesn't compress below FileSizeSegmentThreshold
+	big := make([]byte, 200)
+	rand.New(rand.NewSource(1)).Read(big)
+	var sha1s [][]byte
+	for _, d := range [][]byte{small, big} {
+		sha1, err := store.PutContent(d)
+		u.PanicIfErr(err)
+		_, err = backup.Put(d)
+		u.PanicIfErr(err)
+		sha1s = append(sha1s, sha1)
+	}
+	res, err := store.Fsck()
+	u.PanicIfErr(err)
+	if res.CheckedCount != 2 || len(res.Problems) != 0 {
+		t.Fatalf("unexpected fsck result: %#v", res)
+	}
+
+	// corrupt segment file and delete the big file
+	segmentPath := filepath.Join(store.filesDir, "segment.1.txt")
+	d, err := ioutil.ReadFile(segmentPath)
+	u.PanicIfErr(err)
+	d[0] = 'S'
+	u.PanicIfErr(ioutil.WriteFile(segmentPath, d, 0644))
+	u.PanicIfErr(os.Remove(store.pathForSha1(sha1s[1]) + encodedFileExt))
+	dangling := u.Sha1OfBytes([]byte("dangling"))
+
+	res, err = store.Fsck()
+	u.PanicIfErr(err)
+	referenced := map[string]bool{string(sha1s[0]): true, string(dangling): true}
+	u.PanicIfErr(store.FsckReferenced(res, referenced))
+	var kinds []string
+	for _, p := range res.Problems {
+		kinds = append(kinds, p.Kind)
+	}
+	if strings.Join(kinds, ",") != "corrupt,missing,dangling" && strings.Join(kinds, ",") != "missing,corrupt,dangling" {
+		t.Fatalf("unexpected problems: %v", kinds)
+	}
+
+	store.Repair(res, backup)
+	for _, p := range res.Problems {
+		if p.Repaired != (p.Kind != fsckDangling) {
+			t.Fatalf("unexpected repair status of %s", p)
+		}
+	}
+	res, err = store.Fsck()
+	u.PanicIfErr(err)
+	if len(res.Problems) != 0 {
+		t.Fatalf("problems after repair: %v", res.Problems)
+	}
+}
+
+func TestLocalStoreRecompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quicknotes_recompress")
+	u.PanicIfErr(err)
+	defer os.RemoveAll(dir)
+	store, err := NewLocalStore(dir)
+	u.PanicIfErr(err)
+	defer store.Close()
+	store.FileSizeSegmentThreshold = 1000
+
+	// content saved by old versions, without compression
+	store.Compress = false
+	small := bytes.Repeat([]byte("small note "), 10)
+	big := bytes.Repeat([]byte("big note "), 200)
+	_, err = store.PutContent(small)
+	u.PanicIfErr(err)
+	bigSha1, err := store.PutContent(big)
+	u.PanicIfErr(err)
+	oldBigPath := store.pathForSha1(bigSha1)
+	if !u.FileExists(oldBigPath) {
+		t.Fatalf("'%s' doesn't exist", oldBigPath)
+	}
+
+	store.Compress = true
+	newContent := bytes.Repeat([]byte("new note "), 10)
+	_, err = store.PutContent(newContent)
+	u.PanicIfErr(err)
+
+	stats, err := store.Recompress()
+	u.PanicIfErr(err)
+	if stats.RecompressedCount != 2 || stats.BytesAfter >= stats.BytesBefore {
+		t.Fatalf("unexpected stats: %#v", stats)
+	}
+	if stats.GC.SegmentBytesAfter >= stats.GC.SegmentBytesBefore {
+		t.Fatalf("segments didn't shrink: %#v", stats.GC)
+	}
+	if u.FileExists(oldBigPath) {
+		t.Fatalf("'%s' wasn't deleted", oldBigPath)
+	}
+	for _, d := range [][]byte{small, big, newContent} {
+		sha1 := u.Sha1OfBytes(d)
+		e, err := store.getIndexEntry(sha1)
+		u.PanicIfErr(err)
+		if !e.encoded {
+			t.Fatalf("%x wasn't compressed", sha1)
+		}
+		got, err := store.Get(sha1)
+		u.PanicIfErr(err)
+		if !bytes.Equal(got, d) {
+			t.Fatalf("invalid content of %x after recompress", sha1)
+		}
+		got, err = store.GetLimited(sha1, 5)
+		u.PanicIfErr(err)
+		if !bytes.Equal(got, d[:5]) {
+			t.Fatalf("GetLimited(%x, 5) returned '%s'", sha1, got)
+		}
+	}
+}
+
+func TestLocalStoreDelta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quicknotes_delta")
+	u.PanicIfErr(err)
+	defer os.RemoveAll(dir)
+	store, err := NewLocalStore(dir)
+	u.PanicIfErr(err)
+	defer store.Close()
+	store.DeltaKeyframeInterval = 4
+
+	r := rand.New(rand.NewSource(1))
+	d := make([]byte, 2000)
+	r.Read(d)
+	var versions [][]byte
+	var prev []byte
+	for i := 0; i < 10; i++ {
+		d = append(append([]byte(nil), d...), []byte(fmt.Sprintf("edit %d", i))...)
+		sha1, err := store.PutContentDelta(d, prev)
+		u.PanicIfErr(err)
+		versions = append(versions, d)
+		prev = sha1
+	}
+	for i, d := range versions {
+		sha1 := u.Sha1OfBytes(d)
+		e, err := store.getIndexEntry(sha1)
+		u.PanicIfErr(err)
+		isKeyframe := i%4 == 0
+		if isKeyframe != (e.deltaBase == nil) {
+			t.Fatalf("%d: unexpected entry '%s'", i, e)
+		}
+		got, err := store.GetContentBySha1(sha1)
+		u.PanicIfErr(err)
+		if !bytes.Equal(got, d) {
+			t.Fatalf("%d: invalid content", i)
+		}
+		got, err = store.GetLimited(sha1, 10)
+		u.PanicIfErr(err)
+		if !bytes.Equal(got, d[:10]) {
+			t.Fatalf("%d: invalid limited content", i)
+		}
+	}
+
+	stats, err := store.DeltaStats(map[int][][]byte{1: {u.Sha1OfBytes(versions[0]), u.Sha1OfBytes(versions[1])}})
+	u.PanicIfErr(err)
+	if stats.BlobsCount != 2 || stats.DeltaCount != 1 || stats.DeltaBytes != stats.StoredBytes {
+		t.Fatalf("unexpected stats: %#v", stats)
+	}
+
+	// only the last version is live but bases of its deltas must be kept
+	last := u.Sha1OfBytes(versions[9])
+	gcStats, err := store.CollectGarbage(func(sha1 []byte) bool {
+		return bytes.Equal(sha1, last)
+	})
+	u.PanicIfErr(err)
+	if gcStats.LiveCount != 2 || gcStats.DeletedCount != 8 {
+		t.Fatalf("unexpected gc stats: %#v", gcStats)
+	}
+	got, err := store.GetContentBySha1(last)
+	u.PanicIfErr(err)
+	if !bytes.Equal(got, versions[9]) {
+		t.Fatalf("invalid content after gc")
+	}
+}
+
+func TestRebuildLocalStore(t *testing.T) {
+	defer openTestDbMust()()
+	ctx := context.Background()
+	user, err := repo.GetOrCreateUser(ctx, "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	note := &NewNote{
+		title:   "note",
+		format:  formatText,
+		content: []byte("first version"),
+	}
+	_, err = repo.CreateOrUpdateNote(ctx, user.ID, note)
+	u.PanicIfErr(err)
+	note.content = []byte("second version")
+	_, err = repo.CreateOrUpdateNote(ctx, user.ID, note)
+	u.PanicIfErr(err)
+
+	sha1s, err := getAllVersionsSha1()
+	u.PanicIfErr(err)
+	// welcome note and 2 versions of our note
+	if len(sha1s) != 3 {
+		t.Fatalf("expected 3 blobs, got %d", len(sha1s))
+	}
+
+	// remote store has all but one blob
+	remote, err := NewFileStore(filepath.Join(dataDir, "remote"))
+	u.PanicIfErr(err)
+	for _, sha1 := range sha1s[1:] {
+		d, err := localStore.Get(sha1)
+		u.PanicIfErr(err)
+		_, err = remote.Put(d)
+		u.PanicIfErr(err)
+	}
+	dst, err := NewLocalStore(filepath.Join(dataDir, "rebuilt"))
+	u.PanicIfErr(err)
+	defer dst.Close()
+	d, err := localStore.Get(sha1s[2])
+	u.PanicIfErr(err)
+	_, err = dst.Put(d)
+	u.PanicIfErr(err)
+
+	stats := rebuildLocalStore(dst, remote, sha1s, 2)
+	if stats.PresentCount != 1 || stats.DownloadedCount != 1 || len(stats.Failed) != 1 {
+		t.Fatalf("unexpected stats: %#v", stats)
+	}
+	if !bytes.Equal(stats.Failed[0], sha1s[0]) {
+		t.Fatalf("expected %x to fail, got %x", sha1s[0], stats.Failed[0])
+	}
+	for _, sha1 := range sha1s[1:] {
+		has, err := dst.Has(sha1)
+		u.PanicIfErr(err)
+		if !has {
+			t.Fatalf("%x wasn't downloaded", sha1)
+		}
+	}
+}
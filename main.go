@@ -34,6 +34,7 @@ var (
 	flgUseResourcesZip     bool
 	flgVerbose             bool
 	flgProdDb              bool // if true, use gce db when running localy
+	flgDbDriver            string
 	flgDbHost              string
 	flgDbPort              string
 	flgImportJSONUserLogin string
@@ -43,6 +44,28 @@ var (
 	flgShowNote            string
 	flgListUsers           bool
 	flgImportStackOverflow bool
+	flgBlobStores          string
+	flgGC                  bool
+	flgFsck                bool
+	flgFsckRepair          bool
+	flgRecompress          bool
+	flgContentCacheSizeMB  int
+	flgDeltaVersions       bool
+	flgDeltaStats          bool
+	flgMigrate             string
+	flgMigrateDryRun       bool
+	flgBackup              string
+	flgRestore             string
+	flgRebuildLocalStore   bool
+	flgRebuildConcurrency  int
+	flgUploadWorkers       int
+	flgUploadQueueStatus   bool
+	flgS3Endpoint          string
+	flgS3Region            string
+	flgVersionRetention    string
+	flgPruneVersions       bool
+	flgPruneVersionsDryRun bool
+	flgRebuildLinks        bool
 
 	localStore      *LocalStore
 	httpLogs        *log.DailyRotateFile
@@ -121,8 +144,31 @@ func parseFlags() {
 	flag.BoolVar(&flgListUsers, "list-users", false, "list handles of users in the db")
 	flag.StringVar(&flgSearchTerm, "search", "", "search notes for a given term")
 	flag.StringVar(&flgSearchLocalTerm, "search-local", "", "search local notes for a given term")
+	flag.StringVar(&flgDbDriver, "db", dbDriverMySQL, "database backend: mysql or sqlite (stored in data dir)")
 	flag.StringVar(&flgDbHost, "db-host", "127.0.0.1", "database host")
 	flag.StringVar(&flgDbPort, "db-port", "3306", "database port")
+	flag.StringVar(&flgBlobStores, "blob-stores", "", "comma-separated chain of stores for note content e.g. 'local,gcs'. Stores: local, gcs, fs:<dir>, s3:<bucket>. ro: prefix makes a store read-only, async: prefix uploads to a store in the background")
+	flag.StringVar(&flgS3Endpoint, "s3-endpoint", "", "endpoint of S3-compatible storage (empty for AWS)")
+	flag.StringVar(&flgS3Region, "s3-region", "us-east-1", "region of S3 storage")
+	flag.BoolVar(&flgGC, "gc", false, "delete content no longer referenced from the database from local store and compact segment files. Run when the server is not running")
+	flag.BoolVar(&flgFsck, "fsck", false, "verify content in local store and that all content referenced from the database exists")
+	flag.BoolVar(&flgFsckRepair, "fsck-repair", false, "like -fsck but also re-fetch missing or corrupted content from secondary stores")
+	flag.BoolVar(&flgRecompress, "recompress", false, "compress content in local store that was saved uncompressed and compact segment files. Run when the server is not running")
+	flag.BoolVar(&flgDeltaVersions, "delta-versions", false, "save content of new versions of notes in local store as a delta against the previous version")
+	flag.BoolVar(&flgDeltaStats, "delta-stats", false, "show how much space versions of notes take in local store and how much they would take with -delta-versions")
+	flag.IntVar(&flgContentCacheSizeMB, "content-cache-size", defaultContentCacheSizeMB, "size (in MB) of in-memory cache of note content")
+	flag.StringVar(&flgMigrate, "migrate", "", "manage database migrations: status, up [N] or down [N]")
+	flag.BoolVar(&flgMigrateDryRun, "migrate-dry-run", false, "with -migrate up|down, only print statements that would be executed")
+	flag.StringVar(&flgBackup, "backup", "", "create a backup of the database and note content in a given .tar.gz file")
+	flag.StringVar(&flgRestore, "restore", "", "restore a backup created with -backup into an empty installation")
+	flag.BoolVar(&flgRebuildLocalStore, "rebuild-local-store", false, "download content referenced from the database that is missing in local store from secondary stores")
+	flag.IntVar(&flgRebuildConcurrency, "rebuild-concurrency", defaultRebuildConcurrency, "number of parallel downloads for -rebuild-local-store")
+	flag.IntVar(&flgUploadWorkers, "upload-workers", defaultUploadWorkers, "number of background uploads to async: blob stores")
+	flag.BoolVar(&flgUploadQueueStatus, "upload-queue-status", false, "show pending and failed uploads to async: blob stores. Run when the server is not running")
+	flag.StringVar(&flgVersionRetention, "version-retention", "", "which versions of notes to keep, e.g. 'all=7d,hourly=30d,first=1,last=10' keeps all versions for 7 days, then newest in every hour for 30 days, then newest in every day, and always the first and last 10. Empty keeps all versions. Versions are pruned daily")
+	flag.BoolVar(&flgPruneVersions, "prune-versions", false, "delete versions of notes not kept by -version-retention")
+	flag.BoolVar(&flgPruneVersionsDryRun, "prune-versions-dry-run", false, "like -prune-versions but only report what would be deleted")
+	flag.BoolVar(&flgRebuildLinks, "rebuild-links", false, "re-parse links between notes in all notes, e.g. after upgrading from a version without links")
 	flag.BoolVar(&flgVerbose, "verbose", false, "enable verbose logging")
 	flag.StringVar(&flgShowNote, "show-note", "", "show a note with a given hashed id")
 	flag.BoolVar(&flgProduction, "production", false, "running in production")
@@ -131,14 +177,25 @@ func parseFlags() {
 
 	flag.Parse()
 
+	if flgDbDriver != dbDriverMySQL && flgDbDriver != dbDriverSqlite {
+		log.Fatalf("invalid -db value '%s', must be %s or %s\n", flgDbDriver, dbDriverMySQL, dbDriverSqlite)
+	}
+	if flgDbDriver == dbDriverSqlite && !sqliteSupported {
+		log.Fatalf("-db %s needs a binary built with cgo (CGO_ENABLED=1)\n", dbDriverSqlite)
+	}
+	contentCache = NewContentCache(flgContentCacheSizeMB * 1024 * 1024)
+	if flgVersionRetention != "" {
+		var err error
+		versionRetention, err = parseRetentionPolicy(flgVersionRetention)
+		if err != nil {
+			log.Fatalf("invalid -version-retention: %s\n", err)
+		}
+	}
+
 	if flgProduction {
 		flgHTTPAddr = ":80"
 		redirectHTTPToHTTPS = true
 	}
-
-	// in production or in cowboy mode we save notes to google storage as well
-	// TODO: maybe to it always?
-	onlyLocalStorage = !(flgProduction || flgProdDb)
 }
 
 func runGulpAndWaitExit() {
@@ -165,9 +222,9 @@ func runGulpAsync() {
 }
 
 func listDbUsers() {
-	users, err := dbGetAllUsers()
+	users, err := repo.GetAllUsers(context.Background())
 	if err != nil {
-		log.Fatalf("dbGetAllUsers() failed with '%s'", err)
+		log.Fatalf("repo.GetAllUsers() failed with '%s'", err)
 	}
 	fmt.Printf("Number of users: %d\n", len(users))
 	for _, u := range users {
@@ -208,7 +265,7 @@ func logHTTP(r *http.Request, code, nBytesWritten, userID int, dur time.Duration
 }
 
 func dailyTasksLoop() {
-	buildPublicNotesIndex()
+	buildPublicNotesIndex(serverCtx)
 
 	// tasks we run once a day at 1 am
 	for {
@@ -225,14 +282,15 @@ func dailyTasksLoop() {
 
 		timeStr := time.Now().Format("2006-01-02 15:04:05")
 		log.Infof("executing daily tasks at %s\n", timeStr)
-		buildPublicNotesIndex()
+		buildPublicNotesIndex(serverCtx)
+		pruneVersionsIfConfigured(serverCtx)
 	}
 }
 
 func debugShowNote(hashedNoteID string) {
 	noteID, err := dehashInt(hashedNoteID)
 	u.PanicIfErr(err)
-	note, err := dbGetNoteByID(noteID)
+	note, err := repo.GetNoteByID(context.Background(), noteID)
 	u.PanicIfErr(err)
 	body := note.Content()
 	snippet := note.Snippet
@@ -271,8 +329,8 @@ func main() {
 	}
 
 	if flgImportStackOverflow {
-		localStore, err = NewLocalStore(getLocalStoreDir())
-		u.PanicIfErr(err, "NewLocalStore()")
+		openRepositoryMust()
+		openBlobStoresMust()
 		importStackOverflow()
 		return
 	}
@@ -288,16 +346,111 @@ func main() {
 	// don't reload if we're reading from .zip resources
 	reloadTemplates = !hasZipResources()
 
-	getDbMust()
+	if flgMigrate != "" {
+		err = runMigrateCommand(flgMigrate, flag.Args(), flgMigrateDryRun)
+		if err != nil {
+			log.Fatalf("runMigrateCommand() failed with %s\n", err)
+		}
+		return
+	}
+
+	openRepositoryMust()
 
 	if flgListUsers {
 		listDbUsers()
 		return
 	}
 
-	localStore, err = NewLocalStore(getLocalStoreDir())
-	if err != nil {
-		log.Fatalf("NewLocalStore() failed with %s\n", err)
+	openBlobStoresMust()
+
+	if flgPruneVersions || flgPruneVersionsDryRun {
+		err = runPruneVersions(flgPruneVersionsDryRun)
+		if err != nil {
+			log.Fatalf("runPruneVersions() failed with %s\n", err)
+		}
+		localStore.Close()
+		return
+	}
+
+	if flgUploadQueueStatus {
+		err = runUploadQueueStatus()
+		if err != nil {
+			log.Fatalf("runUploadQueueStatus() failed with %s\n", err)
+		}
+		localStore.Close()
+		return
+	}
+
+	if flgGC {
+		err = runLocalStoreGC()
+		if err != nil {
+			log.Fatalf("runLocalStoreGC() failed with %s\n", err)
+		}
+		localStore.Close()
+		return
+	}
+
+	if flgFsck || flgFsckRepair {
+		err = runLocalStoreFsck(flgFsckRepair)
+		if err != nil {
+			log.Fatalf("runLocalStoreFsck() failed with %s\n", err)
+		}
+		localStore.Close()
+		return
+	}
+
+	if flgRebuildLocalStore {
+		err = runRebuildLocalStore(flgRebuildConcurrency)
+		if err != nil {
+			log.Fatalf("runRebuildLocalStore() failed with %s\n", err)
+		}
+		localStore.Close()
+		return
+	}
+
+	if flgBackup != "" {
+		err = runBackup(flgBackup)
+		if err != nil {
+			log.Fatalf("runBackup() failed with %s\n", err)
+		}
+		localStore.Close()
+		return
+	}
+
+	if flgRestore != "" {
+		err = runRestore(flgRestore)
+		if err != nil {
+			log.Fatalf("runRestore() failed with %s\n", err)
+		}
+		localStore.Close()
+		return
+	}
+
+	if flgRebuildLinks {
+		err = runRebuildLinks()
+		if err != nil {
+			log.Fatalf("runRebuildLinks() failed with %s\n", err)
+		}
+		localStore.Close()
+		return
+	}
+
+	if flgDeltaStats {
+		err = runDeltaStats()
+		if err != nil {
+			log.Fatalf("runDeltaStats() failed with %s\n", err)
+		}
+		localStore.Close()
+		return
+	}
+
+	if flgRecompress {
+		err = runLocalStoreRecompress()
+		if err != nil {
+			log.Fatalf("runLocalStoreRecompress() failed with %s\n", err)
+		}
+		localStore.Close()
+		return
 	}
 
 	if flgShowNote != "" {
@@ -310,11 +463,6 @@ func main() {
 		return
 	}
 
-	if false {
-		testListObjects()
-		return
-	}
-
 	if flgSearchTerm != "" {
 		searchAllNotesTest(flgSearchTerm, defaultMaxResults)
 		return
@@ -324,12 +472,11 @@ func main() {
 		runGulpAsync()
 	}
 
-	initGoogleStorageMust()
-
-	_, err = dbGetOrCreateUser("email:quicknotes@quicknotes.io", "QuickNotes")
-	u.PanicIfErr(err, "dbGetOrCreateUser")
+	_, err = repo.GetOrCreateUser(serverCtx, "email:quicknotes@quicknotes.io", "QuickNotes")
+	u.PanicIfErr(err, "repo.GetOrCreateUser")
 
 	go dailyTasksLoop()
+	uploadQueue.Start(flgUploadWorkers)
 
 	var wg sync.WaitGroup
 	var httpsSrv *http.Server
@@ -355,8 +502,8 @@ func main() {
 		httpsSrv.TLSConfig = &tls.Config{GetCertificate: m.GetCertificate}
 		log.Infof("Starting HTTPS on %s\n", httpsSrv.Addr)
 
+		wg.Add(1)
 		go func() {
-			wg.Add(1)
 			err := httpsSrv.ListenAndServeTLS("", "")
 			// mute error caused by Shutdown()
 			if err == http.ErrServerClosed {
@@ -372,7 +519,7 @@ func main() {
 	}
 
 	var httpSrv *http.Server
-	log.Infof("Starting HTTP on %s. Redirect to https: %v, saving to Google Storage: %v\n", flgHTTPAddr, redirectHTTPToHTTPS, !onlyLocalStorage)
+	log.Infof("Starting HTTP on %s. Redirect to https: %v, blob stores: %s\n", flgHTTPAddr, redirectHTTPToHTTPS, blobStore.Name())
 	if redirectHTTPToHTTPS {
 		httpSrv = makeHTTPToHTTPSRedirectServer()
 	} else {
@@ -383,8 +530,8 @@ func main() {
 	}
 	httpSrv.Addr = flgHTTPAddr
 
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		err := httpSrv.ListenAndServe()
 		// mute error caused by Shutdown()
 		if err == http.ErrServerClosed {
@@ -409,7 +556,11 @@ func main() {
 		httpSrv.Shutdown(ctx)
 	}
 	wg.Wait()
+	// stops queries of websocket connections and background imports
+	cancelServerCtx()
 
+	uploadQueue.Stop()
+	closeRepository()
 	localStore.Close()
 	fmt.Printf("Exited\n")
 }
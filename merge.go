@@ -0,0 +1,158 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+/*
+Three-way merge of concurrent edits of a note.
+
+When an edit is based on a version that is no longer the current version,
+we diff the base version against the current version and against the edit
+and combine the changes. Changes of the same or adjacent lines of the base
+are a conflict. If both sides made the same change it's not a conflict.
+
+Conflicting changes are written out with conflict markers, like git:
+
+<<<<<<< current
+lines from the current version
+=======
+lines from the edit
+>>>>>>> edit
+*/
+
+const (
+	mergeMarkerCurrent = "<<<<<<< current\n"
+	mergeMarkerSep     = "=======\n"
+	mergeMarkerEdit    = ">>>>>>> edit\n"
+)
+
+// mergeChunk replaces lines [start, end) of the base with lines
+type mergeChunk struct {
+	start int
+	end   int
+	lines []string
+	side  int
+}
+
+// splits s into lines, keeping line endings, so that joining the result
+// gives back s
+func splitLinesKeepEnds(s string) []string {
+	var res []string
+	for len(s) > 0 {
+		idx := strings.IndexByte(s, '\n')
+		if idx == -1 {
+			res = append(res, s)
+			break
+		}
+		res = append(res, s[:idx+1])
+		s = s[idx+1:]
+	}
+	return res
+}
+
+// returns changes that transform base into other
+func mergeChunks(base, other []string, side int) []*mergeChunk {
+	var res []*mergeChunk
+	var curr *mergeChunk
+	// index of the next line of base
+	pos := 0
+	for _, e := range myersDiff(base, other) {
+		switch e.op {
+		case diffOpEqual:
+			curr = nil
+			pos = e.aIdx + 1
+		case diffOpDelete:
+			if curr == nil {
+				curr = &mergeChunk{start: e.aIdx, end: e.aIdx, side: side}
+				res = append(res, curr)
+			}
+			curr.end = e.aIdx + 1
+			pos = e.aIdx + 1
+		case diffOpInsert:
+			if curr == nil {
+				curr = &mergeChunk{start: pos, end: pos, side: side}
+				res = append(res, curr)
+			}
+			curr.lines = append(curr.lines, other[e.bIdx])
+		}
+	}
+	return res
+}
+
+// returns lines [start, end) of base with chunks applied
+func applyMergeChunks(base []string, start, end int, chunks []*mergeChunk) []string {
+	var res []string
+	pos := start
+	for _, c := range chunks {
+		res = append(res, base[pos:c.start]...)
+		res = append(res, c.lines...)
+		pos = c.end
+	}
+	return append(res, base[pos:end]...)
+}
+
+// makes sure conflict markers start on a new line
+func appendMergeLines(sb *strings.Builder, lines []string) {
+	for _, l := range lines {
+		sb.WriteString(l)
+	}
+	if n := len(lines); n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+		sb.WriteString("\n")
+	}
+}
+
+// merge3 merges changes made in current and edit to base. Returns merged
+// text and the number of conflicts marked in it
+func merge3(base, current, edit string) (string, int) {
+	baseLines := splitLinesKeepEnds(base)
+	chunks := mergeChunks(baseLines, splitLinesKeepEnds(current), 0)
+	chunks = append(chunks, mergeChunks(baseLines, splitLinesKeepEnds(edit), 1)...)
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].start < chunks[j].start
+	})
+
+	var sb strings.Builder
+	nConflicts := 0
+	pos := 0
+	for i := 0; i < len(chunks); {
+		start, end := chunks[i].start, chunks[i].end
+		var sides [2][]*mergeChunk
+		for ; i < len(chunks) && chunks[i].start <= end; i++ {
+			c := chunks[i]
+			sides[c.side] = append(sides[c.side], c)
+			if c.end > end {
+				end = c.end
+			}
+		}
+		for _, l := range baseLines[pos:start] {
+			sb.WriteString(l)
+		}
+		pos = end
+		currLines := applyMergeChunks(baseLines, start, end, sides[0])
+		editLines := applyMergeChunks(baseLines, start, end, sides[1])
+		if len(sides[1]) == 0 || strings.Join(currLines, "") == strings.Join(editLines, "") {
+			for _, l := range currLines {
+				sb.WriteString(l)
+			}
+			continue
+		}
+		if len(sides[0]) == 0 {
+			for _, l := range editLines {
+				sb.WriteString(l)
+			}
+			continue
+		}
+		nConflicts++
+		sb.WriteString(mergeMarkerCurrent)
+		appendMergeLines(&sb, currLines)
+		sb.WriteString(mergeMarkerSep)
+		appendMergeLines(&sb, editLines)
+		sb.WriteString(mergeMarkerEdit)
+	}
+	for _, l := range baseLines[pos:] {
+		sb.WriteString(l)
+	}
+	return sb.String(), nConflicts
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMerge3(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\nfive\n"
+	tests := []struct {
+		current, edit string
+		exp           string
+		nConflicts    int
+	}{
+		// no changes on one side
+		{base, base, base, 0},
+		{base, "one\ntwo\n", "one\ntwo\n", 0},
+		{"zero\n" + base, base, "zero\n" + base, 0},
+		// changes of different lines
+		{
+			"ONE\ntwo\nthree\nfour\nfive\n",
+			"one\ntwo\nthree\nfour\nFIVE\n",
+			"ONE\ntwo\nthree\nfour\nFIVE\n",
+			0,
+		},
+		{
+			"one\ntwo\nthree\nfour\nfive\nsix\n",
+			"zero\none\ntwo\nfour\nfive\n",
+			"zero\none\ntwo\nfour\nfive\nsix\n",
+			0,
+		},
+		// the same change on both sides
+		{
+			"one\n2\nthree\nfour\nfive\n",
+			"one\n2\nthree\nfour\nFIVE\n",
+			"one\n2\nthree\nfour\nFIVE\n",
+			0,
+		},
+		// changes of the same and adjacent lines
+		{
+			"one\nTWO\nthree\nfour\nfive\n",
+			"one\n2\nthree\nfour\nfive\n",
+			"one\n" + mergeMarkerCurrent + "TWO\n" + mergeMarkerSep + "2\n" + mergeMarkerEdit + "three\nfour\nfive\n",
+			1,
+		},
+		{
+			"one\nTWO\nthree\nfour\nfive\n",
+			"one\ntwo\nTHREE\nfour\nfive",
+			"one\n" + mergeMarkerCurrent + "TWO\nthree\n" + mergeMarkerSep + "two\nTHREE\n" + mergeMarkerEdit + "four\nfive",
+			1,
+		},
+		// conflict in the last line without a newline
+		{
+			"one\ntwo\nthree\nfour\n5",
+			"one\ntwo\nthree\nfour\nV",
+			"one\ntwo\nthree\nfour\n" + mergeMarkerCurrent + "5\n" + mergeMarkerSep + "V\n" + mergeMarkerEdit,
+			1,
+		},
+	}
+	for _, test := range tests {
+		got, n := merge3(base, test.current, test.edit)
+		if got != test.exp || n != test.nConflicts {
+			t.Fatalf("merge of '%s' and '%s' produced '%s' with %d conflicts, expected '%s' with %d conflicts", test.current, test.edit, got, n, test.exp, test.nConflicts)
+		}
+	}
+}
+
+func TestSplitLinesKeepEnds(t *testing.T) {
+	for _, s := range []string{"", "a", "a\n", "a\n\nb", "\n\n"} {
+		if got := strings.Join(splitLinesKeepEnds(s), ""); got != s {
+			t.Fatalf("split of '%s' joined to '%s'", s, got)
+		}
+	}
+}
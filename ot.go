@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf16"
+)
+
+/*
+Operational transformation of text, used for collaborative editing.
+
+The format of operations is the same as in ot.js: a list of components,
+each being one of:
+- a positive number: retain (skip) that many characters
+- a negative number: delete that many characters
+- a string: insert it
+
+An operation covers the whole document: retained and deleted characters
+add up to the length of the document it applies to.
+
+Lengths and positions are in UTF-16 code units, like in JavaScript strings.
+*/
+
+// otComp is a component of TextOp. n > 0 is retain, n < 0 is delete, n == 0
+// is insert of ins
+type otComp struct {
+	n   int
+	ins []uint16
+}
+
+// TextOp is an operation on a text document
+type TextOp []otComp
+
+func (c otComp) isRetain() bool {
+	return c.n > 0
+}
+
+func (c otComp) isDelete() bool {
+	return c.n < 0
+}
+
+func (c otComp) isInsert() bool {
+	return c.n == 0
+}
+
+func (op TextOp) retain(n int) TextOp {
+	if n == 0 {
+		return op
+	}
+	if l := len(op); l > 0 && op[l-1].isRetain() {
+		op[l-1].n += n
+		return op
+	}
+	return append(op, otComp{n: n})
+}
+
+func (op TextOp) insert(s []uint16) TextOp {
+	if len(s) == 0 {
+		return op
+	}
+	l := len(op)
+	if l > 0 && op[l-1].isInsert() {
+		op[l-1].ins = append(op[l-1].ins[:len(op[l-1].ins):len(op[l-1].ins)], s...)
+		return op
+	}
+	// insert before delete so that equivalent operations look the same
+	if l > 0 && op[l-1].isDelete() {
+		if l > 1 && op[l-2].isInsert() {
+			op[l-2].ins = append(op[l-2].ins[:len(op[l-2].ins):len(op[l-2].ins)], s...)
+			return op
+		}
+		op = append(op, op[l-1])
+		op[l-1] = otComp{ins: s}
+		return op
+	}
+	return append(op, otComp{ins: s})
+}
+
+func (op TextOp) delete(n int) TextOp {
+	if n == 0 {
+		return op
+	}
+	if l := len(op); l > 0 && op[l-1].isDelete() {
+		op[l-1].n -= n
+		return op
+	}
+	return append(op, otComp{n: -n})
+}
+
+// BaseLen returns length of the document the operation applies to
+func (op TextOp) BaseLen() int {
+	n := 0
+	for _, c := range op {
+		if c.isRetain() {
+			n += c.n
+		} else if c.isDelete() {
+			n -= c.n
+		}
+	}
+	return n
+}
+
+// TargetLen returns length of the document after applying the operation
+func (op TextOp) TargetLen() int {
+	n := 0
+	for _, c := range op {
+		if c.isRetain() {
+			n += c.n
+		} else if c.isInsert() {
+			n += len(c.ins)
+		}
+	}
+	return n
+}
+
+// IsNoop returns true if the operation doesn't change the document
+func (op TextOp) IsNoop() bool {
+	return len(op) == 0 || (len(op) == 1 && op[0].isRetain())
+}
+
+// MarshalJSON encodes the operation in ot.js format
+func (op TextOp) MarshalJSON() ([]byte, error) {
+	a := make([]interface{}, 0, len(op))
+	for _, c := range op {
+		if c.isInsert() {
+			a = append(a, string(utf16.Decode(c.ins)))
+		} else {
+			a = append(a, c.n)
+		}
+	}
+	return json.Marshal(a)
+}
+
+// parseTextOp parses an operation in ot.js format, as decoded from JSON
+func parseTextOp(v interface{}) (TextOp, error) {
+	a, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("operation is not an array but %T", v)
+	}
+	var op TextOp
+	for _, el := range a {
+		switch c := el.(type) {
+		case float64:
+			if c == 0 || c != math.Trunc(c) {
+				return nil, fmt.Errorf("invalid component %v of operation", c)
+			}
+			if c > 0 {
+				op = op.retain(int(c))
+			} else {
+				op = op.delete(int(-c))
+			}
+		case string:
+			if c == "" {
+				return nil, errors.New("empty insert in operation")
+			}
+			op = op.insert(utf16.Encode([]rune(c)))
+		default:
+			return nil, fmt.Errorf("invalid component %v of type %T in operation", el, el)
+		}
+	}
+	return op, nil
+}
+
+// Apply applies the operation to a document
+func (op TextOp) Apply(doc []uint16) ([]uint16, error) {
+	if op.BaseLen() != len(doc) {
+		return nil, fmt.Errorf("operation applies to a document of length %d, not %d", op.BaseLen(), len(doc))
+	}
+	res := make([]uint16, 0, op.TargetLen())
+	pos := 0
+	for _, c := range op {
+		switch {
+		case c.isRetain():
+			res = append(res, doc[pos:pos+c.n]...)
+			pos += c.n
+		case c.isDelete():
+			pos -= c.n
+		default:
+			res = append(res, c.ins...)
+		}
+	}
+	return res, nil
+}
+
+// transformTextOps transforms concurrent operations a and b, which apply to
+// the same document, into a' and b' such that applying a and then b' gives
+// the same result as applying b and then a'. If both insert at the same
+// position, a's insert goes first
+func transformTextOps(a, b TextOp) (TextOp, TextOp, error) {
+	if a.BaseLen() != b.BaseLen() {
+		return nil, nil, fmt.Errorf("can't transform operations with base lengths %d and %d", a.BaseLen(), b.BaseLen())
+	}
+	var aPrime, bPrime TextOp
+	// copies, because we modify the components
+	a = append(TextOp(nil), a...)
+	b = append(TextOp(nil), b...)
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		if i < len(a) && a[i].isInsert() {
+			aPrime = aPrime.insert(a[i].ins)
+			bPrime = bPrime.retain(len(a[i].ins))
+			i++
+			continue
+		}
+		if j < len(b) && b[j].isInsert() {
+			aPrime = aPrime.retain(len(b[j].ins))
+			bPrime = bPrime.insert(b[j].ins)
+			j++
+			continue
+		}
+		if i >= len(a) || j >= len(b) {
+			return nil, nil, errors.New("operations have different lengths")
+		}
+		ca, cb := &a[i], &b[j]
+		// length of the part of the document covered by both components
+		la, lb := ca.n, cb.n
+		if la < 0 {
+			la = -la
+		}
+		if lb < 0 {
+			lb = -lb
+		}
+		n := la
+		if lb < n {
+			n = lb
+		}
+		switch {
+		case ca.isRetain() && cb.isRetain():
+			aPrime = aPrime.retain(n)
+			bPrime = bPrime.retain(n)
+		case ca.isDelete() && cb.isRetain():
+			aPrime = aPrime.delete(n)
+		case ca.isRetain() && cb.isDelete():
+			bPrime = bPrime.delete(n)
+		}
+		// both deleting the same text needs nothing in a' or b'
+		if la == n {
+			i++
+		} else if ca.isRetain() {
+			ca.n -= n
+		} else {
+			ca.n += n
+		}
+		if lb == n {
+			j++
+		} else if cb.isRetain() {
+			cb.n -= n
+		} else {
+			cb.n += n
+		}
+	}
+	return aPrime, bPrime, nil
+}
+
+// transformIndex returns position of a cursor at index after applying op
+func (op TextOp) transformIndex(index int) int {
+	newIndex := index
+	for _, c := range op {
+		switch {
+		case c.isRetain():
+			index -= c.n
+		case c.isInsert():
+			newIndex += len(c.ins)
+		default:
+			n := -c.n
+			if index < n {
+				newIndex -= index
+			} else {
+				newIndex -= n
+			}
+			index -= n
+		}
+		if index < 0 {
+			break
+		}
+	}
+	return newIndex
+}
+
+// textOpReplace returns an operation that changes a into b, touching only
+// the part between their common prefix and suffix
+func textOpReplace(a, b []uint16) TextOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	var op TextOp
+	op = op.retain(prefix)
+	op = op.delete(len(a) - prefix - suffix)
+	op = op.insert(b[prefix : len(b)-suffix])
+	return op.retain(suffix)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/kjk/u"
+)
+
+func randomTextOp(r *rand.Rand, doc []uint16) TextOp {
+	var op TextOp
+	for pos := 0; pos < len(doc); {
+		n := 1 + r.Intn(len(doc)-pos)
+		switch r.Intn(3) {
+		case 0:
+			op = op.retain(n)
+			pos += n
+		case 1:
+			op = op.delete(n)
+			pos += n
+		default:
+			op = op.insert(utf16.Encode([]rune("ab€😀")[:1+r.Intn(4)]))
+		}
+	}
+	if r.Intn(2) == 0 {
+		op = op.insert(utf16.Encode([]rune("z")))
+	}
+	return op
+}
+
+func TestTransformTextOps(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		doc := utf16.Encode([]rune("hello 😀 world")[:r.Intn(14)])
+		a := randomTextOp(r, doc)
+		b := randomTextOp(r, doc)
+		aPrime, bPrime, err := transformTextOps(a, b)
+		u.PanicIfErr(err)
+		docA, err := a.Apply(doc)
+		u.PanicIfErr(err)
+		docAB, err := bPrime.Apply(docA)
+		u.PanicIfErr(err)
+		docB, err := b.Apply(doc)
+		u.PanicIfErr(err)
+		docBA, err := aPrime.Apply(docB)
+		u.PanicIfErr(err)
+		if !reflect.DeepEqual(docAB, docBA) {
+			t.Fatalf("%v and %v on '%s' diverged: '%s' vs. '%s'", a, b, string(utf16.Decode(doc)), string(utf16.Decode(docAB)), string(utf16.Decode(docBA)))
+		}
+	}
+
+	_, _, err := transformTextOps(TextOp{}.retain(1), TextOp{}.retain(2))
+	if err == nil {
+		t.Fatalf("operations with different base lengths can't be transformed")
+	}
+}
+
+func TestTextOpJSON(t *testing.T) {
+	var v interface{}
+	u.PanicIfErr(json.Unmarshal([]byte(`[2, "x😀", -3, 1]`), &v))
+	op, err := parseTextOp(v)
+	u.PanicIfErr(err)
+	if op.BaseLen() != 6 || op.TargetLen() != 6 {
+		t.Fatalf("unexpected lengths of %v", op)
+	}
+	doc, err := op.Apply(utf16.Encode([]rune("abcdef")))
+	u.PanicIfErr(err)
+	if string(utf16.Decode(doc)) != "abx😀f" {
+		t.Fatalf("got '%s'", string(utf16.Decode(doc)))
+	}
+	d, err := json.Marshal(op)
+	u.PanicIfErr(err)
+	if string(d) != `[2,"x😀",-3,1]` {
+		t.Fatalf("got %s", d)
+	}
+
+	for _, s := range []string{`[0]`, `[1.5]`, `[""]`, `[true]`, `{}`} {
+		u.PanicIfErr(json.Unmarshal([]byte(s), &v))
+		if _, err = parseTextOp(v); err == nil {
+			t.Fatalf("'%s' should be invalid", s)
+		}
+	}
+	if _, err = op.Apply(utf16.Encode([]rune("abc"))); err == nil {
+		t.Fatalf("applying to a document of wrong length should fail")
+	}
+}
+
+func TestTextOpReplace(t *testing.T) {
+	a := utf16.Encode([]rune("hello world"))
+	b := utf16.Encode([]rune("hello big world"))
+	op := textOpReplace(a, b)
+	exp := TextOp{}.retain(6).insert(utf16.Encode([]rune("big "))).retain(5)
+	if !reflect.DeepEqual(op, exp) {
+		t.Fatalf("got %v", op)
+	}
+	if !textOpReplace(a, a).IsNoop() {
+		t.Fatalf("replacing with the same text should be a noop")
+	}
+	// cursors after the insert move, before it don't
+	if op.transformIndex(3) != 3 || op.transformIndex(8) != 12 {
+		t.Fatalf("unexpected transformed indexes %d, %d", op.transformIndex(3), op.transformIndex(8))
+	}
+	del := TextOp{}.retain(2).delete(4).retain(5)
+	if del.transformIndex(4) != 2 || del.transformIndex(9) != 5 {
+		t.Fatalf("unexpected transformed indexes %d, %d", del.transformIndex(4), del.transformIndex(9))
+	}
+}
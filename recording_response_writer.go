@@ -34,3 +34,8 @@ func (rrw *RecordingResponseWriter) WriteHeader(code int) {
 	rrw.Code = code
 	rrw.w.WriteHeader(code)
 }
+
+// Unwrap returns the wrapped ResponseWriter
+func (rrw *RecordingResponseWriter) Unwrap() http.ResponseWriter {
+	return rrw.w
+}
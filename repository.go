@@ -0,0 +1,1499 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+	"github.com/kjk/u"
+)
+
+/*
+Repository is the data access layer. It owns the database connection and
+prepared statements for frequently executed queries.
+
+All methods take a context.Context so that queries are cancelled when
+a client disconnects or the server shuts down.
+
+The server uses a single Repository (repo), opened at startup. Tests
+create one against a temporary sqlite database.
+*/
+
+// columns of notes table, in the order expected by scanNote
+const noteColumns = `id, user_id, curr_version_id, is_deleted, is_public, is_starred, is_encrypted, created_at, updated_at, size, format, title, content_sha1, tags`
+
+// columns of versions table, in the order expected by scanNoteVersion
+const versionColumns = `note_id, user_id, id, is_deleted, is_public, is_starred, is_encrypted, created_at, size, format, title, content_sha1, tags`
+
+var (
+	// repository used by the server, opened by openRepositoryMust
+	repo *Repository
+
+	// updateNote couldn't update a note because its current version is
+	// no longer note.baseVersionID
+	errStaleBaseVersion = errors.New("stale base version")
+)
+
+// how many times we re-read a note that was concurrently updated before
+// giving up
+const maxStaleBaseRetries = 5
+
+// Repository provides access to the database
+type Repository struct {
+	db *sql.DB
+
+	stmtGetNoteByID            *sql.Stmt
+	stmtGetNotesForUser        *sql.Stmt
+	stmtGetNoteVersions        *sql.Stmt
+	stmtGetNoteVersion         *sql.Stmt
+	stmtGetRecentPublicNotes   *sql.Stmt
+	stmtGetUserByID            *sql.Stmt
+	stmtGetUserByLogin         *sql.Stmt
+	stmtGetLatestVersion       *sql.Stmt
+	stmtGetNoteTombstones      *sql.Stmt
+	stmtGetEncryptedSample     *sql.Stmt
+	stmtUpdateNote             *sql.Stmt
+	stmtGetSimpleNoteImports   *sql.Stmt
+	stmtMarkSimpleNoteImported *sql.Stmt
+
+	// all prepared statements, for Close()
+	stmts []*sql.Stmt
+}
+
+// NewRepository creates a repository on top of a database with
+// an up-to-date schema
+func NewRepository(db *sql.DB) (*Repository, error) {
+	r := &Repository{db: db}
+	var err error
+	prepare := func(q string) *sql.Stmt {
+		if err != nil {
+			return nil
+		}
+		var stmt *sql.Stmt
+		stmt, err = db.Prepare(q)
+		if err != nil {
+			log.Errorf("db.Prepare('%s') failed with %s\n", q, err)
+			return nil
+		}
+		r.stmts = append(r.stmts, stmt)
+		return stmt
+	}
+
+	r.stmtGetNoteByID = prepare(`SELECT ` + noteColumns + ` FROM notes WHERE id=?`)
+	r.stmtGetNotesForUser = prepare(`SELECT ` + noteColumns + ` FROM notes WHERE user_id=?`)
+	r.stmtGetNoteVersions = prepare(`SELECT ` + versionColumns + ` FROM versions WHERE note_id=? ORDER BY id DESC`)
+	r.stmtGetNoteVersion = prepare(`SELECT ` + versionColumns + ` FROM versions WHERE id=? AND note_id=?`)
+	r.stmtGetRecentPublicNotes = prepare(`
+SELECT ` + noteColumns + `
+FROM notes
+WHERE is_public=true AND is_encrypted=false
+ORDER BY updated_at DESC
+LIMIT ?`)
+	r.stmtGetUserByID = prepare(`SELECT id, login, full_name, email, created_at, pro_state FROM users WHERE id=?`)
+	r.stmtGetUserByLogin = prepare(`SELECT id, login, full_name, email, created_at, pro_state FROM users WHERE login=?`)
+	r.stmtGetLatestVersion = prepare(`
+SELECT MAX(v) FROM (
+  SELECT MAX(id) AS v FROM versions WHERE user_id=?
+  UNION ALL
+  SELECT MAX(version_id) AS v FROM note_tombstones WHERE user_id=?
+) latest`)
+	r.stmtGetNoteTombstones = prepare(`SELECT version_id, note_id, deleted_at FROM note_tombstones WHERE user_id=? ORDER BY version_id`)
+	r.stmtGetEncryptedSample = prepare(`SELECT encrypted_sample FROM users WHERE id=?`)
+	// Note: I don't know why I need to explicitly set created_at, but it does get changed
+	// to the same value as updated_at when I don't set it here
+	r.stmtUpdateNote = prepare(`
+UPDATE notes SET
+  updated_at=?,
+  created_at=?,
+  content_sha1=?,
+  size=?,
+  format=?,
+  title=?,
+  tags=?,
+  is_public=?,
+  is_deleted=?,
+  is_starred=?,
+  is_encrypted=?,
+  curr_version_id=?,
+  versions_count = versions_count + 1
+WHERE id=? AND (?=0 OR curr_version_id=?)`)
+	r.stmtGetSimpleNoteImports = prepare(`SELECT note_id, simplenote_id, simplenote_version FROM simplenote_imports WHERE user_id = ?`)
+	r.stmtMarkSimpleNoteImported = prepare(`INSERT INTO simplenote_imports (user_id, note_id, simplenote_id, simplenote_version) VALUES (?, ?, ?, ?)`)
+
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// DB returns the underlying database, for code that works on the whole
+// database like migrations and backups
+func (r *Repository) DB() *sql.DB {
+	return r.db
+}
+
+// Close closes prepared statements and the database
+func (r *Repository) Close() error {
+	for _, stmt := range r.stmts {
+		stmt.Close()
+	}
+	r.stmts = nil
+	return r.db.Close()
+}
+
+// rollbackUnlessCommitted is meant to be deferred right after starting
+// a transaction. We set *txPtr to nil after commit
+func rollbackUnlessCommitted(txPtr **sql.Tx) {
+	if *txPtr != nil {
+		(*txPtr).Rollback()
+	}
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scans a row of noteColumns
+func scanNote(row rowScanner) (*Note, error) {
+	var n Note
+	var tagsSerialized string
+	err := row.Scan(
+		&n.id,
+		&n.userID,
+		&n.CurrVersionID,
+		&n.IsDeleted,
+		&n.IsPublic,
+		&n.IsStarred,
+		&n.IsEncrypted,
+		&n.CreatedAt,
+		&n.UpdatedAt,
+		&n.Size,
+		&n.Format,
+		&n.Title,
+		&n.ContentSha1,
+		&tagsSerialized)
+	if err != nil {
+		return nil, err
+	}
+	n.Tags = deserializeTags(tagsSerialized)
+	return &n, nil
+}
+
+// scans a row of versionColumns as a Note at that version. CurrVersionID
+// is the id of the version, CreatedAt and UpdatedAt are both the time the
+// version was created
+func scanNoteVersion(row rowScanner) (*Note, error) {
+	var n Note
+	var tagsSerialized string
+	err := row.Scan(
+		&n.id,
+		&n.userID,
+		&n.CurrVersionID,
+		&n.IsDeleted,
+		&n.IsPublic,
+		&n.IsStarred,
+		&n.IsEncrypted,
+		&n.CreatedAt,
+		&n.Size,
+		&n.Format,
+		&n.Title,
+		&n.ContentSha1,
+		&tagsSerialized)
+	if err != nil {
+		return nil, err
+	}
+	n.UpdatedAt = n.CreatedAt
+	n.Tags = deserializeTags(tagsSerialized)
+	n.HashID = hashInt(n.id)
+	return &n, nil
+}
+
+// scans all rows of noteColumns
+func scanNotes(rows *sql.Rows) ([]*Note, error) {
+	defer rows.Close()
+	var notes []*Note
+	for rows.Next() {
+		n, err := scanNote(rows)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+func (r *Repository) createNewNote(ctx context.Context, userID int, note *NewNote) (int, error) {
+	log.Verbosef("creating a new note '%s' for user %d\n", note.title, userID)
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer rollbackUnlessCommitted(&tx)
+
+	u.PanicIf(note.contentSha1 == nil, "note.contentSha1 is nil")
+	serializedTags := serializeTags(note.tags)
+
+	// for non-imported notes use current time as note creation time
+	if note.createdAt.IsZero() {
+		note.createdAt = time.Now()
+	}
+	vals := NewDbVals("notes", 8)
+	vals.Add("user_id", userID)
+	vals.Add("curr_version_id", 0)
+	vals.Add("versions_count", 1)
+	vals.Add("created_at", note.createdAt)
+	vals.Add("updated_at", note.createdAt)
+	vals.Add("content_sha1", note.contentSha1)
+	vals.Add("size", len(note.content))
+	vals.Add("format", note.format)
+	vals.Add("title", note.title)
+	vals.Add("tags", serializedTags)
+	vals.Add("is_deleted", note.isDeleted)
+	vals.Add("is_public", note.isPublic)
+	vals.Add("is_starred", false)
+	vals.Add("is_encrypted", note.isEncrypted)
+	res, err := vals.TxInsert(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+
+	noteID, err := res.LastInsertId()
+	if err != nil {
+		log.Errorf("res.LastInsertId() of noteID failed with %s\n", err)
+		return 0, err
+	}
+	versionID, err := nextVersionIDTx(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	vals = NewDbVals("versions", 13)
+	vals.Add("id", versionID)
+	vals.Add("note_id", noteID)
+	vals.Add("user_id", userID)
+	vals.Add("created_at", note.createdAt)
+	vals.Add("content_sha1", note.contentSha1)
+	vals.Add("size", len(note.content))
+	vals.Add("format", note.format)
+	vals.Add("title", note.title)
+	vals.Add("tags", serializedTags)
+	vals.Add("is_deleted", note.isDeleted)
+	vals.Add("is_public", note.isPublic)
+	vals.Add("is_starred", false)
+	vals.Add("is_encrypted", note.isEncrypted)
+	_, err = vals.TxInsert(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	note.currVersionID = versionID
+	q := `UPDATE notes SET curr_version_id=? WHERE id=?`
+	_, err = tx.ExecContext(ctx, q, versionID, noteID)
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with %s\n", q, err)
+		return 0, err
+	}
+	note.id = int(noteID)
+	err = r.saveNoteLinksTx(ctx, tx, userID, note)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	tx = nil
+	return int(noteID), err
+}
+
+// most operations mark a note as updated except for starring, which is why
+// we need markUpdated
+func (r *Repository) updateNote(ctx context.Context, userID int, note *NewNote, markUpdated bool) (int, error) {
+	log.Verbosef("noteID: %d, markUpdated: %v\n", note.id, markUpdated)
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if tx != nil {
+			log.Verbosef("noteID: %d, rolled back\n", note.id)
+			tx.Rollback()
+		}
+	}()
+
+	err = r.updateNoteTx(ctx, tx, userID, note, markUpdated)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	tx = nil
+
+	return note.id, err
+}
+
+// nextVersionIDTx allocates an id for a version or a tombstone. Ids come from
+// a counter instead of AUTO_INCREMENT of versions because MySQL before 8.0
+// re-uses ids of deleted rows after a restart and clients rely on ids
+// always increasing for incremental sync. The counter row stays locked
+// until tx ends
+func nextVersionIDTx(ctx context.Context, tx *sql.Tx) (int, error) {
+	q := `UPDATE version_ids SET id=id+1`
+	_, err := tx.ExecContext(ctx, q)
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with %s\n", q, err)
+		return 0, err
+	}
+	var id int
+	err = tx.QueryRowContext(ctx, `SELECT id FROM version_ids`).Scan(&id)
+	return id, err
+}
+
+// updateNoteTx creates a new version of the note as part of tx
+func (r *Repository) updateNoteTx(ctx context.Context, tx *sql.Tx, userID int, note *NewNote, markUpdated bool) error {
+	now := time.Now()
+	if note.createdAt.IsZero() {
+		note.createdAt = now
+		log.Verbosef("note.createdAt is zero, setting to %s\n", note.createdAt)
+	}
+
+	noteSize := len(note.content)
+
+	serializedTags := serializeTags(note.tags)
+	versionID, err := nextVersionIDTx(ctx, tx)
+	if err != nil {
+		return err
+	}
+	vals := NewDbVals("versions", 13)
+	vals.Add("id", versionID)
+	vals.Add("note_id", note.id)
+	vals.Add("user_id", userID)
+	vals.Add("size", noteSize)
+	vals.Add("created_at", now)
+	vals.Add("content_sha1", note.contentSha1)
+	vals.Add("format", note.format)
+	vals.Add("title", note.title)
+	vals.Add("tags", serializedTags)
+	vals.Add("is_deleted", note.isDeleted)
+	vals.Add("is_public", note.isPublic)
+	vals.Add("is_starred", note.isStarred)
+	vals.Add("is_encrypted", note.isEncrypted)
+
+	noteUpdatedAt := note.updatedAt
+	if markUpdated {
+		noteUpdatedAt = now
+	}
+	_, err = vals.TxInsert(ctx, tx)
+	if err != nil {
+		return err
+	}
+	log.Verbosef("inserted new version of note %d, new version id: %d\n", note.id, versionID)
+
+	//Maybe: could get versions_count as:
+	//q := `SELECT count(*) FROM versions WHERE note_id=?`
+
+	res, err := tx.StmtContext(ctx, r.stmtUpdateNote).ExecContext(ctx,
+		noteUpdatedAt,
+		note.createdAt,
+		note.contentSha1,
+		noteSize,
+		note.format,
+		note.title,
+		serializedTags,
+		note.isPublic,
+		note.isDeleted,
+		note.isStarred,
+		note.isEncrypted,
+		versionID,
+		note.id,
+		note.baseVersionID,
+		note.baseVersionID)
+	if err != nil {
+		log.Errorf("updating note %d failed with %s\n", note.id, err)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 && note.baseVersionID != 0 {
+		// the note was updated after we checked its current version
+		return errStaleBaseVersion
+	}
+
+	note.currVersionID = versionID
+	log.Verbosef("updated note with id %d, updated_at: %s, created_at: %s\n", note.id, noteUpdatedAt, note.createdAt)
+	return r.saveNoteLinksTx(ctx, tx, userID, note)
+}
+
+// UpdateNoteWith creates a new version of the note if updateFn changes it.
+// If the note is updated concurrently, updateFn is called again with the
+// updated note
+func (r *Repository) UpdateNoteWith(ctx context.Context, userID, noteID int, markUpdated bool, updateFn func(*NewNote) bool) error {
+	log.Verbosef("UpdateNoteWith: userID=%s, noteID=%s, markUpdated: %v\n", hashInt(userID), hashInt(noteID), markUpdated)
+	defer clearCachedUserInfo(userID)
+
+	for i := 0; i < maxStaleBaseRetries; i++ {
+		err := r.updateNoteWith(ctx, userID, noteID, markUpdated, updateFn)
+		if err != errStaleBaseVersion {
+			return err
+		}
+		log.Verbosef("UpdateNoteWith: note %d was updated concurrently, retrying\n", noteID)
+	}
+	return fmt.Errorf("note %d keeps being updated concurrently", noteID)
+}
+
+func (r *Repository) updateNoteWith(ctx context.Context, userID, noteID int, markUpdated bool, updateFn func(*NewNote) bool) error {
+	note, err := r.GetNoteByID(ctx, noteID)
+	if err != nil {
+		return err
+	}
+	if userID != note.userID {
+		return fmt.Errorf("mismatched note user. noteID: %d, userID: %d, note.userID: %d", noteID, userID, note.userID)
+	}
+	newNote, err := newNoteFromNote(note)
+	if err != nil {
+		return err
+	}
+	log.Verbosef("UpdateNoteWith: note.IsStarred: %v, newNote.isStarred: %v\n", note.IsStarred, newNote.isStarred)
+
+	shouldUpdate := updateFn(newNote)
+	if !shouldUpdate {
+		log.Verbosef("UpdateNoteWith: skipping update of noteID=%s because shouldUpdate=%v\n", hashInt(noteID), shouldUpdate)
+		return nil
+	}
+	_, err = r.updateNote(ctx, userID, newNote, markUpdated)
+	return err
+}
+
+// RestoreNoteVersion creates a new version of the note with content, title,
+// format and tags of its previous version. History is never rewritten
+func (r *Repository) RestoreNoteVersion(ctx context.Context, userID, noteID, versionID int) error {
+	version, err := r.GetNoteVersion(ctx, noteID, versionID)
+	if err != nil {
+		return err
+	}
+	content, err := getCachedContent(version.ContentSha1)
+	if err != nil {
+		return err
+	}
+	return r.UpdateNoteWith(ctx, userID, noteID, true, func(note *NewNote) bool {
+		shouldUpdate := !bytes.Equal(note.contentSha1, version.ContentSha1) ||
+			note.title != version.Title ||
+			note.format != version.Format ||
+			!strArrEqual(note.tags, version.Tags) ||
+			note.isEncrypted != version.IsEncrypted
+		note.content = content
+		note.contentSha1 = version.ContentSha1
+		note.title = version.Title
+		note.format = version.Format
+		note.tags = version.Tags
+		// encryption is a property of the content
+		note.isEncrypted = version.IsEncrypted
+		if note.isEncrypted {
+			note.isPublic = false
+		}
+		return shouldUpdate
+	})
+}
+
+// UpdateNoteTitle changes title of the note
+func (r *Repository) UpdateNoteTitle(ctx context.Context, userID, noteID int, newTitle string) error {
+	return r.UpdateNoteWith(ctx, userID, noteID, true, func(newNote *NewNote) bool {
+		shouldUpdate := newNote.title != newTitle
+		newNote.title = newTitle
+		return shouldUpdate
+	})
+}
+
+// UpdateNoteTags changes tags of the note
+func (r *Repository) UpdateNoteTags(ctx context.Context, userID, noteID int, newTags []string) error {
+	return r.UpdateNoteWith(ctx, userID, noteID, true, func(newNote *NewNote) bool {
+		shouldUpdate := !strArrEqual(newNote.tags, newTags)
+		newNote.tags = newTags
+		return shouldUpdate
+	})
+}
+
+// UpdateTagsOfNotes changes tags of all notes of the user, including
+// deleted, with updateFn in one transaction. Every changed note gets a new
+// version. Returns the number of changed notes. With dryRun only counts them
+func (r *Repository) UpdateTagsOfNotes(ctx context.Context, userID int, dryRun bool, updateFn func(tags []string) []string) (int, error) {
+	defer clearCachedUserInfo(userID)
+
+	for i := 0; i < maxStaleBaseRetries; i++ {
+		n, err := r.updateTagsOfNotes(ctx, userID, dryRun, updateFn)
+		if err != errStaleBaseVersion {
+			return n, err
+		}
+		// a note was updated after we've read it, start over
+		log.Verbosef("UpdateTagsOfNotes: notes of user %d were updated concurrently, retrying\n", userID)
+	}
+	return 0, fmt.Errorf("notes of user %d keep being updated concurrently", userID)
+}
+
+func (r *Repository) updateTagsOfNotes(ctx context.Context, userID int, dryRun bool, updateFn func(tags []string) []string) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer rollbackUnlessCommitted(&tx)
+	rows, err := tx.StmtContext(ctx, r.stmtGetNotesForUser).QueryContext(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	notes, err := scanNotes(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	nChanged := 0
+	for _, n := range notes {
+		newTags := updateFn(append([]string(nil), n.Tags...))
+		if strArrEqual(n.Tags, newTags) {
+			continue
+		}
+		nChanged++
+		if dryRun {
+			continue
+		}
+		newNote, err := newNoteFromNote(n)
+		if err != nil {
+			return 0, err
+		}
+		newNote.tags = newTags
+		err = r.updateNoteTx(ctx, tx, userID, newNote, true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if dryRun || nChanged == 0 {
+		// nothing was written
+		err = tx.Rollback()
+		tx = nil
+		return nChanged, err
+	}
+	err = tx.Commit()
+	tx = nil
+	return nChanged, err
+}
+
+func (r *Repository) getSelectCount(ctx context.Context, query string) (int, error) {
+	n := 0
+	err := r.db.QueryRowContext(ctx, query).Scan(&n)
+	return n, err
+}
+
+// GetUsersCount returns number of users
+func (r *Repository) GetUsersCount(ctx context.Context) (int, error) {
+	return r.getSelectCount(ctx, `SELECT count(*) from users`)
+}
+
+// GetNotesCount returns number of notes
+func (r *Repository) GetNotesCount(ctx context.Context) (int, error) {
+	return r.getSelectCount(ctx, `SELECT count(*) from notes`)
+}
+
+// GetVersionsCount returns number of versions of all notes
+func (r *Repository) GetVersionsCount(ctx context.Context) (int, error) {
+	return r.getSelectCount(ctx, `SELECT count(*) from versions`)
+}
+
+// CreateOrUpdateNote creates a new note. if note.createdAt is non-zero
+// value, this is an import of note from somewhere else, so we want to
+// preserve createdAt value
+func (r *Repository) CreateOrUpdateNote(ctx context.Context, userID int, note *NewNote) (int, error) {
+	log.Verbosef("userID: %d\n", userID)
+	var err error
+	if len(note.content) == 0 {
+		return 0, errors.New("empty note content")
+	}
+
+	if !isValidFormat(note.format) {
+		return 0, fmt.Errorf("invalid format %s", note.format)
+	}
+
+	defer clearCachedUserInfo(userID)
+
+	var noteID int
+	if note.hashID == "" {
+		note.contentSha1, err = saveContent(note.content, nil)
+		if err != nil {
+			log.Errorf("saveContent() failed with %s\n", err)
+			return 0, err
+		}
+		log.Verbosef("creating a new note %s\n", note.title)
+		noteID, err = r.createNewNote(ctx, userID, note)
+		note.hashID = hashInt(noteID)
+		return noteID, err
+	}
+
+	noteID, err = dehashInt(note.hashID)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < maxStaleBaseRetries; i++ {
+		err = r.updateExistingNote(ctx, userID, noteID, note)
+		if err == nil {
+			return noteID, nil
+		}
+		if err != errStaleBaseVersion {
+			return 0, err
+		}
+		// the note was updated after we merged, merge again with that update
+		log.Verbosef("note %d was updated concurrently, retrying\n", noteID)
+	}
+	current, err := r.GetNoteByID(ctx, noteID)
+	if err != nil {
+		return 0, err
+	}
+	return 0, &NoteConflictError{BaseVersionID: note.baseVersionID, Current: current}
+}
+
+// updateExistingNote is CreateOrUpdateNote of an existing note. Returns
+// errStaleBaseVersion if the note was updated concurrently
+func (r *Repository) updateExistingNote(ctx context.Context, userID, noteID int, note *NewNote) error {
+	existingNote, err := r.GetNoteByID(ctx, noteID)
+	if err != nil {
+		return err
+	}
+	u.PanicIf(noteID != existingNote.id)
+	if existingNote.userID != userID {
+		return fmt.Errorf("user %d is trying to update note that belongs to user %d", userID, existingNote.userID)
+	}
+
+	// don't overwrite changes made since the version the edit is based on
+	if note.baseVersionID != 0 && note.baseVersionID != existingNote.CurrVersionID {
+		err = r.mergeConcurrentEdit(ctx, existingNote, note)
+		if err != nil {
+			return err
+		}
+	}
+
+	note.contentSha1, err = saveContent(note.content, existingNote.ContentSha1)
+	if err != nil {
+		log.Errorf("saveContent() failed with %s\n", err)
+		return err
+	}
+
+	note.id = noteID
+
+	// when editing a note, we don't change starred status
+	note.isStarred = existingNote.IsStarred
+	// don't create new versions if not necessary
+	if !needsNewNoteVersion(note, existingNote) {
+		note.currVersionID = existingNote.CurrVersionID
+		return nil
+	}
+	log.Verbosef("updating existing note %d (%s). CreatedAt: %s, UpdatedAt: %s\n", existingNote.id, existingNote.HashID, existingNote.CreatedAt.Format(time.RFC3339), existingNote.UpdatedAt.Format(time.RFC3339))
+
+	note.createdAt = existingNote.CreatedAt
+	if note.rewriteLinks && note.title != existingNote.Title && note.title != "" && !note.isEncrypted {
+		return r.updateNoteRewritingLinks(ctx, userID, note, existingNote.Title)
+	}
+	_, err = r.updateNote(ctx, userID, note, true)
+	return err
+}
+
+// mergeConcurrentEdit merges changes made to the note since
+// note.baseVersionID into note. Title, format, tags and public state changed
+// only in current version are kept, if both changed the edit wins.
+// Returns NoteConflictError if changes of content overlap
+func (r *Repository) mergeConcurrentEdit(ctx context.Context, current *Note, note *NewNote) error {
+	conflict := &NoteConflictError{BaseVersionID: note.baseVersionID, Current: current}
+	// we can't look inside encrypted content
+	if note.isEncrypted || current.IsEncrypted {
+		return conflict
+	}
+	base, err := r.GetNoteVersion(ctx, current.id, note.baseVersionID)
+	if err != nil {
+		// the version might have been pruned
+		log.Errorf("r.GetNoteVersion() failed with %s\n", err)
+		return conflict
+	}
+	if base.IsEncrypted {
+		return conflict
+	}
+	baseContent, err := getNoteContent(base)
+	if err != nil {
+		return err
+	}
+	currentContent, err := getNoteContent(current)
+	if err != nil {
+		return err
+	}
+	merged, nConflicts := merge3(string(baseContent), string(currentContent), string(note.content))
+	if nConflicts > 0 {
+		conflict.Merged = merged
+		conflict.Conflicts = nConflicts
+		return conflict
+	}
+	log.Verbosef("merged edit of note %d based on version %d with version %d\n", current.id, note.baseVersionID, current.CurrVersionID)
+	note.content = []byte(merged)
+	if note.title == base.Title {
+		note.title = current.Title
+	}
+	if note.format == base.Format {
+		note.format = current.Format
+	}
+	if strArrEqual(note.tags, base.Tags) {
+		note.tags = current.Tags
+	}
+	if note.isPublic == base.IsPublic {
+		note.isPublic = current.IsPublic
+	}
+	note.baseVersionID = current.CurrVersionID
+	note.merged = true
+	return nil
+}
+
+// PermanentDeleteNote deletes the note and its versions, leaving
+// a tombstone. Content no longer referenced by any note is deleted from
+// local store by -gc
+// TODO: also delete from google storage
+func (r *Repository) PermanentDeleteNote(ctx context.Context, userID, noteID int) error {
+	defer clearCachedUserInfo(userID)
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rollbackUnlessCommitted(&tx)
+	var id int
+	q := `SELECT id FROM notes WHERE id=? AND user_id=?`
+	err = tx.QueryRowContext(ctx, q, noteID, userID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("user %d doesn't have note %d", userID, noteID)
+	}
+	if err != nil {
+		return err
+	}
+	// the tombstone is newer than all versions so that clients learn
+	// about the deletion in incremental sync
+	versionID, err := nextVersionIDTx(ctx, tx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	q = `
+DELETE FROM versions
+WHERE note_id=?`
+	_, err = tx.ExecContext(ctx, q, noteID)
+	if err != nil {
+		return err
+	}
+	q = `
+DELETE FROM attachments
+WHERE note_id=?`
+	_, err = tx.ExecContext(ctx, q, noteID)
+	if err != nil {
+		return err
+	}
+	linkSources, err := getLinkSourcesTx(ctx, tx, noteID)
+	if err != nil {
+		return err
+	}
+	q = `
+DELETE FROM note_links
+WHERE source_note_id=? OR target_note_id=?`
+	_, err = tx.ExecContext(ctx, q, noteID, noteID)
+	if err != nil {
+		return err
+	}
+	q = `
+DELETE FROM unresolved_note_links
+WHERE source_note_id=?`
+	_, err = tx.ExecContext(ctx, q, noteID)
+	if err != nil {
+		return err
+	}
+	q = `
+DELETE FROM notes
+WHERE id=?`
+	_, err = tx.ExecContext(ctx, q, noteID)
+	if err != nil {
+		return err
+	}
+	err = r.relinkNotesTx(ctx, tx, userID, linkSources)
+	if err != nil {
+		return err
+	}
+	vals := NewDbVals("note_tombstones", 4)
+	vals.Add("version_id", versionID)
+	vals.Add("user_id", userID)
+	vals.Add("note_id", noteID)
+	vals.Add("deleted_at", now)
+	_, err = vals.TxInsert(ctx, tx)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	tx = nil
+	return err
+}
+
+// DeleteNote moves the note to trash
+func (r *Repository) DeleteNote(ctx context.Context, userID, noteID int) error {
+	return r.UpdateNoteWith(ctx, userID, noteID, true, func(note *NewNote) bool {
+		shouldUpdate := !note.isDeleted
+		note.isDeleted = true
+		return shouldUpdate
+	})
+}
+
+// UndeleteNote restores the note from trash
+func (r *Repository) UndeleteNote(ctx context.Context, userID, noteID int) error {
+	return r.UpdateNoteWith(ctx, userID, noteID, true, func(note *NewNote) bool {
+		shouldUpdate := note.isDeleted
+		note.isDeleted = false
+		return shouldUpdate
+	})
+}
+
+// MakeNotePublic makes the note public
+func (r *Repository) MakeNotePublic(ctx context.Context, userID, noteID int) error {
+	// log.Verbosef("MakeNotePublic: userID=%d, noteID=%d", userID, noteID)
+	note, err := r.GetNoteByID(ctx, noteID)
+	if err != nil {
+		return err
+	}
+	if note.IsEncrypted {
+		return errEncryptedNotePublic
+	}
+	// note: doesn't update lastUpdate for stability of display
+	return r.UpdateNoteWith(ctx, userID, noteID, false, func(note *NewNote) bool {
+		shouldUpdate := !note.isPublic
+		note.isPublic = true
+		// log.Verbosef(" shouldUpdate=%v\n", shouldUpdate)
+		return shouldUpdate
+	})
+}
+
+// MakeNotePrivate makes the note private
+func (r *Repository) MakeNotePrivate(ctx context.Context, userID, noteID int) error {
+	// log.Verbosef("MakeNotePrivate: userID: %d, noteID: %d\n", userID, noteID)
+	// note: doesn't update lastUpdate for stability of display
+	return r.UpdateNoteWith(ctx, userID, noteID, false, func(note *NewNote) bool {
+		shouldUpdate := note.isPublic
+		note.isPublic = false
+		return shouldUpdate
+	})
+}
+
+// StarNote stars the note
+func (r *Repository) StarNote(ctx context.Context, userID, noteID int) error {
+	// note: doesn't update lastUpdate for stability of display
+	return r.UpdateNoteWith(ctx, userID, noteID, false, func(note *NewNote) bool {
+		log.Verbosef("StarNote: userID: %s, noteID: %s, isStarred: %v\n", hashInt(userID), hashInt(noteID), note.isStarred)
+		shouldUpdate := !note.isStarred
+		note.isStarred = true
+		return shouldUpdate
+	})
+}
+
+// UnstarNote un-stars the note
+func (r *Repository) UnstarNote(ctx context.Context, userID, noteID int) error {
+	log.Verbosef("UnstarNote: userID: %d, noteID: %d\n", userID, noteID)
+	// note: doesn't update lastUpdate for stability of display
+	return r.UpdateNoteWith(ctx, userID, noteID, false, func(note *NewNote) bool {
+		shouldUpdate := note.isStarred
+		note.isStarred = false
+		log.Verbosef("UnstarNote: shouldUpdate: %v\n", shouldUpdate)
+		return shouldUpdate
+	})
+}
+
+// GetAllNotes returns up to 10000 most recently updated notes
+// note: only use locally for testing search, not in production
+func (r *Repository) GetAllNotes(ctx context.Context) ([]*Note, error) {
+	log.Verbosef("GetAllNotes\n")
+	q := `
+SELECT ` + noteColumns + `
+FROM notes
+ORDER BY updated_at DESC
+LIMIT 10000`
+	rows, err := r.db.QueryContext(ctx, q)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with %s\n", q, err)
+		return nil, err
+	}
+	notes, err := scanNotes(rows)
+	if err != nil {
+		log.Errorf("scanNotes() for '%s' failed with %s\n", q, err)
+		return nil, err
+	}
+	for _, n := range notes {
+		n.SetCalculatedProperties()
+	}
+	return notes, nil
+}
+
+// GetAllVersionsSha1ForUser returns content sha1 of all versions of
+// user's notes and of their attachments
+func (r *Repository) GetAllVersionsSha1ForUser(ctx context.Context, userID int) ([][]byte, error) {
+	q := `
+SELECT content_sha1
+FROM versions
+WHERE note_id IN
+  (SELECT id FROM notes WHERE user_id = ?)
+UNION ALL
+SELECT content_sha1
+FROM attachments
+WHERE user_id = ?;
+`
+	rows, err := r.db.QueryContext(ctx, q, userID, userID)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with %s\n", q, err)
+		return nil, err
+	}
+	var res [][]byte
+	defer rows.Close()
+	for rows.Next() {
+		var sha1 []byte
+		err = rows.Scan(&sha1)
+		if err != nil {
+			log.Errorf("rows.Scan() failed with '%s'\n", err)
+			return nil, err
+		}
+		if len(sha1) != 20 {
+			log.Errorf("content_sha1 is %d bytes, should be 20\n", len(sha1))
+			return nil, fmt.Errorf("content_sha1 is %d bytes (should be 20)", len(sha1))
+		}
+		res = append(res, sha1)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Errorf("rows.Err() for '%s' failed with %s\n", q, err)
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetAllContentSha1 returns sha1 of content referenced by notes, their
+// versions and attachments as map of string(sha1) => true
+func (r *Repository) GetAllContentSha1(ctx context.Context) (map[string]bool, error) {
+	q := `
+SELECT content_sha1 FROM versions
+UNION
+SELECT content_sha1 FROM notes
+UNION
+SELECT content_sha1 FROM attachments`
+	return r.queryContentSha1(ctx, q)
+}
+
+// GetAttachmentsContentSha1 returns sha1 of content of attachments as map
+// of string(sha1) => true
+func (r *Repository) GetAttachmentsContentSha1(ctx context.Context) (map[string]bool, error) {
+	return r.queryContentSha1(ctx, `SELECT content_sha1 FROM attachments`)
+}
+
+// q must select a single content_sha1 column
+func (r *Repository) queryContentSha1(ctx context.Context, q string) (map[string]bool, error) {
+	rows, err := r.db.QueryContext(ctx, q)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with %s\n", q, err)
+		return nil, err
+	}
+	defer rows.Close()
+	res := map[string]bool{}
+	for rows.Next() {
+		var sha1 []byte
+		err = rows.Scan(&sha1)
+		if err != nil {
+			log.Errorf("rows.Scan() failed with '%s'\n", err)
+			return nil, err
+		}
+		res[string(sha1)] = true
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Errorf("rows.Err() for '%s' failed with %s\n", q, err)
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetAllVersionsContentSha1 returns content sha1 of versions of every
+// note, oldest first
+func (r *Repository) GetAllVersionsContentSha1(ctx context.Context) (map[int][][]byte, error) {
+	q := `SELECT note_id, content_sha1 FROM versions ORDER BY note_id, id`
+	rows, err := r.db.QueryContext(ctx, q)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with %s\n", q, err)
+		return nil, err
+	}
+	defer rows.Close()
+	res := map[int][][]byte{}
+	for rows.Next() {
+		var noteID int
+		var sha1 []byte
+		err = rows.Scan(&noteID, &sha1)
+		if err != nil {
+			log.Errorf("rows.Scan() failed with '%s'\n", err)
+			return nil, err
+		}
+		res[noteID] = append(res[noteID], sha1)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Errorf("rows.Err() for '%s' failed with %s\n", q, err)
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetVersionsForRetention returns all versions, ordered by note and
+// oldest first
+func (r *Repository) GetVersionsForRetention(ctx context.Context) ([]*VersionInfo, error) {
+	q := `SELECT id, note_id, created_at, content_sha1 FROM versions ORDER BY note_id, id`
+	rows, err := r.db.QueryContext(ctx, q)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with %s\n", q, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*VersionInfo
+	for rows.Next() {
+		var v VersionInfo
+		err = rows.Scan(&v.ID, &v.NoteID, &v.CreatedAt, &v.ContentSha1)
+		if err != nil {
+			log.Errorf("rows.Scan() failed with '%s'\n", err)
+			return nil, err
+		}
+		res = append(res, &v)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Errorf("rows.Err() for '%s' failed with %s\n", q, err)
+		return nil, err
+	}
+	return res, nil
+}
+
+// DeleteVersions deletes versions of a note. The current version of the
+// note is never deleted. Content no longer referenced by any version is
+// deleted from local store by -gc
+func (r *Repository) DeleteVersions(ctx context.Context, noteID int, versionIDs []int) error {
+	if len(versionIDs) == 0 {
+		return nil
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rollbackUnlessCommitted(&tx)
+	// delete in batches to stay below limit of sql variables
+	const batchSize = 500
+	for len(versionIDs) > 0 {
+		n := len(versionIDs)
+		if n > batchSize {
+			n = batchSize
+		}
+		args := []interface{}{noteID, noteID}
+		for _, id := range versionIDs[:n] {
+			args = append(args, id)
+		}
+		versionIDs = versionIDs[n:]
+		q := `
+DELETE FROM versions
+WHERE note_id=? AND id <> (SELECT curr_version_id FROM notes WHERE id=?) AND id IN (?` + strings.Repeat(",?", n-1) + `)`
+		_, err = tx.ExecContext(ctx, q, args...)
+		if err != nil {
+			log.Errorf("tx.Exec('%s') failed with %s\n", q, err)
+			return err
+		}
+	}
+	q := `
+UPDATE notes
+SET versions_count=(SELECT COUNT(*) FROM versions WHERE note_id=?)
+WHERE id=?`
+	_, err = tx.ExecContext(ctx, q, noteID, noteID)
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with %s\n", q, err)
+		return err
+	}
+	err = tx.Commit()
+	tx = nil
+	return err
+}
+
+// GetNotesForUser returns all notes of the user
+func (r *Repository) GetNotesForUser(ctx context.Context, user *DbUser) ([]*Note, error) {
+	rows, err := r.stmtGetNotesForUser.QueryContext(ctx, user.ID)
+	if err != nil {
+		log.Errorf("getting notes of user %d failed with %s\n", user.ID, err)
+		return nil, err
+	}
+	notes, err := scanNotes(rows)
+	if err != nil {
+		log.Errorf("scanNotes() for user %d failed with %s\n", user.ID, err)
+		return nil, err
+	}
+
+	// if note bodies are not cached locally, download them from google storage
+	// in parallel.
+	nWorkers := 64
+	sem := make(chan bool, nWorkers)
+	var wg sync.WaitGroup
+	for _, note := range notes {
+		sem <- true
+		wg.Add(1)
+		go func(note *Note) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			// force downloading of note content if not cached locally
+			note.SetCalculatedProperties()
+		}(note)
+	}
+	wg.Wait()
+	return notes, nil
+}
+
+// GetRecentPublicNotes returns up to limit most recently updated public notes
+func (r *Repository) GetRecentPublicNotes(ctx context.Context, limit int) ([]*Note, error) {
+	rows, err := r.stmtGetRecentPublicNotes.QueryContext(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := scanNotes(rows)
+	if err != nil {
+		log.Errorf("scanNotes() for recent public notes failed with %s\n", err)
+		return nil, err
+	}
+	for _, n := range notes {
+		n.SetCalculatedProperties()
+	}
+	return notes, nil
+}
+
+// GetPublicNotesCount returns number of public notes that are not deleted
+func (r *Repository) GetPublicNotesCount(ctx context.Context) (int, error) {
+	return r.getSelectCount(ctx, `
+SELECT count(*)
+FROM notes
+WHERE is_public = true AND is_deleted = false AND is_encrypted = false`)
+}
+
+// GetPublicNotesForIndex returns public notes that are not deleted, newest
+// first. Only id, HashID, userID, CreatedAt and Title are set
+func (r *Repository) GetPublicNotesForIndex(ctx context.Context) ([]*Note, error) {
+	q := `
+SELECT
+  id,
+  user_id,
+  created_at,
+  title
+FROM notes
+WHERE is_public = true AND is_deleted = false AND is_encrypted = false
+ORDER BY created_at DESC`
+	rows, err := r.db.QueryContext(ctx, q)
+	if err != nil {
+		log.Errorf("db.Query('%s') failed with '%s'\n", q, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*Note
+	for rows.Next() {
+		var n Note
+		err = rows.Scan(&n.id, &n.userID, &n.CreatedAt, &n.Title)
+		if err != nil {
+			return nil, err
+		}
+		n.HashID = hashInt(n.id)
+		res = append(res, &n)
+	}
+	return res, rows.Err()
+}
+
+// GetNoteByID returns a note
+func (r *Repository) GetNoteByID(ctx context.Context, id int) (*Note, error) {
+	n, err := scanNote(r.stmtGetNoteByID.QueryRowContext(ctx, id))
+	if err != nil {
+		return nil, err
+	}
+	n.SetCalculatedProperties()
+	log.Verbosef("note id: %d, CreatedAt: %s, UpdatedAt: %s\n", n.id, n.CreatedAt, n.UpdatedAt)
+	return n, nil
+}
+
+// GetNoteVersions returns all versions of a note, newest first. Snippets
+// are not set to avoid reading content of every version
+func (r *Repository) GetNoteVersions(ctx context.Context, noteID int) ([]*Note, error) {
+	rows, err := r.stmtGetNoteVersions.QueryContext(ctx, noteID)
+	if err != nil {
+		log.Errorf("getting versions of note %d failed with %s\n", noteID, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*Note
+	for rows.Next() {
+		n, err := scanNoteVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		n.IsPartial = n.Size > snippetSizeThreshold
+		res = append(res, n)
+	}
+	return res, rows.Err()
+}
+
+// GetNoteVersion returns a given version of a note
+func (r *Repository) GetNoteVersion(ctx context.Context, noteID, versionID int) (*Note, error) {
+	n, err := scanNoteVersion(r.stmtGetNoteVersion.QueryRowContext(ctx, versionID, noteID))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("note %d doesn't have version %d", noteID, versionID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	n.SetCalculatedProperties()
+	return n, nil
+}
+
+// GetLatestVersion returns the latest version of user's notes, including
+// tombstones
+func (r *Repository) GetLatestVersion(ctx context.Context, userID int) (int, error) {
+	var v sql.NullInt64
+	err := r.stmtGetLatestVersion.QueryRowContext(ctx, userID, userID).Scan(&v)
+	if err != nil {
+		log.Errorf("getting latest version of user %d failed with %s\n", userID, err)
+		return 0, err
+	}
+	return int(v.Int64), nil
+}
+
+// GetNoteTombstones returns tombstones of permanently deleted notes of
+// the user
+func (r *Repository) GetNoteTombstones(ctx context.Context, userID int) ([]*NoteTombstone, error) {
+	rows, err := r.stmtGetNoteTombstones.QueryContext(ctx, userID)
+	if err != nil {
+		log.Errorf("getting tombstones of user %d failed with %s\n", userID, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*NoteTombstone
+	for rows.Next() {
+		var t NoteTombstone
+		err = rows.Scan(&t.VersionID, &t.NoteID, &t.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, &t)
+	}
+	return res, rows.Err()
+}
+
+// id, login, full_name, email, created_at, pro_state
+func scanUser(row rowScanner) (*DbUser, error) {
+	var user DbUser
+	err := row.Scan(&user.ID, &user.Login, &user.FullName, &user.Email, &user.CreatedAt, &user.ProState)
+	if err != nil {
+		return nil, err
+	}
+	if !isValidProState(user.ProState) {
+		return nil, fmt.Errorf("invalid ProState '%d' for user %d", user.ProState, user.ID)
+	}
+	return &user, nil
+}
+
+// returns nil user if it doesn't exist
+func (r *Repository) getUserByStmt(ctx context.Context, stmt *sql.Stmt, arg interface{}) (*DbUser, error) {
+	user, err := scanUser(stmt.QueryRowContext(ctx, arg))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Errorf("getting user '%v' failed with '%s'\n", arg, err)
+		return nil, err
+	}
+	return user, nil
+}
+
+// GetUserByID returns a user. Returns nil user if it doesn't exist
+func (r *Repository) GetUserByID(ctx context.Context, userID int) (*DbUser, error) {
+	return r.getUserByStmt(ctx, r.stmtGetUserByID, userID)
+}
+
+// GetUserByLogin returns a user. Returns nil user if it doesn't exist
+func (r *Repository) GetUserByLogin(ctx context.Context, login string) (*DbUser, error) {
+	return r.getUserByStmt(ctx, r.stmtGetUserByLogin, login)
+}
+
+// GetAllUsers returns all users
+func (r *Repository) GetAllUsers(ctx context.Context) ([]*DbUser, error) {
+	q := `SELECT id, login, full_name, email, created_at, pro_state FROM users`
+	rows, err := r.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*DbUser
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, user)
+	}
+	return res, rows.Err()
+}
+
+// GetUserEncryptedSample returns encrypted sample of the user
+func (r *Repository) GetUserEncryptedSample(ctx context.Context, userID int) ([]byte, error) {
+	var sample []byte
+	err := r.stmtGetEncryptedSample.QueryRowContext(ctx, userID).Scan(&sample)
+	if err != nil {
+		log.Errorf("getting encrypted sample of user %d failed with %s\n", userID, err)
+		return nil, err
+	}
+	return sample, nil
+}
+
+// SetUserEncryptedSample sets encrypted sample of the user. Encrypted
+// sample is a known text encrypted by the client with the key derived from
+// user's passphrase. The client uses it to verify the passphrase. It can't
+// change while the user has encrypted notes because they would no longer
+// be readable
+func (r *Repository) SetUserEncryptedSample(ctx context.Context, userID int, sample []byte) error {
+	if len(sample) > maxEncryptedSampleSize {
+		return fmt.Errorf("encrypted sample is %d bytes, max is %d", len(sample), maxEncryptedSampleSize)
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rollbackUnlessCommitted(&tx)
+	n := 0
+	q := `SELECT count(*) FROM notes WHERE user_id=? AND is_encrypted=true`
+	err = tx.QueryRowContext(ctx, q, userID).Scan(&n)
+	if err != nil {
+		log.Errorf("tx.QueryRow('%s') failed with %s\n", q, err)
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("can't change encrypted sample of user %d who has %d encrypted notes", userID, n)
+	}
+	q = `UPDATE users SET encrypted_sample=? WHERE id=?`
+	_, err = tx.ExecContext(ctx, q, sample, userID)
+	if err != nil {
+		log.Errorf("tx.Exec('%s') failed with %s\n", q, err)
+		return err
+	}
+	err = tx.Commit()
+	tx = nil
+	return err
+}
+
+// GetOrCreateUser returns a user with a given login, creating it (with
+// a welcome note) if it doesn't exist
+// TODO: also insert oauthJSON
+func (r *Repository) GetOrCreateUser(ctx context.Context, userLogin string, fullName string) (*DbUser, error) {
+	user, err := r.GetUserByLogin(ctx, userLogin)
+	if user != nil {
+		u.PanicIfErr(err)
+		return user, nil
+	}
+
+	vals := NewDbVals("users", 3)
+	vals.Add("login", userLogin)
+	vals.Add("full_name", fullName)
+	vals.Add("pro_state", NotProEligible)
+	_, err = vals.Insert(ctx, r.db)
+	if err != nil {
+		return nil, err
+	}
+
+	dbUser, err := r.GetUserByLogin(ctx, userLogin)
+	if err != nil {
+		return nil, err
+	}
+
+	d := getWelcomeMD()
+	if len(d) > 0 {
+		note := &NewNote{
+			title:     "Welcome!",
+			format:    formatMarkdown,
+			content:   d,
+			tags:      []string{"quicknotes"},
+			createdAt: time.Now(),
+			isDeleted: false,
+			isPublic:  false,
+			isStarred: false,
+		}
+		_, err = r.CreateOrUpdateNote(ctx, dbUser.ID, note)
+		if err != nil {
+			log.Errorf("CreateOrUpdateNote() failed with '%s'\n", err)
+		}
+	}
+	return dbUser, err
+}
+
+// GetSimpleNoteImports returns notes imported from SimpleNote by the user
+func (r *Repository) GetSimpleNoteImports(ctx context.Context, userID int) ([]ImportedSimpleNote, error) {
+	rows, err := r.stmtGetSimpleNoteImports.QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []ImportedSimpleNote
+	for rows.Next() {
+		var sni ImportedSimpleNote
+		err = rows.Scan(&sni.NoteID, &sni.SimpleNoteID, &sni.SimpleNoteVersion)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, sni)
+	}
+	return res, rows.Err()
+}
+
+// MarkSimpleNoteImported records that a given version of SimpleNote note
+// was imported as noteID
+func (r *Repository) MarkSimpleNoteImported(ctx context.Context, userID, noteID int, simplenoteID string, simplenoteVersion int) error {
+	_, err := r.stmtMarkSimpleNoteImported.ExecContext(ctx, userID, noteID, simplenoteID, simplenoteVersion)
+	if err != nil {
+		log.Errorf("marking simplenote import (%v, %v, %v, %v) failed with '%s'\n", userID, noteID, simplenoteID, simplenoteVersion, err)
+	}
+	return err
+}
+
+// openRepository opens the database, creating or upgrading the schema
+// if necessary
+func openRepository() (*Repository, error) {
+	db, err := getQuickNotesDb()
+	if err != nil {
+		return nil, err
+	}
+	err = upgradeDb(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	r, err := NewRepository(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// opens repo
+func openRepositoryMust() {
+	if repo != nil {
+		return
+	}
+	var err error
+	repo, err = openRepository()
+	if err != nil {
+		log.Fatalf("openRepository() with %s failed with '%s'\n", getSQLConnectionSanitized(), err)
+	}
+}
+
+func closeRepository() {
+	if repo != nil {
+		repo.Close()
+		repo = nil
+	}
+}
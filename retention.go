@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+)
+
+/*
+Retention of note versions.
+
+Every edit creates a new version so notes accumulate many of them. A
+retention policy (-version-retention) decides which versions to keep:
+- all versions younger than all=<duration>
+- then the newest version in every hour, for versions younger than
+  hourly=<duration>
+- then the newest version in every day
+- always the first first=N and the last last=N versions (the current
+  version is always kept)
+
+e.g. -version-retention all=7d,hourly=30d,first=1,last=10
+
+Pruning deletes rows from versions table. Content referenced only by pruned
+versions (and not by attachments) is marked for deletion in local store and
+deleted from it and from other writable blob stores right after pruning
+(see CollectMarkedForDeletion).
+*/
+
+// RetentionPolicy describes which versions of notes to keep
+type RetentionPolicy struct {
+	KeepAll    time.Duration
+	KeepHourly time.Duration
+	KeepFirst  int
+	KeepLast   int
+}
+
+// VersionInfo describes a version for the purpose of pruning
+type VersionInfo struct {
+	ID          int
+	NoteID      int
+	CreatedAt   time.Time
+	ContentSha1 []byte
+}
+
+// PruneStats describes the result of pruning versions
+type PruneStats struct {
+	NotesCount     int
+	VersionsCount  int
+	NotesPruned    int
+	VersionsPruned int
+	// content no longer referenced after pruning
+	UnreferencedBlobs int
+}
+
+var (
+	// set from -version-retention, nil if versions are never pruned
+	versionRetention *RetentionPolicy
+)
+
+// like time.ParseDuration but also supports days e.g. "7d"
+func parseRetentionDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid number of days in '%s'", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// parseRetentionPolicy parses a spec like "all=7d,hourly=30d,first=1,last=10"
+func parseRetentionPolicy(spec string) (*RetentionPolicy, error) {
+	p := &RetentionPolicy{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid retention '%s', expected name=value", part)
+		}
+		var err error
+		switch kv[0] {
+		case "all":
+			p.KeepAll, err = parseRetentionDuration(kv[1])
+		case "hourly":
+			p.KeepHourly, err = parseRetentionDuration(kv[1])
+		case "first":
+			p.KeepFirst, err = strconv.Atoi(kv[1])
+		case "last":
+			p.KeepLast, err = strconv.Atoi(kv[1])
+		default:
+			return nil, fmt.Errorf("unknown retention '%s'", kv[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention '%s': %s", part, err)
+		}
+	}
+	if p.KeepFirst < 0 || p.KeepLast < 0 {
+		return nil, fmt.Errorf("invalid retention '%s', first and last can't be negative", spec)
+	}
+	if p.KeepHourly < p.KeepAll {
+		p.KeepHourly = p.KeepAll
+	}
+	return p, nil
+}
+
+// VersionsToPrune returns ids of versions of a single note (sorted by id)
+// that should be deleted
+func (p *RetentionPolicy) VersionsToPrune(versions []*VersionInfo, now time.Time) []int {
+	n := len(versions)
+	keepLast := p.KeepLast
+	if keepLast < 1 {
+		keepLast = 1
+	}
+	// newest version in each hourly or daily bucket
+	bucketNewest := map[string]int{}
+	for i, v := range versions {
+		age := now.Sub(v.CreatedAt)
+		if age < p.KeepAll {
+			continue
+		}
+		t := v.CreatedAt.UTC()
+		var bucket string
+		if age < p.KeepHourly {
+			bucket = t.Format("2006-01-02 15")
+		} else {
+			bucket = t.Format("2006-01-02")
+		}
+		bucketNewest[bucket] = i
+	}
+	keep := make([]bool, n)
+	for _, i := range bucketNewest {
+		keep[i] = true
+	}
+	var res []int
+	for i, v := range versions {
+		if i < p.KeepFirst || i >= n-keepLast || keep[i] || now.Sub(v.CreatedAt) < p.KeepAll {
+			continue
+		}
+		res = append(res, v.ID)
+	}
+	return res
+}
+
+// pruneVersions deletes versions of all notes according to policy and marks
+// content no longer referenced for deletion. With dryRun it only calculates
+// what would be deleted
+func pruneVersions(ctx context.Context, policy *RetentionPolicy, dryRun bool) (*PruneStats, error) {
+	versions, err := repo.GetVersionsForRetention(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stats := &PruneStats{
+		VersionsCount: len(versions),
+	}
+	now := time.Now()
+	byNote := map[int][]*VersionInfo{}
+	var noteIDs []int
+	for _, v := range versions {
+		if byNote[v.NoteID] == nil {
+			noteIDs = append(noteIDs, v.NoteID)
+		}
+		byNote[v.NoteID] = append(byNote[v.NoteID], v)
+	}
+	sort.Ints(noteIDs)
+	stats.NotesCount = len(noteIDs)
+
+	pruned := map[int]bool{}
+	for _, noteID := range noteIDs {
+		toPrune := policy.VersionsToPrune(byNote[noteID], now)
+		if len(toPrune) == 0 {
+			continue
+		}
+		stats.NotesPruned++
+		stats.VersionsPruned += len(toPrune)
+		for _, id := range toPrune {
+			pruned[id] = true
+		}
+		if dryRun {
+			continue
+		}
+		err = repo.DeleteVersions(ctx, noteID, toPrune)
+		if err != nil {
+			log.Errorf("repo.DeleteVersions() of note %d failed with %s\n", noteID, err)
+			return nil, err
+		}
+	}
+
+	// content of notes is also the content of their current versions
+	// which are never pruned
+	referenced := map[string]bool{}
+	for _, v := range versions {
+		if !pruned[v.ID] {
+			referenced[string(v.ContentSha1)] = true
+		}
+	}
+	// attachments can have the same content as a version
+	attached, err := repo.GetAttachmentsContentSha1(ctx)
+	if err != nil {
+		return nil, err
+	}
+	unreferenced := map[string]bool{}
+	var toDelete [][]byte
+	for _, v := range versions {
+		sha1 := string(v.ContentSha1)
+		if !pruned[v.ID] || referenced[sha1] || attached[sha1] || unreferenced[sha1] {
+			continue
+		}
+		unreferenced[sha1] = true
+		toDelete = append(toDelete, v.ContentSha1)
+	}
+	stats.UnreferencedBlobs = len(unreferenced)
+	if dryRun {
+		return stats, nil
+	}
+	// deleting rows is already committed so we must not forget the content
+	err = localStore.MarkForDeletion(toDelete)
+	if err != nil {
+		log.Errorf("localStore.MarkForDeletion() failed with %s\n", err)
+		return nil, err
+	}
+	return stats, nil
+}
+
+// pruneVersionsIfConfigured is a background task that prunes versions
+// according to -version-retention
+func pruneVersionsIfConfigured(ctx context.Context) {
+	if versionRetention == nil {
+		return
+	}
+	timeStart := time.Now()
+	stats, err := pruneVersions(ctx, versionRetention, false)
+	if err != nil {
+		log.Errorf("pruneVersions() failed with %s\n", err)
+		return
+	}
+	log.Infof("pruned %d of %d versions in %d notes, %d blobs no longer referenced, took %s\n", stats.VersionsPruned, stats.VersionsCount, stats.NotesPruned, stats.UnreferencedBlobs, time.Since(timeStart))
+	err = collectContentMarkedForDeletion(ctx)
+	if err != nil {
+		log.Errorf("collectContentMarkedForDeletion() failed with %s\n", err)
+	}
+}
+
+// runPruneVersions prunes versions according to -version-retention and
+// prints a report
+func runPruneVersions(dryRun bool) error {
+	if versionRetention == nil {
+		return fmt.Errorf("-version-retention must be given")
+	}
+	timeStart := time.Now()
+	stats, err := pruneVersions(context.Background(), versionRetention, dryRun)
+	if err != nil {
+		return err
+	}
+	verb := "pruned"
+	if dryRun {
+		verb = "would prune"
+	}
+	fmt.Printf("prune versions took %s\n", time.Since(timeStart))
+	fmt.Printf("notes: %d, versions: %d\n", stats.NotesCount, stats.VersionsCount)
+	fmt.Printf("%s %d versions in %d notes\n", verb, stats.VersionsPruned, stats.NotesPruned)
+	if dryRun {
+		fmt.Printf("content no longer referenced: %d blobs\n", stats.UnreferencedBlobs)
+		return nil
+	}
+	fmt.Printf("content no longer referenced: %d blobs, deleting it from blob stores\n", stats.UnreferencedBlobs)
+	return collectContentMarkedForDeletion(context.Background())
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kjk/u"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	p, err := parseRetentionPolicy("all=7d,hourly=720h,first=1,last=10")
+	u.PanicIfErr(err)
+	exp := &RetentionPolicy{
+		KeepAll:    7 * 24 * time.Hour,
+		KeepHourly: 720 * time.Hour,
+		KeepFirst:  1,
+		KeepLast:   10,
+	}
+	if !reflect.DeepEqual(p, exp) {
+		t.Fatalf("got %#v", p)
+	}
+	invalid := []string{"all", "foo=1", "all=xd", "last=-1", "first=a"}
+	for _, spec := range invalid {
+		if _, err = parseRetentionPolicy(spec); err == nil {
+			t.Fatalf("'%s' should be invalid", spec)
+		}
+	}
+}
+
+func TestVersionsToPrune(t *testing.T) {
+	now := time.Date(2020, 6, 30, 12, 0, 0, 0, time.UTC)
+	// ids are hours before now
+	hoursAgo := []int{24 * 40, 24*40 - 1, 24*20 + 2, 24*20 + 1, 24*20 + 1, 24 * 20, 50, 49, 3, 2, 1}
+	var versions []*VersionInfo
+	for i, h := range hoursAgo {
+		// minutes keep versions in the same hour in order
+		createdAt := now.Add(-time.Duration(h)*time.Hour + time.Duration(i)*time.Minute)
+		versions = append(versions, &VersionInfo{ID: i + 1, CreatedAt: createdAt})
+	}
+	p := &RetentionPolicy{
+		KeepAll:    48 * time.Hour,
+		KeepHourly: 30 * 24 * time.Hour,
+	}
+	// 1, 2 are in the same day, 4, 5 are in the same hour
+	got := p.VersionsToPrune(versions, now)
+	if !reflect.DeepEqual(got, []int{1, 4}) {
+		t.Fatalf("got %v", got)
+	}
+	p.KeepFirst = 1
+	got = p.VersionsToPrune(versions, now)
+	if !reflect.DeepEqual(got, []int{4}) {
+		t.Fatalf("got %v", got)
+	}
+
+	// only the newest version in a day is kept
+	p = &RetentionPolicy{}
+	got = p.VersionsToPrune(versions, now)
+	if !reflect.DeepEqual(got, []int{1, 3, 4, 5, 7, 9, 10}) {
+		t.Fatalf("got %v", got)
+	}
+	p.KeepLast = 8
+	got = p.VersionsToPrune(versions, now)
+	if !reflect.DeepEqual(got, []int{1, 3}) {
+		t.Fatalf("got %v", got)
+	}
+	// the last version is always kept
+	p.KeepLast = 0
+	if got = p.VersionsToPrune(versions[:1], now); len(got) != 0 {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestPruneVersions(t *testing.T) {
+	defer openTestDbMust()()
+	ctx := context.Background()
+
+	user, err := repo.GetOrCreateUser(ctx, "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	note := &NewNote{
+		title:  "pruned",
+		format: formatText,
+	}
+	var noteID int
+	for i := 0; i < 5; i++ {
+		note.content = []byte(fmt.Sprintf("version %d", i))
+		noteID, err = repo.CreateOrUpdateNote(ctx, user.ID, note)
+		u.PanicIfErr(err)
+	}
+	versions, err := repo.GetNoteVersions(ctx, noteID)
+	u.PanicIfErr(err)
+	// all but the last version were created on the same day, 10 days ago
+	old := time.Now().Add(-10 * 24 * time.Hour).UTC().Truncate(24 * time.Hour)
+	for i, v := range versions[1:] {
+		_, err = repo.DB().Exec(`UPDATE versions SET created_at=? WHERE id=?`, old.Add(time.Duration(i)*time.Minute), v.CurrVersionID)
+		u.PanicIfErr(err)
+	}
+
+	// an attachment with the same content as a pruned version
+	_, err = repo.CreateAttachment(ctx, user.ID, noteID, "attached.txt", []byte("version 1"))
+	u.PanicIfErr(err)
+
+	policy, err := parseRetentionPolicy("all=1d,hourly=2d")
+	u.PanicIfErr(err)
+	stats, err := pruneVersions(ctx, policy, true)
+	u.PanicIfErr(err)
+	// new users get a welcome note
+	exp := &PruneStats{
+		NotesCount:        2,
+		VersionsCount:     6,
+		NotesPruned:       1,
+		VersionsPruned:    3,
+		UnreferencedBlobs: 2,
+	}
+	if !reflect.DeepEqual(stats, exp) {
+		t.Fatalf("got %#v", stats)
+	}
+	n, err := repo.GetVersionsCount(ctx)
+	u.PanicIfErr(err)
+	if n != 6 {
+		t.Fatalf("dry run deleted versions, %d left", n)
+	}
+
+	stats, err = pruneVersions(ctx, policy, false)
+	u.PanicIfErr(err)
+	if !reflect.DeepEqual(stats, exp) {
+		t.Fatalf("got %#v", stats)
+	}
+	left, err := repo.GetNoteVersions(ctx, noteID)
+	u.PanicIfErr(err)
+	if len(left) != 2 || left[0].CurrVersionID != versions[0].CurrVersionID || left[1].CurrVersionID != versions[1].CurrVersionID {
+		t.Fatalf("unexpected versions left %#v", left)
+	}
+	var versionsCount int
+	u.PanicIfErr(repo.DB().QueryRow(`SELECT versions_count FROM notes WHERE id=?`, noteID).Scan(&versionsCount))
+	if versionsCount != 2 {
+		t.Fatalf("expected versions_count 2, got %d", versionsCount)
+	}
+
+	// content of pruned versions is deleted unless referenced
+	u.PanicIfErr(collectContentMarkedForDeletion(ctx))
+	for i := 0; i < 5; i++ {
+		d := []byte(fmt.Sprintf("version %d", i))
+		has, err := localStore.Has(u.Sha1OfBytes(d))
+		u.PanicIfErr(err)
+		if expHas := i != 0 && i != 2; has != expHas {
+			t.Fatalf("'%s': expected Has() %v, got %v", d, expHas, has)
+		}
+	}
+
+	// nothing left to prune
+	stats, err = pruneVersions(ctx, policy, false)
+	u.PanicIfErr(err)
+	if stats.VersionsPruned != 0 {
+		t.Fatalf("got %#v", stats)
+	}
+}
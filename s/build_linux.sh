@@ -9,4 +9,7 @@ rm -rf static/dist/*.map static/dist/*.js static/dist/*.css quicknotes_resources
 
 go run tools/gen_resources.go
 
+# cross-compiling disables cgo so the binary only supports -db mysql.
+# -db sqlite (github.com/mattn/go-sqlite3) needs cgo: build on linux
+# (musl for the alpine image) with CGO_ENABLED=1
 GOOS=linux GOARCH=amd64 go build -o quicknotes_linux -ldflags "-X main.sha1ver=`git rev-parse HEAD`"
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/kjk/u"
+)
+
+// S3Store is a BlobStore backed by S3-compatible storage. Credentials are
+// taken from the environment (AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY)
+// or ~/.aws/credentials
+type S3Store struct {
+	svc    *s3.S3
+	bucket string
+}
+
+// NewS3Store creates a store for a given bucket. endpoint is optional and
+// allows using S3-compatible services like MinIO
+func NewS3Store(endpoint, region, bucket string) (*S3Store, error) {
+	conf := &aws.Config{
+		Region: aws.String(region),
+	}
+	if endpoint != "" {
+		conf.Endpoint = aws.String(endpoint)
+		// MinIO and most other S3 clones don't support bucket.host urls
+		conf.S3ForcePathStyle = aws.Bool(true)
+	}
+	return NewS3StoreWithConfig(conf, bucket)
+}
+
+// NewS3StoreWithConfig creates a store with a given aws config
+func NewS3StoreWithConfig(conf *aws.Config, bucket string) (*S3Store, error) {
+	sess, err := session.NewSession(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Store{svc: s3.New(sess), bucket: bucket}, nil
+}
+
+// Name returns name of the store
+func (s *S3Store) Name() string {
+	return "s3:" + s.bucket
+}
+
+func isS3NotFound(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusNotFound
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == s3.ErrCodeNoSuchKey
+	}
+	return false
+}
+
+// Put uploads d unless it's already in the bucket
+func (s *S3Store) Put(d []byte) ([]byte, error) {
+	sha1 := u.Sha1OfBytes(d)
+	has, err := s.Has(sha1)
+	if err != nil {
+		return nil, err
+	}
+	if has {
+		return sha1, nil
+	}
+	params := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(blobStoragePath(sha1)),
+		Body:        bytes.NewReader(d),
+		ContentType: aws.String("text/plain"),
+	}
+	_, err = s.svc.PutObject(params)
+	if err != nil {
+		return nil, err
+	}
+	return sha1, nil
+}
+
+// Get downloads the blob
+func (s *S3Store) Get(sha1 []byte) ([]byte, error) {
+	return s.GetLimited(sha1, -1)
+}
+
+// GetLimited downloads up to limit bytes of the blob
+func (s *S3Store) GetLimited(sha1 []byte, limit int) ([]byte, error) {
+	if limit == 0 {
+		return nil, nil
+	}
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(blobStoragePath(sha1)),
+	}
+	if limit > 0 {
+		params.Range = aws.String(fmt.Sprintf("bytes=0-%d", limit-1))
+	}
+	res, err := s.svc.GetObject(params)
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+	d, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return truncateBlob(d, limit), nil
+}
+
+// Has returns true if the blob is in the bucket
+func (s *S3Store) Has(sha1 []byte) (bool, error) {
+	params := &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(blobStoragePath(sha1)),
+	}
+	_, err := s.svc.HeadObject(params)
+	if err != nil {
+		if isS3NotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Delete deletes the blob from the bucket
+func (s *S3Store) Delete(sha1 []byte) error {
+	params := &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(blobStoragePath(sha1)),
+	}
+	_, err := s.svc.DeleteObject(params)
+	if err != nil && isS3NotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// List lists all blobs in the bucket
+func (s *S3Store) List(fn func(sha1 []byte) error) error {
+	params := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String("notes_sha1/"),
+	}
+	var fnErr error
+	err := s.svc.ListObjectsV2Pages(params,
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				sha1 := sha1FromHex(aws.StringValue(obj.Key))
+				if sha1 == nil {
+					continue
+				}
+				fnErr = fn(sha1)
+				if fnErr != nil {
+					return false
+				}
+			}
+			return true
+		})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
@@ -169,7 +169,8 @@ func sortMatchPositions(m *Match) {
 // search a note for list of terms. This is AND search i.e. all terms
 // must be found
 func searchNote(terms []string, note *Note, maxMatches int) *Match {
-	if note.IsDeleted {
+	// we can't search encrypted content
+	if note.IsDeleted || note.IsEncrypted {
 		return nil
 	}
 	var res *Match
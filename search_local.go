@@ -2,6 +2,7 @@ package main
 
 import (
 	"compress/bzip2"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -118,7 +119,7 @@ func printSearchResults(term string, matches []*MatchWithSimpleNote) {
 
 func searchAllNotesTest(term string, maxResults int) {
 	timeStart := time.Now()
-	notes, err := dbGetAllNotes()
+	notes, err := repo.GetAllNotes(context.Background())
 	u.PanicIfErr(err)
 	fmt.Printf("got %d notes in %s\n", len(notes), time.Since(timeStart))
 
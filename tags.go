@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// tags can be hierarchical e.g. "work/projects/alpha" is a child of
+// "work/projects". They're stored as is in the tags column
+const tagPathSep = "/"
+
+// UpdateTagsRsp is a result of renameTag, mergeTags and deleteTag. With
+// DryRun, NotesCount is the number of notes that would be changed
+type UpdateTagsRsp struct {
+	NotesCount int
+	DryRun     bool
+}
+
+func validateTag(tag string) error {
+	if strings.TrimSpace(tag) == "" {
+		return errors.New("tag can't be empty")
+	}
+	if strings.Contains(tag, tagSepStr) {
+		return fmt.Errorf("invalid tag '%s'", tag)
+	}
+	for _, part := range strings.Split(tag, tagPathSep) {
+		if strings.TrimSpace(part) == "" {
+			return fmt.Errorf("invalid tag '%s'", tag)
+		}
+	}
+	return nil
+}
+
+// tagIsInSubtree returns true if tag is parent or its descendant
+func tagIsInSubtree(tag, parent string) bool {
+	return tag == parent || strings.HasPrefix(tag, parent+tagPathSep)
+}
+
+func noteHasTagInSubtree(note *Note, parent string) bool {
+	for _, tag := range note.Tags {
+		if tagIsInSubtree(tag, parent) {
+			return true
+		}
+	}
+	return false
+}
+
+// TagNode is a node in a tree of hierarchical tags. Count is the number of
+// notes that have Path or any of its descendants
+type TagNode struct {
+	Name     string
+	Path     string
+	Count    int
+	Children []*TagNode `json:",omitempty"`
+}
+
+// buildTagTree builds a tree of tags of notes that are not deleted. Parent
+// nodes exist even if no note has the parent tag itself
+func buildTagTree(notes []*Note) []*TagNode {
+	root := &TagNode{}
+	nodes := map[string]*TagNode{}
+	for _, note := range notes {
+		if note.IsDeleted {
+			continue
+		}
+		counted := map[string]bool{}
+		for _, tag := range note.Tags {
+			parent := root
+			parts := strings.Split(tag, tagPathSep)
+			for i, name := range parts {
+				path := strings.Join(parts[:i+1], tagPathSep)
+				node := nodes[path]
+				if node == nil {
+					node = &TagNode{Name: name, Path: path}
+					nodes[path] = node
+					parent.Children = append(parent.Children, node)
+				}
+				if !counted[path] {
+					counted[path] = true
+					node.Count++
+				}
+				parent = node
+			}
+		}
+	}
+	sortTagNodes(root.Children)
+	return root.Children
+}
+
+func sortTagNodes(nodes []*TagNode) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+	for _, node := range nodes {
+		sortTagNodes(node.Children)
+	}
+}
+
+// replaceTags replaces tags in from with to, at the position of the first
+// of them, without creating duplicates. Descendants of from are moved under
+// to. Empty to removes them together with descendants
+func replaceTags(tags []string, from []string, to string) []string {
+	var res []string
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		for _, parent := range from {
+			if tagIsInSubtree(tag, parent) {
+				if to == "" {
+					tag = ""
+				} else {
+					tag = to + tag[len(parent):]
+				}
+				break
+			}
+		}
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		res = append(res, tag)
+	}
+	return res
+}
+
+func jsonMapGetStringArray(m map[string]interface{}, key string) ([]string, error) {
+	v, ok := m[key]
+	if !ok {
+		return nil, fmt.Errorf("no '%s' in %v", key, m)
+	}
+	a, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not an array. Type: %T, value: '%v'", key, v, v)
+	}
+	var res []string
+	for _, el := range a {
+		s, ok := el.(string)
+		if !ok {
+			return nil, fmt.Errorf("'%s' has a non-string element '%v'", key, el)
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// wsUpdateTags changes a tag and its descendants in all notes of the user:
+// - renameTag: from, to
+// - mergeTags: tags, into
+// - deleteTag: tag
+// With dryRun (optional) only counts notes that would be changed
+func wsUpdateTags(ctx *ReqContext, cmd string, args map[string]interface{}) (*UpdateTagsRsp, error) {
+	if ctx.User == nil {
+		return nil, errors.New("user not logged in")
+	}
+	var from []string
+	var to string
+	var err error
+	switch cmd {
+	case "renameTag":
+		var tag string
+		tag, err = jsonMapGetString(args, "from")
+		if err == nil {
+			from = []string{tag}
+			to, err = jsonMapGetString(args, "to")
+		}
+		if err == nil {
+			err = validateTag(to)
+		}
+	case "mergeTags":
+		from, err = jsonMapGetStringArray(args, "tags")
+		if err == nil {
+			to, err = jsonMapGetString(args, "into")
+		}
+		if err == nil {
+			err = validateTag(to)
+		}
+	case "deleteTag":
+		var tag string
+		tag, err = jsonMapGetString(args, "tag")
+		from = []string{tag}
+	default:
+		err = fmt.Errorf("unknown command '%s'", cmd)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(from) == 0 {
+		return nil, errors.New("no tags to change")
+	}
+
+	dryRun, _ := args["dryRun"].(bool)
+	n, err := repo.UpdateTagsOfNotes(ctx.Context(), ctx.User.id, dryRun, func(tags []string) []string {
+		return replaceTags(tags, from, to)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &UpdateTagsRsp{
+		NotesCount: n,
+		DryRun:     dryRun,
+	}, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/kjk/u"
+)
+
+func TestReplaceTags(t *testing.T) {
+	tests := []struct {
+		tags []string
+		from []string
+		to   string
+		exp  []string
+	}{
+		{[]string{"a", "b"}, []string{"a"}, "c", []string{"c", "b"}},
+		{[]string{"a", "b"}, []string{"x"}, "c", []string{"a", "b"}},
+		{[]string{"a", "b", "c"}, []string{"a", "c"}, "b", []string{"b"}},
+		{[]string{"x", "a", "b"}, []string{"b", "a"}, "c", []string{"x", "c"}},
+		{[]string{"a", "b"}, []string{"a"}, "", []string{"b"}},
+		{[]string{"a"}, []string{"a"}, "", nil},
+		{[]string{"a/b", "ab", "a/b/c"}, []string{"a"}, "x", []string{"x/b", "ab", "x/b/c"}},
+		{[]string{"a/b", "x/b"}, []string{"a"}, "x", []string{"x/b"}},
+		{[]string{"a", "a/b/c", "b"}, []string{"a/b"}, "c", []string{"a", "c/c", "b"}},
+		{[]string{"a", "a/b", "ab"}, []string{"a"}, "", []string{"ab"}},
+	}
+	for _, test := range tests {
+		got := replaceTags(test.tags, test.from, test.to)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Fatalf("replacing %v with '%s' in %v gave %v, expected %v", test.from, test.to, test.tags, got, test.exp)
+		}
+	}
+}
+
+func TestUpdateTags(t *testing.T) {
+	defer openTestDbMust()()
+
+	user, err := repo.GetOrCreateUser(context.Background(), "twitter:test", "Test User")
+	u.PanicIfErr(err)
+	ctx := &ReqContext{User: userSummaryFromDbUser(user)}
+	var noteIDs []int
+	for i, tags := range [][]string{{"go", "todo"}, {"golang"}, {"todo"}} {
+		note := &NewNote{
+			title:   "tagged",
+			format:  formatText,
+			content: []byte{byte('a' + i)},
+			tags:    tags,
+		}
+		noteID, err := repo.CreateOrUpdateNote(ctx.Context(), user.ID, note)
+		u.PanicIfErr(err)
+		noteIDs = append(noteIDs, noteID)
+	}
+	nVersions, err := repo.GetVersionsCount(ctx.Context())
+	u.PanicIfErr(err)
+	getTags := func(noteID int) []string {
+		n, err := repo.GetNoteByID(ctx.Context(), noteID)
+		u.PanicIfErr(err)
+		return n.Tags
+	}
+
+	args := map[string]interface{}{
+		"tags":   []interface{}{"go", "golang"},
+		"into":   "go",
+		"dryRun": true,
+	}
+	rsp, err := wsUpdateTags(ctx, "mergeTags", args)
+	u.PanicIfErr(err)
+	// the first note already has only "go"
+	if rsp.NotesCount != 1 || !rsp.DryRun {
+		t.Fatalf("unexpected %#v", rsp)
+	}
+	if !reflect.DeepEqual(getTags(noteIDs[1]), []string{"golang"}) {
+		t.Fatalf("dry run changed tags")
+	}
+	delete(args, "dryRun")
+	rsp, err = wsUpdateTags(ctx, "mergeTags", args)
+	u.PanicIfErr(err)
+	if rsp.NotesCount != 1 || !reflect.DeepEqual(getTags(noteIDs[1]), []string{"go"}) {
+		t.Fatalf("unexpected %#v, tags: %v", rsp, getTags(noteIDs[1]))
+	}
+
+	rsp, err = wsUpdateTags(ctx, "renameTag", map[string]interface{}{"from": "todo", "to": "later"})
+	u.PanicIfErr(err)
+	if rsp.NotesCount != 2 || !reflect.DeepEqual(getTags(noteIDs[0]), []string{"go", "later"}) {
+		t.Fatalf("unexpected %#v, tags: %v", rsp, getTags(noteIDs[0]))
+	}
+	rsp, err = wsUpdateTags(ctx, "deleteTag", map[string]interface{}{"tag": "go"})
+	u.PanicIfErr(err)
+	if rsp.NotesCount != 2 || len(getTags(noteIDs[1])) != 0 {
+		t.Fatalf("unexpected %#v, tags: %v", rsp, getTags(noteIDs[1]))
+	}
+	// every change created a version
+	n, err := repo.GetVersionsCount(ctx.Context())
+	u.PanicIfErr(err)
+	if n != nVersions+5 {
+		t.Fatalf("expected %d versions, got %d", nVersions+5, n)
+	}
+
+	_, err = wsUpdateTags(ctx, "renameTag", map[string]interface{}{"from": "later", "to": " "})
+	if err == nil {
+		t.Fatalf("renaming to empty tag should fail")
+	}
+}
+
+func TestValidateTag(t *testing.T) {
+	for _, tag := range []string{"a", "work/projects/alpha"} {
+		if err := validateTag(tag); err != nil {
+			t.Fatalf("'%s' should be valid, got %s", tag, err)
+		}
+	}
+	for _, tag := range []string{"", " ", "/a", "a/", "a//b", "a/ /b"} {
+		if err := validateTag(tag); err == nil {
+			t.Fatalf("'%s' should be invalid", tag)
+		}
+	}
+}
+
+func TestBuildTagTree(t *testing.T) {
+	newNote := func(isDeleted bool, tags ...string) *Note {
+		n := &Note{}
+		n.Tags = tags
+		n.IsDeleted = isDeleted
+		return n
+	}
+	notes := []*Note{
+		newNote(false, "work/projects/alpha", "work/projects/beta"),
+		newNote(false, "work", "home"),
+		newNote(false, "work/projects"),
+		newNote(true, "work/todo"),
+	}
+	got := buildTagTree(notes)
+	exp := []*TagNode{
+		{Name: "home", Path: "home", Count: 1},
+		{Name: "work", Path: "work", Count: 3, Children: []*TagNode{
+			{Name: "projects", Path: "work/projects", Count: 2, Children: []*TagNode{
+				{Name: "alpha", Path: "work/projects/alpha", Count: 1},
+				{Name: "beta", Path: "work/projects/beta", Count: 1},
+			}},
+		}},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		d, _ := json.Marshal(got)
+		t.Fatalf("unexpected tree %s", d)
+	}
+
+	if !noteHasTagInSubtree(notes[0], "work") || !noteHasTagInSubtree(notes[0], "work/projects/alpha") {
+		t.Fatalf("note should be in subtree")
+	}
+	if noteHasTagInSubtree(notes[0], "wor") || noteHasTagInSubtree(notes[2], "work/projects/alpha") {
+		t.Fatalf("note shouldn't be in subtree")
+	}
+}
@@ -239,6 +239,7 @@ func createResourcesZip(path string) {
 	dir := filepath.Join(topDir, "static")
 	addZipDirMust(zw, dir, topDir)
 	addZipFileMust(zw, "createdb.sql", "createdb.sql")
+	addZipFileMust(zw, "createdb_sqlite.sql", "createdb_sqlite.sql")
 	path = filepath.Join("data", "welcome.md")
 	addZipFileMust(zw, path, path)
 	err = zw.Close()
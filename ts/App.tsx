@@ -96,7 +96,8 @@ export function appDebugShowNotes() {
 }
 
 function gotBroadcastedNotes(err: Error, notes: Note[]) {
-  if (err) {
+  // notes is null if we need to re-sync
+  if (err || !notes) {
     return;
   }
   console.log('got notes');
@@ -118,7 +119,7 @@ window.addEventListener('DOMContentLoaded', () => {
   api.wsRegisterForBroadcastedMessage(
     'broadcastUserNotes',
     gotBroadcastedNotes,
-    api.getNotesConvertResult
+    api.userNotesFromBroadcast
   );
   api.openWebSocket();
 });
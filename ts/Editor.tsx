@@ -96,6 +96,8 @@ class NoteInEditor {
   body: string;
   isPublic: boolean;
   formatName: string;
+  // version the edit is based on, 0 for new notes
+  baseVersionID: number;
 
   constructor(
     id: string,
@@ -103,7 +105,8 @@ class NoteInEditor {
     tags: string,
     body: string,
     isPublic: boolean,
-    formatName: string
+    formatName: string,
+    baseVersionID: number
   ) {
     this.id = id;
     this.title = title;
@@ -111,6 +114,7 @@ class NoteInEditor {
     this.body = body;
     this.isPublic = isPublic;
     this.formatName = formatName;
+    this.baseVersionID = baseVersionID;
   }
 
   isText(): boolean {
@@ -133,7 +137,8 @@ function noteFromCompact(note: Note, body: string): NoteInEditor {
   const tagsStr = tagsToText(tags);
   const isPublic = note.IsPublic();
   const formatName = note.Format();
-  return new NoteInEditor(id, title, tagsStr, body, isPublic, formatName);
+  const baseVersionID = parseInt(note.CurrentVersion(), 10);
+  return new NoteInEditor(id, title, tagsStr, body, isPublic, formatName, baseVersionID);
 }
 
 interface NoteJSON {
@@ -143,6 +148,12 @@ interface NoteJSON {
   Content: string;
   Tags: string[];
   IsPublic: boolean;
+  // Title and Content are encrypted
+  IsEncrypted?: boolean;
+  // server rejects the edit if the note was changed since this version
+  BaseVersionID?: number;
+  // if the title changes, server updates [[title]] links in other notes
+  RewriteLinks?: boolean;
 }
 
 function toNewNoteJSON(note: NoteInEditor) {
@@ -153,12 +164,13 @@ function toNewNoteJSON(note: NoteInEditor) {
     Content: note.body.trim() + '\n',
     Tags: textToTags(note.tags),
     IsPublic: note.isPublic,
+    BaseVersionID: note.baseVersionID,
   };
   return JSON.stringify(n);
 }
 
 function newEmptyNote(): NoteInEditor {
-  return new NoteInEditor(null, '', '', '', false, FormatMarkdown);
+  return new NoteInEditor(null, '', '', '', false, FormatMarkdown, 0);
 }
 
 function didNoteChange(n1: NoteInEditor, n2: NoteInEditor): boolean {
@@ -824,19 +836,60 @@ export default class Editor extends Component<any, State> {
     });
     action.showTemporaryMessage('Saving note...', 500);
     const isNewNote = note.id;
-    api.createOrUpdateNote(noteJSON, (err: Error, note: any) => {
+    api.createOrUpdateNote(noteJSON, (err: api.WsError, rsp: api.CreateOrUpdateNoteResp) => {
+      if (err && err.conflict) {
+        // keep the edit, saving it again overwrites changes made elsewhere
+        const conflict = err.conflict;
+        note.baseVersionID = conflict.CurrentVersionID;
+        if (conflict.Merged) {
+          note.body = conflict.Merged;
+          const msg = `The note was changed elsewhere. Resolve ${conflict.Conflicts} conflict(s) marked in the text and save again.`;
+          action.showTemporaryMessage(msg);
+        } else {
+          action.showTemporaryMessage('The note was changed elsewhere. Save again to overwrite those changes.');
+        }
+        this.startEditingNote(note);
+        return;
+      }
       if (err) {
         action.showTemporaryMessage('Failed to create a note');
         return;
       }
-      const hashID = note.HashID;
+      const hashID = rsp.HashID;
+      this.adoptSavedNote(note, rsp);
       let msg = isNewNote
         ? `Updated <a href="/n/${hashID}" target="_blank">the note</a>.`
         : `Created <a href="/n/${hashID}" target="_blank">the note</a>.`;
+      if (rsp.Merged) {
+        msg = `Merged with changes made elsewhere and updated <a href="/n/${hashID}" target="_blank">the note</a>.`;
+      }
       action.showTemporaryMessage(msg);
     });
   }
 
+  // saved is the note as it was sent to the server. Further edits must be
+  // based on the version it created and, if it was merged with changes made
+  // elsewhere, on the merged note
+  adoptSavedNote(saved: NoteInEditor, rsp: api.CreateOrUpdateNoteResp) {
+    const before = deepCloneObject(saved);
+    saved.id = rsp.HashID;
+    saved.baseVersionID = rsp.CurrVersionID;
+    if (rsp.Merged) {
+      saved.title = rsp.Title || '';
+      saved.body = rsp.Content || '';
+      saved.tags = tagsToText(rsp.Tags || []);
+      saved.formatName = rsp.Format;
+      saved.isPublic = !!rsp.IsPublic;
+    }
+    // the note might have been opened again before saving finished. If it
+    // wasn't changed since, continue with the saved note. Otherwise saving
+    // it merges with the saved note on the server
+    const editing = this.state.note;
+    if (this.state.isShowing && editing.id == saved.id && !didNoteChange(before, editing)) {
+      this.startEditingNote(saved);
+    }
+  }
+
   handleCancel(e: any) {
     this.setState({
       isShowing: false,
@@ -15,6 +15,8 @@ const noteFormatIdx = 6;
 const noteTagsIdx = 7;
 const noteSnippetIdx = 8;
 const noteContentIdx = 9;
+// only in getNote
+const noteBacklinksIdx = 10;
 
 /*
 Keep expanded/collapsed state of notes as an array. We could try
@@ -85,6 +87,11 @@ export class Note extends Array {
     return this[noteContentIdx] as string;
   }
 
+  // links to this note from other notes, only set in result of getNote
+  Backlinks(): api.NoteLink[] {
+    return (this[noteBacklinksIdx] as api.NoteLink[]) || [];
+  }
+
   SetTitle(title: string) {
     this[noteTitleIdx] = title;
   }
@@ -126,6 +133,11 @@ export class Note extends Array {
     return this.isFlagSet(flagTruncatedBit);
   }
 
+  // title and content are encrypted by the client
+  IsEncrypted(): boolean {
+    return this.isFlagSet(flagEncryptedBit);
+  }
+
   NeedsExpansion(): boolean {
     return this.IsPartial() || this.IsTruncated();
   }
@@ -188,6 +200,7 @@ const flagDeletedBit = 1;
 const flagPublicBit = 2;
 const flagPartialBit = 3;
 const flagTruncatedBit = 4;
+const flagEncryptedBit = 5;
 
 // must match db.go
 export const FormatText = 'txt';
@@ -25,6 +25,25 @@ interface wsResponse {
   cmd: string;
   result: any;
   error?: string;
+  conflict?: NoteConflict;
+}
+
+// sent with an error when createOrUpdateNote is based on a version that is
+// no longer the current version of the note and changes couldn't be merged.
+// Note is the current version, with content. Merged is the content with
+// overlapping changes between conflict markers, empty if it couldn't be
+// merged at all
+export interface NoteConflict {
+  NoteHashID: string;
+  BaseVersionID: number;
+  CurrentVersionID: number;
+  Note: Note;
+  Merged: string;
+  Conflicts: number;
+}
+
+export interface WsError extends Error {
+  conflict?: NoteConflict;
 }
 
 interface WsReq {
@@ -77,7 +96,11 @@ function wsProcessRsp(rsp: wsResponse) {
   }
   if (rsp.error) {
     console.log('error response', rsp, 'for request', req);
-    const err = new Error(rsp.error);
+    const err: WsError = new Error(rsp.error);
+    if (rsp.conflict) {
+      err.conflict = rsp.conflict;
+      err.conflict.Note = toNote(rsp.conflict.Note);
+    }
     req.cb(err, null);
     return;
   }
@@ -323,10 +346,61 @@ function post(url: string, args: ArgsDict, cb: any, cbErr: any) {
   });
 }
 
+// a file attached to a note, served at URL
+export interface Attachment {
+  HashID: string;
+  NoteHashID: string;
+  Name: string;
+  Size: number;
+  URL: string;
+}
+
+export interface AttachmentsResp {
+  NoteHashID: string;
+  Attachments: Attachment[];
+}
+
+// uploads a file and attaches it to the note. cb gets Attachment
+export function uploadAttachment(noteHashID: string, file: File, cb: any, cbErr?: any) {
+  const body = new FormData();
+  body.append('noteHashID', noteHashID);
+  body.append('file', file, file.name);
+  const params: any = {
+    method: 'POST',
+    url: '/api/upload_attachment',
+    body: body,
+  };
+  ajax(params, function(code, respTxt) {
+    handleResponse(code, respTxt, cb, cbErr);
+  });
+}
+
+export function getAttachments(noteHashID: string, cb: WsCb) {
+  const args: any = {
+    noteHashID,
+  };
+  wsSendReq('getAttachments', args, cb, null);
+}
+
+// node in a tree of hierarchical tags. Count is the number of notes that
+// have Path or any of its descendants
+export interface TagNode {
+  Name: string;
+  Path: string;
+  Count: number;
+  Children?: TagNode[];
+}
+
 interface GetNotesResp {
   LoggedUser?: UserInfo;
   Notes?: any[];
+  // if SinceVersion is set, Notes only has notes changed after
+  // SinceVersion and DeletedNotes has hashed ids of deleted notes
+  DeletedNotes?: string[];
+  // always for all notes
+  TagTree?: TagNode[];
   LatestVersion?: number;
+  SinceVersion?: number;
 }
 
 interface GetNotesCallback {
@@ -366,36 +440,64 @@ function keyUserNotes(userIDHash: string) {
   return `notes:${userIDHash}`;
 }
 
+// notes we have for a given user and the version they are at
+let syncedNotes: Dict<GetNotesResp> = {};
+
+function noteHashID(note: any[]): string {
+  const s = note[0] as string;
+  return s.split('-')[0];
+}
+
+// applies a full or incremental result of getNotes to notes we have
+function mergeNotes(prev: GetNotesResp, result: GetNotesResp): any[] {
+  const changed = result.Notes || [];
+  if (!result.SinceVersion || !prev) {
+    return changed;
+  }
+  let replaced: Dict<boolean> = {};
+  for (const note of changed) {
+    replaced[noteHashID(note)] = true;
+  }
+  for (const hashID of result.DeletedNotes || []) {
+    replaced[hashID] = true;
+  }
+  const unchanged = (prev.Notes || []).filter(note => !replaced[noteHashID(note)]);
+  return changed.concat(unchanged);
+}
+
+// remembers notes after merging result and returns them
+function syncNotes(userIDHash: string, result: GetNotesResp): Note[] {
+  const val: GetNotesResp = {
+    Notes: mergeNotes(syncedNotes[userIDHash], result),
+    TagTree: result.TagTree || [],
+    LatestVersion: result.LatestVersion || 0,
+  };
+  syncedNotes[userIDHash] = val;
+
+  // cache the notes if the result is for logged in user
+  if (result.LoggedUser && result.LoggedUser.HashID == userIDHash) {
+    const key = keyUserNotes(userIDHash);
+    localforage.setItem(key, val, function(err: any) {
+      if (err) {
+        console.log(`caching notes for key '${key}' failed with ${err}`);
+      } else {
+        console.log(`cached notes for key '${key}'`);
+      }
+    });
+  }
+  return toNotes(val.Notes.slice());
+}
+
 // calls cb with Note[] and broadcasts action.updateNotes
-function getNotes(userIDHash: string, myLatestVersion: number, cb: WsCb) {
+// asks only for notes changed since the version of notes we have
+function getNotes(userIDHash: string, cb: WsCb) {
+  const prev = syncedNotes[userIDHash];
+  const myLatestVersion = prev ? prev.LatestVersion : 0;
   const args: any = {
     userIDHash,
     latestVersion: myLatestVersion,
   };
 
-  function getNotesConvertResult(result: GetNotesResp): Note[] {
-    if (!result || !result.Notes) {
-      return [];
-    }
-
-    // cache the notes if the result is for logged in user
-    const key = keyUserNotes(userIDHash);
-    if (result.LoggedUser && result.LoggedUser.HashID == userIDHash) {
-      const val: any = {
-        Notes: result.Notes,
-        LatestVersion: result.LatestVersion || 0,
-      };
-      localforage.setItem(key, val, function(err: any) {
-        if (err) {
-          console.log(`caching notes for key '${key}' failed with ${err}`);
-        } else {
-          console.log(`cached notes for key '${key}'`);
-        }
-      });
-    }
-    return toNotes(result.Notes);
-  }
-
   wsSendReq('getNotes', args, getNotesCb);
 
   function getNotesCb(err: Error, result: GetNotesResp) {
@@ -408,7 +510,7 @@ function getNotes(userIDHash: string, myLatestVersion: number, cb: WsCb) {
     if (result.LatestVersion == myLatestVersion) {
       return;
     }
-    const notes = getNotesConvertResult(result);
+    const notes = syncNotes(userIDHash, result);
     cb(null, notes);
     action.updateNotes(notes);
   }
@@ -421,15 +523,31 @@ export function getNotesCached(userIDHash: string, cb: WsCb) {
   function gotCachedNotes(err: any, cachedNotes: GetNotesResp) {
     if (err || !cachedNotes) {
       console.log(`no cached notes for key '${key}'`);
-      getNotes(userIDHash, 0, cb);
+      getNotes(userIDHash, cb);
       return;
     }
     console.log(`got notes for key '${key}' from cache`);
-    // note: we use LoggedUser but I don't think it's used
-    const notes = getNotesConvertResult(cachedNotes);
+    syncedNotes[userIDHash] = cachedNotes;
+    const notes = getNotesConvertResult({ Notes: cachedNotes.Notes.slice() });
     cb(null, notes);
-    getNotes(userIDHash, cachedNotes.LatestVersion, cb);
+    getNotes(userIDHash, cb);
+  }
+}
+
+// converts broadcastUserNotes, which has notes changed by the latest
+// operation. Returns null if we missed earlier changes, in which case we
+// ask for them and broadcast action.updateNotes when we get them
+export function userNotesFromBroadcast(result: GetNotesResp): Note[] {
+  if (!result || !result.LoggedUser) {
+    return null;
   }
+  const userIDHash = result.LoggedUser.HashID;
+  const prev = syncedNotes[userIDHash];
+  if (result.SinceVersion && (!prev || prev.LatestVersion < result.SinceVersion)) {
+    getNotes(userIDHash, function() {});
+    return null;
+  }
+  return syncNotes(userIDHash, result);
 }
 
 // calls cb with Note[]
@@ -445,6 +563,230 @@ export function getNote(noteHashID: string, cb: WsCb) {
   wsSendReq('getNote', args, cb, toNote);
 }
 
+// a link to or from a note. Notes link to other notes with [[Note title]]
+// or note urls
+export interface NoteLink {
+  NoteHashID: string;
+  Title: string;
+  Anchor: string;
+}
+
+export interface BacklinksResp {
+  NoteHashID: string;
+  Backlinks: NoteLink[];
+}
+
+// links to the note from other notes, also part of getNote result
+export function getBacklinks(noteHashID: string, cb: WsCb) {
+  const args: any = {
+    noteHashID,
+  };
+  wsSendReq('getBacklinks', args, cb, null);
+}
+
+export interface NoteVersionsResp {
+  NoteHashID: string;
+  Versions: any[];
+}
+
+function noteVersionsConvertResult(result: NoteVersionsResp): Note[] {
+  if (!result || !result.Versions) {
+    return [];
+  }
+  return toNotes(result.Versions);
+}
+
+// versions of a note, newest first. Version() of each note is version id
+export function getNoteVersions(noteHashID: string, cb: WsCb) {
+  const args: any = {
+    noteHashID,
+  };
+  wsSendReq('getNoteVersions', args, cb, noteVersionsConvertResult);
+}
+
+export function getNoteVersion(noteHashID: string, versionID: number, cb: WsCb) {
+  const args: any = {
+    noteHashID,
+    versionID,
+  };
+  wsSendReq('getNoteVersion', args, cb, toNote);
+}
+
+export interface DiffWord {
+  Op: string; // '=', '+' or '-'
+  Text: string;
+}
+
+export interface DiffLine {
+  Op: string; // '=', '+' or '-'
+  Text: string;
+  Words?: DiffWord[];
+}
+
+export interface DiffHunk {
+  OldStart: number;
+  OldLines: number;
+  NewStart: number;
+  NewLines: number;
+  Lines: DiffLine[];
+}
+
+export interface NoteDiffResp {
+  NoteHashID: string;
+  FromVersionID: number;
+  ToVersionID: number;
+  Hunks: DiffHunk[];
+}
+
+// diff between 2 versions of a note. toVersionID of 0 means the current
+// version. if words is true, changed lines have word-level changes
+export function getNoteDiff(noteHashID: string, fromVersionID: number, toVersionID: number, words: boolean, cb: WsCb) {
+  const args: any = {
+    noteHashID,
+    fromVersionID,
+    toVersionID,
+    words,
+  };
+  wsSendReq('getNoteDiff', args, cb, null);
+}
+
+// creates a new version of the note with content of version versionID
+export function restoreNoteVersion(noteHashID: string, versionID: number, cb: WsCb) {
+  const args: any = {
+    noteHashID,
+    versionID,
+  };
+  wsSendReq('restoreNoteVersion', args, cb, toNote);
+}
+
+// result of renameTag, mergeTags and deleteTag. With dryRun, NotesCount is
+// the number of notes that would be changed
+export interface UpdateTagsResp {
+  NotesCount: number;
+  DryRun: boolean;
+}
+
+// renames a tag in all notes
+export function renameTag(from: string, to: string, dryRun: boolean, cb: WsCb) {
+  const args: any = {
+    from,
+    to,
+    dryRun,
+  };
+  wsSendReq('renameTag', args, cb, null);
+}
+
+// replaces tags with into in all notes
+export function mergeTags(tags: string[], into: string, dryRun: boolean, cb: WsCb) {
+  const args: any = {
+    tags,
+    into,
+    dryRun,
+  };
+  wsSendReq('mergeTags', args, cb, null);
+}
+
+// removes a tag from all notes
+export function deleteTag(tag: string, dryRun: boolean, cb: WsCb) {
+  const args: any = {
+    tag,
+    dryRun,
+  };
+  wsSendReq('deleteTag', args, cb, null);
+}
+
+// collaborative editing of a note. Operations are in ot.js format: a list of
+// retain (n > 0), delete (n < 0) or insert (string). Lengths are in UTF-16
+// code units, like JavaScript strings
+export type TextOp = (number | string)[];
+
+export interface CollabSelection {
+  Anchor: number;
+  Head: number;
+}
+
+export interface CollabPresence {
+  ClientID: number;
+  UserName: string;
+  Selection?: CollabSelection;
+}
+
+export interface CollabJoinResp {
+  NoteHashID: string;
+  ClientID: number;
+  Revision: number;
+  Content: string;
+  Clients: CollabPresence[];
+}
+
+// result of collabOp and collabSelect
+export interface CollabOpResp {
+  NoteHashID: string;
+  Revision: number;
+}
+
+// broadcasted as collabOp when an operation of another client is applied.
+// ClientID is 0 for changes made by the server
+export interface CollabOpMsg {
+  NoteHashID: string;
+  Revision: number;
+  ClientID: number;
+  Op: TextOp;
+  Selection?: CollabSelection;
+}
+
+// broadcasted as collabPresence when clients join, leave or change selection
+export interface CollabPresenceMsg {
+  NoteHashID: string;
+  Clients: CollabPresence[];
+}
+
+export function collabJoin(noteHashID: string, cb: WsCb) {
+  const args: any = {
+    noteHashID,
+  };
+  wsSendReq('collabJoin', args, cb, null);
+}
+
+// op is based on revision. selection is after applying op
+export function collabOp(noteHashID: string, revision: number, op: TextOp, selection: CollabSelection, cb: WsCb) {
+  const args: any = {
+    noteHashID,
+    revision,
+    op,
+    selection,
+  };
+  wsSendReq('collabOp', args, cb, null);
+}
+
+export function collabSelect(noteHashID: string, revision: number, selection: CollabSelection, cb: WsCb) {
+  const args: any = {
+    noteHashID,
+    revision,
+    selection,
+  };
+  wsSendReq('collabSelect', args, cb, null);
+}
+
+// broadcasted as collabConflict (with NoteConflict as the result) when the
+// document couldn't be saved because of overlapping edits made outside of
+// the session. After changing the document to resolve the conflict, call
+// collabResolve with CurrentVersionID of the conflict to save it
+export function collabResolve(noteHashID: string, versionID: number, cb: WsCb) {
+  const args: any = {
+    noteHashID,
+    versionID,
+  };
+  wsSendReq('collabResolve', args, cb, null);
+}
+
+export function collabLeave(noteHashID: string, cb: WsCb) {
+  const args: any = {
+    noteHashID,
+  };
+  wsSendReq('collabLeave', args, cb, null);
+}
+
 export function undeleteNote(noteHashID: string, cb: WsCb) {
   const args: any = {
     noteHashID,
@@ -494,6 +836,22 @@ export function unstarNote(noteHashID: string, cb: WsCb) {
   wsSendReq('unstarNote', args, cb, toNote);
 }
 
+// result of createOrUpdateNote. If the edit was merged with changes made
+// since its BaseVersionID, Merged is true and the rest describes the saved
+// note. LinksRewritten is the number of notes whose links to a renamed note
+// were changed because of RewriteLinks
+export interface CreateOrUpdateNoteResp {
+  HashID: string;
+  CurrVersionID: number;
+  Merged: boolean;
+  LinksRewritten?: number;
+  Title?: string;
+  Content?: string;
+  Tags?: string[];
+  Format?: string;
+  IsPublic?: boolean;
+}
+
 export function createOrUpdateNote(noteJSON: string, cb: WsCb) {
   const args: any = {
     noteJSON,
@@ -501,11 +859,26 @@ export function createOrUpdateNote(noteJSON: string, cb: WsCb) {
   wsSendReq('createOrUpdateNote', args, cb, null);
 }
 
-export function searchUserNotes(userIDHash: string, searchTerm: string, cb: WsCb) {
+export function getEncryptedSample(cb: WsCb) {
+  wsSendReq('getEncryptedSample', {}, cb, null);
+}
+
+export function setEncryptedSample(encryptedSample: string, cb: WsCb) {
+  const args: any = {
+    encryptedSample,
+  };
+  wsSendReq('setEncryptedSample', args, cb, null);
+}
+
+// if tag is given, only searches notes with the tag or its descendants
+export function searchUserNotes(userIDHash: string, searchTerm: string, cb: WsCb, tag?: string) {
   const args: any = {
     userIDHash,
     searchTerm,
   };
+  if (tag) {
+    args.tag = tag;
+  }
   wsSendReq('searchUserNotes', args, cb, null);
 }
 
@@ -10,13 +10,17 @@ export function isUndefined(v: any) {
   return typeof v === 'undefined';
 }
 
+// tags are hierarchical e.g. 'work/projects' is a child of 'work'
+export const tagPathSep = '/';
+
+// returns true if note has tag or any of its descendants
 export function noteHasTag(note: Note, tag: string) {
   const tags = note.Tags();
   if (!tags) {
     return false;
   }
   for (let tag2 of tags) {
-    if (tag2 == tag) {
+    if (tag2 == tag || tag2.startsWith(tag + tagPathSep)) {
       return true;
     }
   }
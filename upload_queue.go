@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kjk/quicknotes/pkg/log"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+/*
+UploadQueue is a persistent queue of uploads of content from LocalStore to
+remote stores (async: stores in -blob-stores). Saving a note only has to
+wait for the write to LocalStore and the queue, which is fast and doesn't
+depend on the network.
+
+The queue lives in LocalStore's leveldb under keys:
+  upq:{sha1}{store name} => json-serialized uploadQueueItem
+
+Background workers upload content and remove items from the queue. Failed
+uploads are retried with exponential backoff.
+*/
+
+const (
+	defaultUploadWorkers = 4
+	uploadRetryMinDelay  = 5 * time.Second
+	uploadRetryMaxDelay  = time.Hour
+	// how often we check the queue if nothing wakes us up
+	uploadQueuePollInterval = time.Minute
+)
+
+var (
+	dbKeyPrefixUploadQueue = []byte("upq:")
+
+	// queue of uploads to async: stores, created by openBlobStoresMust
+	uploadQueue *UploadQueue
+)
+
+type uploadQueueItem struct {
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// UploadQueueFailure describes an upload that failed at least once
+type UploadQueueFailure struct {
+	Sha1        []byte
+	Store       string
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+}
+
+// UploadQueueStatus describes the state of the queue
+type UploadQueueStatus struct {
+	// number of pending uploads per store
+	Pending  map[string]int
+	Failed   []*UploadQueueFailure
+	Uploaded int
+}
+
+// Count returns number of pending uploads
+func (s *UploadQueueStatus) Count() int {
+	n := 0
+	for _, c := range s.Pending {
+		n += c
+	}
+	return n
+}
+
+// UploadQueue uploads content from LocalStore to remote stores in the
+// background
+type UploadQueue struct {
+	src *LocalStore
+
+	mu       sync.Mutex
+	stores   map[string]BlobStore
+	inFlight map[string]bool
+	uploaded int
+
+	wakeup chan bool
+	stop   chan bool
+	wg     sync.WaitGroup
+}
+
+// NewUploadQueue creates a queue of uploads of content from src
+func NewUploadQueue(src *LocalStore) *UploadQueue {
+	return &UploadQueue{
+		src:      src,
+		stores:   map[string]BlobStore{},
+		inFlight: map[string]bool{},
+		wakeup:   make(chan bool, 1),
+	}
+}
+
+// AddStore registers a store we upload to
+func (q *UploadQueue) AddStore(store BlobStore) {
+	q.mu.Lock()
+	q.stores[store.Name()] = store
+	q.mu.Unlock()
+}
+
+func uploadQueueKey(sha1 []byte, storeName string) []byte {
+	key := dbKey(dbKeyPrefixUploadQueue, sha1)
+	return append(key, []byte(storeName)...)
+}
+
+func parseUploadQueueKey(key []byte) ([]byte, string, bool) {
+	key = key[len(dbKeyPrefixUploadQueue):]
+	if len(key) <= 20 {
+		return nil, "", false
+	}
+	sha1 := append([]byte(nil), key[:20]...)
+	return sha1, string(key[20:]), true
+}
+
+func (q *UploadQueue) putItem(key []byte, item *uploadQueueItem) error {
+	d, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return q.src.db.Put(key, d, &opt.WriteOptions{Sync: true})
+}
+
+// Add queues upload of content with sha1 (which must be in LocalStore)
+// to a store. The item is durable when Add returns
+func (q *UploadQueue) Add(sha1 []byte, storeName string) error {
+	item := &uploadQueueItem{NextAttempt: time.Now()}
+	err := q.putItem(uploadQueueKey(sha1, storeName), item)
+	if err != nil {
+		log.Errorf("UploadQueue.Add(%x, %s) failed with %s\n", sha1, storeName, err)
+		return err
+	}
+	select {
+	case q.wakeup <- true:
+	default:
+	}
+	return nil
+}
+
+func uploadRetryDelay(attempts int) time.Duration {
+	delay := uploadRetryMinDelay
+	for i := 1; i < attempts && delay < uploadRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > uploadRetryMaxDelay {
+		delay = uploadRetryMaxDelay
+	}
+	return delay
+}
+
+// upload handles a single item of the queue
+func (q *UploadQueue) upload(key []byte) {
+	defer func() {
+		q.mu.Lock()
+		delete(q.inFlight, string(key))
+		q.mu.Unlock()
+	}()
+
+	sha1, storeName, _ := parseUploadQueueKey(key)
+	q.mu.Lock()
+	store := q.stores[storeName]
+	q.mu.Unlock()
+	err := fmt.Errorf("store %s is not configured", storeName)
+	if store != nil {
+		var d []byte
+		d, err = q.src.Get(sha1)
+		if err == ErrBlobNotFound {
+			// deleted e.g. by -gc so there's nothing to upload
+			log.Errorf("%x is no longer in local store, not uploading to %s\n", sha1, storeName)
+			q.src.db.Delete(key, nil)
+			return
+		}
+		if err == nil {
+			_, err = store.Put(d)
+		}
+	}
+	if err == nil {
+		err = q.src.db.Delete(key, nil)
+		if err != nil {
+			log.Errorf("deleting upload queue item for %x failed with %s\n", sha1, err)
+		}
+		q.mu.Lock()
+		q.uploaded++
+		q.mu.Unlock()
+		return
+	}
+
+	item := &uploadQueueItem{}
+	d, err2 := q.src.db.Get(key, nil)
+	if err2 == nil {
+		json.Unmarshal(d, item)
+	}
+	item.Attempts++
+	item.LastError = err.Error()
+	item.NextAttempt = time.Now().Add(uploadRetryDelay(item.Attempts))
+	log.Errorf("uploading %x to %s failed with %s, attempt %d, will retry at %s\n", sha1, storeName, err, item.Attempts, item.NextAttempt.Format(time.RFC3339))
+	err = q.putItem(key, item)
+	if err != nil {
+		log.Errorf("updating upload queue item for %x failed with %s\n", sha1, err)
+	}
+}
+
+// returns keys of items that are due and not being uploaded, marks them
+// as in flight. Also returns when the next item will be due
+func (q *UploadQueue) dueItems() ([][]byte, time.Time) {
+	now := time.Now()
+	next := now.Add(uploadQueuePollInterval)
+	var res [][]byte
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	iter := q.src.db.NewIterator(util.BytesPrefix(dbKeyPrefixUploadQueue), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if q.inFlight[string(iter.Key())] {
+			continue
+		}
+		var item uploadQueueItem
+		err := json.Unmarshal(iter.Value(), &item)
+		if err == nil && item.NextAttempt.After(now) {
+			if item.NextAttempt.Before(next) {
+				next = item.NextAttempt
+			}
+			continue
+		}
+		key := append([]byte(nil), iter.Key()...)
+		q.inFlight[string(key)] = true
+		res = append(res, key)
+	}
+	return res, next
+}
+
+func (q *UploadQueue) run(work chan []byte) {
+	defer q.wg.Done()
+	defer close(work)
+	for {
+		keys, next := q.dueItems()
+		for i, key := range keys {
+			select {
+			case work <- key:
+			case <-q.stop:
+				q.mu.Lock()
+				for _, key := range keys[i:] {
+					delete(q.inFlight, string(key))
+				}
+				q.mu.Unlock()
+				return
+			}
+		}
+		select {
+		case <-q.wakeup:
+		case <-time.After(time.Until(next)):
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// Start starts background workers uploading content
+func (q *UploadQueue) Start(nWorkers int) {
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+	q.stop = make(chan bool)
+	work := make(chan []byte)
+	q.wg.Add(1)
+	go q.run(work)
+	for i := 0; i < nWorkers; i++ {
+		q.wg.Add(1)
+		go func() {
+			for key := range work {
+				q.upload(key)
+			}
+			q.wg.Done()
+		}()
+	}
+}
+
+// Stop stops background workers, waiting for uploads in progress
+func (q *UploadQueue) Stop() {
+	if q.stop == nil {
+		return
+	}
+	close(q.stop)
+	q.wg.Wait()
+	q.stop = nil
+}
+
+// Status returns the state of the queue
+func (q *UploadQueue) Status() (*UploadQueueStatus, error) {
+	res := &UploadQueueStatus{Pending: map[string]int{}}
+	iter := q.src.db.NewIterator(util.BytesPrefix(dbKeyPrefixUploadQueue), nil)
+	defer iter.Release()
+	for iter.Next() {
+		sha1, storeName, ok := parseUploadQueueKey(iter.Key())
+		if !ok {
+			continue
+		}
+		res.Pending[storeName]++
+		var item uploadQueueItem
+		err := json.Unmarshal(iter.Value(), &item)
+		if err != nil || item.Attempts == 0 {
+			continue
+		}
+		f := &UploadQueueFailure{
+			Sha1:        sha1,
+			Store:       storeName,
+			Attempts:    item.Attempts,
+			NextAttempt: item.NextAttempt,
+			LastError:   item.LastError,
+		}
+		res.Failed = append(res.Failed, f)
+	}
+	sort.Slice(res.Failed, func(i, j int) bool {
+		return res.Failed[i].Attempts > res.Failed[j].Attempts
+	})
+	q.mu.Lock()
+	res.Uploaded = q.uploaded
+	q.mu.Unlock()
+	return res, iter.Error()
+}
+
+// runUploadQueueStatus prints the state of uploadQueue
+func runUploadQueueStatus() error {
+	status, err := uploadQueue.Status()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for name := range status.Pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("pending uploads: %d\n", status.Count())
+	for _, name := range names {
+		fmt.Printf("  %s: %d\n", name, status.Pending[name])
+	}
+	fmt.Printf("failed uploads: %d\n", len(status.Failed))
+	for _, f := range status.Failed {
+		fmt.Printf("  %x to %s, attempts: %d, next attempt: %s, error: %s\n", f.Sha1, f.Store, f.Attempts, f.NextAttempt.Format(time.RFC3339), f.LastError)
+	}
+	return nil
+}
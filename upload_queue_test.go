@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kjk/u"
+)
+
+// failingStore is a BlobStore whose writes always fail
+type failingStore struct {
+	*FileStore
+}
+
+func (s *failingStore) Name() string {
+	return "failing"
+}
+
+func (s *failingStore) Put(d []byte) ([]byte, error) {
+	return nil, errors.New("upload failed")
+}
+
+func waitForUploadQueue(t *testing.T, q *UploadQueue, cond func(*UploadQueueStatus) bool) *UploadQueueStatus {
+	timeout := time.Now().Add(10 * time.Second)
+	for {
+		status, err := q.Status()
+		u.PanicIfErr(err)
+		if cond(status) {
+			return status
+		}
+		if time.Now().After(timeout) {
+			t.Fatalf("timed out waiting for upload queue, status: %#v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUploadQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quicknotes_upload_queue")
+	u.PanicIfErr(err)
+	defer os.RemoveAll(dir)
+
+	local, err := NewLocalStore(filepath.Join(dir, "local"))
+	u.PanicIfErr(err)
+	remote, err := NewFileStore(filepath.Join(dir, "remote"))
+	u.PanicIfErr(err)
+	fs, err := NewFileStore(filepath.Join(dir, "failing"))
+	u.PanicIfErr(err)
+	failing := &failingStore{fs}
+
+	q := NewUploadQueue(local)
+	store := NewTieredStore()
+	store.Add(local, false)
+	store.AddAsync(remote, q)
+	store.AddAsync(failing, q)
+
+	// save succeeds before anything is uploaded
+	d := []byte("content uploaded in the background")
+	sha1, err := store.Put(d)
+	u.PanicIfErr(err)
+	has, _ := remote.Has(sha1)
+	if has {
+		t.Fatalf("remote store shouldn't have %x before workers run", sha1)
+	}
+	status, err := q.Status()
+	u.PanicIfErr(err)
+	if status.Count() != 2 {
+		t.Fatalf("expected 2 pending uploads, got %d", status.Count())
+	}
+
+	q.Start(2)
+	status = waitForUploadQueue(t, q, func(s *UploadQueueStatus) bool {
+		return s.Pending[remote.Name()] == 0 && len(s.Failed) == 1
+	})
+	q.Stop()
+	got, err := remote.Get(sha1)
+	u.PanicIfErr(err)
+	if string(got) != string(d) {
+		t.Fatalf("got '%s', expected '%s'", got, d)
+	}
+	f := status.Failed[0]
+	if f.Store != "failing" || f.Attempts != 1 || f.LastError != "upload failed" || !f.NextAttempt.After(time.Now()) {
+		t.Fatalf("unexpected failed upload %#v", f)
+	}
+
+	// failed uploads survive a restart
+	local.Close()
+	local, err = NewLocalStore(filepath.Join(dir, "local"))
+	u.PanicIfErr(err)
+	defer local.Close()
+	q = NewUploadQueue(local)
+	status, err = q.Status()
+	u.PanicIfErr(err)
+	if status.Count() != 1 || len(status.Failed) != 1 {
+		t.Fatalf("unexpected status after restart %#v", status)
+	}
+
+	if uploadRetryDelay(1) != uploadRetryMinDelay || uploadRetryDelay(100) != uploadRetryMaxDelay {
+		t.Fatalf("unexpected retry delays %s, %s", uploadRetryDelay(1), uploadRetryDelay(100))
+	}
+}